@@ -6,10 +6,38 @@ app: rancher-csp-adapter
 csp-config
 {{- end }}
 
+{{- define "csp-adapter.usageConfigMap" -}}
+csp-usage
+{{- end }}
+
+{{- define "csp-adapter.journalConfigMap" -}}
+csp-token-journal
+{{- end }}
+
+{{- define "csp-adapter.dashboardConfigMap" -}}
+csp-dashboard
+{{- end }}
+
+{{- define "csp-adapter.sinksConfigMap" -}}
+csp-output-sinks
+{{- end }}
+
+{{- define "csp-adapter.alertsConfigMap" -}}
+csp-alerts
+{{- end }}
+
 {{- define "csp-adapter.outputNotification" -}}
 csp-compliance
 {{- end }}
 
+{{- define "csp-adapter.warningNotification" -}}
+csp-compliance-warning
+{{- end }}
+
+{{- define "csp-adapter.startupNotification" -}}
+csp-startup-error
+{{- end }}
+
 {{- define "csp-adapter.cacheSecret" -}}
 csp-adapter-cache
 {{- end }}
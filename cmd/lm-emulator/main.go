@@ -0,0 +1,64 @@
+// Command lm-emulator runs the License Manager emulator as a standalone server. Point the adapter at it by setting
+// CATTLE_AWS_ENDPOINT to the emulator's address, along with CATTLE_DEV_MODE=true to use the test product skus
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rancher/csp-adapter/pkg/emulator"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultLicenses grants a license for the test product sku used in dev mode
+const defaultLicenses = "83929a73-7c49-4511-aa45-8854a4f001d4=5"
+
+func main() {
+	addr := flag.String("addr", ":9000", "address to serve the emulated apis on")
+	account := flag.String("account", "123456789012", "account number of the emulated account")
+	licenses := flag.String("licenses", defaultLicenses, "comma separated licenses to grant, as sku=RKE_NODE_SUPP entitlements")
+	tokenTTL := flag.Duration("token-ttl", emulator.DefaultTokenTTL, "how long checkouts are held before they expire if not extended")
+	debug := flag.Bool("debug", false, "log every call made to the emulator")
+	flag.Parse()
+
+	if *debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+	e := emulator.New(*account)
+	e.SetTokenTTL(*tokenTTL)
+	if err := addLicenses(e, *licenses); err != nil {
+		logrus.Fatalf("lm-emulator failed to start: %v", err)
+	}
+	logrus.Infof("lm-emulator serving account %s on %s", *account, *addr)
+	server := &http.Server{
+		Addr:              *addr,
+		Handler:           e,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if err := server.ListenAndServe(); err != nil {
+		logrus.Fatalf("lm-emulator failed with error: %v", err)
+	}
+}
+
+func addLicenses(e *emulator.Emulator, licenses string) error {
+	for _, license := range strings.Split(licenses, ",") {
+		if license == "" {
+			continue
+		}
+		sku, count, ok := strings.Cut(license, "=")
+		if !ok {
+			return fmt.Errorf("invalid license %s, expected sku=entitlements", license)
+		}
+		maxCount, err := strconv.Atoi(count)
+		if err != nil {
+			return fmt.Errorf("invalid number of entitlements for license %s: %v", license, err)
+		}
+		arn := e.AddLicense(sku, maxCount)
+		logrus.Infof("granted license %s for sku %s with %d entitlement(s)", arn, sku, maxCount)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rancher/csp-adapter/pkg/clients/k8s"
+	"github.com/rancher/csp-adapter/pkg/ledger"
+	"k8s.io/client-go/rest"
+)
+
+const exportUsageCommand = "export-usage"
+
+// runExportUsage writes the usage ledger to stdout, it is meant to be run from inside the adapter pod, for example:
+// kubectl exec -n cattle-csp-adapter-system deploy/rancher-csp-adapter -- csp-adapter export-usage -format csv
+func runExportUsage(args []string) error {
+	flags := flag.NewFlagSet(exportUsageCommand, flag.ContinueOnError)
+	formatName := flags.String("format", string(ledger.FormatCSV), "output format, one of csv or json")
+	fromValue := flags.String("from", "", "only include usage from this time onwards, as an RFC3339 timestamp or YYYY-MM-DD date")
+	toValue := flags.String("to", "", "only include usage before this time, as an RFC3339 timestamp or YYYY-MM-DD date")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	format, err := ledger.ParseFormat(*formatName)
+	if err != nil {
+		return err
+	}
+	from, err := ledger.ParseTime(*fromValue)
+	if err != nil {
+		return fmt.Errorf("invalid from: %v", err)
+	}
+	to, err := ledger.ParseTime(*toValue)
+	if err != nil {
+		return fmt.Errorf("invalid to: %v", err)
+	}
+
+	k8sTimeout, err := durationFromEnv(k8sTimeoutEnv, k8s.DefaultTimeout)
+	if err != nil {
+		return err
+	}
+	cfg, err := rest.InClusterConfig()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	k8sClients, err := k8s.New(ctx, cfg, k8sTimeout)
+	if err != nil {
+		return err
+	}
+	entries, err := ledger.New(k8sClients, 0, 0).Entries(ctx, from, to)
+	if err != nil {
+		return err
+	}
+	return ledger.Export(os.Stdout, format, entries)
+}
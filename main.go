@@ -1,14 +1,28 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/rancher/csp-adapter/pkg/alert"
 	"github.com/rancher/csp-adapter/pkg/clients/aws"
 	"github.com/rancher/csp-adapter/pkg/clients/k8s"
+	"github.com/rancher/csp-adapter/pkg/dashboard"
+	"github.com/rancher/csp-adapter/pkg/history"
+	"github.com/rancher/csp-adapter/pkg/ledger"
+	"github.com/rancher/csp-adapter/pkg/logging"
 	"github.com/rancher/csp-adapter/pkg/manager"
+	"github.com/rancher/csp-adapter/pkg/messages"
 	"github.com/rancher/csp-adapter/pkg/metrics"
+	"github.com/rancher/csp-adapter/pkg/output"
+	"github.com/rancher/csp-adapter/pkg/redact"
+	"github.com/rancher/csp-adapter/pkg/server"
+	"github.com/rancher/csp-adapter/pkg/tracing"
 	"github.com/rancher/wrangler/v3/pkg/k8scheck"
 	"github.com/rancher/wrangler/v3/pkg/ratelimit"
 	"github.com/rancher/wrangler/v3/pkg/signals"
@@ -22,15 +36,61 @@ var (
 )
 
 func main() {
+	if err := logging.Configure(os.Getenv(logFormatEnv)); err != nil {
+		logrus.Fatalf("csp-adapter failed to configure logging: %v", err)
+	}
+	logrus.AddHook(redact.NewHook(redact.Default()))
+	redact.Default().RedactAccounts(os.Getenv(redactAccountsEnv) == "true")
+	if len(os.Args) > 1 && os.Args[1] == exportUsageCommand {
+		if err := runExportUsage(os.Args[2:]); err != nil {
+			logrus.Fatalf("csp-adapter failed to export usage with error: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == supportBundleCommand {
+		if err := runSupportBundle(os.Args[2:]); err != nil {
+			logrus.Fatalf("csp-adapter failed to create support bundle with error: %v", err)
+		}
+		return
+	}
 	if err := run(); err != nil {
 		logrus.Fatalf("csp-adapter failed to run with error: %v", err)
 	}
 }
 
 const (
-	debugEnv   = "CATTLE_DEBUG"
-	devModeEnv = "CATTLE_DEV_MODE"
-	awsCSP     = "aws"
+	debugEnv          = "CATTLE_DEBUG"
+	logFormatEnv      = "CATTLE_LOG_FORMAT"
+	tracingEndpoint   = "CATTLE_TRACING_ENDPOINT"
+	k8sTimeoutEnv     = "CATTLE_K8S_TIMEOUT"
+	awsTimeoutEnv     = "CATTLE_AWS_TIMEOUT"
+	devModeEnv        = "CATTLE_DEV_MODE"
+	awsEndpointEnv    = "CATTLE_AWS_ENDPOINT"
+	awsRolesEnv       = "CATTLE_AWS_LICENSE_ROLES"
+	productSKUsEnv    = "CATTLE_AWS_PRODUCT_SKUS"
+	dimensionsEnv     = "CATTLE_ENTITLEMENT_DIMENSIONS"
+	localeEnv         = "CATTLE_LOCALE"
+	localeSetting     = "CATTLE_LOCALE_SETTING"
+	marketplaceURL    = "CATTLE_MARKETPLACE_URL"
+	docsURL           = "CATTLE_DOCS_URL"
+	redactAccountsEnv = "CATTLE_REDACT_ACCOUNT_NUMBERS"
+	usageStrategyEnv  = "CATTLE_USAGE_STRATEGY"
+	usageWindowEnv    = "CATTLE_USAGE_WINDOW"
+	ledgerRetention   = "CATTLE_LEDGER_RETENTION"
+	ledgerMaxEntries  = "CATTLE_LEDGER_MAX_ENTRIES"
+	headroomWarning   = "CATTLE_HEADROOM_WARNING_PERCENT"
+	exhaustionDays    = "CATTLE_EXHAUSTION_WARNING_DAYS"
+	licenseExpiry     = "CATTLE_LICENSE_EXPIRY_WARNING_DAYS"
+	apiPortEnv        = "CATTLE_API_PORT"
+	intervalEnv       = "CATTLE_COMPLIANCE_INTERVAL"
+	leadTimeEnv       = "CATTLE_EXTENSION_LEAD_TIME"
+	scrapeTimeoutEnv  = "CATTLE_SCRAPE_TIMEOUT"
+	eventDrivenEnv    = "CATTLE_EVENT_DRIVEN"
+	resyncEnv         = "CATTLE_RESYNC_INTERVAL"
+	debounceEnv       = "CATTLE_EVENT_DEBOUNCE"
+	historySizeEnv    = "CATTLE_HISTORY_SIZE"
+	defaultAPIPort    = "8080"
+	awsCSP            = "aws"
 )
 
 func run() error {
@@ -46,51 +106,362 @@ func run() error {
 	}
 	cfg.RateLimiter = ratelimit.None
 	ctx := signals.SetupSignalContext()
+
+	shutdownTracing, err := tracing.Setup(ctx, tracing.Options{Endpoint: os.Getenv(tracingEndpoint), ServiceVersion: Version})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// the signal context is done by now, so flushing the last spans needs a context of its own
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			logrus.Warnf("unable to flush traces: %v", err)
+		}
+	}()
+
 	err = k8scheck.Wait(ctx, *cfg)
 	if err != nil {
 		return err
 	}
 
-	k8sClients, err := k8s.New(ctx, cfg)
+	k8sTimeout, awsTimeout, err := clientTimeoutsFromEnv()
+	if err != nil {
+		// without k8s clients there's nowhere to register the error
+		return fmt.Errorf("failed to start, invalid client timeouts: %v", err)
+	}
+	k8sClients, err := k8s.New(ctx, cfg, k8sTimeout)
 	if err != nil {
 		return err
 	}
 
+	catalogue := messageCatalogue(ctx, k8sClients)
+
+	alerter, err := alert.ParseConfig(getAlertConfig(ctx, k8sClients), os.Getenv)
+	if err != nil {
+		// alerting can't be relied on to report its own misconfiguration
+		registerErr := registerStartupError(ctx, k8sClients, nil, catalogue, createCSPInfo(awsCSP, "unknown"), err)
+		if registerErr != nil {
+			return fmt.Errorf("unable to start or register manager error, start error: %v, register error: %v", err, registerErr)
+		}
+		return fmt.Errorf("failed to start, invalid alert config: %v", err)
+	}
+	alerter.SetRedactor(redact.Default())
+
 	devMode := os.Getenv(devModeEnv) == "true"
 
-	awsClient, err := aws.NewClient(ctx, devMode)
+	clientOpts := aws.ClientOptions{UseTestProducts: devMode, AdditionalProductSKUs: productSKUs(), Endpoint: os.Getenv(awsEndpointEnv), Timeout: awsTimeout}
+	awsClient, err := aws.NewClient(ctx, clientOpts)
 	if err != nil {
-		registerErr := registerStartupError(k8sClients, createCSPInfo(awsCSP, "unknown"), err)
+		registerErr := registerStartupError(ctx, k8sClients, alerter, catalogue, createCSPInfo(awsCSP, "unknown"), err)
 		if registerErr != nil {
 			return fmt.Errorf("unable to start or register manager error, start error: %v, register error: %v", err, registerErr)
 		}
 		return fmt.Errorf("failed to start, unable to start aws client: %v", err)
 	}
 
-	hostname, err := k8sClients.GetRancherHostname()
+	hostname, err := k8sClients.GetRancherHostname(ctx)
 	if err != nil {
-		registerErr := registerStartupError(k8sClients, createCSPInfo(awsCSP, awsClient.AccountNumber()), err)
+		registerErr := registerStartupError(ctx, k8sClients, alerter, catalogue, createCSPInfo(awsCSP, awsClient.AccountNumber()), err)
 		if registerErr != nil {
 			return fmt.Errorf("unable to start or register manager error, start error: %v, register error: %v", err, registerErr)
 		}
 		return fmt.Errorf("failed to start, unable to get hostname: %v", err)
 	}
 
-	m := manager.NewAWS(awsClient, k8sClients, metrics.NewScraper(hostname, cfg))
+	opts, err := managerOptionsFromEnv()
+	if err != nil {
+		registerErr := registerStartupError(ctx, k8sClients, alerter, catalogue, createCSPInfo(awsCSP, awsClient.AccountNumber()), err)
+		if registerErr != nil {
+			return fmt.Errorf("unable to start or register manager error, start error: %v, register error: %v", err, registerErr)
+		}
+		return fmt.Errorf("failed to start, invalid manager configuration: %v", err)
+	}
+
+	opts.AdditionalAccounts, err = additionalAccountClients(ctx, clientOpts)
+	if err != nil {
+		registerErr := registerStartupError(ctx, k8sClients, alerter, catalogue, createCSPInfo(awsCSP, awsClient.AccountNumber()), err)
+		if registerErr != nil {
+			return fmt.Errorf("unable to start or register manager error, start error: %v, register error: %v", err, registerErr)
+		}
+		return fmt.Errorf("failed to start, unable to start aws client for additional account: %v", err)
+	}
+
+	opts.Sinks, err = outputSinks(ctx, k8sClients)
+	if err != nil {
+		registerErr := registerStartupError(ctx, k8sClients, alerter, catalogue, createCSPInfo(awsCSP, awsClient.AccountNumber()), err)
+		if registerErr != nil {
+			return fmt.Errorf("unable to start or register manager error, start error: %v, register error: %v", err, registerErr)
+		}
+		return fmt.Errorf("failed to start, invalid output sinks: %v", err)
+	}
+
+	scrapeTimeout, err := durationFromEnv(scrapeTimeoutEnv, metrics.DefaultScrapeTimeout)
+	if err != nil {
+		registerErr := registerStartupError(ctx, k8sClients, alerter, catalogue, createCSPInfo(awsCSP, awsClient.AccountNumber()), err)
+		if registerErr != nil {
+			return fmt.Errorf("unable to start or register manager error, start error: %v, register error: %v", err, registerErr)
+		}
+		return fmt.Errorf("failed to start, invalid scrape timeout: %v", err)
+	}
+
+	opts.Alerter = alerter
+	opts.Messages = catalogue
+	opts.NotificationLinks = notificationLinks(catalogue)
+	m := manager.NewAWS(awsClient, k8sClients, metrics.NewScraper(hostname, cfg, scrapeTimeout), opts)
 
 	errs := make(chan error, 1)
 	m.Start(ctx, errs)
+	if opts.EventDriven {
+		if err := k8sClients.WatchNodeChanges(ctx, m.TriggerCheck); err != nil {
+			// the resync still runs, so compliance is checked without the watch, just less promptly
+			logrus.Warnf("unable to watch for node changes, falling back to the resync interval: %v", err)
+		}
+	}
 	go func() {
 		for err := range errs {
 			logrus.Errorf("aws manager error: %v", err)
 		}
 	}()
 
+	port := os.Getenv(apiPortEnv)
+	if port == "" {
+		port = defaultAPIPort
+	}
+	s := server.New(":" + port)
+	// callers need the access that the kubernetes api requires to reach the api through its service proxy
+	access := k8s.APIAccess()
+	s.Handle("GET /v1/usage/export", server.Authorized(k8sClients, access, ledger.ExportHandler(m.Ledger())))
+	s.Handle("GET /v1/dashboard", server.Authorized(k8sClients, access, dashboard.Handler(m)))
+	s.Handle("GET /v1/status/decisions", server.Authorized(k8sClients, access, history.Handler(m.History(), redact.Default())))
+	serverErrs := make(chan error, 1)
+	s.Start(ctx, serverErrs)
+	go func() {
+		for err := range serverErrs {
+			logrus.Errorf("api server error: %v", err)
+		}
+	}()
+
 	<-ctx.Done()
 
 	return nil
 }
 
+// managerOptionsFromEnv reads the manager's tunable settings from the env. Unset values are left for the manager to default
+func managerOptionsFromEnv() (manager.Options, error) {
+	var opts manager.Options
+	strategy, err := manager.ParseUsageStrategy(os.Getenv(usageStrategyEnv))
+	if err != nil {
+		return opts, err
+	}
+	opts.UsageStrategy = strategy
+	if window := os.Getenv(usageWindowEnv); window != "" {
+		opts.UsageWindow, err = time.ParseDuration(window)
+		if err != nil {
+			return opts, fmt.Errorf("unable to parse %s: %v", usageWindowEnv, err)
+		}
+		if opts.UsageWindow <= 0 {
+			return opts, fmt.Errorf("%s must be a positive duration, got %s", usageWindowEnv, window)
+		}
+	}
+	if retention := os.Getenv(ledgerRetention); retention != "" {
+		opts.LedgerRetention, err = time.ParseDuration(retention)
+		if err != nil {
+			return opts, fmt.Errorf("unable to parse %s: %v", ledgerRetention, err)
+		}
+	}
+	if maxEntries := os.Getenv(ledgerMaxEntries); maxEntries != "" {
+		opts.LedgerMaxEntries, err = strconv.Atoi(maxEntries)
+		if err != nil {
+			return opts, fmt.Errorf("unable to parse %s: %v", ledgerMaxEntries, err)
+		}
+	}
+	if percent := os.Getenv(headroomWarning); percent != "" {
+		opts.HeadroomWarningPercent, err = strconv.ParseFloat(percent, 64)
+		if err != nil {
+			return opts, fmt.Errorf("unable to parse %s: %v", headroomWarning, err)
+		}
+		if opts.HeadroomWarningPercent < 0 || opts.HeadroomWarningPercent > 100 {
+			return opts, fmt.Errorf("%s must be between 0 and 100, got %s", headroomWarning, percent)
+		}
+	}
+	if days := os.Getenv(exhaustionDays); days != "" {
+		opts.ExhaustionWarningDays, err = strconv.Atoi(days)
+		if err != nil {
+			return opts, fmt.Errorf("unable to parse %s: %v", exhaustionDays, err)
+		}
+		if opts.ExhaustionWarningDays < 0 {
+			return opts, fmt.Errorf("%s must not be negative, got %s", exhaustionDays, days)
+		}
+	}
+	opts.Dimensions, err = manager.ParseDimensions(os.Getenv(dimensionsEnv))
+	if err != nil {
+		return opts, fmt.Errorf("unable to parse %s: %v", dimensionsEnv, err)
+	}
+	if size := os.Getenv(historySizeEnv); size != "" {
+		opts.HistorySize, err = strconv.Atoi(size)
+		if err != nil {
+			return opts, fmt.Errorf("unable to parse %s: %v", historySizeEnv, err)
+		}
+		if opts.HistorySize <= 0 {
+			return opts, fmt.Errorf("%s must be a positive number, got %s", historySizeEnv, size)
+		}
+	}
+	if days := os.Getenv(licenseExpiry); days != "" {
+		opts.LicenseExpiryWarningDays, err = strconv.Atoi(days)
+		if err != nil {
+			return opts, fmt.Errorf("unable to parse %s: %v", licenseExpiry, err)
+		}
+		if opts.LicenseExpiryWarningDays < 0 {
+			return opts, fmt.Errorf("%s must not be negative, got %s", licenseExpiry, days)
+		}
+	}
+	if opts.Interval, err = durationFromEnv(intervalEnv, manager.DefaultInterval); err != nil {
+		return opts, err
+	}
+	if opts.ExtensionLeadTime, err = durationFromEnv(leadTimeEnv, manager.DefaultExtensionLeadTime); err != nil {
+		return opts, err
+	}
+	if err := manager.ValidateTiming(opts.Interval, opts.ExtensionLeadTime); err != nil {
+		return opts, fmt.Errorf("invalid %s or %s: %v", intervalEnv, leadTimeEnv, err)
+	}
+	opts.EventDriven = os.Getenv(eventDrivenEnv) == "true"
+	if opts.ResyncInterval, err = durationFromEnv(resyncEnv, manager.DefaultResyncInterval); err != nil {
+		return opts, err
+	}
+	if opts.Debounce, err = durationFromEnv(debounceEnv, manager.DefaultDebounce); err != nil {
+		return opts, err
+	}
+	if opts.EventDriven {
+		// the resync is the only periodic check in event-driven mode, so it must also run within the lead time
+		if err := manager.ValidateTiming(opts.ResyncInterval, opts.ExtensionLeadTime); err != nil {
+			return opts, fmt.Errorf("invalid %s or %s: %v", resyncEnv, leadTimeEnv, err)
+		}
+	}
+	return opts, nil
+}
+
+// durationFromEnv parses the positive duration in the env var env, returning defaultValue if it isn't set
+func durationFromEnv(env string, defaultValue time.Duration) (time.Duration, error) {
+	value := os.Getenv(env)
+	if value == "" {
+		return defaultValue, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse %s: %v", env, err)
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("%s must be a positive duration, got %s", env, value)
+	}
+	return duration, nil
+}
+
+// clientTimeoutsFromEnv reads how long each call to kubernetes and to aws can take, defaulting those which aren't set
+func clientTimeoutsFromEnv() (k8sTimeout, awsTimeout time.Duration, err error) {
+	k8sTimeout, err = durationFromEnv(k8sTimeoutEnv, k8s.DefaultTimeout)
+	if err != nil {
+		return 0, 0, err
+	}
+	awsTimeout, err = durationFromEnv(awsTimeoutEnv, aws.DefaultTimeout)
+	if err != nil {
+		return 0, 0, err
+	}
+	return k8sTimeout, awsTimeout, nil
+}
+
+// productSKUs gives the product skus in the comma-separated list in productSKUsEnv, whose licenses are found along with
+// those of the rancher offers
+func productSKUs() []string {
+	var skus []string
+	for _, sku := range strings.Split(os.Getenv(productSKUsEnv), ",") {
+		if sku = strings.TrimSpace(sku); sku != "" {
+			skus = append(skus, sku)
+		}
+	}
+	return skus
+}
+
+// additionalAccountClients creates a client for each role in the comma-separated list in awsRolesEnv, in order, so that
+// licenses held by those accounts are checked out once the adapter's own account's licenses are used up
+func additionalAccountClients(ctx context.Context, opts aws.ClientOptions) ([]aws.Client, error) {
+	var clients []aws.Client
+	for _, role := range strings.Split(os.Getenv(awsRolesEnv), ",") {
+		role = strings.TrimSpace(role)
+		if role == "" {
+			continue
+		}
+		opts.RoleArn = role
+		client, err := aws.NewClient(ctx, opts)
+		if err != nil {
+			return nil, fmt.Errorf("role %s: %v", role, err)
+		}
+		logrus.Infof("checking out licenses from account %s after the adapter's own account", client.AccountNumber())
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+// messageCatalogue gives the catalogue for the locale set in localeEnv, or in the rancher setting named by localeSetting
+// if that isn't set. Falls back to the default locale if neither is set, or the locale isn't supported
+func messageCatalogue(ctx context.Context, clients *k8s.Clients) *messages.Catalogue {
+	locale := os.Getenv(localeEnv)
+	if setting := os.Getenv(localeSetting); locale == "" && setting != "" {
+		var err error
+		locale, err = clients.GetSetting(ctx, setting)
+		if err != nil {
+			logrus.Warnf("unable to get locale from rancher setting %s, using %s: %v", setting, messages.DefaultLocale, err)
+			return messages.Default()
+		}
+	}
+	catalogue, err := messages.New(locale)
+	if err != nil {
+		logrus.Warnf("using locale %s for messages: %v", messages.DefaultLocale, err)
+		return messages.Default()
+	}
+	logrus.Debugf("using locale %s for messages", catalogue.Locale())
+	return catalogue
+}
+
+// notificationLinks gives the links included in notifications, for the urls set in marketplaceURL and docsURL
+func notificationLinks(catalogue *messages.Catalogue) []k8s.Link {
+	var links []k8s.Link
+	if url := os.Getenv(marketplaceURL); url != "" {
+		links = append(links, k8s.Link{Title: catalogue.Render(messages.MarketplaceLink, nil), URL: url})
+	}
+	if url := os.Getenv(docsURL); url != "" {
+		links = append(links, k8s.Link{Title: catalogue.Render(messages.DocsLink, nil), URL: url})
+	}
+	return links
+}
+
+// getAlertConfig retrieves the alerting config, treating a failure to read it as alerting being unconfigured so that
+// the adapter can still start
+func getAlertConfig(ctx context.Context, clients *k8s.Clients) string {
+	raw, err := clients.GetAlertConfig(ctx)
+	if err != nil {
+		logrus.Warnf("unable to get alerts configmap, no alerts will be sent: %v", err)
+		return ""
+	}
+	return raw
+}
+
+// outputSinks creates the additional output sinks configured in the sinks configmap
+func outputSinks(ctx context.Context, clients *k8s.Clients) ([]output.Sink, error) {
+	raw, err := clients.GetOutputSinks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get sinks configmap: %v", err)
+	}
+	sinks, err := output.ParseSinks(raw, os.Getenv)
+	if err != nil {
+		return nil, err
+	}
+	for _, sink := range sinks {
+		logrus.Infof("writing compliance reports to %s", sink.Name())
+	}
+	return sinks, nil
+}
+
 // createCSPInfo creates a manager.CSPInfo from a provided csp name and account number
 func createCSPInfo(csp, acctNumber string) manager.CSPInfo {
 	return manager.CSPInfo{
@@ -101,22 +472,32 @@ func createCSPInfo(csp, acctNumber string) manager.CSPInfo {
 
 // registerStartupError registers that an error occurred when starting the manager for the cloud account represented by
 // cspInfo if we could start our k8s clients but couldn't init some other part of the manager infra, we need to
-// report this to the user and save the error so it can be included in the supportconfig bundle
-func registerStartupError(clients *k8s.Clients, cspInfo manager.CSPInfo, startupErr error) error {
-	defaultConfig := manager.GetDefaultSupportConfig(clients)
+// report this to the user and save the error so it can be included in the supportconfig bundle. The error is also sent
+// to alerter, if it's configured
+func registerStartupError(ctx context.Context, clients *k8s.Clients, alerter *alert.Alerter, catalogue *messages.Catalogue, cspInfo manager.CSPInfo, startupErr error) error {
+	alerter.Fire(ctx, alert.Alert{
+		Type:     alert.TypeStartupError,
+		Severity: alert.SeverityCritical,
+		Message:  fmt.Sprintf("CSP adapter unable to start due to error: %v", startupErr),
+	})
+	defaultConfig := manager.GetDefaultSupportConfig(ctx, clients)
 	defaultConfig.Compliance = manager.ComplianceInfo{
 		Status:  manager.StatusNotInCompliance,
-		Message: fmt.Sprintf("CSP adapter unable to start due to error: %v", startupErr),
+		Message: catalogue.Render(messages.StartupFailed, messages.Params{"Error": startupErr.Error()}),
 	}
 	defaultConfig.CSP = cspInfo
 	marshalledConfig, err := json.Marshal(defaultConfig)
 	if err != nil {
 		return err
 	}
-	err = clients.UpdateUserNotification(false, "Marketplace Adapter: unable to start csp adapter, check adapter logs")
+	err = clients.UpdateNotification(ctx, k8s.NotificationStartupError, &k8s.Notification{
+		Severity: k8s.SeverityError,
+		Message:  catalogue.Render(messages.StartupFailedNotification, nil),
+		Links:    notificationLinks(catalogue),
+	})
 	if err != nil {
 		return err
 	}
-	err = clients.UpdateCSPConfigOutput(marshalledConfig)
+	err = clients.UpdateCSPConfigOutput(ctx, marshalledConfig)
 	return err
 }
@@ -0,0 +1,153 @@
+// Package alert sends alerts to on-call tooling, such as chat webhooks, when the adapter's state changes in a way that
+// needs attention
+package alert
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rancher/csp-adapter/pkg/redact"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// TypeNonCompliant is fired when the adapter becomes non-compliant
+	TypeNonCompliant = "NonCompliant"
+	// TypeComplianceRestored is fired when the adapter becomes compliant again after a NonCompliant alert
+	TypeComplianceRestored = "ComplianceRestored"
+	// TypeStartupError is fired when the adapter fails to start
+	TypeStartupError = "StartupError"
+	// TypeTokenExtendFailed is fired when a license checkout couldn't be extended
+	TypeTokenExtendFailed = "TokenExtendFailed"
+	// TypeLicenseExpiring is fired when a license is approaching the end of its validity period
+	TypeLicenseExpiring = "LicenseExpiring"
+
+	SeverityCritical = "critical"
+	SeverityWarning  = "warning"
+	SeverityInfo     = "info"
+
+	// DefaultResendInterval is how often an alert which is still active is sent again
+	DefaultResendInterval = 4 * time.Hour
+)
+
+// Alert describes something that needs attention
+type Alert struct {
+	// Type is one of the Type constants
+	Type string `json:"type"`
+	// Subject is what the alert is about, such as a license arn. Alerts are deduplicated by their type and subject
+	Subject  string    `json:"subject,omitempty"`
+	Severity string    `json:"severity"`
+	Message  string    `json:"message"`
+	Time     time.Time `json:"time"`
+}
+
+// Key identifies the alert for deduplication
+func (a Alert) Key() string {
+	if a.Subject == "" {
+		return a.Type
+	}
+	return a.Type + "/" + a.Subject
+}
+
+// Sender delivers an alert somewhere
+type Sender interface {
+	// Name identifies the sender in logs
+	Name() string
+	Send(ctx context.Context, alert Alert) error
+}
+
+// Alerter sends alerts to every sender, deduplicating alerts which are still active. A nil Alerter discards every alert,
+// so that callers don't need to check whether alerting is configured
+type Alerter struct {
+	senders        []Sender
+	resendInterval time.Duration
+	now            func() time.Time
+	redactor       *redact.Redactor
+
+	mu sync.Mutex
+	// active holds when each active alert was last sent, by key
+	active map[string]time.Time
+}
+
+// New creates an Alerter which sends to senders, sending an alert which is still active again after resendInterval
+func New(senders []Sender, resendInterval time.Duration) *Alerter {
+	if resendInterval <= 0 {
+		resendInterval = DefaultResendInterval
+	}
+	return &Alerter{
+		senders:        senders,
+		resendInterval: resendInterval,
+		now:            time.Now,
+		active:         map[string]time.Time{},
+	}
+}
+
+// SetRedactor masks the secrets and account numbers known to redactor from every alert sent from now on
+func (a *Alerter) SetRedactor(redactor *redact.Redactor) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.redactor = redactor
+}
+
+// Fire sends alert, unless the same alert was sent within the resend interval and hasn't been resolved since. An alert
+// which no sender accepted is sent again on the next call. The alert is marked as sent before the senders are called,
+// without holding the lock, so that a slow sender doesn't block other alerts while concurrent calls send it only once
+func (a *Alerter) Fire(ctx context.Context, alert Alert) {
+	if a == nil || len(a.senders) == 0 {
+		return
+	}
+	a.mu.Lock()
+	now := a.now()
+	if sent, ok := a.active[alert.Key()]; ok && now.Sub(sent) < a.resendInterval {
+		a.mu.Unlock()
+		return
+	}
+	a.active[alert.Key()] = now
+	redactor := a.redactor
+	a.mu.Unlock()
+
+	if alert.Time.IsZero() {
+		alert.Time = now
+	}
+	sent := alert
+	if redactor != nil {
+		sent.Subject = redactor.Redact(alert.Subject)
+		sent.Message = redactor.Redact(alert.Message)
+	}
+	delivered := false
+	for _, sender := range a.senders {
+		if err := sender.Send(ctx, sent); err != nil {
+			logrus.Warnf("unable to send %s alert to %s: %v", alert.Type, sender.Name(), err)
+			continue
+		}
+		delivered = true
+	}
+	if delivered {
+		logrus.Debugf("sent %s alert", alert.Key())
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// leave the alert alone if it was resolved and fired again while sending
+	if sent, ok := a.active[alert.Key()]; ok && sent.Equal(now) {
+		delete(a.active, alert.Key())
+	}
+}
+
+// Resolve marks the alert of alertType about subject as no longer active, so that it is sent as soon as it recurs.
+// Returns true if the alert was active
+func (a *Alerter) Resolve(alertType, subject string) bool {
+	if a == nil {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := Alert{Type: alertType, Subject: subject}.Key()
+	_, ok := a.active[key]
+	delete(a.active, key)
+	return ok
+}
@@ -0,0 +1,277 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// alertServer is a local webhook which records the payloads posted to it
+type alertServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	payloads []string
+	headers  []http.Header
+	status   int
+}
+
+func newAlertServer(t *testing.T) *alertServer {
+	s := &alertServer{status: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.payloads = append(s.payloads, string(body))
+		s.headers = append(s.headers, r.Header)
+		w.WriteHeader(s.status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *alertServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.payloads...)
+}
+
+func TestDeduplication(t *testing.T) {
+	server := newAlertServer(t)
+	webhook, err := NewWebhook(server.URL, "", nil, time.Second)
+	require.NoError(t, err)
+	alerter := New([]Sender{webhook}, time.Hour)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	alerter.now = func() time.Time { return now }
+	nonCompliant := Alert{Type: TypeNonCompliant, Severity: SeverityCritical, Message: "2 more licenses required"}
+
+	alerter.Fire(context.TODO(), nonCompliant)
+	alerter.Fire(context.TODO(), nonCompliant)
+	assert.Len(t, server.received(), 1, "expected an active alert not to be sent again")
+
+	// a different subject is a different alert
+	alerter.Fire(context.TODO(), Alert{Type: TypeLicenseExpiring, Subject: "license-1", Severity: SeverityWarning})
+	alerter.Fire(context.TODO(), Alert{Type: TypeLicenseExpiring, Subject: "license-2", Severity: SeverityWarning})
+	assert.Len(t, server.received(), 3)
+
+	// still active after the resend interval, so it's sent again
+	now = now.Add(2 * time.Hour)
+	alerter.Fire(context.TODO(), nonCompliant)
+	assert.Len(t, server.received(), 4)
+
+	// once resolved it's sent as soon as it recurs
+	assert.True(t, alerter.Resolve(TypeNonCompliant, ""))
+	assert.False(t, alerter.Resolve(TypeNonCompliant, ""), "expected a resolved alert to no longer be active")
+	alerter.Fire(context.TODO(), nonCompliant)
+	assert.Len(t, server.received(), 5)
+}
+
+func TestFailedAlertIsRetried(t *testing.T) {
+	server := newAlertServer(t)
+	server.status = http.StatusBadGateway
+	webhook, err := NewWebhook(server.URL, "", nil, time.Second)
+	require.NoError(t, err)
+	alerter := New([]Sender{webhook}, time.Hour)
+
+	alerter.Fire(context.TODO(), Alert{Type: TypeStartupError})
+	server.mu.Lock()
+	server.status = http.StatusOK
+	server.mu.Unlock()
+	alerter.Fire(context.TODO(), Alert{Type: TypeStartupError})
+	alerter.Fire(context.TODO(), Alert{Type: TypeStartupError})
+	assert.Len(t, server.received(), 2, "expected the failed alert to be sent again, and then deduplicated")
+}
+
+// blockingSender counts the alerts sent to it, holding each send until release is closed
+type blockingSender struct {
+	started chan struct{}
+	release chan struct{}
+	mu      sync.Mutex
+	sends   int
+}
+
+func (s *blockingSender) Name() string { return "blocking" }
+
+func (s *blockingSender) Send(ctx context.Context, alert Alert) error {
+	s.mu.Lock()
+	s.sends++
+	s.mu.Unlock()
+	s.started <- struct{}{}
+	<-s.release
+	return nil
+}
+
+func TestConcurrentFireSendsOnce(t *testing.T) {
+	sender := &blockingSender{started: make(chan struct{}, 10), release: make(chan struct{})}
+	alerter := New([]Sender{sender}, time.Hour)
+	nonCompliant := Alert{Type: TypeNonCompliant, Severity: SeverityCritical}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		alerter.Fire(context.TODO(), nonCompliant)
+	}()
+	<-sender.started
+	// the first send is in flight, so these are deduplicated rather than sent again
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			alerter.Fire(context.TODO(), nonCompliant)
+		}()
+	}
+	close(sender.release)
+	wg.Wait()
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	assert.Equal(t, 1, sender.sends)
+}
+
+func TestUnreachableWebhookURLNotLogged(t *testing.T) {
+	// a closed server's address refuses connections, and the path is a secret as in chat webhooks
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	webhookURL := server.URL + "/hooks/webhook-secret-value"
+	webhook, err := NewWebhook(webhookURL, "", nil, time.Second)
+	require.NoError(t, err)
+
+	logger := logrus.StandardLogger()
+	var logs bytes.Buffer
+	level, out := logger.GetLevel(), logger.Out
+	logger.SetOutput(&logs)
+	logger.SetLevel(logrus.DebugLevel)
+	defer func() {
+		logger.SetOutput(out)
+		logger.SetLevel(level)
+	}()
+
+	New([]Sender{webhook}, time.Hour).Fire(context.TODO(), Alert{Type: TypeStartupError})
+	assert.Contains(t, logs.String(), "unable to post alert to "+webhook.host)
+	assert.NotContains(t, logs.String(), "webhook-secret-value")
+	assert.NotContains(t, logs.String(), webhookURL)
+}
+
+func TestWebhookTemplates(t *testing.T) {
+	alert := Alert{
+		Type:     TypeTokenExtendFailed,
+		Subject:  "arn:aws:license-manager::111111111111:license:l-1",
+		Severity: SeverityWarning,
+		Message:  `unable to extend "token"`,
+		Time:     time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		name       string            // name of the test, to be displayed on failure
+		template   string            // template for the payload
+		headers    map[string]string // headers set on the webhook
+		expected   string            // payload expected, as JSON
+		errDesired bool              // if creating the webhook should fail
+	}{
+		{
+			name:     "default template",
+			expected: `{"type":"TokenExtendFailed","subject":"arn:aws:license-manager::111111111111:license:l-1","severity":"warning","message":"unable to extend \"token\"","time":"2024-01-01T00:00:00Z"}`,
+		},
+		{
+			name:     "slack style template",
+			template: `{"text":{{json (printf "[%s] %s" .Severity .Message)}}}`,
+			headers:  map[string]string{"Authorization": "Bearer token"},
+			expected: `{"text":"[warning] unable to extend \"token\""}`,
+		},
+		{
+			name:       "invalid template",
+			template:   `{{.Type`,
+			errDesired: true,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			server := newAlertServer(t)
+			webhook, err := NewWebhook(server.URL, test.template, test.headers, time.Second)
+			if test.errDesired {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, webhook.Send(context.TODO(), alert))
+			received := server.received()
+			require.Len(t, received, 1)
+			assert.True(t, json.Valid([]byte(received[0])), "expected a valid JSON payload, got %s", received[0])
+			assert.JSONEq(t, test.expected, received[0])
+			for key, value := range test.headers {
+				assert.Equal(t, value, server.headers[0].Get(key))
+			}
+		})
+	}
+}
+
+func TestNilAlerter(t *testing.T) {
+	var alerter *Alerter
+	alerter.Fire(context.TODO(), Alert{Type: TypeNonCompliant})
+	assert.False(t, alerter.Resolve(TypeNonCompliant, ""))
+}
+
+func TestParseConfig(t *testing.T) {
+	env := map[string]string{"SLACK_URL": "https://hooks.example.com/secret"}
+	getenv := func(key string) string { return env[key] }
+	tests := []struct {
+		name            string // name of the test, to be displayed on failure
+		raw             string // alerts configmap contents
+		expectedSenders []string
+		errDesired      bool // if parsing should fail
+	}{
+		{
+			name: "not configured",
+			raw:  "",
+		},
+		{
+			name:            "webhooks",
+			raw:             `{"resendInterval":"1h","webhooks":[{"url":"https://example.com/alerts","timeout":"5s"},{"urlEnv":"SLACK_URL","template":"{\"text\":{{json .Message}}}"}]}`,
+			expectedSenders: []string{"webhook to example.com", "webhook to hooks.example.com"},
+		},
+		{
+			name:       "url env not set",
+			raw:        `{"webhooks":[{"urlEnv":"MISSING"}]}`,
+			errDesired: true,
+		},
+		{
+			name:       "no url",
+			raw:        `{"webhooks":[{}]}`,
+			errDesired: true,
+		},
+		{
+			name:       "invalid resend interval",
+			raw:        `{"resendInterval":"often","webhooks":[]}`,
+			errDesired: true,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			alerter, err := ParseConfig(test.raw, getenv)
+			if test.errDesired {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			if test.expectedSenders == nil {
+				assert.Nil(t, alerter)
+				return
+			}
+			var names []string
+			for _, sender := range alerter.senders {
+				names = append(names, sender.Name())
+			}
+			assert.Equal(t, test.expectedSenders, names)
+		})
+	}
+}
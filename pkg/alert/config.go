@@ -0,0 +1,80 @@
+package alert
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Config configures alerting, as stored in the alerts configmap
+type Config struct {
+	// ResendInterval is how often an alert which is still active is sent again, as a duration string. Defaults to
+	// DefaultResendInterval
+	ResendInterval string          `json:"resendInterval,omitempty"`
+	Webhooks       []WebhookConfig `json:"webhooks"`
+}
+
+// WebhookConfig configures a webhook that alerts are sent to
+type WebhookConfig struct {
+	// URL is where alerts are posted to
+	URL string `json:"url,omitempty"`
+	// URLEnv is the env var holding the url, for webhooks whose url is a secret. Used if URL is empty
+	URLEnv string `json:"urlEnv,omitempty"`
+	// Template renders the payload, see NewWebhook
+	Template string `json:"template,omitempty"`
+	// Headers are set on each request, overriding the default content type if set
+	Headers map[string]string `json:"headers,omitempty"`
+	// Timeout is how long the webhook has to respond, as a duration string. Defaults to DefaultWebhookTimeout
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// ParseConfig creates an Alerter from raw, a JSON Config. getenv looks up the env vars holding webhook urls. Returns a nil
+// Alerter, which discards alerts, if raw is empty
+func ParseConfig(raw string, getenv func(string) string) (*Alerter, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var config Config
+	if err := json.Unmarshal([]byte(raw), &config); err != nil {
+		return nil, fmt.Errorf("unable to parse alert config: %v", err)
+	}
+	var resendInterval time.Duration
+	if config.ResendInterval != "" {
+		var err error
+		resendInterval, err = time.ParseDuration(config.ResendInterval)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse resend interval: %v", err)
+		}
+	}
+	senders := make([]Sender, 0, len(config.Webhooks))
+	for i, webhookConfig := range config.Webhooks {
+		webhook, err := webhookConfig.webhook(getenv)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %d: %v", i, err)
+		}
+		senders = append(senders, webhook)
+	}
+	return New(senders, resendInterval), nil
+}
+
+func (c WebhookConfig) webhook(getenv func(string) string) (*Webhook, error) {
+	url := c.URL
+	if url == "" && c.URLEnv != "" {
+		url = getenv(c.URLEnv)
+		if url == "" {
+			return nil, fmt.Errorf("url env var %s is not set", c.URLEnv)
+		}
+	}
+	if url == "" {
+		return nil, fmt.Errorf("a url or urlEnv is required")
+	}
+	var timeout time.Duration
+	if c.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(c.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse timeout: %v", err)
+		}
+	}
+	return NewWebhook(url, c.Template, c.Headers, timeout)
+}
@@ -0,0 +1,106 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+)
+
+const (
+	// DefaultTemplate is the payload sent by a webhook without a template
+	DefaultTemplate = `{"type":{{json .Type}},"subject":{{json .Subject}},"severity":{{json .Severity}},"message":{{json .Message}},"time":{{json .Time}}}`
+	// DefaultWebhookTimeout is how long a webhook has to respond before the alert fails to send
+	DefaultWebhookTimeout = 10 * time.Second
+)
+
+// templateFuncs are available to webhook templates, in addition to the text/template builtins
+var templateFuncs = template.FuncMap{
+	// json encodes a value as JSON, so that it can be embedded in a JSON payload with quoting and escaping
+	"json": func(v interface{}) (string, error) {
+		encoded, err := json.Marshal(v)
+		return string(encoded), err
+	},
+}
+
+// Webhook POSTs each alert to a url, with a payload rendered from a Go template with the Alert as its data
+type Webhook struct {
+	url string
+	// host is the host of url, which identifies the webhook in logs without the rest of the url, since urls such as
+	// chat webhooks often contain a secret
+	host     string
+	headers  map[string]string
+	template *template.Template
+	client   *http.Client
+}
+
+// NewWebhook creates a webhook which posts to url with headers, rendering the payload from tmpl. DefaultTemplate is used
+// if tmpl is empty. Returns an error if tmpl can't be parsed
+func NewWebhook(webhookURL, tmpl string, headers map[string]string, timeout time.Duration) (*Webhook, error) {
+	if tmpl == "" {
+		tmpl = DefaultTemplate
+	}
+	parsed, err := template.New("payload").Funcs(templateFuncs).Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse template: %v", err)
+	}
+	if timeout <= 0 {
+		timeout = DefaultWebhookTimeout
+	}
+	var host string
+	if parsed, err := url.Parse(webhookURL); err == nil {
+		host = parsed.Host
+	}
+	return &Webhook{
+		url:      webhookURL,
+		host:     host,
+		headers:  headers,
+		template: parsed,
+		client:   &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (w *Webhook) Name() string {
+	if w.host == "" {
+		return "webhook"
+	}
+	return "webhook to " + w.host
+}
+
+func (w *Webhook) Send(ctx context.Context, alert Alert) error {
+	var body bytes.Buffer
+	if err := w.template.Execute(&body, alert); err != nil {
+		return fmt.Errorf("unable to render payload: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, &body)
+	if err != nil {
+		// the error quotes the url, so only say that it couldn't be used
+		return fmt.Errorf("unable to create a request to %s", w.host)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range w.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		// the client's errors contain the url, which is logged when the alert fails to send
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return fmt.Errorf("unable to post alert to %s: %w", w.host, urlErr.Err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	// drain the body so the connection can be reused
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	lm "github.com/aws/aws-sdk-go-v2/service/licensemanager"
+	"github.com/aws/aws-sdk-go-v2/service/licensemanager/types"
+	"github.com/rancher/csp-adapter/pkg/logging"
+	"github.com/rancher/csp-adapter/pkg/tracing"
+)
+
+const (
+	// defaultCatalogueTTL is how long the listed licenses are reused before listing them again
+	defaultCatalogueTTL = 5 * time.Minute
+	// defaultCatalogueMaxStale is how long after they were listed the licenses are still used while listing them fails.
+	// After that, licenses which may have since expired or been revoked aren't relied on
+	defaultCatalogueMaxStale = 30 * time.Minute
+)
+
+// LicenseQuery selects licenses from the license catalogue. Empty fields match every license
+type LicenseQuery struct {
+	// ProductSKUs matches licenses for any of the skus. Results are ordered by the position of their sku in this list
+	ProductSKUs []string
+	// Statuses matches licenses in any of the statuses
+	Statuses []types.LicenseStatus
+	// ProductName matches licenses for the product with this name, ignoring case
+	ProductName string
+}
+
+// Matches reports whether the license is selected by q
+func (q LicenseQuery) Matches(license types.GrantedLicense) bool {
+	if len(q.ProductSKUs) > 0 && skuIndex(q.ProductSKUs, license) < 0 {
+		return false
+	}
+	if len(q.Statuses) > 0 {
+		found := false
+		for _, status := range q.Statuses {
+			if license.Status == status {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.ProductName != "" && (license.ProductName == nil || !strings.EqualFold(*license.ProductName, q.ProductName)) {
+		return false
+	}
+	return true
+}
+
+// skuIndex gives the position of the license's sku in skus, or -1 if it isn't there
+func skuIndex(skus []string, license types.GrantedLicense) int {
+	if license.ProductSKU == nil {
+		return -1
+	}
+	for i, sku := range skus {
+		if sku == *license.ProductSKU {
+			return i
+		}
+	}
+	return -1
+}
+
+// licenseCatalogue lists the licenses received for a set of product skus and caches them, so that every license the
+// account holds can be queried without listing them from aws each time
+type licenseCatalogue struct {
+	lm       licenseManagerClient
+	skus     []string
+	ttl      time.Duration
+	maxStale time.Duration
+	now      func() time.Time
+
+	mu       sync.Mutex
+	licenses []types.GrantedLicense
+	listedAt time.Time
+	valid    bool
+}
+
+func newLicenseCatalogue(lmClient licenseManagerClient, skus []string, ttl time.Duration) *licenseCatalogue {
+	return &licenseCatalogue{
+		lm:       lmClient,
+		skus:     skus,
+		ttl:      ttl,
+		maxStale: defaultCatalogueMaxStale,
+		now:      time.Now,
+	}
+}
+
+// Query returns the licenses matching q, listing the licenses from aws first if the cache has expired. If listing fails
+// but licenses were listed within maxStale, the stale licenses are used rather than failing
+func (c *licenseCatalogue) Query(ctx context.Context, q LicenseQuery) ([]types.GrantedLicense, error) {
+	licenses, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var matched []types.GrantedLicense
+	for _, license := range licenses {
+		if q.Matches(license) {
+			matched = append(matched, license)
+		}
+	}
+	if len(q.ProductSKUs) > 1 {
+		// stable so that the order aws listed the licenses in is kept within a sku
+		sort.SliceStable(matched, func(i, j int) bool {
+			return skuIndex(q.ProductSKUs, matched[i]) < skuIndex(q.ProductSKUs, matched[j])
+		})
+	}
+	return matched, nil
+}
+
+// Invalidate forces the licenses to be listed again on the next query, for use when aws rejects a cached license
+func (c *licenseCatalogue) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.valid = false
+}
+
+func (c *licenseCatalogue) get(ctx context.Context) ([]types.GrantedLicense, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.valid && c.now().Sub(c.listedAt) < c.ttl {
+		return c.licenses, nil
+	}
+	licenses, failed, err := c.list(ctx)
+	stale := c.now().Sub(c.listedAt) >= c.maxStale
+	if err != nil {
+		if c.licenses != nil && !stale {
+			logging.FromContext(ctx).Warnf("unable to list licenses, using licenses listed at %s: %v", c.listedAt.Format(time.RFC3339), err)
+			return c.licenses, nil
+		}
+		if c.licenses != nil {
+			return nil, fmt.Errorf("%w, and the licenses listed at %s are too old to use", err, c.listedAt.Format(time.RFC3339))
+		}
+		return nil, err
+	}
+	if len(failed) > 0 && stale {
+		// the failed skus' licenses are dropped rather than relied on, the others can still be used
+		logging.FromContext(ctx).Warnf("unable to list licenses for skus %v since %s, leaving them out", failed, c.listedAt.Format(time.RFC3339))
+		return licenses, nil
+	}
+	if len(failed) > 0 {
+		// keep what was listed before for the skus which failed, rather than dropping their licenses until the next
+		// listing. The catalogue isn't marked valid, so the failed skus are listed again on the next query
+		for _, license := range c.licenses {
+			if license.ProductSKU != nil && containsSKU(failed, *license.ProductSKU) {
+				licenses = append(licenses, license)
+			}
+		}
+		c.licenses = licenses
+		return licenses, nil
+	}
+	c.licenses = licenses
+	c.listedAt = c.now()
+	c.valid = true
+	logging.FromContext(ctx).Debugf("listed %d license(s) for the license catalogue", len(licenses))
+	return licenses, nil
+}
+
+// list reads every license for each of the catalogue's skus from aws. Skus which can't be listed are skipped with a
+// warning and returned as failed, an error is only returned if every sku fails
+func (c *licenseCatalogue) list(ctx context.Context) (licenses []types.GrantedLicense, failed []string, err error) {
+	ctx, end := tracing.Start(ctx, "aws.ListReceivedLicenses")
+	defer end(&err)
+	var lastErr error
+	for _, sku := range c.skus {
+		skuLicenses, err := c.listForProductID(ctx, sku)
+		if err != nil {
+			logging.FromContext(ctx).Warnf("unable to list licenses for sku %s: %v", sku, err)
+			failed = append(failed, sku)
+			lastErr = fmt.Errorf("unable to list licenses for sku %s: %w", sku, err)
+			continue
+		}
+		licenses = append(licenses, skuLicenses...)
+	}
+	if len(c.skus) > 0 && len(failed) == len(c.skus) {
+		return nil, nil, lastErr
+	}
+	return licenses, failed, nil
+}
+
+// containsSKU reports whether sku is in skus
+func containsSKU(skus []string, sku string) bool {
+	for _, s := range skus {
+		if s == sku {
+			return true
+		}
+	}
+	return false
+}
+
+// listForProductID lists every license received for productID, following pagination until all have been read
+func (c *licenseCatalogue) listForProductID(ctx context.Context, productID string) ([]types.GrantedLicense, error) {
+	input := &lm.ListReceivedLicensesInput{
+		Filters: []types.Filter{
+			{
+				Name:   &productSKUField,
+				Values: []string{productID},
+			},
+		},
+		MaxResults: &maxResults,
+	}
+
+	var licenses []types.GrantedLicense
+	for {
+		res, err := c.lm.ListReceivedLicenses(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		licenses = append(licenses, res.Licenses...)
+		if res.NextToken == nil || *res.NextToken == "" {
+			break
+		}
+		input.NextToken = res.NextToken
+	}
+
+	for i := range licenses {
+		if licenses[i].ProductSKU == nil {
+			// we expect this value to be set, but given that the value is a pointer we can't be sure
+			sku := productID
+			licenses[i].ProductSKU = &sku
+		}
+	}
+
+	return licenses, nil
+}
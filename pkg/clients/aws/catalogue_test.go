@@ -0,0 +1,163 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/licensemanager/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLicenseCatalogueCaching(t *testing.T) {
+	mockLMClient := mockLicenseManagerClient{}
+	mockLMClient.AddLicenseForSku(rancherProductSKUNonEmea, fakeAccountNum, true)
+	skus := []string{rancherProductSKUNonEmea, rancherProductSKUEmea}
+	catalogue := newLicenseCatalogue(&mockLMClient, skus, time.Minute)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	catalogue.now = func() time.Time { return now }
+
+	licenses, err := catalogue.Query(context.Background(), LicenseQuery{})
+	assert.NoError(t, err)
+	assert.Len(t, licenses, 1)
+	assert.Equal(t, len(skus), mockLMClient.listCalls, "expected one listing per sku")
+
+	// within the ttl the cached licenses are used, even if aws has changed
+	mockLMClient.AddLicenseForSku(rancherProductSKUEmea, fakeAccountNum, true)
+	licenses, err = catalogue.Query(context.Background(), LicenseQuery{})
+	assert.NoError(t, err)
+	assert.Len(t, licenses, 1)
+	assert.Equal(t, len(skus), mockLMClient.listCalls, "expected the cached licenses to be used")
+
+	// invalidating lists the licenses again
+	catalogue.Invalidate()
+	licenses, err = catalogue.Query(context.Background(), LicenseQuery{})
+	assert.NoError(t, err)
+	assert.Len(t, licenses, 2)
+	assert.Equal(t, 2*len(skus), mockLMClient.listCalls)
+
+	// once the ttl has passed the licenses are listed again, falling back to the stale licenses if that fails
+	now = now.Add(2 * time.Minute)
+	mockLMClient.listErr = fmt.Errorf("throttled")
+	licenses, err = catalogue.Query(context.Background(), LicenseQuery{})
+	assert.NoError(t, err)
+	assert.Len(t, licenses, 2)
+	assert.Equal(t, 3*len(skus), mockLMClient.listCalls, "expected every sku to be tried")
+
+	// the stale licenses are only used until they are maxStale old, after which the error is returned
+	now = now.Add(catalogue.maxStale)
+	_, err = catalogue.Query(context.Background(), LicenseQuery{})
+	assert.ErrorContains(t, err, "throttled")
+	mockLMClient.listErr = nil
+	licenses, err = catalogue.Query(context.Background(), LicenseQuery{})
+	assert.NoError(t, err)
+	assert.Len(t, licenses, 2)
+}
+
+func TestLicenseCatalogueListError(t *testing.T) {
+	mockLMClient := mockLicenseManagerClient{listErr: fmt.Errorf("access denied")}
+	catalogue := newLicenseCatalogue(&mockLMClient, []string{rancherProductSKUNonEmea}, time.Minute)
+	_, err := catalogue.Query(context.Background(), LicenseQuery{})
+	assert.Error(t, err, "expected an error when nothing has been listed before")
+}
+
+func TestLicenseCataloguePartialListError(t *testing.T) {
+	mockLMClient := mockLicenseManagerClient{}
+	mockLMClient.AddLicenseForSku(rancherProductSKUNonEmea, fakeAccountNum, true)
+	mockLMClient.AddLicenseForSku(rancherProductSKUEmea, fakeAccountNum, true)
+	catalogue := newLicenseCatalogue(&mockLMClient, []string{rancherProductSKUNonEmea, rancherProductSKUEmea}, time.Minute)
+
+	// one sku failing keeps the licenses of the others
+	mockLMClient.skuListErrs = map[string]error{rancherProductSKUEmea: fmt.Errorf("throttled")}
+	licenses, err := catalogue.Query(context.Background(), LicenseQuery{})
+	assert.NoError(t, err)
+	if assert.Len(t, licenses, 1) {
+		assert.Equal(t, rancherProductSKUNonEmea, *licenses[0].ProductSKU)
+	}
+
+	// the failed sku is listed again on the next query, rather than waiting for the ttl
+	mockLMClient.skuListErrs = nil
+	licenses, err = catalogue.Query(context.Background(), LicenseQuery{})
+	assert.NoError(t, err)
+	assert.Len(t, licenses, 2)
+
+	// once listed, a failing sku keeps its previously listed licenses
+	catalogue.Invalidate()
+	mockLMClient.skuListErrs = map[string]error{rancherProductSKUNonEmea: fmt.Errorf("throttled")}
+	licenses, err = catalogue.Query(context.Background(), LicenseQuery{})
+	assert.NoError(t, err)
+	assert.Len(t, licenses, 2)
+
+	// a failing sku's licenses are left out once they are maxStale old
+	now := time.Now()
+	catalogue.now = func() time.Time { return now.Add(catalogue.maxStale) }
+	licenses, err = catalogue.Query(context.Background(), LicenseQuery{})
+	assert.NoError(t, err)
+	if assert.Len(t, licenses, 1) {
+		assert.Equal(t, rancherProductSKUEmea, *licenses[0].ProductSKU)
+	}
+
+	// every sku failing without any listed before is an error
+	empty := newLicenseCatalogue(&mockLMClient, []string{rancherProductSKUNonEmea}, time.Minute)
+	_, err = empty.Query(context.Background(), LicenseQuery{})
+	assert.Error(t, err)
+}
+
+func TestQueryLicenses(t *testing.T) {
+	mockLMClient := mockLicenseManagerClient{}
+	mockLMClient.AddLicenseForSku(rancherProductSKUEmea, fakeAccountNum, true)
+	mockLMClient.AddLicenseForSku(rancherProductSKUNonEmea, fakeAccountNum, true)
+	mockLMClient.AddLicenseForSku(rancherProductSKUNonEmea, fakeAccountNum, true)
+	productName := "Rancher Prime"
+	emea := &mockLMClient.licenses[rancherProductSKUEmea][0]
+	emea.Status = types.LicenseStatusAvailable
+	emea.ProductName = &productName
+	nonEmea := &mockLMClient.licenses[rancherProductSKUNonEmea][0]
+	nonEmea.Status = types.LicenseStatusExpired
+	client := newClient(&mockSTSClient{accountNumber: fakeAccountNum}, &mockLMClient, []string{rancherProductSKUEmea, rancherProductSKUNonEmea})
+
+	tests := []struct {
+		name         string       // name of the test, to be displayed on failure
+		query        LicenseQuery // query to run against the client's licenses
+		expectedArns []string     // arns expected in the result, in order
+	}{
+		{
+			name:         "empty query matches everything",
+			query:        LicenseQuery{},
+			expectedArns: []string{*emea.LicenseArn, *nonEmea.LicenseArn, *mockLMClient.licenses[rancherProductSKUNonEmea][1].LicenseArn},
+		},
+		{
+			name:         "ordered by sku",
+			query:        LicenseQuery{ProductSKUs: []string{rancherProductSKUNonEmea, rancherProductSKUEmea}},
+			expectedArns: []string{*nonEmea.LicenseArn, *mockLMClient.licenses[rancherProductSKUNonEmea][1].LicenseArn, *emea.LicenseArn},
+		},
+		{
+			name:         "by status",
+			query:        LicenseQuery{Statuses: []types.LicenseStatus{types.LicenseStatusExpired}},
+			expectedArns: []string{*nonEmea.LicenseArn},
+		},
+		{
+			name:         "by product name",
+			query:        LicenseQuery{ProductName: "rancher prime"},
+			expectedArns: []string{*emea.LicenseArn},
+		},
+		{
+			name:         "no matches",
+			query:        LicenseQuery{ProductSKUs: []string{"unknown"}},
+			expectedArns: nil,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			licenses, err := client.QueryLicenses(context.Background(), test.query)
+			assert.NoError(t, err)
+			var arns []string
+			for _, license := range licenses {
+				arns = append(arns, *license.LicenseArn)
+			}
+			assert.Equal(t, test.expectedArns, arns)
+		})
+	}
+}
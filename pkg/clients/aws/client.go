@@ -6,28 +6,40 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"time"
 
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	lm "github.com/aws/aws-sdk-go-v2/service/licensemanager"
 	"github.com/aws/aws-sdk-go-v2/service/licensemanager/types"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
-	"github.com/google/uuid"
+	"github.com/aws/smithy-go"
+	"github.com/rancher/csp-adapter/pkg/tracing"
 	"github.com/sirupsen/logrus"
 )
 
 type Client interface {
 	// AccountNumber gets the account number for the AWS account this client will issue calls to
 	AccountNumber() string
-	// GetRancherLicense returns the license which is for the rancher product sku
-	GetRancherLicense(ctx context.Context) (*types.GrantedLicense, error)
-	// CheckoutRancherLicense checks out the license for entitlementAmt entitlements to RKE_NODE_SUPP
-	CheckoutRancherLicense(ctx context.Context, l types.GrantedLicense, entitlementAmt int) (*lm.CheckoutLicenseOutput, error)
+	// GetRancherLicenses returns every license received for the rancher product skus, in the order of the skus
+	GetRancherLicenses(ctx context.Context) ([]types.GrantedLicense, error)
+	// QueryLicenses returns the licenses received for the rancher product skus which match q, see LicenseQuery
+	QueryLicenses(ctx context.Context, q LicenseQuery) ([]types.GrantedLicense, error)
+	// CheckoutRancherLicense checks out entitlementAmt entitlements of dimension from the license. Repeating a checkout
+	// with the same clientToken returns the original checkout rather than consuming more entitlements
+	CheckoutRancherLicense(ctx context.Context, l types.GrantedLicense, dimension string, entitlementAmt int, clientToken string) (*lm.CheckoutLicenseOutput, error)
 	// CheckInRancherLicense checks in a license using the provided consumptionToken
 	CheckInRancherLicense(ctx context.Context, consumptionToken string) (*lm.CheckInLicenseOutput, error)
 	// ExtendRancherLicenseConsumptionToken extends the Expiry time of the provided consumptionToken
 	ExtendRancherLicenseConsumptionToken(ctx context.Context, consumptionToken string) (*lm.ExtendLicenseConsumptionOutput, error)
-	// GetNumberOfAvailableEntitlements gets the number of RKE_NODE_SUPP entitlements available on license
-	GetNumberOfAvailableEntitlements(ctx context.Context, license types.GrantedLicense) (int, error)
+	// GetNumberOfAvailableEntitlements gets the number of entitlements of dimension available on license
+	GetNumberOfAvailableEntitlements(ctx context.Context, license types.GrantedLicense, dimension string) (int, error)
+	// GetNumberOfConsumedEntitlements gets the number of entitlements of dimension checked out from license by every
+	// consumer in the account
+	GetNumberOfConsumedEntitlements(ctx context.Context, license types.GrantedLicense, dimension string) (int, error)
 }
 type licenseManagerClient interface {
 	ListReceivedLicenses(ctx context.Context, params *lm.ListReceivedLicensesInput, optFns ...func(*lm.Options)) (*lm.ListReceivedLicensesOutput, error)
@@ -42,13 +54,35 @@ type stsClient interface {
 }
 
 type client struct {
-	acctNum         string
-	sts             stsClient
-	lm              licenseManagerClient
-	useTestProducts bool
+	acctNum   string
+	sts       stsClient
+	lm        licenseManagerClient
+	skus      []string
+	catalogue *licenseCatalogue
 }
 
-func NewClient(ctx context.Context, useTestProducts bool) (Client, error) {
+// ClientOptions configures how a client connects to aws
+type ClientOptions struct {
+	// UseTestProducts looks for licenses for the test product skus rather than the production skus
+	UseTestProducts bool
+	// Endpoint sends License Manager and STS calls to this url rather than to aws, for use with the License Manager
+	// emulator
+	Endpoint string
+	// RoleArn is a role to assume for every call, so that licenses held by another account can be used. If empty, calls
+	// are made with the adapter's own credentials
+	RoleArn string
+	// Timeout is how long each request to aws can take before it fails and is retried, zero uses DefaultTimeout
+	Timeout time.Duration
+	// AdditionalProductSKUs are looked for after the rancher product skus, for marketplace offers such as other
+	// subscription tiers which use their own skus
+	AdditionalProductSKUs []string
+}
+
+// DefaultTimeout is how long a request to aws can take if no timeout is configured
+const DefaultTimeout = 30 * time.Second
+
+// NewClient creates a client using the default aws config, configured by opts
+func NewClient(ctx context.Context, opts ClientOptions) (Client, error) {
 	cfg, err := config.LoadDefaultConfig(ctx)
 	if err != nil {
 		return nil, err
@@ -56,10 +90,29 @@ func NewClient(ctx context.Context, useTestProducts bool) (Client, error) {
 
 	logrus.Debugf("aws config region: %+v", cfg.Region)
 
-	c := &client{
-		sts: sts.NewFromConfig(cfg),
-		lm:  lm.NewFromConfig(cfg),
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
 	}
+	cfg.HTTPClient = awshttp.NewBuildableClient().WithTimeout(timeout)
+
+	var stsOpts []func(*sts.Options)
+	var lmOpts []func(*lm.Options)
+	if opts.Endpoint != "" {
+		logrus.Infof("using custom aws endpoint %s", opts.Endpoint)
+		stsOpts = append(stsOpts, func(o *sts.Options) { o.BaseEndpoint = &opts.Endpoint })
+		lmOpts = append(lmOpts, func(o *lm.Options) { o.BaseEndpoint = &opts.Endpoint })
+	}
+	if opts.RoleArn != "" {
+		logrus.Infof("assuming role %s for aws calls", opts.RoleArn)
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg, stsOpts...), opts.RoleArn, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = roleSessionName
+		})
+		cfg.Credentials = awssdk.NewCredentialsCache(provider)
+	}
+
+	skus := append(productSKUs(opts.UseTestProducts), opts.AdditionalProductSKUs...)
+	c := newClient(sts.NewFromConfig(cfg, stsOpts...), lm.NewFromConfig(cfg, lmOpts...), skus)
 
 	acctNum, err := c.getAccountNumber(ctx)
 	if err != nil {
@@ -67,19 +120,31 @@ func NewClient(ctx context.Context, useTestProducts bool) (Client, error) {
 	}
 
 	c.acctNum = acctNum
-	c.useTestProducts = useTestProducts
 
 	logrus.Debugf("account number: %s", acctNum)
 
 	return c, nil
 }
 
+// newClient creates a client for the licenses of skus using the provided aws service clients, the account number is
+// left for the caller to set
+func newClient(stsClient stsClient, lmClient licenseManagerClient, skus []string) *client {
+	return &client{
+		sts:       stsClient,
+		lm:        lmClient,
+		skus:      skus,
+		catalogue: newLicenseCatalogue(lmClient, skus, defaultCatalogueTTL),
+	}
+}
+
 func (c *client) AccountNumber() string {
 	return c.acctNum // set in constructor
 }
 
 // getAccountNumber returns the account number of the account to which the associated IAM user belongs.
-func (c *client) getAccountNumber(ctx context.Context) (string, error) {
+func (c *client) getAccountNumber(ctx context.Context) (account string, err error) {
+	ctx, end := tracing.Start(ctx, "aws.GetCallerIdentity")
+	defer end(&err)
 	var in sts.GetCallerIdentityInput
 	out, err := c.sts.GetCallerIdentity(ctx, &in) // no permissions required to make this call
 	if err != nil {
@@ -93,6 +158,11 @@ func (c *client) getAccountNumber(ctx context.Context) (string, error) {
 	return *out.Account, nil
 }
 
+const (
+	// roleSessionName identifies the adapter's sessions when it assumes a role in another account
+	roleSessionName = "rancher-csp-adapter"
+)
+
 var (
 	productSKUField          = "ProductSKU"
 	rancherProductSKUNonEmea = "0b87d4fa-d1fe-41d8-830b-67d4ec381549"
@@ -100,74 +170,53 @@ var (
 	// test skus - should not be enabled at the same time as prod skus
 	rancherProductTestSKUNonEmea       = "83929a73-7c49-4511-aa45-8854a4f001d4"
 	rancherProductTestSKUEmea          = "e001cf36-9e45-496e-be2c-b48749bf7dd2"
-	maxResults                   int32 = 1
+	maxResults                   int32 = 50
 )
 
-func (c *client) GetRancherLicense(ctx context.Context) (*types.GrantedLicense, error) {
-	// only attempt to retrieve the Emea licenses if we can't get the standard license
-	productSKUs := []string{rancherProductSKUNonEmea, rancherProductSKUEmea}
+// productSKUs gives the rancher product skus, with the standard sku before the Emea sku
+func productSKUs(useTestProducts bool) []string {
 	// test product IDs should only be used specifically when requested
-	if c.useTestProducts {
-		productSKUs = []string{rancherProductTestSKUNonEmea, rancherProductTestSKUEmea}
-	}
-	var errors []error
-	for _, productSKU := range productSKUs {
-		license, err := c.getLicenseForProductID(ctx, productSKU)
-		if err != nil {
-			errors = append(errors, fmt.Errorf("unable to get license for sku %s: %w", productSKU, err))
-			continue
-		}
-		// if we found a valid license, return the first one that we find
-		return license, nil
-	}
-	// if we got to this point, then we never found a valid license
-	err := fmt.Errorf("unable to get a valid rancher license")
-	// aggregate all individual errors into one message so we can see each error for each product sku
-	for _, productError := range errors {
-		err = fmt.Errorf("%s, %s", err.Error(), productError.Error())
+	if useTestProducts {
+		return []string{rancherProductTestSKUNonEmea, rancherProductTestSKUEmea}
 	}
-	return nil, err
+	return []string{rancherProductSKUNonEmea, rancherProductSKUEmea}
 }
 
-func (c *client) getLicenseForProductID(ctx context.Context, productID string) (*types.GrantedLicense, error) {
-	// per aws engineering, there should only ever be at most one license for a given product sku.
-	input := &lm.ListReceivedLicensesInput{
-		Filters: []types.Filter{
-			{
-				Name:   &productSKUField,
-				Values: []string{productID},
-			},
-		},
-		MaxResults: &maxResults,
-	}
-
-	res, err := c.lm.ListReceivedLicenses(ctx, input)
+func (c *client) GetRancherLicenses(ctx context.Context) ([]types.GrantedLicense, error) {
+	licenses, err := c.QueryLicenses(ctx, LicenseQuery{ProductSKUs: c.skus})
 	if err != nil {
-		return nil, err
-	}
-
-	if len(res.Licenses) == 0 {
-		return nil, fmt.Errorf("unable to find license for product id %s", productID)
+		return nil, fmt.Errorf("unable to get a valid rancher license, %w", err)
 	}
-
-	license := &res.Licenses[0]
-	if license.ProductSKU == nil {
-		// we expect this value to be set, but given that the value is a pointer we can't be sure
-		license.ProductSKU = &productID
+	if len(licenses) == 0 {
+		return nil, fmt.Errorf("unable to get a valid rancher license, no license found for skus %v", c.skus)
 	}
-
-	return license, nil
+	return licenses, nil
 }
 
-var (
-	entitlementDimension = "RKE_NODE_SUPP"
-)
+func (c *client) QueryLicenses(ctx context.Context, q LicenseQuery) ([]types.GrantedLicense, error) {
+	return c.catalogue.Query(ctx, q)
+}
 
 const (
-	entitlementUnit = "Count"
+	// DefaultDimension is the entitlement dimension of the original rancher offers, each entitlement of which covers 20
+	// nodes
+	DefaultDimension = "RKE_NODE_SUPP"
+	entitlementUnit  = "Count"
 )
 
-func (c *client) CheckoutRancherLicense(ctx context.Context, l types.GrantedLicense, entitlementAmt int) (*lm.CheckoutLicenseOutput, error) {
+// HasDimension reports whether license grants entitlements of dimension
+func HasDimension(license types.GrantedLicense, dimension string) bool {
+	for _, entitlement := range license.Entitlements {
+		if entitlement.Name != nil && *entitlement.Name == dimension {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *client) CheckoutRancherLicense(ctx context.Context, l types.GrantedLicense, dimension string, entitlementAmt int, clientToken string) (res *lm.CheckoutLicenseOutput, err error) {
+	ctx, end := tracing.Start(ctx, "aws.CheckoutLicense")
+	defer end(&err)
 	if l.Issuer == nil || l.Issuer.KeyFingerprint == nil {
 		if l.LicenseArn == nil {
 			return nil, fmt.Errorf("license is missing arn and KeyFingerprint/Issuer")
@@ -175,58 +224,74 @@ func (c *client) CheckoutRancherLicense(ctx context.Context, l types.GrantedLice
 		return nil, fmt.Errorf("license %s must have a KeyFingerprint for checkout", *l.LicenseArn)
 	}
 
-	token := uuid.New().String()
 	entitlementStr := fmt.Sprintf("%d", entitlementAmt)
-	res, err := c.lm.CheckoutLicense(ctx, &lm.CheckoutLicenseInput{
+	res, err = c.lm.CheckoutLicense(ctx, &lm.CheckoutLicenseInput{
 		CheckoutType:   types.CheckoutTypeProvisional,
-		ClientToken:    &token,
+		ClientToken:    &clientToken,
 		ProductSKU:     l.ProductSKU,
 		KeyFingerprint: l.Issuer.KeyFingerprint,
 		Entitlements: []types.EntitlementData{
 			{
-				Name:  &entitlementDimension,
+				Name:  &dimension,
 				Unit:  entitlementUnit,
 				Value: &entitlementStr,
 			},
 		},
 	})
 	if err != nil {
+		// the license may have changed since it was listed, make sure the next caller sees its current state
+		c.catalogue.Invalidate()
 		return nil, err
 	}
 
 	return res, nil
 }
 
-func (c *client) CheckInRancherLicense(ctx context.Context, consumptionToken string) (*lm.CheckInLicenseOutput, error) {
-	res, err := c.lm.CheckInLicense(ctx, &lm.CheckInLicenseInput{LicenseConsumptionToken: &consumptionToken})
+func (c *client) CheckInRancherLicense(ctx context.Context, consumptionToken string) (res *lm.CheckInLicenseOutput, err error) {
+	ctx, end := tracing.Start(ctx, "aws.CheckInLicense")
+	defer end(&err)
+	res, err = c.lm.CheckInLicense(ctx, &lm.CheckInLicenseInput{LicenseConsumptionToken: &consumptionToken})
 	if err != nil {
 		return nil, err
 	}
 	return res, nil
 }
 
-func (c *client) ExtendRancherLicenseConsumptionToken(ctx context.Context, consumptionToken string) (*lm.ExtendLicenseConsumptionOutput, error) {
-	res, err := c.lm.ExtendLicenseConsumption(ctx, &lm.ExtendLicenseConsumptionInput{LicenseConsumptionToken: &consumptionToken})
+func (c *client) ExtendRancherLicenseConsumptionToken(ctx context.Context, consumptionToken string) (res *lm.ExtendLicenseConsumptionOutput, err error) {
+	ctx, end := tracing.Start(ctx, "aws.ExtendLicenseConsumption")
+	defer end(&err)
+	res, err = c.lm.ExtendLicenseConsumption(ctx, &lm.ExtendLicenseConsumptionInput{LicenseConsumptionToken: &consumptionToken})
 	if err != nil {
+		c.catalogue.Invalidate()
 		return nil, err
 	}
 	return res, nil
 }
 
-func (c *client) GetNumberOfAvailableEntitlements(ctx context.Context, license types.GrantedLicense) (int, error) {
-	res, err := c.lm.GetLicenseUsage(ctx, &lm.GetLicenseUsageInput{LicenseArn: license.LicenseArn})
+func (c *client) GetNumberOfAvailableEntitlements(ctx context.Context, license types.GrantedLicense, dimension string) (int, error) {
+	consumed, err := c.GetNumberOfConsumedEntitlements(ctx, license, dimension)
 	if err != nil {
 		// this function can't guarantee availability, so return 0 and an err so the caller can sort this out
 		return 0, err
 	}
-	maxEntitlements, err := getMaxRKEEntitlements(license)
+	maxEntitlements, err := getMaxEntitlements(license, dimension)
+	if err != nil {
+		// if we can't figure out how many entitlements the license has at max, we can't see how many we have left
+		return 0, err
+	}
+	// this should be safe to do - we rely on licenseManager to control if we are/are not allowed to go over
+	return maxEntitlements - consumed, nil
+}
+
+func (c *client) GetNumberOfConsumedEntitlements(ctx context.Context, license types.GrantedLicense, dimension string) (total int, err error) {
+	ctx, end := tracing.Start(ctx, "aws.GetLicenseUsage")
+	defer end(&err)
+	res, err := c.lm.GetLicenseUsage(ctx, &lm.GetLicenseUsageInput{LicenseArn: license.LicenseArn})
 	if err != nil {
-		// if we can't figure out how many RKE nodes we can support at max, we can't see how many we have left
 		return 0, err
 	}
-	total := 0
 	for _, usage := range res.LicenseUsage.EntitlementUsages {
-		if *usage.Name == entitlementDimension {
+		if *usage.Name == dimension {
 			consumedValue, err := strconv.Atoi(*usage.ConsumedValue)
 			if err != nil {
 				return 0, err
@@ -234,15 +299,35 @@ func (c *client) GetNumberOfAvailableEntitlements(ctx context.Context, license t
 			total += consumedValue
 		}
 	}
-	// this should be safe to do - we rely on licenseManager to control if we are/are not allowed to go over
-	return maxEntitlements - total, nil
+	return total, nil
 }
 
-func getMaxRKEEntitlements(license types.GrantedLicense) (int, error) {
+func getMaxEntitlements(license types.GrantedLicense, dimension string) (int, error) {
 	for _, entitlement := range license.Entitlements {
-		if *entitlement.Name == entitlementDimension {
+		if *entitlement.Name == dimension {
 			return int(*entitlement.MaxCount), nil
 		}
 	}
-	return 0, fmt.Errorf("entitlement %s not found on license for %s", entitlementDimension, *license.LicenseArn)
+	return 0, fmt.Errorf("entitlement %s not found on license for %s", dimension, *license.LicenseArn)
+}
+
+// IsClientFault reports whether err is an error response from aws which faults the request itself, such as there being
+// no entitlements left to check out. Such a call had no effect and would fail again if repeated. Throttling is reported
+// as a client fault too, but it passes, so it isn't one here. Server faults, and calls which failed for any other reason
+// such as a timeout, may still have been applied by aws
+func IsClientFault(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrorFault() != smithy.FaultClient {
+		return false
+	}
+	return !isThrottle(apiErr.ErrorCode())
+}
+
+// isThrottle reports whether code is the error code of a throttled call. License Manager throttles with its own
+// RateLimitExceededException, which isn't one of the sdk's throttle codes
+func isThrottle(code string) bool {
+	if _, ok := retry.DefaultThrottleErrorCodes[code]; ok {
+		return true
+	}
+	return code == "RateLimitExceededException"
 }
@@ -2,31 +2,35 @@ package aws
 
 import (
 	"context"
+	"fmt"
 	"testing"
 
+	"github.com/aws/aws-sdk-go-v2/service/licensemanager/types"
+	"github.com/aws/smithy-go"
 	"github.com/stretchr/testify/assert"
 )
 
 const fakeAccountNum = "123456789101"
 
-func TestGetRancherLicense(t *testing.T) {
+func TestGetRancherLicenses(t *testing.T) {
 	tests := []struct {
-		name                  string // name of the test, to be displayed on failure
-		hasNonEmeaLicense     bool   // if the account has a license for the non-EMEA product sku
-		hasEmeaLicense        bool   // if the account has a licensed for the EMEA product sku
-		hasTestNonEmeaLicense bool   // if the account has a license for the test non-EMEA product sku
-		hasTestEmeaLicense    bool   // if the account has a license for the test EMEA product sku
-		usesTestIDs           bool   // if the account is using a test product id
-		includeProductSku     bool   // if the return from aws should include or exclude a product sku
-		desiredLicense        string // which license our client should pick - emea, non-emea, or nothing
-		errDesired            bool   // if we wanted an error for this test case
+		name                  string   // name of the test, to be displayed on failure
+		hasNonEmeaLicense     bool     // if the account has a license for the non-EMEA product sku
+		hasEmeaLicense        bool     // if the account has a licensed for the EMEA product sku
+		hasTestNonEmeaLicense bool     // if the account has a license for the test non-EMEA product sku
+		hasTestEmeaLicense    bool     // if the account has a license for the test EMEA product sku
+		usesTestIDs           bool     // if the account is using a test product id
+		additionalSKU         string   // an additional sku that the client looks for, and the account has a license for
+		includeProductSku     bool     // if the return from aws should include or exclude a product sku
+		desiredLicenses       []string // which licenses our client should return, in order - emea, non-emea, or nothing
+		errDesired            bool     // if we wanted an error for this test case
 	}{
 		{
 			name:              "test non-emea license",
 			hasNonEmeaLicense: true,
 			hasEmeaLicense:    false,
 			includeProductSku: true,
-			desiredLicense:    rancherProductSKUNonEmea,
+			desiredLicenses:   []string{rancherProductSKUNonEmea},
 			errDesired:        false,
 		},
 		{
@@ -34,15 +38,15 @@ func TestGetRancherLicense(t *testing.T) {
 			hasNonEmeaLicense: false,
 			hasEmeaLicense:    true,
 			includeProductSku: true,
-			desiredLicense:    rancherProductSKUEmea,
+			desiredLicenses:   []string{rancherProductSKUEmea},
 			errDesired:        false,
 		},
 		{
-			name:              "test non-emea + emea license - should not occur in reality",
+			name:              "test non-emea + emea license",
 			hasNonEmeaLicense: true,
 			hasEmeaLicense:    true,
 			includeProductSku: true,
-			desiredLicense:    rancherProductSKUNonEmea,
+			desiredLicenses:   []string{rancherProductSKUNonEmea, rancherProductSKUEmea},
 			errDesired:        false,
 		},
 		{
@@ -50,7 +54,6 @@ func TestGetRancherLicense(t *testing.T) {
 			hasNonEmeaLicense: false,
 			hasEmeaLicense:    false,
 			includeProductSku: false,
-			desiredLicense:    "",
 			errDesired:        true,
 		},
 		{
@@ -58,7 +61,7 @@ func TestGetRancherLicense(t *testing.T) {
 			hasNonEmeaLicense: true,
 			hasEmeaLicense:    false,
 			includeProductSku: false,
-			desiredLicense:    rancherProductSKUNonEmea,
+			desiredLicenses:   []string{rancherProductSKUNonEmea},
 			errDesired:        false,
 		},
 		{
@@ -66,7 +69,7 @@ func TestGetRancherLicense(t *testing.T) {
 			hasNonEmeaLicense: false,
 			hasEmeaLicense:    true,
 			includeProductSku: false,
-			desiredLicense:    rancherProductSKUEmea,
+			desiredLicenses:   []string{rancherProductSKUEmea},
 			errDesired:        false,
 		},
 		{
@@ -74,14 +77,14 @@ func TestGetRancherLicense(t *testing.T) {
 			hasTestNonEmeaLicense: true,
 			usesTestIDs:           true,
 			includeProductSku:     true,
-			desiredLicense:        rancherProductTestSKUNonEmea,
+			desiredLicenses:       []string{rancherProductTestSKUNonEmea},
 		},
 		{
 			name:               "test emea test license",
 			hasTestEmeaLicense: true,
 			usesTestIDs:        true,
 			includeProductSku:  true,
-			desiredLicense:     rancherProductTestSKUEmea,
+			desiredLicenses:    []string{rancherProductTestSKUEmea},
 		},
 		{
 			name:                  "test non-emea + emea test license",
@@ -89,7 +92,7 @@ func TestGetRancherLicense(t *testing.T) {
 			hasTestEmeaLicense:    true,
 			usesTestIDs:           true,
 			includeProductSku:     true,
-			desiredLicense:        rancherProductTestSKUNonEmea,
+			desiredLicenses:       []string{rancherProductTestSKUNonEmea, rancherProductTestSKUEmea},
 		},
 		{
 			name:                  "test non-emea test + prod skus, test requested, test used",
@@ -97,7 +100,7 @@ func TestGetRancherLicense(t *testing.T) {
 			hasTestNonEmeaLicense: true,
 			usesTestIDs:           true,
 			includeProductSku:     true,
-			desiredLicense:        rancherProductTestSKUNonEmea,
+			desiredLicenses:       []string{rancherProductTestSKUNonEmea},
 		},
 		{
 			name:                  "test non-emea test + prod skus, prod requested, prod used",
@@ -105,19 +108,33 @@ func TestGetRancherLicense(t *testing.T) {
 			hasTestNonEmeaLicense: true,
 			usesTestIDs:           false,
 			includeProductSku:     true,
-			desiredLicense:        rancherProductSKUNonEmea,
+			desiredLicenses:       []string{rancherProductSKUNonEmea},
+		},
+		{
+			name:              "test additional sku after rancher skus",
+			hasNonEmeaLicense: true,
+			additionalSKU:     "prime-tier-sku",
+			includeProductSku: true,
+			desiredLicenses:   []string{rancherProductSKUNonEmea, "prime-tier-sku"},
+		},
+		{
+			name:              "test additional sku only",
+			additionalSKU:     "prime-tier-sku",
+			includeProductSku: true,
+			desiredLicenses:   []string{"prime-tier-sku"},
 		},
 	}
 	for _, test := range tests {
 		test := test
 		t.Run(test.name, func(t *testing.T) {
 			mockLMClient := mockLicenseManagerClient{}
-			client := &client{
-				acctNum:         fakeAccountNum,
-				lm:              &mockLMClient,
-				sts:             &mockSTSClient{accountNumber: fakeAccountNum},
-				useTestProducts: test.usesTestIDs,
+			skus := productSKUs(test.usesTestIDs)
+			if test.additionalSKU != "" {
+				skus = append(skus, test.additionalSKU)
+				mockLMClient.AddLicenseForSku(test.additionalSKU, fakeAccountNum, test.includeProductSku)
 			}
+			client := newClient(&mockSTSClient{accountNumber: fakeAccountNum}, &mockLMClient, skus)
+			client.acctNum = fakeAccountNum
 			if test.hasNonEmeaLicense {
 				mockLMClient.AddLicenseForSku(rancherProductSKUNonEmea, fakeAccountNum, test.includeProductSku)
 			}
@@ -131,14 +148,97 @@ func TestGetRancherLicense(t *testing.T) {
 				mockLMClient.AddLicenseForSku(rancherProductTestSKUEmea, fakeAccountNum, test.includeProductSku)
 			}
 
-			license, err := client.GetRancherLicense(context.Background())
+			licenses, err := client.GetRancherLicenses(context.Background())
 			if test.errDesired {
 				assert.Error(t, err, "expected an error but err was nil")
 			} else {
 				assert.NoError(t, err, "no error was expected, but got an error")
-				assert.NotNil(t, license, "expected a valid license but was nil")
-				assert.Equal(t, *license.ProductSKU, test.desiredLicense, "received unexpected product sku")
+				var skus []string
+				for _, license := range licenses {
+					skus = append(skus, *license.ProductSKU)
+				}
+				assert.Equal(t, test.desiredLicenses, skus, "received unexpected product skus")
 			}
 		})
 	}
 }
+
+func TestGetRancherLicensesPaginated(t *testing.T) {
+	mockLMClient := mockLicenseManagerClient{}
+	client := newClient(&mockSTSClient{accountNumber: fakeAccountNum}, &mockLMClient, productSKUs(false))
+	client.acctNum = fakeAccountNum
+	// more licenses than fit in a single page
+	numLicenses := int(maxResults) + 5
+	for i := 0; i < numLicenses; i++ {
+		mockLMClient.AddLicenseForSku(rancherProductSKUNonEmea, fakeAccountNum, true)
+	}
+	mockLMClient.AddLicenseForSku(rancherProductSKUEmea, fakeAccountNum, true)
+
+	licenses, err := client.GetRancherLicenses(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, licenses, numLicenses+1)
+	seen := map[string]bool{}
+	for _, license := range licenses {
+		assert.False(t, seen[*license.LicenseArn], "license %s returned more than once", *license.LicenseArn)
+		seen[*license.LicenseArn] = true
+	}
+}
+
+func TestHasDimension(t *testing.T) {
+	nodes, clusters := DefaultDimension, "RANCHER_CLUSTER_SUPP"
+	license := types.GrantedLicense{Entitlements: []types.Entitlement{{Name: &nodes}, {Name: &clusters}}}
+	assert.True(t, HasDimension(license, DefaultDimension))
+	assert.True(t, HasDimension(license, "RANCHER_CLUSTER_SUPP"))
+	assert.False(t, HasDimension(license, "RANCHER_VCPU_SUPP"))
+	assert.False(t, HasDimension(types.GrantedLicense{}, DefaultDimension))
+}
+
+func TestIsClientFault(t *testing.T) {
+	tests := []struct {
+		name     string // name of the test, to be displayed on failure
+		err      error  // error to check
+		expected bool   // if err should be reported as a client fault
+	}{
+		{
+			name:     "client fault",
+			err:      &types.NoEntitlementsAllowedException{},
+			expected: true,
+		},
+		{
+			name:     "wrapped client fault",
+			err:      fmt.Errorf("checkout failed: %w", &smithy.GenericAPIError{Code: "ValidationException", Fault: smithy.FaultClient}),
+			expected: true,
+		},
+		{
+			name:     "license manager throttling",
+			err:      &types.RateLimitExceededException{},
+			expected: false,
+		},
+		{
+			name:     "sdk throttling code",
+			err:      &smithy.GenericAPIError{Code: "ThrottlingException", Fault: smithy.FaultClient},
+			expected: false,
+		},
+		{
+			name:     "server fault",
+			err:      &types.ServerInternalException{},
+			expected: false,
+		},
+		{
+			name:     "unknown fault",
+			err:      &smithy.GenericAPIError{Code: "InternalFailure"},
+			expected: false,
+		},
+		{
+			name:     "timeout",
+			err:      context.DeadlineExceeded,
+			expected: false,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, IsClientFault(test.err))
+		})
+	}
+}
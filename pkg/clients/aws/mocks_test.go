@@ -3,6 +3,7 @@ package aws
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"time"
 
 	lm "github.com/aws/aws-sdk-go-v2/service/licensemanager"
@@ -13,9 +14,14 @@ import (
 const timeFormat = time.RFC3339
 
 type mockLicenseManagerClient struct {
-	licenses           map[string]types.GrantedLicense
+	licenses           map[string][]types.GrantedLicense
 	checkedOutLicenses map[string]licenseInfo
 	licenseCounter     int
+	// listCalls counts the calls to ListReceivedLicenses, listErr is returned from them when set
+	listCalls int
+	listErr   error
+	// skuListErrs is returned from listing the licenses of a sku, when set for it
+	skuListErrs map[string]error
 }
 
 type mockSTSClient struct {
@@ -29,7 +35,7 @@ type licenseInfo struct {
 
 func (m *mockLicenseManagerClient) AddLicenseForSku(productSku string, accountNumber string, includeSkuInReturn bool) {
 	if m.licenses == nil {
-		m.licenses = map[string]types.GrantedLicense{}
+		m.licenses = map[string][]types.GrantedLicense{}
 	}
 	licenseArn := fmt.Sprintf("arn:aws:license-manager::%s:license:l-%06d", accountNumber, m.licenseCounter)
 	m.licenseCounter++
@@ -39,16 +45,20 @@ func (m *mockLicenseManagerClient) AddLicenseForSku(productSku string, accountNu
 	if includeSkuInReturn {
 		license.ProductSKU = &productSku
 	}
-	m.licenses[productSku] = license
+	m.licenses[productSku] = append(m.licenses[productSku], license)
 }
 
 func (m *mockLicenseManagerClient) Clear() {
-	m.licenses = map[string]types.GrantedLicense{}
+	m.licenses = map[string][]types.GrantedLicense{}
 	m.checkedOutLicenses = map[string]licenseInfo{}
 	m.licenseCounter = 0
 }
 
 func (m *mockLicenseManagerClient) ListReceivedLicenses(ctx context.Context, params *lm.ListReceivedLicensesInput, optFns ...func(*lm.Options)) (*lm.ListReceivedLicensesOutput, error) {
+	m.listCalls++
+	if m.listErr != nil {
+		return nil, m.listErr
+	}
 	var productIDs []string
 	for _, filter := range params.Filters {
 		if *filter.Name == productSKUField {
@@ -57,13 +67,32 @@ func (m *mockLicenseManagerClient) ListReceivedLicenses(ctx context.Context, par
 	}
 	var licenses []types.GrantedLicense
 	for _, productID := range productIDs {
-		if license, ok := m.licenses[productID]; ok {
-			licenses = append(licenses, license)
+		if err := m.skuListErrs[productID]; err != nil {
+			return nil, err
 		}
+		licenses = append(licenses, m.licenses[productID]...)
 	}
-	return &lm.ListReceivedLicensesOutput{
-		Licenses: licenses,
-	}, nil
+	// paginate using the index of the next license as the token
+	start := 0
+	if params.NextToken != nil {
+		var err error
+		start, err = strconv.Atoi(*params.NextToken)
+		if err != nil {
+			return nil, fmt.Errorf("invalid next token %s", *params.NextToken)
+		}
+	}
+	end := len(licenses)
+	if params.MaxResults != nil && start+int(*params.MaxResults) < end {
+		end = start + int(*params.MaxResults)
+	}
+	output := &lm.ListReceivedLicensesOutput{
+		Licenses: licenses[start:end],
+	}
+	if end < len(licenses) {
+		nextToken := strconv.Itoa(end)
+		output.NextToken = &nextToken
+	}
+	return output, nil
 }
 func (m *mockLicenseManagerClient) CheckoutLicense(ctx context.Context, params *lm.CheckoutLicenseInput, optFns ...func(*lm.Options)) (*lm.CheckoutLicenseOutput, error) {
 	consumptionToken := params.ClientToken
@@ -109,7 +138,7 @@ func (m *mockLicenseManagerClient) GetLicenseUsage(ctx context.Context, params *
 	var entitlementUsage []types.EntitlementUsage
 	for _, value := range m.checkedOutLicenses {
 		// find only the check-outs for this license
-		if license, ok := m.licenses[*value.checkOutInput.ProductSKU]; ok {
+		for _, license := range m.licenses[*value.checkOutInput.ProductSKU] {
 			if *license.LicenseArn == *licenseArn {
 				// add each usage separately, no need to combine into one
 				for _, data := range value.checkOutInput.Entitlements {
@@ -0,0 +1,70 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rancher/csp-adapter/pkg/tracing"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ReviewToken asks kubernetes whether token is a valid bearer token, giving the user it authenticates as
+func (c *Clients) ReviewToken(ctx context.Context, token string) (user authenticationv1.UserInfo, authenticated bool, err error) {
+	ctx, end := tracing.Start(ctx, "k8s.ReviewToken")
+	defer end(&err)
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+	review, err := c.TokenReviews.Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return authenticationv1.UserInfo{}, false, fmt.Errorf("unable to review token: %v", err)
+	}
+	if review.Status.Error != "" {
+		return authenticationv1.UserInfo{}, false, fmt.Errorf("unable to review token: %s", review.Status.Error)
+	}
+	return review.Status.User, review.Status.Authenticated, nil
+}
+
+// ReviewAccess asks kubernetes whether user may act on the resource described by attributes, with a
+// SubjectAccessReview
+func (c *Clients) ReviewAccess(ctx context.Context, user authenticationv1.UserInfo, attributes authorizationv1.ResourceAttributes) (allowed bool, err error) {
+	ctx, end := tracing.Start(ctx, "k8s.ReviewAccess")
+	defer end(&err)
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+	extra := make(map[string]authorizationv1.ExtraValue, len(user.Extra))
+	for key, value := range user.Extra {
+		extra[key] = authorizationv1.ExtraValue(value)
+	}
+	review, err := c.SubjectAccessReviews.Create(ctx, &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			ResourceAttributes: &attributes,
+			User:               user.Username,
+			UID:                user.UID,
+			Groups:             user.Groups,
+			Extra:              extra,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, fmt.Errorf("unable to review access: %v", err)
+	}
+	if review.Status.EvaluationError != "" && !review.Status.Allowed {
+		return false, fmt.Errorf("unable to review access: %s", review.Status.EvaluationError)
+	}
+	return review.Status.Allowed, nil
+}
+
+// APIAccess is the access a caller of the adapter's api needs: get on the proxy of the adapter's api service, which is
+// what the kubernetes api requires to reach the api through its service proxy
+func APIAccess() authorizationv1.ResourceAttributes {
+	return authorizationv1.ResourceAttributes{
+		Namespace:   cspAdapterNamespace,
+		Verb:        "get",
+		Resource:    "services",
+		Subresource: "proxy",
+		Name:        apiServiceName,
+	}
+}
@@ -6,16 +6,20 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/rancher/csp-adapter/pkg/tracing"
 	"github.com/rancher/lasso/pkg/controller"
 	v3 "github.com/rancher/rancher/pkg/apis/management.cattle.io/v3"
 	"github.com/rancher/wrangler/v3/pkg/clients"
-	v1 "github.com/rancher/wrangler/v3/pkg/generated/controllers/core/v1"
 	corev1 "k8s.io/api/core/v1"
 	apierror "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	typedauthenticationv1 "k8s.io/client-go/kubernetes/typed/authentication/v1"
+	typedauthorizationv1 "k8s.io/client-go/kubernetes/typed/authorization/v1"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 )
 
@@ -23,44 +27,91 @@ const (
 	cspAdapterNamespace = "cattle-csp-adapter-system"
 	cspAdapterSecret    = "K8S_CACHE_SECRET"
 	cspAdapterConfigMap = "K8S_OUTPUT_CONFIGMAP"
+	cspUsageConfigMap   = "K8S_USAGE_CONFIGMAP"
+	cspJournalConfigMap = "K8S_JOURNAL_CONFIGMAP"
+	cspDashboardMap     = "K8S_DASHBOARD_CONFIGMAP"
+	cspAPIService       = "K8S_API_SERVICE"
+	cspSinksConfigMap   = "K8S_OUTPUT_SINKS_CONFIGMAP"
+	cspAlertsConfigMap  = "K8S_ALERTS_CONFIGMAP"
 	cspNotification     = "K8S_OUTPUT_NOTIFICATION"
+	cspWarning          = "K8S_OUTPUT_WARNING_NOTIFICATION"
+	cspStartupError     = "K8S_OUTPUT_STARTUP_NOTIFICATION"
 	hostnameSettingEnv  = "K8S_HOSTNAME_SETTING"
 	versionSettingEnv   = "K8S_RANCHER_VERSION_SETTING"
 	cspConfigKey        = "data"
+	cspSinksKey         = "sinks"
+	cspAlertsKey        = "config"
+	cspJournalKey       = "journal"
+	cspDashboardKey     = "usage"
 	cspComponentName    = "csp-adapter"
 )
 
 var (
-	outputConfigMapName    string
-	outputNotificationName string
-	cacheName              string
-	hostnameSetting        string
-	versionSetting         string
+	outputConfigMapName     string
+	usageConfigMapName      string
+	journalConfigMapName    string
+	dashboardConfigMapName  string
+	apiServiceName          string
+	sinksConfigMapName      string
+	alertsConfigMapName     string
+	outputNotificationName  string
+	warningNotificationName string
+	startupNotificationName string
+	cacheName               string
+	hostnameSetting         string
+	versionSetting          string
 )
 
 type Client interface {
 	// GetConsumptionTokenSecret retrieves the secret containing consumption token info from k8s
-	GetConsumptionTokenSecret() (*corev1.Secret, error)
+	GetConsumptionTokenSecret(ctx context.Context) (*corev1.Secret, error)
 	// UpdateConsumptionTokenSecret stores data into the secret containing consumption token info
-	UpdateConsumptionTokenSecret(data map[string]string) error
+	UpdateConsumptionTokenSecret(ctx context.Context, data map[string]string) error
 	// UpdateCSPConfigOutput stores config to k8s as a configmap with a static/constant name
-	UpdateCSPConfigOutput(marshalledData []byte) error
-	// UpdateUserNotification creates/updates a RancherUserNotification based on isInCompliance and the provided message
-	UpdateUserNotification(isInCompliance bool, message string) error
+	UpdateCSPConfigOutput(ctx context.Context, marshalledData []byte) error
+	// GetUsageData retrieves the usage records stored in the usage configmap, keyed by record type
+	GetUsageData(ctx context.Context) (map[string]string, error)
+	// UpdateUsageData stores value under key in the usage configmap, leaving other keys untouched
+	UpdateUsageData(ctx context.Context, key string, value string) error
+	// GetTokenJournal retrieves the journal of checkouts from the token journal configmap, returning an empty string if
+	// the configmap doesn't exist
+	GetTokenJournal(ctx context.Context) (string, error)
+	// UpdateTokenJournal stores the journal of checkouts in the token journal configmap
+	UpdateTokenJournal(ctx context.Context, journal string) error
+	// UpdateDashboard stores the usage shown by the dashboard, as JSON, in the dashboard configmap
+	UpdateDashboard(ctx context.Context, usage string) error
+	// UpdateNotification creates/updates the RancherUserNotification for kind to show notification, or removes it if
+	// notification is nil
+	UpdateNotification(ctx context.Context, kind NotificationKind, notification *Notification) error
 	// GetRancherHostname finds the hostname for the core rancher install from the settings.
-	GetRancherHostname() (string, error)
+	GetRancherHostname(ctx context.Context) (string, error)
 	// GetRancherVersion finds the version of rancher from the settings
-	GetRancherVersion() (string, error)
+	GetRancherVersion(ctx context.Context) (string, error)
 }
 
 type Clients struct {
-	ConfigMaps    v1.ConfigMapClient
-	Secrets       v1.SecretController
+	ConfigMaps    typedcorev1.ConfigMapInterface
+	Secrets       typedcorev1.SecretInterface
 	Notifications controller.SharedController
 	Settings      controller.SharedController
+	Pods          typedcorev1.PodInterface
+	TokenReviews  typedauthenticationv1.TokenReviewInterface
+	// SubjectAccessReviews checks what the callers of the adapter's api may access
+	SubjectAccessReviews typedauthorizationv1.SubjectAccessReviewInterface
+
+	factory controller.SharedControllerFactory
+	timeout time.Duration
 }
 
-func New(ctx context.Context, rest *rest.Config) (*Clients, error) {
+// DefaultTimeout is how long a call to the kubernetes api can take if no timeout is configured
+const DefaultTimeout = 10 * time.Second
+
+// New creates the clients and starts the controllers they use, which run until ctx is done. Calls which take longer than
+// timeout fail, a timeout of zero uses DefaultTimeout
+func New(ctx context.Context, rest *rest.Config, timeout time.Duration) (*Clients, error) {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
 	err := readConstantsFromEnv()
 	if err != nil {
 		return nil, err
@@ -89,7 +140,7 @@ func New(ctx context.Context, rest *rest.Config) (*Clients, error) {
 	settingGVR := schema.GroupVersionResource{Group: "management.cattle.io", Version: "v3", Resource: "settings"}
 	settingKind := "Setting"
 	settingController := factory.ForResourceKind(settingGVR, settingKind, false)
-	err = settingController.Start(context.Background(), 1)
+	err = settingController.Start(ctx, 1)
 	if err != nil {
 		return nil, fmt.Errorf("error when starting setting controller %w", err)
 	}
@@ -97,26 +148,40 @@ func New(ctx context.Context, rest *rest.Config) (*Clients, error) {
 	notificationGVR := schema.GroupVersionResource{Group: "management.cattle.io", Version: "v3", Resource: "rancherusernotifications"}
 	notificationKind := "RancherUserNotification"
 	notificationController := factory.ForResourceKind(notificationGVR, notificationKind, false)
-	err = notificationController.Start(context.Background(), 1)
+	err = notificationController.Start(ctx, 1)
 	if err != nil {
 		return nil, fmt.Errorf("error when starting notification controller %w", err)
 	}
 
 	return &Clients{
-		ConfigMaps:    clients.Core.ConfigMap(),
-		Secrets:       clients.Core.Secret(),
-		Notifications: notificationController,
-		Settings:      settingController,
+		ConfigMaps:           clients.K8s.CoreV1().ConfigMaps(cspAdapterNamespace),
+		Secrets:              clients.K8s.CoreV1().Secrets(cspAdapterNamespace),
+		Notifications:        notificationController,
+		Settings:             settingController,
+		Pods:                 clients.K8s.CoreV1().Pods(cspAdapterNamespace),
+		TokenReviews:         clients.K8s.AuthenticationV1().TokenReviews(),
+		SubjectAccessReviews: clients.K8s.AuthorizationV1().SubjectAccessReviews(),
+		factory:              factory,
+		timeout:              timeout,
 	}, nil
 }
 
-// readConstantsFromEnv sets the outputConfigMapName, outputNotificationName, cacheName, and hostnameSetting after
+// readConstantsFromEnv sets the outputConfigMapName, usageConfigMapName, journalConfigMapName, dashboardConfigMapName,
+// apiServiceName, sinksConfigMapName, alertsConfigMapName, outputNotificationName, warningNotificationName, startupNotificationName, cacheName, and hostnameSetting after
 // reading values from the env - returns an error if one or more values were not found. Values for these are defined
 // in _helpers.tpl
 func readConstantsFromEnv() error {
 	cacheName = os.Getenv(cspAdapterSecret)
 	outputNotificationName = os.Getenv(cspNotification)
+	warningNotificationName = os.Getenv(cspWarning)
+	startupNotificationName = os.Getenv(cspStartupError)
 	outputConfigMapName = os.Getenv(cspAdapterConfigMap)
+	usageConfigMapName = os.Getenv(cspUsageConfigMap)
+	journalConfigMapName = os.Getenv(cspJournalConfigMap)
+	dashboardConfigMapName = os.Getenv(cspDashboardMap)
+	apiServiceName = os.Getenv(cspAPIService)
+	sinksConfigMapName = os.Getenv(cspSinksConfigMap)
+	alertsConfigMapName = os.Getenv(cspAlertsConfigMap)
 	hostnameSetting = os.Getenv(hostnameSettingEnv)
 	versionSetting = os.Getenv(versionSettingEnv)
 	var missingEnvVars []string
@@ -126,9 +191,33 @@ func readConstantsFromEnv() error {
 	if outputNotificationName == "" {
 		missingEnvVars = append(missingEnvVars, cspNotification)
 	}
+	if warningNotificationName == "" {
+		missingEnvVars = append(missingEnvVars, cspWarning)
+	}
+	if startupNotificationName == "" {
+		missingEnvVars = append(missingEnvVars, cspStartupError)
+	}
 	if outputConfigMapName == "" {
 		missingEnvVars = append(missingEnvVars, cspAdapterConfigMap)
 	}
+	if usageConfigMapName == "" {
+		missingEnvVars = append(missingEnvVars, cspUsageConfigMap)
+	}
+	if journalConfigMapName == "" {
+		missingEnvVars = append(missingEnvVars, cspJournalConfigMap)
+	}
+	if dashboardConfigMapName == "" {
+		missingEnvVars = append(missingEnvVars, cspDashboardMap)
+	}
+	if apiServiceName == "" {
+		missingEnvVars = append(missingEnvVars, cspAPIService)
+	}
+	if sinksConfigMapName == "" {
+		missingEnvVars = append(missingEnvVars, cspSinksConfigMap)
+	}
+	if alertsConfigMapName == "" {
+		missingEnvVars = append(missingEnvVars, cspAlertsConfigMap)
+	}
 	if hostnameSetting == "" {
 		missingEnvVars = append(missingEnvVars, hostnameSettingEnv)
 	}
@@ -141,105 +230,208 @@ func readConstantsFromEnv() error {
 	return fmt.Errorf("unable to read required env vars %v", missingEnvVars)
 }
 
-func (c *Clients) GetConsumptionTokenSecret() (*corev1.Secret, error) {
-	return c.Secrets.Get(cspAdapterNamespace, cacheName, metav1.GetOptions{})
+func (c *Clients) GetConsumptionTokenSecret(ctx context.Context) (secret *corev1.Secret, err error) {
+	ctx, end := tracing.Start(ctx, "k8s.GetConsumptionTokenSecret")
+	defer end(&err)
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+	return c.Secrets.Get(ctx, cacheName, metav1.GetOptions{})
 }
 
-func (c *Clients) UpdateConsumptionTokenSecret(data map[string]string) error {
-	secret, err := c.Secrets.Get(cspAdapterNamespace, cacheName, metav1.GetOptions{})
+func (c *Clients) UpdateConsumptionTokenSecret(ctx context.Context, data map[string]string) (err error) {
+	ctx, end := tracing.Start(ctx, "k8s.UpdateConsumptionTokenSecret")
+	defer end(&err)
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+	secret, err := c.Secrets.Get(ctx, cacheName, metav1.GetOptions{})
 	if err != nil {
 		if apierror.IsNotFound(err) {
-			_, err = c.Secrets.Create(&corev1.Secret{
+			_, err = c.Secrets.Create(ctx, &corev1.Secret{
 				StringData: data,
 				ObjectMeta: metav1.ObjectMeta{
 					Name:      cacheName,
 					Namespace: cspAdapterNamespace,
 				},
-			})
+			}, metav1.CreateOptions{})
 		}
 		return err
 	}
 	secret = secret.DeepCopy()
-	secret.StringData = data
-	_, err = c.Secrets.Update(secret)
+	// replace rather than merge the data, so that keys which are no longer used are removed
+	secret.Data = map[string][]byte{}
+	for key, value := range data {
+		secret.Data[key] = []byte(value)
+	}
+	_, err = c.Secrets.Update(ctx, secret, metav1.UpdateOptions{})
 	return err
 }
 
-func (c *Clients) UpdateCSPConfigOutput(marshalledData []byte) error {
+func (c *Clients) UpdateCSPConfigOutput(ctx context.Context, marshalledData []byte) (err error) {
+	ctx, end := tracing.Start(ctx, "k8s.UpdateCSPConfigOutput")
+	defer end(&err)
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
 	// since the data from this output is nested, we have to stick this all under one key in raw format
 	data := map[string]string{
 		cspConfigKey: string(marshalledData),
 	}
-	currentConfigMap, err := c.ConfigMaps.Get(cspAdapterNamespace, outputConfigMapName, metav1.GetOptions{})
+	currentConfigMap, err := c.ConfigMaps.Get(ctx, outputConfigMapName, metav1.GetOptions{})
 	if apierror.IsNotFound(err) {
-		_, err = c.ConfigMaps.Create(&corev1.ConfigMap{
+		_, err = c.ConfigMaps.Create(ctx, &corev1.ConfigMap{
 			Data: data,
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      outputConfigMapName,
 				Namespace: cspAdapterNamespace,
 			},
-		})
+		}, metav1.CreateOptions{})
 		return err
 	}
 	currentConfigMap = currentConfigMap.DeepCopy()
 	currentConfigMap.Data = data
-	_, err = c.ConfigMaps.Update(currentConfigMap)
+	_, err = c.ConfigMaps.Update(ctx, currentConfigMap, metav1.UpdateOptions{})
 	return err
 }
 
-func (c *Clients) UpdateUserNotification(isInCompliance bool, message string) error {
-	if isInCompliance {
-		// if we are in compliance, remove any existing notification
-		err := c.Notifications.Client().Delete(context.TODO(), "", outputNotificationName, metav1.DeleteOptions{})
-		if err != nil && !apierror.IsNotFound(err) {
-			// ignore not found errors - this means we didn't have a notification to delete, so we didn't need to adjust
-			return err
-		}
-	} else {
-		current := &v3.RancherUserNotification{}
-		err := c.Notifications.Client().Get(context.TODO(), "", outputNotificationName, current, metav1.GetOptions{})
-		if err != nil {
-			if apierror.IsNotFound(err) {
-				// not found means we need to make a new notification
-				current = &v3.RancherUserNotification{
-					ObjectMeta: metav1.ObjectMeta{
-						Name: outputNotificationName,
-					},
-					ComponentName: cspComponentName,
-					Message:       message,
-				}
-				err = c.Notifications.Client().Create(context.TODO(), "", current, current, metav1.CreateOptions{})
-			}
-			return err
-		}
-		// update all relevant fields - also updating component name to future-proof against changes made to this field
-		current = current.DeepCopy()
-		current.Message = message
-		current.ComponentName = cspComponentName
-		err = c.Notifications.Client().Update(context.TODO(), "", current, current, metav1.UpdateOptions{})
-		if err != nil {
-			return err
-		}
+func (c *Clients) GetUsageData(ctx context.Context) (data map[string]string, err error) {
+	ctx, end := tracing.Start(ctx, "k8s.GetUsageData")
+	defer end(&err)
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+	configMap, err := c.ConfigMaps.Get(ctx, usageConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return configMap.Data, nil
+}
+
+// GetOutputSinks retrieves the additional output sinks configured in the sinks configmap, as a JSON list. Returns an
+// empty string if the configmap doesn't exist
+func (c *Clients) GetOutputSinks(ctx context.Context) (string, error) {
+	return c.getConfigMapValue(ctx, sinksConfigMapName, cspSinksKey)
+}
+
+// GetAlertConfig retrieves the alerting config from the alerts configmap, as JSON. Returns an empty string if the
+// configmap doesn't exist
+func (c *Clients) GetAlertConfig(ctx context.Context) (string, error) {
+	return c.getConfigMapValue(ctx, alertsConfigMapName, cspAlertsKey)
+}
+
+// getConfigMapValue retrieves key from the configmap with name, returning an empty string if the configmap doesn't exist
+func (c *Clients) getConfigMapValue(ctx context.Context, name, key string) (value string, err error) {
+	ctx, end := tracing.Start(ctx, "k8s.GetConfigMap")
+	defer end(&err)
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+	configMap, err := c.ConfigMaps.Get(ctx, name, metav1.GetOptions{})
+	if apierror.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return configMap.Data[key], nil
+}
+
+func (c *Clients) UpdateUsageData(ctx context.Context, key string, value string) (err error) {
+	ctx, end := tracing.Start(ctx, "k8s.UpdateUsageData")
+	defer end(&err)
+	return c.updateConfigMapValue(ctx, usageConfigMapName, key, value)
+}
+
+// GetTokenJournal retrieves the journal of checkouts. It is kept in a configmap of its own, apart from the usage
+// configmap, so that the ledger and samples growing can't stop the journal from being saved
+func (c *Clients) GetTokenJournal(ctx context.Context) (string, error) {
+	return c.getConfigMapValue(ctx, journalConfigMapName, cspJournalKey)
+}
+
+func (c *Clients) UpdateTokenJournal(ctx context.Context, journal string) (err error) {
+	ctx, end := tracing.Start(ctx, "k8s.UpdateTokenJournal")
+	defer end(&err)
+	return c.updateConfigMapValue(ctx, journalConfigMapName, cspJournalKey, journal)
+}
+
+// UpdateDashboard publishes the dashboard's usage in a configmap of its own, so that rancher's ui can read it through
+// the kubernetes api with the user's own permissions
+func (c *Clients) UpdateDashboard(ctx context.Context, usage string) (err error) {
+	ctx, end := tracing.Start(ctx, "k8s.UpdateDashboard")
+	defer end(&err)
+	return c.updateConfigMapValue(ctx, dashboardConfigMapName, cspDashboardKey, usage)
+}
+
+// updateConfigMapValue stores value under key in the configmap with name, creating it if it doesn't exist and leaving
+// other keys untouched
+func (c *Clients) updateConfigMapValue(ctx context.Context, name, key, value string) error {
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+	currentConfigMap, err := c.ConfigMaps.Get(ctx, name, metav1.GetOptions{})
+	if apierror.IsNotFound(err) {
+		_, err = c.ConfigMaps.Create(ctx, &corev1.ConfigMap{
+			Data: map[string]string{
+				key: value,
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: cspAdapterNamespace,
+			},
+		}, metav1.CreateOptions{})
+		return err
 	}
-	return nil
+	if err != nil {
+		return err
+	}
+	currentConfigMap = currentConfigMap.DeepCopy()
+	if currentConfigMap.Data == nil {
+		currentConfigMap.Data = map[string]string{}
+	}
+	currentConfigMap.Data[key] = value
+	_, err = c.ConfigMaps.Update(ctx, currentConfigMap, metav1.UpdateOptions{})
+	return err
 }
 
-func (c *Clients) GetRancherHostname() (string, error) {
+func (c *Clients) GetRancherHostname(ctx context.Context) (hostname string, err error) {
+	ctx, end := tracing.Start(ctx, "k8s.GetRancherHostname")
+	defer end(&err)
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
 	setting := &v3.Setting{}
-	err := c.Settings.Client().Get(context.TODO(), "", hostnameSetting, setting, metav1.GetOptions{})
+	err = c.Settings.Client().Get(ctx, "", hostnameSetting, setting, metav1.GetOptions{})
 	if err != nil {
 		return "", err
 	}
 	// server-url includes the protocol prefix - we need the actual hostname to be returned
-	hostname := strings.TrimPrefix(setting.Value, "https://")
+	hostname = strings.TrimPrefix(setting.Value, "https://")
 	return hostname, nil
 }
 
-func (c *Clients) GetRancherVersion() (string, error) {
+// GetSetting gives the value of the rancher setting with name
+func (c *Clients) GetSetting(ctx context.Context, name string) (value string, err error) {
+	ctx, end := tracing.Start(ctx, "k8s.GetSetting")
+	defer end(&err)
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
 	setting := &v3.Setting{}
-	err := c.Settings.Client().Get(context.TODO(), "", versionSetting, setting, metav1.GetOptions{})
+	err = c.Settings.Client().Get(ctx, "", name, setting, metav1.GetOptions{})
 	if err != nil {
 		return "", err
 	}
 	return setting.Value, nil
 }
+
+func (c *Clients) GetRancherVersion(ctx context.Context) (version string, err error) {
+	ctx, end := tracing.Start(ctx, "k8s.GetRancherVersion")
+	defer end(&err)
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+	setting := &v3.Setting{}
+	err = c.Settings.Client().Get(ctx, "", versionSetting, setting, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	return setting.Value, nil
+}
+
+// callContext gives the context for a single call to the kubernetes api, which is cancelled once the call's timeout has
+// passed
+func (c *Clients) callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, c.timeout)
+}
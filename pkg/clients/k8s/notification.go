@@ -0,0 +1,144 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/rancher/csp-adapter/pkg/tracing"
+
+	v3 "github.com/rancher/rancher/pkg/apis/management.cattle.io/v3"
+	apierror "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NotificationKind identifies one of the notifications the adapter shows. Each kind has its own RancherUserNotification
+// with a stable name, so that each can be dismissed and cleared independently
+type NotificationKind string
+
+const (
+	// NotificationNonCompliance is shown while the adapter is out of compliance or unable to run its compliance check
+	NotificationNonCompliance NotificationKind = "non-compliance"
+	// NotificationWarning is shown while in compliance when action may be needed to stay compliant, such as licenses
+	// running out
+	NotificationWarning NotificationKind = "warning"
+	// NotificationStartupError is shown while the adapter is unable to start
+	NotificationStartupError NotificationKind = "startup-error"
+
+	// SeverityWarning is for notifications about something which needs attention soon
+	SeverityWarning = "warning"
+	// SeverityError is for notifications about something which needs attention now
+	SeverityError = "error"
+
+	// severityAnnotation, linksAnnotation and kindLabel describe the notification to tooling, since
+	// RancherUserNotification only has a message
+	severityAnnotation = "csp-adapter.cattle.io/severity"
+	linksAnnotation    = "csp-adapter.cattle.io/links"
+	kindLabel          = "csp-adapter.cattle.io/notification-kind"
+)
+
+// Notification is the content of a notification shown to rancher's users
+type Notification struct {
+	// Severity is SeverityWarning or SeverityError
+	Severity string
+	Message  string
+	// Links are where the user can act on the notification, they are appended to the message
+	Links []Link
+}
+
+// Link is a titled url included in a notification
+type Link struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// fullMessage gives the message with its links appended, since the message is all that rancher shows
+func (n Notification) fullMessage() string {
+	parts := []string{n.Message}
+	for _, link := range n.Links {
+		parts = append(parts, fmt.Sprintf("%s: %s", link.Title, link.URL))
+	}
+	return strings.Join(parts, " ")
+}
+
+// notificationName gives the name of the RancherUserNotification for kind, as configured in _helpers.tpl
+func notificationName(kind NotificationKind) (string, error) {
+	switch kind {
+	case NotificationNonCompliance:
+		return outputNotificationName, nil
+	case NotificationWarning:
+		return warningNotificationName, nil
+	case NotificationStartupError:
+		return startupNotificationName, nil
+	default:
+		return "", fmt.Errorf("unknown notification kind %s", kind)
+	}
+}
+
+func (c *Clients) UpdateNotification(ctx context.Context, kind NotificationKind, notification *Notification) (err error) {
+	ctx, end := tracing.Start(ctx, "k8s.UpdateNotification")
+	defer end(&err)
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+	name, err := notificationName(kind)
+	if err != nil {
+		return err
+	}
+	if notification == nil {
+		return c.deleteNotification(ctx, name)
+	}
+	return c.applyNotification(ctx, name, kind, *notification)
+}
+
+// deleteNotification removes the RancherUserNotification with the given name, if it exists
+func (c *Clients) deleteNotification(ctx context.Context, name string) error {
+	err := c.Notifications.Client().Delete(ctx, "", name, metav1.DeleteOptions{})
+	if err != nil && !apierror.IsNotFound(err) {
+		// ignore not found errors - this means we didn't have a notification to delete, so we didn't need to adjust
+		return err
+	}
+	return nil
+}
+
+// applyNotification creates or updates the RancherUserNotification with the given name so that it shows notification
+func (c *Clients) applyNotification(ctx context.Context, name string, kind NotificationKind, notification Notification) error {
+	links, err := json.Marshal(notification.Links)
+	if err != nil {
+		return fmt.Errorf("unable to marshal notification links: %v", err)
+	}
+	current := &v3.RancherUserNotification{}
+	err = c.Notifications.Client().Get(ctx, "", name, current, metav1.GetOptions{})
+	if err != nil {
+		if apierror.IsNotFound(err) {
+			// not found means we need to make a new notification
+			current = &v3.RancherUserNotification{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: name,
+				},
+			}
+			describeNotification(current, kind, notification, links)
+			err = c.Notifications.Client().Create(ctx, "", current, current, metav1.CreateOptions{})
+		}
+		return err
+	}
+	// update all relevant fields - also updating component name to future-proof against changes made to this field
+	current = current.DeepCopy()
+	describeNotification(current, kind, notification, links)
+	return c.Notifications.Client().Update(ctx, "", current, current, metav1.UpdateOptions{})
+}
+
+// describeNotification sets the content of obj to notification, leaving other labels and annotations untouched
+func describeNotification(obj *v3.RancherUserNotification, kind NotificationKind, notification Notification, links []byte) {
+	obj.ComponentName = cspComponentName
+	obj.Message = notification.fullMessage()
+	if obj.Labels == nil {
+		obj.Labels = map[string]string{}
+	}
+	obj.Labels[kindLabel] = string(kind)
+	if obj.Annotations == nil {
+		obj.Annotations = map[string]string{}
+	}
+	obj.Annotations[severityAnnotation] = notification.Severity
+	obj.Annotations[linksAnnotation] = string(links)
+}
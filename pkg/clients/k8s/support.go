@@ -0,0 +1,85 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/rancher/csp-adapter/pkg/logging"
+	"github.com/rancher/csp-adapter/pkg/tracing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// adapterPodSelector selects the adapter's pods, matching the labels set in deployment.yaml
+const adapterPodSelector = "app=rancher-csp-adapter"
+
+// SupportReader reads the adapter's state for inclusion in a support bundle
+type SupportReader interface {
+	// GetCSPConfigOutput retrieves the support config last stored by UpdateCSPConfigOutput
+	GetCSPConfigOutput(ctx context.Context) ([]byte, error)
+	// GetAdapterLogs retrieves up to tailLines of the most recent logs of each of the adapter's pods, keyed by pod name.
+	// For containers which have restarted, the logs from before the restart are included under "<pod>.previous"
+	GetAdapterLogs(ctx context.Context, tailLines int64) (map[string][]byte, error)
+}
+
+func (c *Clients) GetCSPConfigOutput(ctx context.Context) (data []byte, err error) {
+	ctx, end := tracing.Start(ctx, "k8s.GetCSPConfigOutput")
+	defer end(&err)
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+	configMap, err := c.ConfigMaps.Get(ctx, outputConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return []byte(configMap.Data[cspConfigKey]), nil
+}
+
+func (c *Clients) GetAdapterLogs(ctx context.Context, tailLines int64) (logs map[string][]byte, err error) {
+	ctx, end := tracing.Start(ctx, "k8s.GetAdapterLogs")
+	defer end(&err)
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+	pods, err := c.Pods.List(ctx, metav1.ListOptions{LabelSelector: adapterPodSelector})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list adapter pods: %v", err)
+	}
+	logs = map[string][]byte{}
+	for _, pod := range pods.Items {
+		current, err := c.podLogs(ctx, pod.Name, tailLines, false)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get logs for pod %s: %v", pod.Name, err)
+		}
+		logs[pod.Name] = current
+		if !restarted(pod) {
+			continue
+		}
+		previous, err := c.podLogs(ctx, pod.Name, tailLines, true)
+		if err != nil {
+			// the previous container's logs may already have been cleaned up, which shouldn't lose the current logs
+			logging.FromContext(ctx).Debugf("unable to get logs from before pod %s restarted: %v", pod.Name, err)
+			continue
+		}
+		logs[pod.Name+".previous"] = previous
+	}
+	return logs, nil
+}
+
+func (c *Clients) podLogs(ctx context.Context, name string, tailLines int64, previous bool) ([]byte, error) {
+	stream, err := c.Pods.GetLogs(name, &corev1.PodLogOptions{TailLines: &tailLines, Previous: previous}).Stream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	return io.ReadAll(stream)
+}
+
+func restarted(pod corev1.Pod) bool {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.RestartCount > 0 {
+			return true
+		}
+	}
+	return false
+}
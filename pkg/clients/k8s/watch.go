@@ -0,0 +1,82 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/rancher/lasso/pkg/controller"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// NodeWatcher reports changes to rancher which may change the number of nodes that need to be licensed
+type NodeWatcher interface {
+	// WatchNodeChanges calls onChange, with a description of the change, whenever a node or cluster is added to or
+	// removed from rancher, until ctx is done
+	WatchNodeChanges(ctx context.Context, onChange func(reason string)) error
+}
+
+// watchedResource is a rancher resource whose presence affects the number of licensed nodes
+type watchedResource struct {
+	gvr        schema.GroupVersionResource
+	kind       string
+	namespaced bool
+}
+
+var nodeCountResources = []watchedResource{
+	{
+		gvr:  schema.GroupVersionResource{Group: "management.cattle.io", Version: "v3", Resource: "clusters"},
+		kind: "Cluster",
+	},
+	{
+		gvr:        schema.GroupVersionResource{Group: "management.cattle.io", Version: "v3", Resource: "nodes"},
+		kind:       "Node",
+		namespaced: true,
+	},
+}
+
+func (c *Clients) WatchNodeChanges(ctx context.Context, onChange func(reason string)) error {
+	tracker := newPresenceTracker()
+	for _, resource := range nodeCountResources {
+		resource := resource
+		sharedController := c.factory.ForResourceKind(resource.gvr, resource.kind, resource.namespaced)
+		handlerName := fmt.Sprintf("%s-%s-watch", cspComponentName, resource.gvr.Resource)
+		sharedController.RegisterHandler(ctx, handlerName, controller.SharedControllerHandlerFunc(func(key string, obj runtime.Object) (runtime.Object, error) {
+			// updates to existing objects don't change the node count, only objects appearing or disappearing do
+			if change := tracker.update(resource.kind+"/"+key, obj != nil); change != "" {
+				onChange(fmt.Sprintf("%s %s %s", resource.kind, key, change))
+			}
+			return obj, nil
+		}))
+		if err := sharedController.Start(ctx, 1); err != nil {
+			return fmt.Errorf("error when starting %s controller %w", resource.gvr.Resource, err)
+		}
+	}
+	return nil
+}
+
+// presenceTracker tracks which objects exist, so that adds and deletes can be told apart from updates
+type presenceTracker struct {
+	mu      sync.Mutex
+	present map[string]bool
+}
+
+func newPresenceTracker() *presenceTracker {
+	return &presenceTracker{present: map[string]bool{}}
+}
+
+// update records whether the object with key exists, returning "added" or "removed" if that changed, or "" otherwise
+func (p *presenceTracker) update(key string, exists bool) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.present[key] == exists {
+		return ""
+	}
+	if exists {
+		p.present[key] = true
+		return "added"
+	}
+	delete(p.present, key)
+	return "removed"
+}
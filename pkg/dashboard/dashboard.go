@@ -0,0 +1,155 @@
+// Package dashboard serves the license usage of the rancher install to rancher's ui, which shows it as a dashboard. The
+// response is versioned by the api path, fields are only ever added within a version
+package dashboard
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rancher/csp-adapter/pkg/ledger"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// APIVersion is the version of Usage served by Handler and published in the dashboard configmap
+	APIVersion = "v1"
+	// DefaultHistory is how far back the usage history goes if the request doesn't set "from"
+	DefaultHistory = 30 * 24 * time.Hour
+)
+
+// Usage is the current license usage of the rancher install, as shown by the dashboard
+type Usage struct {
+	APIVersion string `json:"apiVersion"`
+	// Time is when the nodes and entitlements were gathered
+	Time time.Time `json:"time"`
+	// Nodes is the number of nodes across every downstream cluster
+	Nodes int `json:"nodes"`
+	// CPUs is the allocatable cpu cores across every downstream cluster, 0 if rancher doesn't report them
+	CPUs float64 `json:"cpus"`
+	// LicensedNodes is the node count being licensed according to UsageStrategy, as of the last compliance check
+	LicensedNodes int    `json:"licensedNodes"`
+	UsageStrategy string `json:"usageStrategy"`
+	// Compliance is the outcome of the last compliance check, nil if none has completed since the adapter started
+	Compliance *Compliance `json:"compliance,omitempty"`
+	// Entitlements and Headroom are of the first dimension which counts nodes, such as RKE_NODE_SUPP
+	Entitlements Entitlements `json:"entitlements"`
+	Headroom     Headroom     `json:"headroom"`
+	// Dimensions are the entitlements of each configured dimension
+	Dimensions []Dimension `json:"dimensions"`
+	Licenses   []License   `json:"licenses"`
+	Clusters   []Cluster   `json:"clusters"`
+	// History is the outcome of each compliance check since the "from" query parameter, from the usage ledger
+	History []ledger.Entry `json:"history"`
+}
+
+// Compliance is the outcome of a compliance check
+type Compliance struct {
+	Time         time.Time `json:"time"`
+	InCompliance bool      `json:"inCompliance"`
+	// Error is why the check failed, empty if it completed
+	Error string `json:"error,omitempty"`
+}
+
+// Entitlements counts licenses, each of which covers a fixed number of nodes
+type Entitlements struct {
+	// NodesPerEntitlement is the number of nodes covered by each entitlement
+	NodesPerEntitlement int `json:"nodesPerEntitlement"`
+	// Required is the number of entitlements needed for the licensed nodes
+	Required int `json:"required"`
+	// CheckedOut is the number of entitlements held by the adapter
+	CheckedOut int `json:"checkedOut"`
+	// Available is the number of entitlements that could still be checked out across every usable license
+	Available int `json:"available"`
+}
+
+// Dimension is an entitlement dimension of the licenses, and what it counts
+type Dimension struct {
+	Name string `json:"name"`
+	// Counting is what the dimension counts, such as nodes or clusters
+	Counting string `json:"counting"`
+	// UnitsPerEntitlement is how many of what is counted a single entitlement covers
+	UnitsPerEntitlement int `json:"unitsPerEntitlement"`
+	// Counted is the number of units currently counted
+	Counted int `json:"counted"`
+	// Required is the number of entitlements needed for Counted
+	Required int `json:"required"`
+	// CheckedOut is the number of entitlements held by the adapter
+	CheckedOut int `json:"checkedOut"`
+	// Available is the number of entitlements that could still be checked out across every usable license granting it
+	Available int `json:"available"`
+	// Error is why the dimension couldn't be counted, in which case Counted and Required are 0
+	Error string `json:"error,omitempty"`
+}
+
+// Headroom is how many more nodes the entitlements held and available could cover
+type Headroom struct {
+	// CoveredNodes is the most nodes that the entitlements checked out and available could license
+	CoveredNodes int `json:"coveredNodes"`
+	// Nodes is the number of nodes that could be added before running out, negative if already short
+	Nodes int `json:"nodes"`
+	// Percent is Nodes as a percentage of CoveredNodes
+	Percent float64 `json:"percent"`
+}
+
+// License is a license found in aws, and how much of it is used. CheckedOut and Available are of the same dimension
+// as Usage.Entitlements
+type License struct {
+	Arn     string `json:"arn"`
+	Account string `json:"account"`
+	Usable  bool   `json:"usable"`
+	// Reason is why the license can't be used, empty if it is usable
+	Reason     string `json:"reason,omitempty"`
+	CheckedOut int    `json:"checkedOut"`
+	Available  int    `json:"available"`
+	// Error is why the available entitlements couldn't be determined, in which case Available is 0
+	Error string `json:"error,omitempty"`
+}
+
+// Cluster is a downstream cluster and the nodes it counts towards the license
+type Cluster struct {
+	ID    string `json:"id"`
+	Nodes int    `json:"nodes"`
+	// CPUs is the allocatable cpu cores of the cluster's nodes, 0 if rancher doesn't report them
+	CPUs float64 `json:"cpus"`
+}
+
+// Source gathers the usage shown by the dashboard, with history from the ledger since from
+type Source interface {
+	Usage(ctx context.Context, from time.Time) (*Usage, error)
+}
+
+// Handler serves the usage from source as json. The "from" query parameter sets how far back the history goes, see
+// ledger.ParseTime for the accepted values, and defaults to DefaultHistory ago
+func Handler(source Source) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		from := time.Now().Add(-DefaultHistory)
+		if raw := r.URL.Query().Get("from"); raw != "" {
+			var err error
+			from, err = ledger.ParseTime(raw)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid from: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		usage, err := source.Usage(r.Context(), from)
+		if err != nil {
+			logrus.Errorf("[dashboard] unable to gather license usage: %v", err)
+			http.Error(w, "unable to gather license usage", http.StatusServiceUnavailable)
+			return
+		}
+		usage.APIVersion = APIVersion
+		body, err := json.Marshal(usage)
+		if err != nil {
+			logrus.Errorf("[dashboard] unable to marshal license usage: %v", err)
+			http.Error(w, "unable to gather license usage", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		// the usage is gathered from aws on each request that misses the source's cache, so let the browser reuse it
+		w.Header().Set("Cache-Control", "private, max-age=30")
+		_, _ = w.Write(body)
+	})
+}
@@ -0,0 +1,78 @@
+package dashboard
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSource struct {
+	usage *Usage
+	err   error
+	from  time.Time
+}
+
+func (f *fakeSource) Usage(_ context.Context, from time.Time) (*Usage, error) {
+	f.from = from
+	return f.usage, f.err
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name         string    // name of the test, to be displayed on failure
+		query        string    // query of the request
+		sourceErr    error     // error returned by the source
+		expectedCode int       // status code expected in the response
+		expectedFrom time.Time // from expected to be passed to the source, zero to expect DefaultHistory ago
+	}{
+		{
+			name:         "default history",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "history from a date",
+			query:        "?from=2024-01-01",
+			expectedCode: http.StatusOK,
+			expectedFrom: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:         "invalid from",
+			query:        "?from=last-week",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "source failed",
+			sourceErr:    errors.New("unable to reach aws"),
+			expectedCode: http.StatusServiceUnavailable,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := &fakeSource{usage: &Usage{Nodes: 40, Clusters: []Cluster{{ID: "c-1", Nodes: 40}}}, err: test.sourceErr}
+			rec := httptest.NewRecorder()
+			Handler(source).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/dashboard"+test.query, nil))
+			require.Equal(t, test.expectedCode, rec.Code)
+			if test.expectedCode != http.StatusOK {
+				return
+			}
+			if test.expectedFrom.IsZero() {
+				assert.WithinDuration(t, time.Now().Add(-DefaultHistory), source.from, time.Minute)
+			} else {
+				assert.True(t, test.expectedFrom.Equal(source.from), "expected from %s, got %s", test.expectedFrom, source.from)
+			}
+			assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+			var usage Usage
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &usage))
+			assert.Equal(t, APIVersion, usage.APIVersion)
+			assert.Equal(t, 40, usage.Nodes)
+			assert.Equal(t, []Cluster{{ID: "c-1", Nodes: 40}}, usage.Clusters)
+		})
+	}
+}
@@ -0,0 +1,425 @@
+// Package emulator provides a stateful emulator of the AWS License Manager and STS apis used by the adapter. It speaks the
+// same wire protocols as AWS, so the real aws client can be pointed at it to run the adapter end-to-end without an AWS
+// account, including token expiry, idempotent checkouts, throttling and several consumers sharing a license
+package emulator
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	lm "github.com/aws/aws-sdk-go-v2/service/licensemanager"
+	"github.com/aws/aws-sdk-go-v2/service/licensemanager/types"
+)
+
+const (
+	// DefaultTokenTTL matches how long AWS holds a checkout before it is returned if it isn't extended
+	DefaultTokenTTL = time.Hour
+
+	entitlementDimension = "RKE_NODE_SUPP"
+	keyFingerprint       = "aws:294406891311:AWS/Marketplace:issuer-fingerprint"
+	defaultMaxResults    = 100
+)
+
+// checkout is a set of entitlements held from a license by a consumption token
+type checkout struct {
+	licenseArn  string
+	clientToken string
+	// issuedToken is the consumption token the checkout was made with, which retrying the checkout still returns after
+	// extending it has replaced the token
+	issuedToken  string
+	entitlements map[string]int
+	expiry       time.Time
+}
+
+// apiError is an error returned to the caller in the same shape as an AWS error
+type apiError struct {
+	code    string
+	message string
+	status  int
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s: %s", e.code, e.message)
+}
+
+func newAPIError(status int, code, format string, args ...interface{}) *apiError {
+	return &apiError{code: code, message: fmt.Sprintf(format, args...), status: status}
+}
+
+// Emulator holds the licenses and checkouts for a single emulated AWS account. It is safe for concurrent use, so several
+// clients can consume from the same licenses
+type Emulator struct {
+	accountNumber string
+
+	mu           sync.Mutex
+	now          func() time.Time
+	tokenTTL     time.Duration
+	licenses     []*types.GrantedLicense
+	checkouts    map[string]*checkout
+	clientTokens map[string]string
+	throttled    int
+	// failures is how many more calls of each operation fail after they are applied
+	failures   map[string]int
+	licenseCtr int
+	tokenCtr   int
+}
+
+// New creates an emulator for the account accountNumber, without any licenses
+func New(accountNumber string) *Emulator {
+	return &Emulator{
+		accountNumber: accountNumber,
+		now:           time.Now,
+		tokenTTL:      DefaultTokenTTL,
+		checkouts:     map[string]*checkout{},
+		clientTokens:  map[string]string{},
+		failures:      map[string]int{},
+	}
+}
+
+// AddLicense grants the account an available license for productSKU with maxCount RKE_NODE_SUPP entitlements, returning
+// the arn of the new license
+func (e *Emulator) AddLicense(productSKU string, maxCount int) string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.licenseCtr++
+	arn := fmt.Sprintf("arn:aws:license-manager::%s:license:l-%032d", e.accountNumber, e.licenseCtr)
+	name := fmt.Sprintf("Rancher license %d", e.licenseCtr)
+	maxCount64 := int64(maxCount)
+	fingerprint := keyFingerprint
+	dimension := entitlementDimension
+	begin := e.now().UTC().Add(-24 * time.Hour).Format(time.RFC3339)
+	e.licenses = append(e.licenses, &types.GrantedLicense{
+		LicenseArn:  &arn,
+		LicenseName: &name,
+		ProductSKU:  &productSKU,
+		Status:      types.LicenseStatusAvailable,
+		Issuer:      &types.IssuerDetails{KeyFingerprint: &fingerprint},
+		Validity:    &types.DatetimeRange{Begin: &begin},
+		Entitlements: []types.Entitlement{
+			{
+				Name:     &dimension,
+				MaxCount: &maxCount64,
+				Unit:     types.EntitlementUnitCount,
+			},
+		},
+	})
+	return arn
+}
+
+// SetLicenseStatus changes the status of the license licenseArn, for example to emulate it expiring or being suspended
+func (e *Emulator) SetLicenseStatus(licenseArn string, status types.LicenseStatus) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	license := e.getLicense(licenseArn)
+	if license == nil {
+		return fmt.Errorf("license %s not found", licenseArn)
+	}
+	license.Status = status
+	return nil
+}
+
+// SetClock replaces the clock used to expire checkouts, so tests can move time forward without waiting
+func (e *Emulator) SetClock(now func() time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.now = now
+}
+
+// SetTokenTTL sets how long a checkout is held for before it expires, unless it is extended
+func (e *Emulator) SetTokenTTL(ttl time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.tokenTTL = ttl
+}
+
+// Throttle rejects the next n License Manager calls with a RateLimitExceededException
+func (e *Emulator) Throttle(n int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.throttled = n
+}
+
+// FailAfterApplying makes the next n calls of the License Manager operation, such as "CheckoutLicense", fail with a
+// ServerInternalException once they have been applied, as when aws makes a change but fails to respond
+func (e *Emulator) FailAfterApplying(operation string, n int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failures[operation] = n
+}
+
+// Consumed gives the number of entitlements currently checked out from the license licenseArn, by every consumer
+func (e *Emulator) Consumed(licenseArn string) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.expireCheckouts()
+	return e.consumed(licenseArn, entitlementDimension)
+}
+
+// Checkouts gives the number of consumption tokens which are currently held
+func (e *Emulator) Checkouts() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.expireCheckouts()
+	return len(e.checkouts)
+}
+
+// takeThrottle reports whether the current call should be throttled. Must be called with the lock held
+func (e *Emulator) takeThrottle() bool {
+	if e.throttled <= 0 {
+		return false
+	}
+	e.throttled--
+	return true
+}
+
+// takeFailure reports whether the current call of operation should fail after it is applied. Must be called with the
+// lock held
+func (e *Emulator) takeFailure(operation string) bool {
+	if e.failures[operation] <= 0 {
+		return false
+	}
+	e.failures[operation]--
+	return true
+}
+
+func (e *Emulator) getLicense(licenseArn string) *types.GrantedLicense {
+	for _, license := range e.licenses {
+		if *license.LicenseArn == licenseArn {
+			return license
+		}
+	}
+	return nil
+}
+
+// expireCheckouts returns the entitlements of every checkout which has passed its expiry without being extended
+func (e *Emulator) expireCheckouts() {
+	now := e.now()
+	for token, c := range e.checkouts {
+		if now.After(c.expiry) {
+			delete(e.checkouts, token)
+			delete(e.clientTokens, c.clientToken)
+		}
+	}
+}
+
+func (e *Emulator) consumed(licenseArn, entitlement string) int {
+	total := 0
+	for _, c := range e.checkouts {
+		if c.licenseArn == licenseArn {
+			total += c.entitlements[entitlement]
+		}
+	}
+	return total
+}
+
+func maxCount(license *types.GrantedLicense, entitlement string) int {
+	for _, e := range license.Entitlements {
+		if e.Name != nil && *e.Name == entitlement && e.MaxCount != nil {
+			return int(*e.MaxCount)
+		}
+	}
+	return 0
+}
+
+func (e *Emulator) listReceivedLicenses(in *lm.ListReceivedLicensesInput) (*lm.ListReceivedLicensesOutput, error) {
+	var matched []types.GrantedLicense
+	for _, license := range e.licenses {
+		if matchesFilters(*license, in.Filters) && matchesArns(*license, in.LicenseArns) {
+			matched = append(matched, *license)
+		}
+	}
+	// the next token is the index of the first license of the next page
+	start := 0
+	if in.NextToken != nil {
+		var err error
+		start, err = strconv.Atoi(*in.NextToken)
+		if err != nil || start < 0 || start > len(matched) {
+			return nil, newAPIError(400, "InvalidParameterValueException", "invalid next token %s", *in.NextToken)
+		}
+	}
+	pageSize := defaultMaxResults
+	if in.MaxResults != nil && *in.MaxResults > 0 {
+		pageSize = int(*in.MaxResults)
+	}
+	end := start + pageSize
+	if end > len(matched) {
+		end = len(matched)
+	}
+	out := &lm.ListReceivedLicensesOutput{Licenses: matched[start:end]}
+	if end < len(matched) {
+		next := strconv.Itoa(end)
+		out.NextToken = &next
+	}
+	return out, nil
+}
+
+func matchesFilters(license types.GrantedLicense, filters []types.Filter) bool {
+	for _, filter := range filters {
+		if filter.Name == nil {
+			continue
+		}
+		var value string
+		switch *filter.Name {
+		case "ProductSKU":
+			if license.ProductSKU != nil {
+				value = *license.ProductSKU
+			}
+		case "Status":
+			value = string(license.Status)
+		default:
+			continue
+		}
+		if !contains(filter.Values, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesArns(license types.GrantedLicense, arns []string) bool {
+	return len(arns) == 0 || contains(arns, *license.LicenseArn)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Emulator) checkoutLicense(in *lm.CheckoutLicenseInput) (*lm.CheckoutLicenseOutput, error) {
+	if in.ClientToken == nil || *in.ClientToken == "" {
+		return nil, newAPIError(400, "ValidationException", "ClientToken is required")
+	}
+	if in.ProductSKU == nil || in.KeyFingerprint == nil {
+		return nil, newAPIError(400, "ValidationException", "ProductSKU and KeyFingerprint are required")
+	}
+	// retrying a request with the same client token returns the original checkout rather than checking out again
+	if token, ok := e.clientTokens[*in.ClientToken]; ok {
+		c := e.checkouts[token]
+		return e.checkoutOutput(c.issuedToken, c), nil
+	}
+	requested := map[string]int{}
+	for _, data := range in.Entitlements {
+		if data.Name == nil || data.Value == nil {
+			return nil, newAPIError(400, "ValidationException", "entitlement name and value are required")
+		}
+		value, err := strconv.Atoi(*data.Value)
+		if err != nil || value <= 0 {
+			return nil, newAPIError(400, "ValidationException", "invalid value %s for entitlement %s", *data.Value, *data.Name)
+		}
+		requested[*data.Name] += value
+	}
+	found := false
+	for _, license := range e.licenses {
+		if *license.ProductSKU != *in.ProductSKU || *license.Issuer.KeyFingerprint != *in.KeyFingerprint {
+			continue
+		}
+		found = true
+		if license.Status != types.LicenseStatusAvailable || !e.hasCapacity(license, requested) {
+			continue
+		}
+		e.tokenCtr++
+		token := fmt.Sprintf("emulator-token-%d", e.tokenCtr)
+		c := &checkout{
+			licenseArn:   *license.LicenseArn,
+			clientToken:  *in.ClientToken,
+			issuedToken:  token,
+			entitlements: requested,
+			expiry:       e.now().Add(e.tokenTTL),
+		}
+		e.checkouts[token] = c
+		e.clientTokens[*in.ClientToken] = token
+		return e.checkoutOutput(token, c), nil
+	}
+	if !found {
+		return nil, newAPIError(404, "ResourceNotFoundException", "no license found for product sku %s", *in.ProductSKU)
+	}
+	return nil, newAPIError(400, "NoEntitlementsAllowedException", "no license for product sku %s has the requested entitlements available", *in.ProductSKU)
+}
+
+func (e *Emulator) hasCapacity(license *types.GrantedLicense, requested map[string]int) bool {
+	for name, value := range requested {
+		if e.consumed(*license.LicenseArn, name)+value > maxCount(license, name) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *Emulator) checkoutOutput(token string, c *checkout) *lm.CheckoutLicenseOutput {
+	expiration := c.expiry.UTC().Format(time.RFC3339)
+	var entitlements []types.EntitlementData
+	for name, value := range c.entitlements {
+		name, valueStr := name, strconv.Itoa(value)
+		entitlements = append(entitlements, types.EntitlementData{Name: &name, Value: &valueStr, Unit: types.EntitlementDataUnitCount})
+	}
+	return &lm.CheckoutLicenseOutput{
+		CheckoutType:            types.CheckoutTypeProvisional,
+		LicenseArn:              &c.licenseArn,
+		LicenseConsumptionToken: &token,
+		Expiration:              &expiration,
+		EntitlementsAllowed:     entitlements,
+	}
+}
+
+func (e *Emulator) checkInLicense(in *lm.CheckInLicenseInput) (*lm.CheckInLicenseOutput, error) {
+	if in.LicenseConsumptionToken == nil {
+		return nil, newAPIError(400, "ValidationException", "LicenseConsumptionToken is required")
+	}
+	c, ok := e.checkouts[*in.LicenseConsumptionToken]
+	if !ok {
+		return nil, newAPIError(404, "ResourceNotFoundException", "consumption token %s not found", *in.LicenseConsumptionToken)
+	}
+	delete(e.checkouts, *in.LicenseConsumptionToken)
+	delete(e.clientTokens, c.clientToken)
+	return &lm.CheckInLicenseOutput{}, nil
+}
+
+func (e *Emulator) extendLicenseConsumption(in *lm.ExtendLicenseConsumptionInput) (*lm.ExtendLicenseConsumptionOutput, error) {
+	if in.LicenseConsumptionToken == nil {
+		return nil, newAPIError(400, "ValidationException", "LicenseConsumptionToken is required")
+	}
+	c, ok := e.checkouts[*in.LicenseConsumptionToken]
+	if !ok {
+		return nil, newAPIError(404, "ResourceNotFoundException", "consumption token %s not found", *in.LicenseConsumptionToken)
+	}
+	// each extension replaces the consumption token, as aws does
+	e.tokenCtr++
+	token := fmt.Sprintf("emulator-token-%d", e.tokenCtr)
+	delete(e.checkouts, *in.LicenseConsumptionToken)
+	e.checkouts[token] = c
+	e.clientTokens[c.clientToken] = token
+	c.expiry = e.now().Add(e.tokenTTL)
+	expiration := c.expiry.UTC().Format(time.RFC3339)
+	return &lm.ExtendLicenseConsumptionOutput{
+		LicenseConsumptionToken: &token,
+		Expiration:              &expiration,
+	}, nil
+}
+
+func (e *Emulator) getLicenseUsage(in *lm.GetLicenseUsageInput) (*lm.GetLicenseUsageOutput, error) {
+	if in.LicenseArn == nil {
+		return nil, newAPIError(400, "ValidationException", "LicenseArn is required")
+	}
+	license := e.getLicense(*in.LicenseArn)
+	if license == nil {
+		return nil, newAPIError(404, "ResourceNotFoundException", "license %s not found", *in.LicenseArn)
+	}
+	usage := &types.LicenseUsage{}
+	for _, entitlement := range license.Entitlements {
+		consumed := strconv.Itoa(e.consumed(*license.LicenseArn, *entitlement.Name))
+		maxCountStr := strconv.Itoa(maxCount(license, *entitlement.Name))
+		usage.EntitlementUsages = append(usage.EntitlementUsages, types.EntitlementUsage{
+			Name:          entitlement.Name,
+			ConsumedValue: &consumed,
+			MaxCount:      &maxCountStr,
+			Unit:          types.EntitlementDataUnit(entitlement.Unit),
+		})
+	}
+	return &lm.GetLicenseUsageOutput{LicenseUsage: usage}, nil
+}
@@ -0,0 +1,114 @@
+package emulator
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	lm "github.com/aws/aws-sdk-go-v2/service/licensemanager"
+	"github.com/aws/aws-sdk-go-v2/service/licensemanager/types"
+	"github.com/rancher/csp-adapter/pkg/clients/aws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testAccount = "123456789012"
+	// testSKU is the non-emea test product sku, used by the aws client in dev mode
+	testSKU = "83929a73-7c49-4511-aa45-8854a4f001d4"
+)
+
+// startEmulator serves e for the duration of the test, and configures the default aws config with static credentials
+func startEmulator(t *testing.T, e *Emulator) string {
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+	t.Setenv("AWS_ACCESS_KEY_ID", "emulator")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "emulator")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_CONFIG_FILE", t.TempDir()+"/config")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", t.TempDir()+"/credentials")
+	return server.URL
+}
+
+func newClient(t *testing.T, endpoint string) aws.Client {
+	client, err := aws.NewClient(context.Background(), aws.ClientOptions{UseTestProducts: true, Endpoint: endpoint})
+	require.NoError(t, err)
+	return client
+}
+
+func TestTokenExpiry(t *testing.T) {
+	e := New(testAccount)
+	now := time.Now()
+	e.SetClock(func() time.Time { return now })
+	arn := e.AddLicense(testSKU, 2)
+	client := newClient(t, startEmulator(t, e))
+	assert.Equal(t, testAccount, client.AccountNumber())
+
+	licenses, err := client.GetRancherLicenses(context.Background())
+	require.NoError(t, err)
+	out, err := client.CheckoutRancherLicense(context.Background(), licenses[0], aws.DefaultDimension, 2, "client-token")
+	require.NoError(t, err)
+	assert.Equal(t, 2, e.Consumed(arn))
+
+	// extending holds the entitlements past the original expiry
+	now = now.Add(50 * time.Minute)
+	_, err = client.ExtendRancherLicenseConsumptionToken(context.Background(), *out.LicenseConsumptionToken)
+	require.NoError(t, err)
+	now = now.Add(50 * time.Minute)
+	assert.Equal(t, 2, e.Consumed(arn))
+
+	// once the token expires the entitlements are returned and the token can't be extended
+	now = now.Add(2 * time.Hour)
+	assert.Equal(t, 0, e.Consumed(arn))
+	_, err = client.ExtendRancherLicenseConsumptionToken(context.Background(), *out.LicenseConsumptionToken)
+	assert.Error(t, err)
+}
+
+func TestIdempotentClientToken(t *testing.T) {
+	e := New(testAccount)
+	arn := e.AddLicense(testSKU, 2)
+	server := httptest.NewServer(e)
+	defer server.Close()
+	lmClient := lm.New(lm.Options{
+		BaseEndpoint: &server.URL,
+		Region:       "us-east-1",
+		Credentials:  credentials.NewStaticCredentialsProvider("emulator", "emulator", ""),
+	})
+
+	input := &lm.CheckoutLicenseInput{
+		CheckoutType:   types.CheckoutTypeProvisional,
+		ClientToken:    awssdk.String("client-token"),
+		ProductSKU:     awssdk.String(testSKU),
+		KeyFingerprint: awssdk.String(keyFingerprint),
+		Entitlements: []types.EntitlementData{
+			{Name: awssdk.String(entitlementDimension), Unit: types.EntitlementDataUnitCount, Value: awssdk.String("1")},
+		},
+	}
+	first, err := lmClient.CheckoutLicense(context.Background(), input)
+	require.NoError(t, err)
+	retried, err := lmClient.CheckoutLicense(context.Background(), input)
+	require.NoError(t, err)
+	assert.Equal(t, *first.LicenseConsumptionToken, *retried.LicenseConsumptionToken)
+	assert.Equal(t, 1, e.Consumed(arn), "expected a retried checkout not to check out again")
+
+	input.ClientToken = awssdk.String("other-client-token")
+	input.Entitlements[0].Value = awssdk.String("2")
+	_, err = lmClient.CheckoutLicense(context.Background(), input)
+	assert.Error(t, err, "expected a checkout over the license's entitlements to fail")
+}
+
+func TestThrottling(t *testing.T) {
+	e := New(testAccount)
+	e.AddLicense(testSKU, 2)
+	client := newClient(t, startEmulator(t, e))
+
+	e.Throttle(1)
+	_, err := client.GetRancherLicenses(context.Background())
+	assert.Error(t, err, "expected a throttled listing to fail")
+	licenses, err := client.GetRancherLicenses(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, licenses, 1)
+}
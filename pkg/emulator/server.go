@@ -0,0 +1,156 @@
+package emulator
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+
+	lm "github.com/aws/aws-sdk-go-v2/service/licensemanager"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	licenseManagerTargetPrefix = "AWSLicenseManager."
+	stsNamespace               = "https://sts.amazonaws.com/doc/2011-06-15/"
+)
+
+// ServeHTTP serves License Manager calls, which use the aws json 1.1 protocol, and STS calls, which use the aws query
+// protocol. Point both services' endpoints at the emulator to use it
+func (e *Emulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if target := r.Header.Get("X-Amz-Target"); target != "" {
+		e.serveLicenseManager(w, r, strings.TrimPrefix(target, licenseManagerTargetPrefix))
+		return
+	}
+	e.serveSTS(w, r)
+}
+
+func (e *Emulator) serveLicenseManager(w http.ResponseWriter, r *http.Request, operation string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	logrus.Debugf("emulator: license manager %s", operation)
+	if e.takeThrottle() {
+		writeJSONError(w, newAPIError(http.StatusTooManyRequests, "RateLimitExceededException", "rate exceeded"))
+		return
+	}
+	e.expireCheckouts()
+
+	var out interface{}
+	var err error
+	switch operation {
+	case "ListReceivedLicenses":
+		in := &lm.ListReceivedLicensesInput{}
+		if err = decodeJSON(r, in); err == nil {
+			out, err = e.listReceivedLicenses(in)
+		}
+	case "CheckoutLicense":
+		in := &lm.CheckoutLicenseInput{}
+		if err = decodeJSON(r, in); err == nil {
+			out, err = e.checkoutLicense(in)
+		}
+	case "CheckInLicense":
+		in := &lm.CheckInLicenseInput{}
+		if err = decodeJSON(r, in); err == nil {
+			out, err = e.checkInLicense(in)
+		}
+	case "ExtendLicenseConsumption":
+		in := &lm.ExtendLicenseConsumptionInput{}
+		if err = decodeJSON(r, in); err == nil {
+			out, err = e.extendLicenseConsumption(in)
+		}
+	case "GetLicenseUsage":
+		in := &lm.GetLicenseUsageInput{}
+		if err = decodeJSON(r, in); err == nil {
+			out, err = e.getLicenseUsage(in)
+		}
+	default:
+		err = newAPIError(http.StatusBadRequest, "UnknownOperationException", "operation %s is not supported by the emulator", operation)
+	}
+	if err == nil && e.takeFailure(operation) {
+		err = newAPIError(http.StatusInternalServerError, "ServerInternalException", "internal failure")
+	}
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		logrus.Warnf("emulator: unable to write %s response: %v", operation, err)
+	}
+}
+
+func decodeJSON(r *http.Request, into interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(into); err != nil {
+		return newAPIError(http.StatusBadRequest, "SerializationException", "unable to decode request: %v", err)
+	}
+	return nil
+}
+
+func writeJSONError(w http.ResponseWriter, err error) {
+	apiErr, ok := err.(*apiError)
+	if !ok {
+		apiErr = newAPIError(http.StatusInternalServerError, "ServerInternalException", "%v", err)
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.Header().Set("X-Amzn-Errortype", apiErr.code)
+	w.WriteHeader(apiErr.status)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"__type":  apiErr.code,
+		"message": apiErr.message,
+	})
+}
+
+type getCallerIdentityResponse struct {
+	XMLName xml.Name `xml:"GetCallerIdentityResponse"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Result  struct {
+		Arn     string `xml:"Arn"`
+		UserID  string `xml:"UserId"`
+		Account string `xml:"Account"`
+	} `xml:"GetCallerIdentityResult"`
+	RequestID string `xml:"ResponseMetadata>RequestId"`
+}
+
+type stsErrorResponse struct {
+	XMLName xml.Name `xml:"ErrorResponse"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Type    string   `xml:"Error>Type"`
+	Code    string   `xml:"Error>Code"`
+	Message string   `xml:"Error>Message"`
+}
+
+func (e *Emulator) serveSTS(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeXML(w, http.StatusBadRequest, stsErrorResponse{Xmlns: stsNamespace, Type: "Sender", Code: "MalformedInput", Message: err.Error()})
+		return
+	}
+	action := r.PostForm.Get("Action")
+	logrus.Debugf("emulator: sts %s", action)
+	if action != "GetCallerIdentity" {
+		writeXML(w, http.StatusBadRequest, stsErrorResponse{
+			Xmlns:   stsNamespace,
+			Type:    "Sender",
+			Code:    "InvalidAction",
+			Message: fmt.Sprintf("action %s is not supported by the emulator", action),
+		})
+		return
+	}
+	resp := getCallerIdentityResponse{Xmlns: stsNamespace, RequestID: "emulator"}
+	resp.Result.Account = e.accountNumber
+	resp.Result.UserID = "EMULATOR"
+	resp.Result.Arn = fmt.Sprintf("arn:aws:iam::%s:user/emulator", e.accountNumber)
+	writeXML(w, http.StatusOK, resp)
+}
+
+func writeXML(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(status)
+	if err := xml.NewEncoder(w).Encode(body); err != nil {
+		logrus.Warnf("emulator: unable to write sts response: %v", err)
+	}
+}
@@ -0,0 +1,42 @@
+package history
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/rancher/csp-adapter/pkg/redact"
+	"github.com/sirupsen/logrus"
+)
+
+// Response is the body served by Handler
+type Response struct {
+	Decisions []Decision `json:"decisions"`
+}
+
+// Handler serves the decisions in r as json, newest first, limited to the number given by the "limit" query parameter.
+// Secrets known to redactor, such as consumption tokens in errors from aws, are masked. A nil redactor masks nothing
+func Handler(r *Ring, redactor *redact.Redactor) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		limit := 0
+		if raw := req.URL.Query().Get("limit"); raw != "" {
+			var err error
+			limit, err = strconv.Atoi(raw)
+			if err != nil || limit < 0 {
+				http.Error(w, "invalid limit, must be a positive number", http.StatusBadRequest)
+				return
+			}
+		}
+		body, err := json.Marshal(Response{Decisions: r.List(limit)})
+		if err != nil {
+			logrus.Errorf("[history] unable to marshal decisions: %v", err)
+			http.Error(w, "unable to read compliance history", http.StatusInternalServerError)
+			return
+		}
+		if redactor != nil {
+			body = []byte(redactor.RedactSecrets(string(body)))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(body)
+	})
+}
@@ -0,0 +1,169 @@
+// Package history keeps the most recent compliance decisions in memory, so that the running adapter can be asked what it
+// last decided and why
+package history
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultSize is the number of decisions kept if no size is configured
+const DefaultSize = 100
+
+// ActionType is something the manager did to the licenses during a compliance check
+type ActionType string
+
+const (
+	ActionCheckout ActionType = "checkout"
+	ActionCheckin  ActionType = "checkin"
+	ActionExtend   ActionType = "extend"
+)
+
+// Decision is what one compliance check saw, what it did about it, and what came of it
+type Decision struct {
+	RunID   string    `json:"runId"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Inputs  Inputs    `json:"inputs"`
+	Actions []Action  `json:"actions"`
+	Result  Result    `json:"result"`
+}
+
+// Inputs are what the check based its decisions on
+type Inputs struct {
+	// Nodes is the node count scraped from rancher
+	Nodes int `json:"nodes"`
+	// LicensedNodes is the node count licensed according to UsageStrategy
+	LicensedNodes int    `json:"licensedNodes"`
+	UsageStrategy string `json:"usageStrategy"`
+	// RequiredLicenses is the number of entitlements needed of the dimension counting nodes, or of the first dimension if
+	// none counts nodes, and RequiredDimensions the number needed of each dimension, by name
+	RequiredLicenses   int            `json:"requiredLicenses"`
+	RequiredDimensions map[string]int `json:"requiredDimensions,omitempty"`
+	// Licenses are the licenses found in aws
+	Licenses []License `json:"licenses"`
+	// CachedTokens are the ids of the consumption tokens cached by earlier checks, see redact.TokenID
+	CachedTokens []string `json:"cachedTokens"`
+}
+
+// License is a license found in aws, and whether it could be checked out from
+type License struct {
+	Arn    string `json:"arn"`
+	Usable bool   `json:"usable"`
+	// Reason is why the license can't be used, empty if it is usable
+	Reason string `json:"reason,omitempty"`
+}
+
+// Action is a single call made to change what is checked out
+type Action struct {
+	Type       ActionType `json:"type"`
+	LicenseArn string     `json:"licenseArn"`
+	// Entitlements is the number of entitlements checked out, checked in or extended
+	Entitlements int `json:"entitlements"`
+	// TokenID identifies the consumption token resulting from the action, or checked in by it
+	TokenID string `json:"tokenId,omitempty"`
+	// Error is why the action failed, empty if it succeeded
+	Error string `json:"error,omitempty"`
+}
+
+// Result is the outcome of the check
+type Result struct {
+	InCompliance bool `json:"inCompliance"`
+	// CheckedOut is the number of entitlements held of the same dimension as Inputs.RequiredLicenses, and
+	// CheckedOutDimensions the number held of each dimension, by name
+	CheckedOut           int            `json:"checkedOut"`
+	CheckedOutDimensions map[string]int `json:"checkedOutDimensions,omitempty"`
+	// Error is why the check failed, empty if it completed
+	Error string `json:"error,omitempty"`
+}
+
+// Recorder builds up the decision of a single check. It is safe for concurrent use
+type Recorder struct {
+	mu       sync.Mutex
+	decision Decision
+}
+
+type recorderKey struct{}
+
+// Start begins recording the decision of the check with runID, returning a context carrying the recorder so that the
+// calls made by the check can add to it with Update and AddAction
+func Start(ctx context.Context, runID string) (context.Context, *Recorder) {
+	r := &Recorder{decision: Decision{RunID: runID, Start: time.Now()}}
+	return context.WithValue(ctx, recorderKey{}, r), r
+}
+
+// Update applies update to the decision being recorded in ctx, doing nothing if there isn't one
+func Update(ctx context.Context, update func(d *Decision)) {
+	r, ok := ctx.Value(recorderKey{}).(*Recorder)
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	update(&r.decision)
+}
+
+// AddAction adds action to the decision being recorded in ctx, doing nothing if there isn't one
+func AddAction(ctx context.Context, action Action) {
+	Update(ctx, func(d *Decision) {
+		d.Actions = append(d.Actions, action)
+	})
+}
+
+// Finish completes the decision, recording err as the reason the check failed if it is set
+func (r *Recorder) Finish(err error) Decision {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.decision.End = time.Now()
+	if err != nil {
+		r.decision.Result.Error = err.Error()
+	}
+	return r.decision
+}
+
+// Ring holds the most recent decisions, dropping the oldest once it is full. It is safe for concurrent use
+type Ring struct {
+	mu        sync.RWMutex
+	decisions []Decision
+	// next is the index that the next decision is stored at
+	next int
+	full bool
+}
+
+// NewRing creates a ring holding up to size decisions, a size of zero uses DefaultSize
+func NewRing(size int) *Ring {
+	if size <= 0 {
+		size = DefaultSize
+	}
+	return &Ring{decisions: make([]Decision, size)}
+}
+
+// Add stores decision, replacing the oldest decision if the ring is full
+func (r *Ring) Add(decision Decision) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.decisions[r.next] = decision
+	r.next = (r.next + 1) % len(r.decisions)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// List gives up to limit of the decisions held, newest first. A limit of zero gives every decision
+func (r *Ring) List(limit int) []Decision {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	count := r.next
+	if r.full {
+		count = len(r.decisions)
+	}
+	if limit > 0 && limit < count {
+		count = limit
+	}
+	decisions := make([]Decision, 0, count)
+	for i := 1; i <= count; i++ {
+		decisions = append(decisions, r.decisions[(r.next-i+len(r.decisions))%len(r.decisions)])
+	}
+	return decisions
+}
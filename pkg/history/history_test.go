@@ -0,0 +1,133 @@
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rancher/csp-adapter/pkg/redact"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func runIDs(decisions []Decision) []string {
+	ids := make([]string, 0, len(decisions))
+	for _, decision := range decisions {
+		ids = append(ids, decision.RunID)
+	}
+	return ids
+}
+
+func TestRing(t *testing.T) {
+	tests := []struct {
+		name     string   // name of the test, to be displayed on failure
+		size     int      // size of the ring
+		added    []string // run ids of the decisions added, in order
+		limit    int      // limit passed to List
+		expected []string // run ids expected from List, in order
+	}{
+		{
+			name:     "empty",
+			size:     3,
+			expected: []string{},
+		},
+		{
+			name:     "newest first",
+			size:     3,
+			added:    []string{"a", "b"},
+			expected: []string{"b", "a"},
+		},
+		{
+			name:     "oldest dropped when full",
+			size:     3,
+			added:    []string{"a", "b", "c", "d", "e"},
+			expected: []string{"e", "d", "c"},
+		},
+		{
+			name:     "exactly full",
+			size:     3,
+			added:    []string{"a", "b", "c"},
+			expected: []string{"c", "b", "a"},
+		},
+		{
+			name:     "limited",
+			size:     3,
+			added:    []string{"a", "b", "c", "d"},
+			limit:    2,
+			expected: []string{"d", "c"},
+		},
+		{
+			name:     "limit above count",
+			size:     3,
+			added:    []string{"a"},
+			limit:    5,
+			expected: []string{"a"},
+		},
+		{
+			name:     "default size",
+			added:    []string{"a", "b"},
+			expected: []string{"b", "a"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ring := NewRing(test.size)
+			for _, runID := range test.added {
+				ring.Add(Decision{RunID: runID})
+			}
+			assert.Equal(t, test.expected, runIDs(ring.List(test.limit)))
+		})
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	// recording without a recorder in the context is a no-op
+	AddAction(context.Background(), Action{Type: ActionCheckin})
+
+	ctx, recorder := Start(context.Background(), "run-1")
+	Update(ctx, func(d *Decision) {
+		d.Inputs.Nodes = 40
+	})
+	AddAction(ctx, Action{Type: ActionCheckin, LicenseArn: "arn-1", Entitlements: 1})
+	AddAction(ctx, Action{Type: ActionCheckout, LicenseArn: "arn-1", Entitlements: 2})
+	decision := recorder.Finish(errors.New("unable to save"))
+
+	assert.Equal(t, "run-1", decision.RunID)
+	assert.Equal(t, 40, decision.Inputs.Nodes)
+	require.Len(t, decision.Actions, 2)
+	assert.Equal(t, ActionCheckin, decision.Actions[0].Type)
+	assert.Equal(t, ActionCheckout, decision.Actions[1].Type)
+	assert.Equal(t, "unable to save", decision.Result.Error)
+	assert.False(t, decision.End.Before(decision.Start))
+}
+
+func TestHandler(t *testing.T) {
+	ring := NewRing(5)
+	ring.Add(Decision{RunID: "a"})
+	ring.Add(Decision{RunID: "b", Actions: []Action{{Type: ActionExtend, Error: "token e5f1d2a8c7b94a3f has expired"}}})
+	redactor := redact.New()
+	redactor.AddToken("e5f1d2a8c7b94a3f")
+	handler := Handler(ring, redactor)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/status/decisions", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.NotContains(t, rec.Body.String(), "e5f1d2a8c7b94a3f")
+	var response Response
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.Equal(t, []string{"b", "a"}, runIDs(response.Decisions))
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/status/decisions?limit=1", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.Equal(t, []string{"b"}, runIDs(response.Decisions))
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/status/decisions?limit=all", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
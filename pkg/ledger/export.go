@@ -0,0 +1,100 @@
+package ledger
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format is an output format that the ledger can be exported in
+type Format string
+
+const (
+	FormatCSV  Format = "csv"
+	FormatJSON Format = "json"
+
+	dateLayout = "2006-01-02"
+)
+
+var csvHeader = []string{"start", "end", "checks", "nodes", "required_licenses", "checked_out_licenses", "token_id", "status", "dimensions"}
+
+// ParseFormat converts a user provided format name into a Format. An empty name gives csv
+func ParseFormat(name string) (Format, error) {
+	switch format := Format(name); format {
+	case "":
+		return FormatCSV, nil
+	case FormatCSV, FormatJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown export format %q, must be one of %s, %s", name, FormatCSV, FormatJSON)
+	}
+}
+
+// ParseTime parses a time bound for an export, either as an RFC3339 timestamp or a date (midnight UTC). An empty
+// value gives the zero time, which leaves the range unbounded
+func ParseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(dateLayout, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to parse %q as an RFC3339 timestamp or a YYYY-MM-DD date", value)
+	}
+	return t, nil
+}
+
+// Export writes entries to w in the given format
+func Export(w io.Writer, format Format, entries []Entry) error {
+	switch format {
+	case FormatJSON:
+		if entries == nil {
+			// always produce a list, even if it's empty
+			entries = []Entry{}
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	case FormatCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write(csvHeader); err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			err := writer.Write([]string{
+				entry.Start.Format(time.RFC3339),
+				entry.End.Format(time.RFC3339),
+				strconv.Itoa(entry.Checks),
+				strconv.Itoa(entry.Nodes),
+				strconv.Itoa(entry.RequiredLicenses),
+				strconv.Itoa(entry.CheckedOut),
+				entry.TokenID,
+				entry.Status,
+				formatDimensions(entry.Dimensions),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	default:
+		return fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+// formatDimensions writes the usage of each dimension as name=required/checked_out, separated by semicolons, so that it
+// fits in a single csv column
+func formatDimensions(dimensions []DimensionUsage) string {
+	parts := make([]string, 0, len(dimensions))
+	for _, dimension := range dimensions {
+		parts = append(parts, fmt.Sprintf("%s=%d/%d", dimension.Dimension, dimension.RequiredLicenses, dimension.CheckedOut))
+	}
+	return strings.Join(parts, ";")
+}
@@ -0,0 +1,52 @@
+package ledger
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ExportHandler serves the ledger in the format given by the "format" query parameter, limited to the range given by
+// the "from" and "to" query parameters. See ParseFormat and ParseTime for the accepted values
+func ExportHandler(l *Ledger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		format, err := ParseFormat(query.Get("format"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		from, err := ParseTime(query.Get("from"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid from: %v", err), http.StatusBadRequest)
+			return
+		}
+		to, err := ParseTime(query.Get("to"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid to: %v", err), http.StatusBadRequest)
+			return
+		}
+		entries, err := l.Entries(r.Context(), from, to)
+		if err != nil {
+			logrus.Errorf("[ledger] unable to read entries for export: %v", err)
+			http.Error(w, "unable to read usage ledger", http.StatusInternalServerError)
+			return
+		}
+		// export to a buffer first so that a failure part way through doesn't produce a truncated 200 response
+		var buf bytes.Buffer
+		if err := Export(&buf, format, entries); err != nil {
+			logrus.Errorf("[ledger] unable to export entries: %v", err)
+			http.Error(w, "unable to export usage ledger", http.StatusInternalServerError)
+			return
+		}
+		if format == FormatJSON {
+			w.Header().Set("Content-Type", "application/json")
+		} else {
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", `attachment; filename="usage.csv"`)
+		}
+		_, _ = w.Write(buf.Bytes())
+	})
+}
@@ -0,0 +1,240 @@
+// Package ledger keeps a persisted history of compliance checks so that license consumption can be reconciled later
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rancher/csp-adapter/pkg/clients/k8s"
+	"github.com/rancher/csp-adapter/pkg/redact"
+	apierror "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	// ledgerKey is the key in the usage configmap that the ledger is stored under
+	ledgerKey = "ledger"
+	// DefaultRetention is how long entries are kept when no retention is configured
+	DefaultRetention = 90 * 24 * time.Hour
+	// DefaultMaxEntries bounds the number of entries so that the ledger still fits in a configmap
+	DefaultMaxEntries = 5000
+	// MaxBytes bounds the size of the persisted ledger, whatever the number of entries, leaving room in the 1MiB usage
+	// configmap for the usage samples
+	MaxBytes = 768 * 1024
+	// mergedSaveInterval is how often a check merged into the last entry is persisted. Checks which start a new entry are
+	// always persisted, so at most this much of the last entry's time can be lost on a restart
+	mergedSaveInterval = 5 * time.Minute
+)
+
+// Entry records the outcome of one or more consecutive compliance checks. Consecutive checks with the same outcome are
+// merged into a single entry covering the time from its first to its last check. RequiredLicenses and CheckedOut are
+// the entitlements of the dimension counting nodes, or of the first dimension if none counts nodes, since entitlements of
+// different dimensions cover different things. Dimensions holds the entitlements of every dimension
+type Entry struct {
+	Start            time.Time        `json:"start"`
+	End              time.Time        `json:"end"`
+	Checks           int              `json:"checks"`
+	Nodes            int              `json:"nodes"`
+	RequiredLicenses int              `json:"required_licenses"`
+	CheckedOut       int              `json:"checked_out_licenses"`
+	Dimensions       []DimensionUsage `json:"dimensions,omitempty"`
+	TokenID          string           `json:"token_id"`
+	Status           string           `json:"status"`
+}
+
+// DimensionUsage is the number of entitlements of a dimension that a check required and held
+type DimensionUsage struct {
+	Dimension        string `json:"dimension"`
+	RequiredLicenses int    `json:"required_licenses"`
+	CheckedOut       int    `json:"checked_out_licenses"`
+}
+
+// sameOutcome is true if e and other only differ in the times they cover
+func (e Entry) sameOutcome(other Entry) bool {
+	return e.Nodes == other.Nodes &&
+		e.RequiredLicenses == other.RequiredLicenses &&
+		e.CheckedOut == other.CheckedOut &&
+		slices.Equal(e.Dimensions, other.Dimensions) &&
+		e.TokenID == other.TokenID &&
+		e.Status == other.Status
+}
+
+// Check holds the outcome of a single compliance check, to be recorded in the ledger, see Entry
+type Check struct {
+	Time             time.Time
+	Nodes            int
+	RequiredLicenses int
+	CheckedOut       int
+	Dimensions       []DimensionUsage
+	ConsumptionToken string
+	Status           string
+}
+
+// Ledger is a history of compliance checks, persisted to the usage configmap. It is read from the configmap once, then
+// served from memory. It is safe for concurrent use, so that the api can read it while the manager records checks
+type Ledger struct {
+	mu         sync.Mutex
+	k8s        k8s.Client
+	retention  time.Duration
+	maxEntries int
+	entries    []Entry
+	loaded     bool
+	// savedAt is the time of the last check persisted
+	savedAt time.Time
+}
+
+// New creates a ledger stored using k. Entries older than retention are dropped, as are the oldest entries once there
+// are more than maxEntries. Zero values use DefaultRetention and DefaultMaxEntries
+func New(k k8s.Client, retention time.Duration, maxEntries int) *Ledger {
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxEntries
+	}
+	return &Ledger{
+		k8s:        k,
+		retention:  retention,
+		maxEntries: maxEntries,
+	}
+}
+
+// Record adds check to the ledger and persists the result. A check merged into the last entry is only persisted if the
+// last was persisted mergedSaveInterval before it, so that the configmap isn't rewritten on every check. If the
+// configmap changed since it was read, the ledger is read again and the check added to that
+func (l *Ledger) Record(ctx context.Context, check Check) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.ensureLoaded(ctx); err != nil {
+		return err
+	}
+	if merged := l.add(check); merged && check.Time.Sub(l.savedAt) < mergedSaveInterval {
+		return nil
+	}
+	err := l.save(ctx)
+	if apierror.IsConflict(err) {
+		if err := l.load(ctx); err != nil {
+			return err
+		}
+		l.add(check)
+		err = l.save(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	l.savedAt = check.Time
+	return nil
+}
+
+// add adds check to the entries, returning whether it was merged into the last entry rather than starting a new one
+func (l *Ledger) add(check Check) (merged bool) {
+	entry := Entry{
+		Start:            check.Time.UTC(),
+		End:              check.Time.UTC(),
+		Checks:           1,
+		Nodes:            check.Nodes,
+		RequiredLicenses: check.RequiredLicenses,
+		CheckedOut:       check.CheckedOut,
+		Dimensions:       check.Dimensions,
+		TokenID:          TokenID(check.ConsumptionToken),
+		Status:           check.Status,
+	}
+	if len(l.entries) > 0 && l.entries[len(l.entries)-1].sameOutcome(entry) {
+		last := &l.entries[len(l.entries)-1]
+		last.End = entry.End
+		last.Checks++
+		merged = true
+	} else {
+		l.entries = append(l.entries, entry)
+	}
+	l.prune(check.Time)
+	return merged
+}
+
+// Entries returns every entry which covers some time in [from, to). A zero from or to leaves that side unbounded. The
+// ledger is only read from the configmap the first time, so readers outside the manager, such as the export command,
+// should use a ledger of their own
+func (l *Ledger) Entries(ctx context.Context, from, to time.Time) ([]Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.ensureLoaded(ctx); err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for _, entry := range l.entries {
+		if !from.IsZero() && entry.End.Before(from) {
+			continue
+		}
+		if !to.IsZero() && !entry.Start.Before(to) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// prune drops entries older than the retention period and, failing that, the oldest entries over maxEntries
+func (l *Ledger) prune(now time.Time) {
+	cutoff := now.Add(-l.retention)
+	i := 0
+	for i < len(l.entries) && l.entries[i].End.Before(cutoff) {
+		i++
+	}
+	if len(l.entries)-i > l.maxEntries {
+		i = len(l.entries) - l.maxEntries
+	}
+	l.entries = l.entries[i:]
+}
+
+func (l *Ledger) ensureLoaded(ctx context.Context) error {
+	if l.loaded {
+		return nil
+	}
+	return l.load(ctx)
+}
+
+func (l *Ledger) load(ctx context.Context) error {
+	data, err := l.k8s.GetUsageData(ctx)
+	if err != nil && !apierror.IsNotFound(err) {
+		// not found just means that nothing has been recorded yet
+		return fmt.Errorf("unable to read ledger: %v", err)
+	}
+	l.entries = nil
+	if raw, ok := data[ledgerKey]; ok {
+		if err := json.Unmarshal([]byte(raw), &l.entries); err != nil {
+			return fmt.Errorf("unable to parse ledger: %v", err)
+		}
+	}
+	l.loaded = true
+	return nil
+}
+
+// save persists the entries, dropping the oldest of them if they don't fit in MaxBytes
+func (l *Ledger) save(ctx context.Context) error {
+	marshalled, err := json.Marshal(l.entries)
+	if err != nil {
+		return err
+	}
+	for len(marshalled) > MaxBytes && len(l.entries) > 1 {
+		// drop enough entries, by their average size, to get under the limit, with one more to allow for rounding
+		drop := (len(marshalled)-MaxBytes)/(len(marshalled)/len(l.entries)) + 1
+		if drop >= len(l.entries) {
+			drop = len(l.entries) - 1
+		}
+		l.entries = l.entries[drop:]
+		marshalled, err = json.Marshal(l.entries)
+		if err != nil {
+			return err
+		}
+	}
+	return l.k8s.UpdateUsageData(ctx, ledgerKey, string(marshalled))
+}
+
+// TokenID identifies a consumption token without storing the token itself, so that entries can be matched with the
+// checkouts seen in AWS while keeping the ledger safe to hand out
+func TokenID(consumptionToken string) string {
+	return redact.TokenID(consumptionToken)
+}
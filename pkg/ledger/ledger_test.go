@@ -0,0 +1,229 @@
+package ledger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rancher/csp-adapter/pkg/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newCheck(offset time.Duration, nodes int, token string) Check {
+	return Check{
+		Time:             start.Add(offset),
+		Nodes:            nodes,
+		RequiredLicenses: (nodes + 19) / 20,
+		CheckedOut:       (nodes + 19) / 20,
+		ConsumptionToken: token,
+		Status:           "Compliant",
+	}
+}
+
+// withClusters adds a cluster dimension to check, needing and holding clusters entitlements
+func withClusters(check Check, clusters int) Check {
+	check.Dimensions = []DimensionUsage{
+		{Dimension: "RKE_NODE_SUPP", RequiredLicenses: check.RequiredLicenses, CheckedOut: check.CheckedOut},
+		{Dimension: "RANCHER_CLUSTER_SUPP", RequiredLicenses: clusters, CheckedOut: clusters},
+	}
+	return check
+}
+
+func TestRecord(t *testing.T) {
+	tests := []struct {
+		name            string  // name of the test, to be displayed on failure
+		maxEntries      int     // max entries for the ledger
+		checks          []Check // checks recorded, in order
+		expectedEntries int     // number of entries expected after recording
+		expectedChecks  []int   // number of checks expected in each entry
+	}{
+		{
+			name:            "identical checks are merged",
+			checks:          []Check{newCheck(0, 20, "a"), newCheck(time.Minute, 20, "a"), newCheck(2*time.Minute, 20, "a")},
+			expectedEntries: 1,
+			expectedChecks:  []int{3},
+		},
+		{
+			name:            "changes start a new entry",
+			checks:          []Check{newCheck(0, 20, "a"), newCheck(time.Minute, 40, "b"), newCheck(2*time.Minute, 40, "b")},
+			expectedEntries: 2,
+			expectedChecks:  []int{1, 2},
+		},
+		{
+			name:            "changes to another dimension start a new entry",
+			checks:          []Check{withClusters(newCheck(0, 20, "a"), 1), withClusters(newCheck(time.Minute, 20, "a"), 2)},
+			expectedEntries: 2,
+			expectedChecks:  []int{1, 1},
+		},
+		{
+			name:            "old entries are dropped after retention",
+			checks:          []Check{newCheck(0, 20, "a"), newCheck(48*time.Hour, 40, "b")},
+			expectedEntries: 1,
+			expectedChecks:  []int{1},
+		},
+		{
+			name:            "oldest entries are dropped over max entries",
+			maxEntries:      2,
+			checks:          []Check{newCheck(0, 20, "a"), newCheck(time.Minute, 40, "b"), newCheck(2*time.Minute, 60, "c")},
+			expectedEntries: 2,
+			expectedChecks:  []int{1, 1},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			l := New(mocks.NewMockK8sClient(nil), 24*time.Hour, test.maxEntries)
+			for _, check := range test.checks {
+				require.NoError(t, l.Record(context.TODO(), check))
+			}
+			entries, err := l.Entries(context.TODO(), time.Time{}, time.Time{})
+			require.NoError(t, err)
+			assert.Len(t, entries, test.expectedEntries)
+			for i, entry := range entries {
+				assert.Equal(t, test.expectedChecks[i], entry.Checks)
+			}
+		})
+	}
+}
+
+func TestEntriesRange(t *testing.T) {
+	l := New(mocks.NewMockK8sClient(nil), 0, 0)
+	require.NoError(t, l.Record(context.TODO(), newCheck(0, 20, "a")))
+	require.NoError(t, l.Record(context.TODO(), newCheck(24*time.Hour, 40, "b")))
+	require.NoError(t, l.Record(context.TODO(), newCheck(48*time.Hour, 60, "c")))
+
+	entries, err := l.Entries(context.TODO(), start.Add(time.Hour), start.Add(48*time.Hour))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, 40, entries[0].Nodes)
+}
+
+func TestConcurrentRecordAndEntries(t *testing.T) {
+	// the manager records checks while the export endpoint reads them, run with -race to catch unguarded access
+	l := New(mocks.NewMockK8sClient(nil), 0, 0)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			assert.NoError(t, l.Record(context.TODO(), newCheck(time.Duration(i)*time.Hour, 20+i, "a")))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			_, err := l.Entries(context.TODO(), time.Time{}, time.Time{})
+			assert.NoError(t, err)
+		}
+	}()
+	wg.Wait()
+	entries, err := l.Entries(context.TODO(), time.Time{}, time.Time{})
+	require.NoError(t, err)
+	assert.Len(t, entries, 50)
+}
+
+func TestEntriesServedFromMemory(t *testing.T) {
+	k8sClient := mocks.NewMockK8sClient(nil)
+	l := New(k8sClient, 0, 0)
+	require.NoError(t, l.Record(context.TODO(), newCheck(0, 20, "a")))
+	k8sClient.CurrentUsageData[ledgerKey] = "[]"
+
+	entries, err := l.Entries(context.TODO(), time.Time{}, time.Time{})
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestMergedChecksSavedPeriodically(t *testing.T) {
+	k8sClient := mocks.NewMockK8sClient(nil)
+	l := New(k8sClient, 0, 0)
+	saved := func() []Entry {
+		var entries []Entry
+		require.NoError(t, json.Unmarshal([]byte(k8sClient.CurrentUsageData[ledgerKey]), &entries))
+		return entries
+	}
+	require.NoError(t, l.Record(context.TODO(), newCheck(0, 20, "a")))
+	require.NoError(t, l.Record(context.TODO(), newCheck(time.Minute, 20, "a")))
+	assert.Equal(t, 1, saved()[0].Checks, "a merged check shouldn't be saved straight away")
+
+	require.NoError(t, l.Record(context.TODO(), newCheck(mergedSaveInterval, 20, "a")))
+	assert.Equal(t, 3, saved()[0].Checks)
+
+	require.NoError(t, l.Record(context.TODO(), newCheck(mergedSaveInterval+time.Minute, 40, "a")))
+	assert.Len(t, saved(), 2, "a new entry should be saved straight away")
+}
+
+func TestRecordReloadsOnConflict(t *testing.T) {
+	k8sClient := mocks.NewMockK8sClient(nil)
+	l := New(k8sClient, 0, 0)
+	require.NoError(t, l.Record(context.TODO(), newCheck(0, 20, "a")))
+
+	// another writer replaces the ledger, so the next save conflicts and the ledger is read again
+	otherClient := mocks.NewMockK8sClient(nil)
+	require.NoError(t, New(otherClient, 0, 0).Record(context.TODO(), newCheck(0, 60, "b")))
+	k8sClient.CurrentUsageData[ledgerKey] = otherClient.CurrentUsageData[ledgerKey]
+	k8sClient.UsageDataConflicts = 1
+
+	require.NoError(t, l.Record(context.TODO(), newCheck(time.Hour, 40, "a")))
+	entries, err := l.Entries(context.TODO(), time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, 60, entries[0].Nodes)
+	assert.Equal(t, 40, entries[1].Nodes)
+	assert.Contains(t, k8sClient.CurrentUsageData[ledgerKey], `"nodes":40`)
+}
+
+func TestTokenIsNotStored(t *testing.T) {
+	k8sClient := mocks.NewMockK8sClient(nil)
+	l := New(k8sClient, 0, 0)
+	require.NoError(t, l.Record(context.TODO(), newCheck(0, 20, "super-secret-token")))
+	assert.NotContains(t, k8sClient.CurrentUsageData[ledgerKey], "super-secret-token")
+	entries, err := l.Entries(context.TODO(), time.Time{}, time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, TokenID("super-secret-token"), entries[0].TokenID)
+}
+
+func TestExport(t *testing.T) {
+	dimensions := []DimensionUsage{{Dimension: "RKE_NODE_SUPP", RequiredLicenses: 1, CheckedOut: 1}, {Dimension: "RANCHER_CLUSTER_SUPP", RequiredLicenses: 2, CheckedOut: 1}}
+	entries := []Entry{{Start: start, End: start.Add(time.Minute), Checks: 2, Nodes: 20, RequiredLicenses: 1, CheckedOut: 1, Dimensions: dimensions, TokenID: "abc", Status: "Compliant"}}
+
+	var csvOut bytes.Buffer
+	require.NoError(t, Export(&csvOut, FormatCSV, entries))
+	lines := strings.Split(strings.TrimSpace(csvOut.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Equal(t, strings.Join(csvHeader, ","), lines[0])
+	assert.Equal(t, "2024-01-01T00:00:00Z,2024-01-01T00:01:00Z,2,20,1,1,abc,Compliant,RKE_NODE_SUPP=1/1;RANCHER_CLUSTER_SUPP=2/1", lines[1])
+
+	var jsonOut bytes.Buffer
+	require.NoError(t, Export(&jsonOut, FormatJSON, nil))
+	assert.Equal(t, "[]", strings.TrimSpace(jsonOut.String()))
+}
+
+func TestExportHandler(t *testing.T) {
+	l := New(mocks.NewMockK8sClient(nil), 0, 0)
+	require.NoError(t, l.Record(context.TODO(), newCheck(0, 20, "a")))
+	handler := ExportHandler(l)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/usage/export?format=json&from=2023-12-31", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var entries []Entry
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &entries))
+	assert.Len(t, entries, 1)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/usage/export?format=xml", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/usage/export?to=yesterday", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
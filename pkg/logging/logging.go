@@ -0,0 +1,93 @@
+// Package logging configures the adapter's log format, and correlates the logs of each compliance run by carrying a run
+// id in the context passed to every call the run makes
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// FormatText logs lines of key=value pairs, this is the default
+	FormatText = "text"
+	// FormatJSON logs each entry as a json object, for log aggregators
+	FormatJSON = "json"
+)
+
+// fields set on entries by this package
+const (
+	RunIDField     = "run_id"
+	OperationField = "operation"
+	DurationField  = "duration_ms"
+	OutcomeField   = "outcome"
+
+	OutcomeSuccess = "success"
+	OutcomeError   = "error"
+)
+
+// Configure sets the format of the standard logger to format, one of FormatText or FormatJSON. An empty format gives
+// FormatText
+func Configure(format string) error {
+	switch format {
+	case "", FormatText:
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	case FormatJSON:
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q, must be one of %s, %s", format, FormatText, FormatJSON)
+	}
+	return nil
+}
+
+type runIDKey struct{}
+
+// NewRunID gives a random id for a compliance run
+func NewRunID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// the id only correlates logs, so a clock based id is good enough if there's no randomness available
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// WithRunID gives a context carrying runID, which is added to every entry logged with FromContext
+func WithRunID(ctx context.Context, runID string) context.Context {
+	return context.WithValue(ctx, runIDKey{}, runID)
+}
+
+// RunID gives the run id carried by ctx, or an empty string if there isn't one
+func RunID(ctx context.Context) string {
+	runID, _ := ctx.Value(runIDKey{}).(string)
+	return runID
+}
+
+// FromContext gives an entry of the standard logger with the run id carried by ctx, if any
+func FromContext(ctx context.Context) *logrus.Entry {
+	entry := logrus.NewEntry(logrus.StandardLogger())
+	if runID := RunID(ctx); runID != "" {
+		entry = entry.WithField(RunIDField, runID)
+	}
+	return entry
+}
+
+// Observe logs the duration and outcome of operation, which started at start and failed if *err is set. It is meant to
+// be deferred at the start of a call with a named error result:
+//
+//	defer logging.Observe(ctx, "aws.CheckoutLicense", time.Now(), &err)
+func Observe(ctx context.Context, operation string, start time.Time, err *error) {
+	entry := FromContext(ctx).WithFields(logrus.Fields{
+		OperationField: operation,
+		DurationField:  time.Since(start).Milliseconds(),
+	})
+	if err != nil && *err != nil {
+		entry.WithField(OutcomeField, OutcomeError).WithError(*err).Debugf("%s failed", operation)
+		return
+	}
+	entry.WithField(OutcomeField, OutcomeSuccess).Debugf("%s succeeded", operation)
+}
@@ -0,0 +1,95 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// captureJSON sends the standard logger's entries to the returned buffer as json, at debug level
+func captureJSON(t *testing.T) *bytes.Buffer {
+	logger := logrus.StandardLogger()
+	var buf bytes.Buffer
+	level, out, formatter := logger.GetLevel(), logger.Out, logger.Formatter
+	require.NoError(t, Configure(FormatJSON))
+	logger.SetOutput(&buf)
+	logger.SetLevel(logrus.DebugLevel)
+	t.Cleanup(func() {
+		logger.SetOutput(out)
+		logger.SetLevel(level)
+		logger.SetFormatter(formatter)
+	})
+	return &buf
+}
+
+func TestConfigure(t *testing.T) {
+	tests := []struct {
+		name      string // name of the test, to be displayed on failure
+		format    string // format to configure
+		expectErr bool   // whether an error is expected
+	}{
+		{name: "default", format: ""},
+		{name: "text", format: FormatText},
+		{name: "json", format: FormatJSON},
+		{name: "unknown", format: "xml", expectErr: true},
+	}
+	formatter := logrus.StandardLogger().Formatter
+	t.Cleanup(func() { logrus.SetFormatter(formatter) })
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			err := Configure(test.format)
+			if test.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestRunID(t *testing.T) {
+	assert.Empty(t, RunID(context.Background()))
+	first, second := NewRunID(), NewRunID()
+	assert.NotEqual(t, first, second, "expected each run to get a new id")
+	assert.Equal(t, first, RunID(WithRunID(context.Background(), first)))
+}
+
+func TestObserve(t *testing.T) {
+	tests := []struct {
+		name            string // name of the test, to be displayed on failure
+		err             error  // error returned by the observed call
+		expectedOutcome string // expected outcome field
+	}{
+		{name: "success", expectedOutcome: OutcomeSuccess},
+		{name: "failure", err: errors.New("access denied"), expectedOutcome: OutcomeError},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			logs := captureJSON(t)
+			ctx := WithRunID(context.Background(), "run-1")
+			func() (err error) {
+				defer Observe(ctx, "aws.CheckoutLicense", time.Now().Add(-time.Second), &err)
+				return test.err
+			}()
+
+			var entry map[string]interface{}
+			require.NoError(t, json.Unmarshal(logs.Bytes(), &entry))
+			assert.Equal(t, "run-1", entry[RunIDField])
+			assert.Equal(t, "aws.CheckoutLicense", entry[OperationField])
+			assert.Equal(t, test.expectedOutcome, entry[OutcomeField])
+			assert.GreaterOrEqual(t, entry[DurationField], float64(1000))
+			if test.err != nil {
+				assert.Equal(t, test.err.Error(), entry[logrus.ErrorKey])
+			}
+		})
+	}
+}
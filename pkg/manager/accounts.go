@@ -0,0 +1,99 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rancher/csp-adapter/pkg/clients/aws"
+	"github.com/rancher/csp-adapter/pkg/logging"
+)
+
+// AccountUsage describes how much is checked out from the licenses held by one AWS account
+type AccountUsage struct {
+	Account    string `json:"account"`
+	Licenses   int    `json:"licenses"`
+	CheckedOut int    `json:"checked_out"`
+}
+
+// client gives the client for the account that the license in state is held by
+func (m *AWS) client(state licenseState) aws.Client {
+	return m.accounts[state.account]
+}
+
+// clientForAccount gives the client for the account with acctNum. Checkouts made before several accounts were supported
+// don't record an account, and fall back to the primary account which made them
+func (m *AWS) clientForAccount(acctNum string) aws.Client {
+	for _, client := range m.accounts {
+		if client.AccountNumber() == acctNum {
+			return client
+		}
+	}
+	return m.accounts[0]
+}
+
+// getLicenses gets the rancher licenses held by every account, split into those usable at now and those which aren't.
+// Usable licenses are ordered by the priority of their account, and then by partitionLicenses within an account. An
+// account whose licenses can't be listed is skipped and returned in failed, keyed by its account number, so an error is
+// only returned if no account has any
+func (m *AWS) getLicenses(ctx context.Context, now time.Time) (usable, unusable []licenseState, failed map[string]bool, err error) {
+	var errs []error
+	failed = map[string]bool{}
+	for i, client := range m.accounts {
+		licenses, err := client.GetRancherLicenses(ctx)
+		if err != nil {
+			if len(m.accounts) > 1 {
+				logging.FromContext(ctx).Warnf("unable to get rancher licenses from account %s, skipping it: %v", client.AccountNumber(), err)
+			}
+			errs = append(errs, err)
+			failed[client.AccountNumber()] = true
+			continue
+		}
+		accountUsable, accountUnusable := partitionLicenses(licenses, now)
+		for _, state := range accountUsable {
+			state.account = i
+			usable = append(usable, state)
+		}
+		for _, state := range accountUnusable {
+			state.account = i
+			unusable = append(unusable, state)
+		}
+	}
+	if len(errs) == len(m.accounts) {
+		if len(errs) == 1 {
+			return nil, nil, nil, errs[0]
+		}
+		return nil, nil, nil, fmt.Errorf("no rancher licenses found in any account %v", errs)
+	}
+	return usable, unusable, failed, nil
+}
+
+// fromFailedAccounts splits checkouts into those held from an account in failed, whose licenses couldn't be listed, and
+// the rest. Whether the licenses of a failed account are still usable is unknown, so its checkouts are kept rather than
+// returned and checked out again
+func (m *AWS) fromFailedAccounts(checkouts []licenseCheckoutInfo, failed map[string]bool) (of, rest []licenseCheckoutInfo) {
+	for _, checkout := range checkouts {
+		if failed[m.clientForAccount(checkout.Account).AccountNumber()] {
+			of = append(of, checkout)
+		} else {
+			rest = append(rest, checkout)
+		}
+	}
+	return of, rest
+}
+
+// accountUsage gives the number of licenses found in each account, and how many entitlements are checked out from them
+func (m *AWS) accountUsage(usable, unusable []licenseState, checkouts []licenseCheckoutInfo) []AccountUsage {
+	usage := make([]AccountUsage, len(m.accounts))
+	for i, client := range m.accounts {
+		usage[i].Account = client.AccountNumber()
+	}
+	for _, state := range usable {
+		usage[state.account].Licenses++
+		usage[state.account].CheckedOut += entitledFrom(checkouts, state.arn())
+	}
+	for _, state := range unusable {
+		usage[state.account].Licenses++
+	}
+	return usage
+}
@@ -0,0 +1,133 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/rancher/csp-adapter/pkg/clients/aws"
+	"github.com/rancher/csp-adapter/pkg/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckoutAcrossAccounts(t *testing.T) {
+	tests := []struct {
+		name               string // name of the test, to be displayed on failure
+		accountMaxCounts   []int  // max entitlements for the license in each account, in priority order
+		numRancherNodes    int    // nodes reported by rancher
+		inCompliance       bool   // if the check should be compliant
+		expectedCheckedOut []int  // entitlements expected to be checked out from each account
+	}{
+		{
+			name:               "primary account covers everything",
+			accountMaxCounts:   []int{3, 2},
+			numRancherNodes:    60,
+			inCompliance:       true,
+			expectedCheckedOut: []int{3, 0},
+		},
+		{
+			name:               "additional account covers the rest",
+			accountMaxCounts:   []int{1, 2, 2},
+			numRancherNodes:    60,
+			inCompliance:       true,
+			expectedCheckedOut: []int{1, 2, 0},
+		},
+		{
+			name:               "primary account without entitlements is skipped",
+			accountMaxCounts:   []int{0, 2},
+			numRancherNodes:    40,
+			inCompliance:       true,
+			expectedCheckedOut: []int{0, 2},
+		},
+		{
+			name:               "not enough across all accounts",
+			accountMaxCounts:   []int{1, 1},
+			numRancherNodes:    60,
+			inCompliance:       false,
+			expectedCheckedOut: []int{1, 1},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			var clients []*mocks.MockAWSClient
+			var additional []aws.Client
+			for i, maxCount := range test.accountMaxCounts {
+				client := mocks.NewMockAWSClientForAccount(fmt.Sprintf("%012d", i+1), maxCount)
+				clients = append(clients, client)
+				if i > 0 {
+					additional = append(additional, client)
+				}
+			}
+			mockK8sClient := mocks.NewMockK8sClient(nil)
+			m := NewAWS(clients[0], mockK8sClient, mocks.NewMockScraper(test.numRancherNodes), Options{AdditionalAccounts: additional})
+			assert.NoError(t, m.runComplianceCheck(context.TODO()))
+
+			var config CSPSupportConfig
+			require.NoError(t, json.Unmarshal(mockK8sClient.CurrentSupportConfig, &config))
+			assert.Equal(t, complianceStatus(test.inCompliance), config.Compliance.Status)
+			assert.Equal(t, clients[0].AccountNumber(), config.CSP.AcctNumber)
+			require.Len(t, config.Accounts, len(clients))
+			for i, client := range clients {
+				arn := *client.Licenses[0].LicenseArn
+				assert.Equal(t, test.expectedCheckedOut[i], client.CheckedOutForLicense(arn), "checked out from account %d", i)
+				assert.Equal(t, AccountUsage{Account: client.AccountNumber(), Licenses: 1, CheckedOut: test.expectedCheckedOut[i]}, config.Accounts[i])
+				assert.Equal(t, client.AccountNumber(), config.Licenses[i].Account)
+			}
+		})
+	}
+}
+
+func TestCheckInAcrossAccounts(t *testing.T) {
+	primary := mocks.NewMockAWSClientForAccount("000000000001", 1)
+	secondary := mocks.NewMockAWSClientForAccount("000000000002", 2)
+	scraper := mocks.NewMockScraper(60)
+	m := NewAWS(primary, mocks.NewMockK8sClient(nil), scraper, Options{AdditionalAccounts: []aws.Client{secondary}})
+	assert.NoError(t, m.runComplianceCheck(context.TODO()))
+	assert.Equal(t, 1, primary.CheckedOutForLicense(*primary.Licenses[0].LicenseArn))
+	assert.Equal(t, 2, secondary.CheckedOutForLicense(*secondary.Licenses[0].LicenseArn))
+
+	// each checkout is checked in with the account it was made from before checking out again
+	scraper.Nodes = 20
+	assert.NoError(t, m.runComplianceCheck(context.TODO()))
+	assert.Equal(t, 1, primary.CheckedOutForLicense(*primary.Licenses[0].LicenseArn))
+	assert.Equal(t, 0, secondary.CheckedOutForLicense(*secondary.Licenses[0].LicenseArn))
+}
+
+func TestKeepCheckoutsOfFailedAccount(t *testing.T) {
+	primary := mocks.NewMockAWSClientForAccount("000000000001", 1)
+	secondary := mocks.NewMockAWSClientForAccount("000000000002", 2)
+	m := NewAWS(primary, mocks.NewMockK8sClient(nil), mocks.NewMockScraper(60), Options{AdditionalAccounts: []aws.Client{secondary}})
+	assert.NoError(t, m.runComplianceCheck(context.TODO()))
+	before, err := m.getLicenseCheckouts(context.TODO())
+	require.NoError(t, err)
+
+	// the secondary account's licenses can't be listed, but its checkout is still held
+	secondary.GetLicensesErr = fmt.Errorf("throttled")
+	assert.NoError(t, m.runComplianceCheck(context.TODO()))
+	assert.Equal(t, 1, primary.CheckedOutForLicense(*primary.Licenses[0].LicenseArn))
+	assert.Equal(t, 2, secondary.CheckedOutForLicense(*secondary.Licenses[0].LicenseArn), "expected the checkout not to be checked in")
+	assert.Equal(t, 1, primary.CheckoutTokenCtr, "expected nothing to be checked out again")
+	assert.Equal(t, 1, secondary.CheckoutTokenCtr, "expected nothing to be checked out again")
+	after, err := m.getLicenseCheckouts(context.TODO())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, consumptionTokensOf(before), consumptionTokensOf(after))
+}
+
+func consumptionTokensOf(checkouts []licenseCheckoutInfo) []string {
+	var tokens []string
+	for _, checkout := range checkouts {
+		tokens = append(tokens, checkout.ConsumptionToken)
+	}
+	return tokens
+}
+
+func TestClientForAccount(t *testing.T) {
+	primary := mocks.NewMockAWSClientForAccount("000000000001", 1)
+	secondary := mocks.NewMockAWSClientForAccount("000000000002", 1)
+	m := NewAWS(primary, mocks.NewMockK8sClient(nil), mocks.NewMockScraper(0), Options{AdditionalAccounts: []aws.Client{secondary}})
+	assert.Equal(t, secondary, m.clientForAccount("000000000002"))
+	assert.Equal(t, primary, m.clientForAccount(""), "expected checkouts without an account to use the primary account")
+}
@@ -0,0 +1,68 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rancher/csp-adapter/pkg/alert"
+	"github.com/rancher/csp-adapter/pkg/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newAlertRecorder starts a local webhook, returning an alerter which sends to it and a func giving the types of the
+// alerts received so far
+func newAlertRecorder(t *testing.T) (*alert.Alerter, func() []string) {
+	var mu sync.Mutex
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var sent alert.Alert
+		assert.NoError(t, json.Unmarshal(body, &sent))
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, sent.Type)
+	}))
+	t.Cleanup(server.Close)
+	webhook, err := alert.NewWebhook(server.URL, "", nil, time.Second)
+	require.NoError(t, err)
+	return alert.New([]alert.Sender{webhook}, time.Hour), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, received...)
+	}
+}
+
+func TestComplianceAlerts(t *testing.T) {
+	alerter, received := newAlertRecorder(t)
+	scraper := mocks.NewMockScraper(40)
+	m := NewAWS(mocks.NewMockAWSClient(1), mocks.NewMockK8sClient(nil), scraper, Options{Alerter: alerter})
+
+	assert.NoError(t, m.runComplianceCheck(context.TODO()))
+	assert.NoError(t, m.runComplianceCheck(context.TODO()))
+	assert.Equal(t, []string{alert.TypeNonCompliant}, received(), "expected a single alert while non-compliant")
+
+	scraper.Nodes = 20
+	assert.NoError(t, m.runComplianceCheck(context.TODO()))
+	assert.NoError(t, m.runComplianceCheck(context.TODO()))
+	assert.Equal(t, []string{alert.TypeNonCompliant, alert.TypeComplianceRestored}, received())
+
+	scraper.Nodes = 40
+	assert.NoError(t, m.runComplianceCheck(context.TODO()))
+	assert.Equal(t, []string{alert.TypeNonCompliant, alert.TypeComplianceRestored, alert.TypeNonCompliant}, received(),
+		"expected losing compliance again to alert")
+}
+
+func TestTokenExtendFailedAlert(t *testing.T) {
+	alerter, received := newAlertRecorder(t)
+	m := NewAWS(mocks.NewMockAWSClient(1), mocks.NewMockK8sClient(nil), mocks.NewMockScraper(0), Options{Alerter: alerter})
+	unknown := licenseCheckoutInfo{LicenseArn: "arn", ConsumptionToken: "unknown-token", EntitledLicenses: 1, Expiry: time.Now()}
+	assert.Empty(t, m.extendCheckouts(context.TODO(), time.Minute, []licenseCheckoutInfo{unknown}))
+	assert.Equal(t, []string{alert.TypeTokenExtendFailed}, received())
+}
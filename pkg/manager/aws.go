@@ -4,245 +4,530 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"math"
-	"strconv"
 	"time"
 
+	"github.com/rancher/csp-adapter/pkg/alert"
 	"github.com/rancher/csp-adapter/pkg/clients/aws"
 	"github.com/rancher/csp-adapter/pkg/clients/k8s"
+	"github.com/rancher/csp-adapter/pkg/history"
+	"github.com/rancher/csp-adapter/pkg/ledger"
+	"github.com/rancher/csp-adapter/pkg/logging"
+	"github.com/rancher/csp-adapter/pkg/messages"
 	"github.com/rancher/csp-adapter/pkg/metrics"
+	"github.com/rancher/csp-adapter/pkg/output"
+	"github.com/rancher/csp-adapter/pkg/redact"
+	"github.com/rancher/csp-adapter/pkg/tracing"
 	"github.com/sirupsen/logrus"
 )
 
 type AWS struct {
-	cancel  context.CancelFunc
-	aws     aws.Client
-	k8s     k8s.Client
-	scraper metrics.Scraper
+	cancel context.CancelFunc
+	// accounts holds a client for each account that licenses are checked out from, in priority order
+	accounts []aws.Client
+	k8s      k8s.Client
+	scraper  metrics.Scraper
+	usage    *usageStore
+	ledger   *ledger.Ledger
+	output   *output.Fanout
+	alerts   *alert.Alerter
+	messages *messages.Catalogue
+	redactor *redact.Redactor
+	history  *history.Ring
+	// dimensions are the entitlement dimensions checked out, in order, see Dimension
+	dimensions []Dimension
+	// usageCache holds the usage last gathered for rancher's dashboard
+	usageCache usageCache
+
+	headroomWarningPercent   float64
+	exhaustionWarningDays    int
+	licenseExpiryWarningDays int
+
+	interval          time.Duration
+	extensionLeadTime time.Duration
+	eventDriven       bool
+	resyncInterval    time.Duration
+	debounce          time.Duration
+	// triggers holds a pending request for a compliance check in event-driven mode
+	triggers chan string
+	// tokenLifetime is the lifetime of the most recent token issued by aws, and leadTimeCapped is set once the extension
+	// lead time has been found to be too long for it
+	tokenLifetime  time.Duration
+	leadTimeCapped bool
+
+	// checkedIn holds the client tokens of checkouts checked in since the token journal was last saved
+	checkedIn map[string]bool
 }
 
-func NewAWS(a aws.Client, k k8s.Client, s metrics.Scraper) *AWS {
+// Options holds the tunable settings of a manager. Zero values are replaced with defaults
+type Options struct {
+	// UsageStrategy determines which node count is licensed, see UsageStrategy
+	UsageStrategy UsageStrategy
+	// UsageWindow is the length of time that rolling usage strategies consider
+	UsageWindow time.Duration
+	// LedgerRetention is how long the outcome of each compliance check is kept in the usage ledger
+	LedgerRetention time.Duration
+	// LedgerMaxEntries is the most entries kept in the usage ledger, the oldest are dropped first
+	LedgerMaxEntries int
+	// HeadroomWarningPercent warns the user when less than this percent of the nodes covered by the available licenses
+	// are unused. Zero disables the warning
+	HeadroomWarningPercent float64
+	// ExhaustionWarningDays warns the user when node growth over the usage window is projected to exceed the available
+	// licenses within this many days. Zero disables the warning
+	ExhaustionWarningDays int
+	// LicenseExpiryWarningDays warns the user when the end of the license's validity period is within this many days.
+	// Zero disables the warning
+	LicenseExpiryWarningDays int
+	// Interval is how often the compliance check runs
+	Interval time.Duration
+	// ExtensionLeadTime is how long before a checkout expires that it is extended, see ValidateTiming
+	ExtensionLeadTime time.Duration
+	// EventDriven runs the compliance check when TriggerCheck is called, with ResyncInterval replacing Interval as a
+	// slower periodic check in case a change is missed
+	EventDriven bool
+	// ResyncInterval is how often the compliance check runs in event-driven mode
+	ResyncInterval time.Duration
+	// Debounce is how long to wait after a trigger for further changes before running the compliance check
+	Debounce time.Duration
+	// AdditionalAccounts are checked out from, in order, once the licenses of the manager's primary account are used up
+	AdditionalAccounts []aws.Client
+	// Sinks receive the result of each compliance check, as well as the csp-config configmap and rancher's notifications.
+	// Their failures are logged rather than failing the check
+	Sinks []output.Sink
+	// Alerter is sent alerts when compliance is lost or restored, a checkout can't be extended, or a license is expiring.
+	// If nil, no alerts are sent
+	Alerter *alert.Alerter
+	// Messages renders the messages shown to users and stored in the support config. Defaults to the default locale
+	Messages *messages.Catalogue
+	// NotificationLinks are included in the notifications shown to rancher's users, such as the marketplace listing
+	NotificationLinks []k8s.Link
+	// Redactor is given each consumption token and account number, and masks them from the reports written to the sinks.
+	// Defaults to redact.Default(), which masks them from the logs too
+	Redactor *redact.Redactor
+	// HistorySize is the number of compliance check decisions kept for the status api. Defaults to history.DefaultSize
+	HistorySize int
+	// Dimensions are the entitlement dimensions checked out from the licenses which grant them, each counted in its own
+	// way. Defaults to DefaultDimensions
+	Dimensions []Dimension
+}
+
+func NewAWS(a aws.Client, k k8s.Client, s metrics.Scraper, opts Options) *AWS {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultInterval
+	}
+	if opts.ExtensionLeadTime <= 0 {
+		opts.ExtensionLeadTime = DefaultExtensionLeadTime
+	}
+	if opts.ResyncInterval <= 0 {
+		opts.ResyncInterval = DefaultResyncInterval
+	}
+	if opts.Debounce <= 0 {
+		opts.Debounce = DefaultDebounce
+	}
+	if opts.Messages == nil {
+		opts.Messages = messages.Default()
+	}
+	if opts.Redactor == nil {
+		opts.Redactor = redact.Default()
+	}
+	if len(opts.Dimensions) == 0 {
+		opts.Dimensions = DefaultDimensions()
+	}
+	accounts := append([]aws.Client{a}, opts.AdditionalAccounts...)
+	for _, account := range accounts {
+		opts.Redactor.AddAccount(account.AccountNumber())
+	}
 	return &AWS{
-		aws:     a,
-		k8s:     k,
-		scraper: s,
+		accounts: accounts,
+		k8s:      k,
+		scraper:  s,
+		usage:    newUsageStore(k, opts.UsageStrategy, opts.UsageWindow),
+		ledger:   ledger.New(k, opts.LedgerRetention, opts.LedgerMaxEntries),
+		output:   output.NewFanout([]output.Sink{output.NewConfigMapSink(k), output.NewNotificationSink(k, opts.NotificationLinks)}, opts.Sinks, opts.Redactor),
+		alerts:   opts.Alerter,
+		messages: opts.Messages,
+		redactor: opts.Redactor,
+		history:  history.NewRing(opts.HistorySize),
+
+		dimensions: opts.Dimensions,
+
+		interval:          opts.Interval,
+		extensionLeadTime: opts.ExtensionLeadTime,
+		eventDriven:       opts.EventDriven,
+		resyncInterval:    opts.ResyncInterval,
+		debounce:          opts.Debounce,
+		triggers:          make(chan string, 1),
+		checkedIn:         map[string]bool{},
+
+		headroomWarningPercent:   opts.HeadroomWarningPercent,
+		exhaustionWarningDays:    opts.ExhaustionWarningDays,
+		licenseExpiryWarningDays: opts.LicenseExpiryWarningDays,
 	}
 }
 
+// Ledger returns the ledger that the manager records the outcome of each compliance check in
+func (m *AWS) Ledger() *ledger.Ledger {
+	return m.ledger
+}
+
 func (m *AWS) Start(ctx context.Context, errs chan<- error) {
 	go m.start(ctx, errs)
 }
 
 const (
-	managerInterval = 30 * time.Second
 	nodesPerLicense = 20
 	// same as RFC3339 from time.time without the Z7:00 indicating timezone. Some AWS timestamps have this format
 	rfc3339NoTZ = "2006-01-02T15:04:05"
 	// keys for the consumption token secret's data. Can't do a straight marshal because we need all values to be strings
-	tokenKey     = "consumptionToken"
-	nodeKey      = "entitledNodes"
-	expiryKey    = "expiry"
-	statusPrefix = "AWS Marketplace Adapter:"
+	tokenKey  = "consumptionToken"
+	nodeKey   = "entitledNodes"
+	expiryKey = "expiry"
 )
 
-type licenseCheckoutInfo struct {
-	ConsumptionToken string
-	EntitledLicenses int
-	Expiry           time.Time
-}
-
 func (m *AWS) start(ctx context.Context, errs chan<- error) {
-	for range ticker(ctx, managerInterval) {
-		err := m.runComplianceCheck(ctx)
+	if err := m.reconcileOrphans(logging.WithRunID(ctx, logging.NewRunID())); err != nil {
+		// not fatal, orphaned checkouts expire on their own if they aren't extended
+		logging.FromContext(ctx).Warnf("unable to reconcile orphaned license checkouts: %v", err)
+	}
+	resync := ticker(ctx, m.tickerInterval())
+	publish := ticker(ctx, dashboardPublishInterval)
+	var debounced <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			logging.FromContext(ctx).Infof("[manager] exiting")
+			return
+		case <-publish:
+			// published from this loop so that gathering the usage never runs alongside a check
+			if err := m.publishUsage(ctx); err != nil {
+				logging.FromContext(ctx).Warnf("unable to publish license usage for the dashboard: %v", err)
+			}
+			continue
+		case reason := <-m.triggers:
+			logging.FromContext(ctx).Debugf("compliance check triggered by %s", reason)
+			if debounced == nil {
+				// wait for a burst of changes, such as a cluster scaling up, to settle before checking
+				debounced = time.After(m.debounce)
+			}
+			continue
+		case <-debounced:
+		case <-resync:
+		}
+		debounced = nil
+		// every log of the run, including those of the calls it makes, carries the run's id so they can be correlated
+		runCtx := logging.WithRunID(ctx, logging.NewRunID())
+		err := m.runComplianceCheck(runCtx)
+		if err != nil && ctx.Err() != nil {
+			// the check was cancelled by shutdown rather than failing, so there's nothing to report
+			logging.FromContext(runCtx).Infof("[manager] exiting, compliance check cancelled: %v", err)
+			return
+		}
 		if err != nil {
-			updError := m.updateAdapterOutput(false, fmt.Sprintf("unable to run compliance check with error: %v", err),
-				fmt.Sprintf("%s Unable to run the adapter, please check the adapter logs", statusPrefix))
+			updError := m.updateAdapterOutput(runCtx, adapterOutput{
+				ConfigMessage:       m.messages.Render(messages.CheckFailed, messages.Params{"Error": err.Error()}),
+				NotificationMessage: m.messages.Render(messages.CheckFailedNotification, nil),
+			})
 			if updError != nil {
 				errs <- err
 			}
 			errs <- err
 		}
 	}
-	logrus.Infof("[manager] exiting")
 }
 
-// runComplianceCheck compares the number of nodes registered with rancher with the number of entitlements currently
-// held * nodesPerLicense. If we are not at the desired value, it checks in currently held entitlements and attempts
-// to check out the right amount. If we are and our tokens are about to expire, it extends the checkout period. If
-// any part of this fatally fails, the process will return an error
-func (m *AWS) runComplianceCheck(ctx context.Context) error {
-	license, err := m.aws.GetRancherLicense(ctx)
+// runComplianceCheck compares what each entitlement dimension counts, such as the number of nodes registered with rancher
+// (as determined by the usage strategy), with the number of entitlements of that dimension currently held. If we are not
+// at the desired value, it checks in currently held entitlements and attempts to check out the right amount, spread
+// across every usable license granting the dimension. If we are and our tokens are about to expire, it extends the
+// checkout period. If any part of this fatally fails, the process will return an error
+func (m *AWS) runComplianceCheck(ctx context.Context) (err error) {
+	ctx, end := tracing.Start(ctx, "manager.ComplianceCheck")
+	defer end(&err)
+	ctx, decision := history.Start(ctx, logging.RunID(ctx))
+	defer func() {
+		m.history.Add(decision.Finish(err))
+	}()
+	usable, unusable, failed, err := m.getLicenses(ctx, time.Now())
 	if err != nil {
 		return fmt.Errorf("unable to get rancher license, err: %v", err)
 	}
-	nodeCounts, err := m.scraper.ScrapeAndParse()
+	history.Update(ctx, func(d *history.Decision) {
+		d.Inputs.Licenses = historyLicenses(usable, unusable)
+	})
+	nodeCounts, err := m.scraper.ScrapeAndParse(ctx)
 	if err != nil {
 		return fmt.Errorf("unable to determine number of active nodes: %v", err)
 	}
-	logrus.Debugf("found %d nodes from rancher metrics", nodeCounts.Total)
-	currentCheckoutInfo, err := m.getLicenseCheckoutInfo()
+	logging.FromContext(ctx).Debugf("found %d nodes from rancher metrics", nodeCounts.Total)
+	licensedNodes := m.usage.record(ctx, time.Now(), nodeCounts.Total)
+	logging.FromContext(ctx).Debugf("licensing %d nodes using the %s usage strategy", licensedNodes, m.usage.strategy)
+	history.Update(ctx, func(d *history.Decision) {
+		d.Inputs.Nodes = nodeCounts.Total
+		d.Inputs.LicensedNodes = licensedNodes
+		d.Inputs.UsageStrategy = string(m.usage.strategy)
+	})
+	logging.FromContext(ctx).Debugf("found %d usable and %d unusable rancher license(s)", len(usable), len(unusable))
+	if len(usable) == 0 && licensedNodes > 0 {
+		// the licenses found are what would be needed if they were usable, so the same rule decides which dimensions count
+		requirements, err := m.requirements(licensedNodes, nodeCounts, unusable)
+		if err != nil {
+			logging.FromContext(ctx).Warnf("unable to determine required licenses: %v", err)
+			requirements = nil
+		}
+		return m.reportUnusableLicenses(ctx, unusable, failed, licensedNodes, requirements)
+	}
+	requirements, err := m.requirements(licensedNodes, nodeCounts, usable)
+	if err != nil {
+		return fmt.Errorf("unable to determine required licenses: %v", err)
+	}
+	if len(usable) > 0 && len(requirements) == 0 && licensedNodes > 0 {
+		return fmt.Errorf("no usable rancher license grants any of the entitlement dimensions %v", dimensionNames(m.dimensions))
+	}
+	checkouts, err := m.getLicenseCheckouts(ctx)
 	if err != nil {
 		// not a breaking error, just means that we need to assume we have no registered entitlements
-		logrus.Warnf("unable to get current license consumption info, will start fresh %v", err)
-		currentCheckoutInfo = &licenseCheckoutInfo{
-			EntitledLicenses: 0,
-			ConsumptionToken: "",
-		}
+		logging.FromContext(ctx).Warnf("unable to get current license consumption info, will start fresh %v", err)
+		checkouts = nil
 	}
-	requiredLicenses := int(math.Ceil(float64(nodeCounts.Total) / float64(nodesPerLicense)))
-	logrus.Debugf("have %d licenses checked out, need %d licenses", currentCheckoutInfo.EntitledLicenses, requiredLicenses)
-	if currentCheckoutInfo.EntitledLicenses != requiredLicenses {
-		// if we know we need a new set of entitlements, checkin what we are currently using since we only hold one
-		// checked out set of entitlements at a time
-		if currentCheckoutInfo.ConsumptionToken != "" {
-			_, err = m.aws.CheckInRancherLicense(ctx, currentCheckoutInfo.ConsumptionToken)
-			if err != nil {
-				logrus.Warnf("unable to checkin license with error %v", err)
-			} else {
-				logrus.Debugf("successfully checked in license")
-				currentCheckoutInfo.EntitledLicenses = 0
-				currentCheckoutInfo.ConsumptionToken = ""
-			}
-		}
-		availableLicenses, err := m.aws.GetNumberOfAvailableEntitlements(ctx, *license)
-		logrus.Debugf("found %d entitlements available", availableLicenses)
-		if err != nil {
-			logrus.Warnf("unable to determine number of available entitlements, will attempt full checkout %v", err)
-			// if we can't verify how many licenses are available, assume that we have enough to meet our requirements
-			availableLicenses = requiredLicenses
-		}
-		checkoutAmount := requiredLicenses
-		if checkoutAmount > availableLicenses {
-			// only checkout what we actually have available to us
-			checkoutAmount = availableLicenses
-		}
-		if checkoutAmount > 0 {
-			// it's possible that we have no licenses available - don't attempt checkout in this case
-			resp, err := m.aws.CheckoutRancherLicense(ctx, *license, checkoutAmount)
-			if err != nil {
-				return fmt.Errorf("unable to checkout rancher licenses %v", err)
-			}
-			logrus.Debugf("successfully checked out license")
-			currentCheckoutInfo.ConsumptionToken = *resp.LicenseConsumptionToken
-			currentCheckoutInfo.EntitledLicenses = checkoutAmount
-			currentCheckoutInfo.Expiry = parseExpirationTimestamp(*resp.Expiration)
-		}
-	} else if requiredLicenses != 0 {
-		// extend our checkout as long as we have something checked out
-		newCheckoutInfo, err := m.extendCheckout(ctx, 5*managerInterval, currentCheckoutInfo)
-		if err != nil {
-			currentCheckoutInfo.EntitledLicenses = 0
-			currentCheckoutInfo.ConsumptionToken = ""
-			logrus.Warnf("unable to extend license checkout, will assume it failed and reset: %v", err)
-		} else {
-			currentCheckoutInfo = newCheckoutInfo
-		}
+	checkouts = m.releaseUnusable(ctx, checkouts, usable, failed)
+	intents, err := m.getCheckoutIntents(ctx)
+	if err != nil {
+		logging.FromContext(ctx).Warnf("unable to get checkout intents from earlier runs, they will not be retried: %v", err)
+		intents = nil
+	}
+	adopted, intents := m.resolveIntents(ctx, intents, usable)
+	checkouts = append(checkouts, adopted...)
+	requiredUsage := usageOf(requirements, nil)
+	required, _ := usageByDimension(requiredUsage)
+	history.Update(ctx, func(d *history.Decision) {
+		d.Inputs.RequiredLicenses = m.primaryUsage(requiredUsage).RequiredLicenses
+		d.Inputs.RequiredDimensions = required
+		d.Inputs.CachedTokens = tokenIDs(checkouts)
+	})
+	checkouts, intents, inCompliance, checkoutErr := m.holdRequirements(ctx, requirements, usable, failed, checkouts, intents)
+	err = m.saveCheckouts(ctx, checkouts, intents)
+	if err != nil {
+		logging.FromContext(ctx).Warnf("unable to save current checkout info, next run may fail with checkout/checkin")
+	}
+	if err := m.saveTokenJournal(ctx, checkouts); err != nil {
+		logging.FromContext(ctx).Warnf("unable to save the token journal, orphaned checkouts may not be recovered: %v", err)
+	}
+	if checkoutErr != nil {
+		return checkoutErr
 	}
-	err = m.saveCheckoutInfo(currentCheckoutInfo)
+
+	usage := usageOf(requirements, checkouts)
+	primary := m.primaryUsage(usage)
+	_, checkedOut := usageByDimension(usage)
+	history.Update(ctx, func(d *history.Decision) {
+		d.Result.InCompliance = inCompliance
+		d.Result.CheckedOut = primary.CheckedOut
+		d.Result.CheckedOutDimensions = checkedOut
+	})
+	err = m.ledger.Record(ctx, ledger.Check{
+		Time:             time.Now(),
+		Nodes:            licensedNodes,
+		RequiredLicenses: primary.RequiredLicenses,
+		CheckedOut:       primary.CheckedOut,
+		Dimensions:       usage,
+		ConsumptionToken: consumptionTokens(checkouts),
+		Status:           complianceStatus(inCompliance),
+	})
 	if err != nil {
-		logrus.Warnf("unable to save current checkout info, next run may fail with checkout/checkin")
+		logging.FromContext(ctx).Warnf("unable to record compliance check in the usage ledger: %v", err)
 	}
 
 	var statusMessage string
-	if currentCheckoutInfo.EntitledLicenses == requiredLicenses {
-		statusMessage = fmt.Sprintf("%s Rancher server has the required amount of licenses", statusPrefix)
+	if inCompliance {
+		statusMessage = m.messages.Render(messages.Compliant, nil)
 	} else {
-		statusMessage = fmt.Sprintf("%s You have exceeded your licensed node count. At least %d more license(s) are required in AWS to become compliant.",
-			statusPrefix, requiredLicenses-currentCheckoutInfo.EntitledLicenses)
+		statusMessage = m.messages.Render(messages.NonCompliant, messages.Params{"Missing": missingEntitlements(usage)})
+	}
+	configMessage := m.renderPerDimension(messages.CheckoutSummary, usage, func(u ledger.DimensionUsage) messages.Params {
+		return messages.Params{"Required": u.RequiredLicenses, "CheckedOut": u.CheckedOut}
+	})
+
+	var conditions []Condition
+	if inCompliance && licensedNodes > 0 && (m.headroomWarningPercent > 0 || m.exhaustionWarningDays > 0) {
+		if coveredNodes, ok := m.coveredNodes(ctx, usable, checkouts); ok {
+			conditions = m.exhaustionWarnings(licensedNodes, coveredNodes)
+		}
+	}
+	for _, state := range usable {
+		if expiring := state.expiryWarning(time.Now(), m.licenseExpiryWarningDays, m.messages); expiring != nil {
+			conditions = append(conditions, *expiring)
+			m.alerts.Fire(ctx, alert.Alert{Type: alert.TypeLicenseExpiring, Subject: state.arn(), Severity: alert.SeverityWarning, Message: expiring.Message})
+		} else {
+			m.alerts.Resolve(alert.TypeLicenseExpiring, state.arn())
+		}
 	}
-	configMessage := fmt.Sprintf("Rancher server required %d license(s) and was able to check out %d license(s)", requiredLicenses, currentCheckoutInfo.EntitledLicenses)
+	m.alertCompliance(ctx, inCompliance, configMessage)
 
-	return m.updateAdapterOutput(currentCheckoutInfo.EntitledLicenses == requiredLicenses, configMessage, statusMessage)
+	return m.updateAdapterOutput(ctx, adapterOutput{
+		InCompliance:        inCompliance,
+		ConfigMessage:       configMessage,
+		NotificationMessage: statusMessage,
+		Conditions:          conditions,
+		Licenses:            m.licenseInfos(usable, unusable, checkouts),
+		Accounts:            m.accountUsage(usable, unusable, checkouts),
+	})
 }
 
-// extendCheckout extends the checkout of the licenses in info if info.Expiry is within minTimeTillExpiry
-func (m *AWS) extendCheckout(ctx context.Context, minTimeTillExpiry time.Duration, info *licenseCheckoutInfo) (*licenseCheckoutInfo, error) {
-	timeUntilExpiry := info.Expiry.Sub(time.Now())
-	if timeUntilExpiry > minTimeTillExpiry { // no need to extend consumption token yet
-		return info, nil
-	}
-	logrus.Debugf("extending consumption token")
-	res, err := m.aws.ExtendRancherLicenseConsumptionToken(ctx, info.ConsumptionToken)
-	if err != nil {
-		return nil, err
+// coveredNodes gives the most nodes that could be licensed using the entitlements of the node dimension already in
+// checkouts plus those still available across the usable licenses. Licenses whose availability can't be determined are
+// skipped. Returns false if no dimension counts nodes
+func (m *AWS) coveredNodes(ctx context.Context, usable []licenseState, checkouts []licenseCheckoutInfo) (int, bool) {
+	dimension, ok := m.nodeDimension()
+	if !ok {
+		return 0, false
+	}
+	// by this point our own checkouts are counted as consumed, so what remains is what we could still grow into
+	held, _ := checkoutsOf(checkouts, dimension.Name)
+	covered := totalEntitled(held)
+	for _, state := range licensesWith(usable, dimension.Name) {
+		availableLicenses, err := m.client(state).GetNumberOfAvailableEntitlements(ctx, state.license, dimension.Name)
+		if err != nil {
+			logging.FromContext(ctx).Warnf("unable to determine number of available entitlements for %s, exhaustion warnings may be inaccurate: %v", state.arn(), err)
+			continue
+		}
+		covered += availableLicenses
 	}
-	return &licenseCheckoutInfo{
-		ConsumptionToken: *res.LicenseConsumptionToken,
-		Expiry:           parseExpirationTimestamp(*res.Expiration),
-		EntitledLicenses: info.EntitledLicenses,
-	}, nil
+	return covered * dimension.UnitsPerEntitlement, true
 }
 
-// getLicenseCheckoutInfo retrieves checkoutInfo from the cache in k8s - we cache to k8s to recover from pod restart
-// returns an error if it couldn't parse every one of the values from the cache
-func (m *AWS) getLicenseCheckoutInfo() (*licenseCheckoutInfo, error) {
-	secret, err := m.k8s.GetConsumptionTokenSecret()
-	if err != nil {
-		return nil, err
+// licenseInfos creates the support config details for every license, including the account holding it and how much is
+// checked out from it
+func (m *AWS) licenseInfos(usable, unusable []licenseState, checkouts []licenseCheckoutInfo) []LicenseInfo {
+	infos := make([]LicenseInfo, 0, len(usable)+len(unusable))
+	for _, state := range usable {
+		info := state.info(entitledFrom(checkouts, state.arn()))
+		info.Account = m.client(state).AccountNumber()
+		infos = append(infos, info)
 	}
-	token, tOk := secret.Data[tokenKey]
-	licenses, lOk := secret.Data[nodeKey]
-	expiry, eOk := secret.Data[expiryKey]
-	if !(tOk && lOk && eOk) {
-		// if we couldn't extract the token or node counts, we can't return accurate checkout info
-		return nil, fmt.Errorf("couldn't license consumption info from secret")
+	for _, state := range unusable {
+		info := state.info(0)
+		info.Account = m.client(state).AccountNumber()
+		infos = append(infos, info)
 	}
-	numLicenses, err := strconv.Atoi(string(licenses))
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse the number of nodes the license token is for %v", err)
+	return infos
+}
+
+// reportUnusableLicenses returns anything checked out, since none of the licenses can be relied on, and reports
+// licensedNodes, needing requirements, as non-compliant due to the state of the licenses. Checkouts from the failed
+// accounts whose licenses couldn't be listed are kept
+func (m *AWS) reportUnusableLicenses(ctx context.Context, unusable []licenseState, failed map[string]bool, licensedNodes int, requirements []requirement) error {
+	// report the first license's state, which for the common case of a single license is the only one
+	validity := unusable[0].validity
+	logging.FromContext(ctx).Warnf("no usable rancher license, first license is %s: %s", validity.Reason, validity.Message)
+	var kept []licenseCheckoutInfo
+	if checkouts, err := m.getLicenseCheckouts(ctx); err == nil {
+		var released []licenseCheckoutInfo
+		kept, released = m.fromFailedAccounts(checkouts, failed)
+		kept = m.extendCheckouts(ctx, m.effectiveLeadTime(), kept)
+		// expected to fail for most unusable licenses, the tokens will expire on their own
+		m.checkInAll(ctx, released)
+	}
+	if err := m.saveCheckouts(ctx, kept, nil); err != nil {
+		logging.FromContext(ctx).Warnf("unable to clear current checkout info: %v", err)
 	}
-	expiryTime, err := time.Parse(time.RFC3339, string(expiry))
+	usage := usageOf(requirements, kept)
+	primary := m.primaryUsage(usage)
+	required, _ := usageByDimension(usage)
+	history.Update(ctx, func(d *history.Decision) {
+		d.Inputs.RequiredLicenses = primary.RequiredLicenses
+		d.Inputs.RequiredDimensions = required
+	})
+	err := m.ledger.Record(ctx, ledger.Check{
+		Time:             time.Now(),
+		Nodes:            licensedNodes,
+		RequiredLicenses: primary.RequiredLicenses,
+		CheckedOut:       primary.CheckedOut,
+		Dimensions:       usage,
+		ConsumptionToken: consumptionTokens(kept),
+		Status:           StatusNotInCompliance,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("unable to parse the token's expiry time %v", err)
+		logging.FromContext(ctx).Warnf("unable to record compliance check in the usage ledger: %v", err)
 	}
-	return &licenseCheckoutInfo{
-		ConsumptionToken: string(token),
-		EntitledLicenses: numLicenses,
-		Expiry:           expiryTime,
-	}, nil
+	licenseMessage := validity.localizedMessage(m.messages)
+	configMessage := m.renderPerDimension(messages.UnusableLicenseSummary, usage, func(u ledger.DimensionUsage) messages.Params {
+		return messages.Params{"Required": u.RequiredLicenses, "License": licenseMessage}
+	})
+	m.alertCompliance(ctx, false, configMessage)
+	return m.updateAdapterOutput(ctx, adapterOutput{
+		Reason:              validity.Reason,
+		ConfigMessage:       configMessage,
+		NotificationMessage: m.messages.Render(messages.UnusableLicenseNotification, messages.Params{"License": licenseMessage}),
+		Licenses:            m.licenseInfos(nil, unusable, nil),
+		Accounts:            m.accountUsage(nil, unusable, nil),
+	})
 }
 
-// saveCheckoutInfo saves the checkoutInfo to the k8s cache. If this fails, returns an error
-func (m *AWS) saveCheckoutInfo(info *licenseCheckoutInfo) error {
-	return m.k8s.UpdateConsumptionTokenSecret(map[string]string{
-		tokenKey:  info.ConsumptionToken,
-		nodeKey:   fmt.Sprintf("%d", info.EntitledLicenses),
-		expiryKey: info.Expiry.Format(time.RFC3339),
-	})
+// alertCompliance alerts with message when the adapter isn't in compliance, and when compliance is restored after that
+func (m *AWS) alertCompliance(ctx context.Context, inCompliance bool, message string) {
+	if !inCompliance {
+		m.alerts.Fire(ctx, alert.Alert{Type: alert.TypeNonCompliant, Severity: alert.SeverityCritical, Message: message})
+		return
+	}
+	if m.alerts.Resolve(alert.TypeNonCompliant, "") {
+		m.alerts.Fire(ctx, alert.Alert{Type: alert.TypeComplianceRestored, Severity: alert.SeverityInfo, Message: message})
+		// restoration is a one-off event rather than an ongoing state, so it should be sent every time it happens
+		m.alerts.Resolve(alert.TypeComplianceRestored, "")
+	}
+}
+
+// adapterOutput is the result of a compliance check, as reported to the user and other apps
+type adapterOutput struct {
+	InCompliance bool
+	// Reason is set when the check is non-compliant for a reason other than too few licenses
+	Reason string
+	// ConfigMessage is used to update the supportConfig configmap
+	ConfigMessage string
+	// NotificationMessage is created in a user-facing object
+	NotificationMessage string
+	// Conditions are reported in the supportConfig, and as a separate warning to the user while in compliance
+	Conditions []Condition
+	// Licenses describes every license found for the check
+	Licenses []LicenseInfo
+	// Accounts describes the usage of each account's licenses
+	Accounts []AccountUsage
 }
 
-// updateAdapterOutput uses the k8s client to update the status objects signaling compliance/non-compliance to other apps
-// configMessage is used to update the supportConfig configmap, and notificationMessage is created in a user-facing object
-func (m *AWS) updateAdapterOutput(inCompliance bool, configMessage string, notificationMessage string) error {
-	config := GetDefaultSupportConfig(m.k8s)
+// updateAdapterOutput writes the status signaling compliance/non-compliance to other apps to every output sink
+func (m *AWS) updateAdapterOutput(ctx context.Context, out adapterOutput) error {
+	config := GetDefaultSupportConfig(ctx, m.k8s)
 	config.CSP = CSPInfo{
 		Name:       awsSupportConfigCSP,
-		AcctNumber: m.aws.AccountNumber(),
+		AcctNumber: m.accounts[0].AccountNumber(),
 	}
-	rancherVersion, err := m.k8s.GetRancherVersion()
+	rancherVersion, err := m.k8s.GetRancherVersion(ctx)
 	if err != nil {
 		return fmt.Errorf("unable to get rancher version: %v", err)
 	}
 	config.Product = createProductString(rancherVersion)
-	info := ComplianceInfo{
-		Message: configMessage,
-	}
-	if inCompliance {
-		info.Status = StatusInCompliance
-	} else {
-		info.Status = StatusNotInCompliance
+	config.Licenses = out.Licenses
+	config.Accounts = out.Accounts
+	config.Compliance = ComplianceInfo{
+		Status:     complianceStatus(out.InCompliance),
+		Reason:     out.Reason,
+		Message:    out.ConfigMessage,
+		Conditions: out.Conditions,
 	}
-	config.Compliance = info
-	err = m.k8s.UpdateUserNotification(inCompliance, notificationMessage)
-	if err != nil {
-		// don't bother marshalling the config if we can't report the error to the user
-		return err
+	var warning string
+	if out.InCompliance {
+		// when out of compliance the user is already being told to buy more licenses, no need to warn them as well
+		warning = warningMessage(m.messages, out.Conditions)
 	}
 	marshalled, err := json.Marshal(config)
 	if err != nil {
 		return fmt.Errorf("unable to marshall config: %v", err)
 	}
-	return m.k8s.UpdateCSPConfigOutput(marshalled)
+	return m.output.Write(ctx, output.Report{
+		Time:         time.Now(),
+		InCompliance: out.InCompliance,
+		Notification: out.NotificationMessage,
+		Warning:      warning,
+		Config:       marshalled,
+	})
 }
 
 func ticker(ctx context.Context, duration time.Duration) <-chan time.Time {
@@ -256,16 +541,22 @@ func ticker(ctx context.Context, duration time.Duration) <-chan time.Time {
 
 // parseExpirationTimestamp parses the timestamp from aws into a time.Time object
 func parseExpirationTimestamp(expirationTS string) time.Time {
-	// timestamps from extendLicenseCheckout seem to be RFC3339. However, timestamps from checkoutLicense are of the
-	// modified form. Optimize for the standardized case
-	expiration, err := time.Parse(time.RFC3339, expirationTS)
-	if err != nil {
-		logrus.Warnf("unable to parse timestamp with rfc3339 format, falling back to modified format: %v", err)
-		expiration, err = time.Parse(rfc3339NoTZ, expirationTS)
-	}
+	expiration, err := parseTimestamp(expirationTS)
 	if err != nil {
 		logrus.Warnf("couldn't parse license expiration time: %v, defaulting to 1 hour renewal", err)
 		expiration = time.Now().Add(1 * time.Hour)
 	}
 	return expiration
 }
+
+// parseTimestamp parses a timestamp from aws, which may or may not include a timezone
+func parseTimestamp(ts string) (time.Time, error) {
+	// timestamps from extendLicenseCheckout seem to be RFC3339. However, timestamps from checkoutLicense are of the
+	// modified form. Optimize for the standardized case
+	parsed, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		logrus.Debugf("unable to parse timestamp with rfc3339 format, falling back to modified format: %v", err)
+		parsed, err = time.Parse(rfc3339NoTZ, ts)
+	}
+	return parsed, err
+}
@@ -1,14 +1,22 @@
 package manager
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
 	"testing"
+	"time"
 
+	"github.com/rancher/csp-adapter/pkg/clients/aws"
+	"github.com/rancher/csp-adapter/pkg/messages"
 	"github.com/rancher/csp-adapter/pkg/mocks"
+	"github.com/rancher/csp-adapter/pkg/output"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type testScenario struct {
@@ -29,7 +37,7 @@ func (s *testScenario) runScenario(t *testing.T) {
 	mockAWSClient := mocks.NewMockAWSClient(s.numAWSEntitlements)
 	var secretData map[string]string
 	if s.currentEntitlements != 0 {
-		output, _ := mockAWSClient.CheckoutRancherLicense(context.TODO(), mockAWSClient.License, s.currentEntitlements)
+		output, _ := mockAWSClient.CheckoutRancherLicense(context.TODO(), mockAWSClient.Licenses[0], aws.DefaultDimension, s.currentEntitlements, "existing-checkout")
 		checkedOut := strconv.Itoa(s.currentEntitlements)
 		secretData = map[string]string{
 			tokenKey:  *output.LicenseConsumptionToken,
@@ -39,11 +47,7 @@ func (s *testScenario) runScenario(t *testing.T) {
 	}
 	mockK8sClient := mocks.NewMockK8sClient(secretData)
 	mockScraper := mocks.NewMockScraper(s.numRancherNodes)
-	mockAWS := AWS{
-		aws:     mockAWSClient,
-		k8s:     mockK8sClient,
-		scraper: mockScraper,
-	}
+	mockAWS := NewAWS(mockAWSClient, mockK8sClient, mockScraper, Options{})
 	err := mockAWS.runComplianceCheck(context.TODO())
 
 	// check that the results were as expected
@@ -70,10 +74,14 @@ func (s *testScenario) runScenario(t *testing.T) {
 		actualEntitlements += value
 	}
 	assert.Equal(t, s.result.numUsedEntitlements, actualEntitlements, fmt.Sprintf("Scenario: %v", s))
+	_, ok := mockK8sClient.CurrentUsageData["ledger"]
+	assert.True(t, ok, fmt.Sprintf("No ledger entry recorded for Scenario: %v", s))
 	if s.result.cachedToken {
 		assert.NotNil(t, mockK8sClient.CurrentSecretData, fmt.Sprintf("Scenario: %v", s))
-		_, ok := mockK8sClient.CurrentSecretData[tokenKey]
-		assert.Equal(t, true, ok, fmt.Sprintf("No stored token for Scenario: %v", s))
+		var checkouts []licenseCheckoutInfo
+		err = json.Unmarshal([]byte(mockK8sClient.CurrentSecretData[checkoutsKey]), &checkouts)
+		assert.NoError(t, err, fmt.Sprintf("Unable to read stored checkouts for Scenario: %v", s))
+		assert.Equal(t, true, len(checkouts) > 0 && checkouts[0].ConsumptionToken != "", fmt.Sprintf("No stored token for Scenario: %v", s))
 	}
 }
 
@@ -182,3 +190,35 @@ func TestCheckInCheckout(t *testing.T) {
 		scenario.runScenario(t)
 	}
 }
+
+func TestAdditionalSinks(t *testing.T) {
+	var buf bytes.Buffer
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	mockK8sClient := mocks.NewMockK8sClient(nil)
+	m := NewAWS(mocks.NewMockAWSClient(1), mockK8sClient, mocks.NewMockScraper(40), Options{
+		Sinks: []output.Sink{output.NewWebhookSink(failing.URL, nil, time.Second), output.NewStreamSink("buffer", &buf)},
+	})
+	assert.NoError(t, m.runComplianceCheck(context.TODO()), "expected a failing additional sink not to fail the check")
+
+	var report output.Report
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &report))
+	assert.False(t, report.InCompliance)
+	assert.Equal(t, mockK8sClient.CurrentNotificationMessage, report.Notification)
+	assert.JSONEq(t, string(mockK8sClient.CurrentSupportConfig), string(report.Config))
+}
+
+func TestLocalizedMessages(t *testing.T) {
+	catalogue, err := messages.New("de-DE")
+	require.NoError(t, err)
+	mockK8sClient := mocks.NewMockK8sClient(nil)
+	m := NewAWS(mocks.NewMockAWSClient(1), mockK8sClient, mocks.NewMockScraper(40), Options{Messages: catalogue})
+	assert.NoError(t, m.runComplianceCheck(context.TODO()))
+
+	assert.Equal(t, catalogue.Render(messages.NonCompliant, messages.Params{"Missing": 1}), mockK8sClient.CurrentNotificationMessage)
+	var config CSPSupportConfig
+	require.NoError(t, json.Unmarshal(mockK8sClient.CurrentSupportConfig, &config))
+	assert.Equal(t, "Der Rancher-Server benötigte 2 Lizenz(en) und konnte 1 Lizenz(en) auschecken", config.Compliance.Message)
+}
@@ -0,0 +1,460 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rancher/csp-adapter/pkg/alert"
+	"github.com/rancher/csp-adapter/pkg/clients/aws"
+	"github.com/rancher/csp-adapter/pkg/history"
+	"github.com/rancher/csp-adapter/pkg/logging"
+)
+
+const (
+	// checkoutsKey is the key in the consumption token secret that the current checkouts are stored under
+	checkoutsKey = "checkouts"
+	// intentsKey is the key in the consumption token secret that checkouts which haven't been confirmed are stored under
+	intentsKey = "checkoutIntents"
+	// checkoutIntentTTL is how long an intent is retried for. Anything checked out for it has expired in aws by then,
+	// since the checkout was never extended
+	checkoutIntentTTL = time.Hour
+)
+
+// licenseCheckoutInfo describes a set of entitlements of one dimension checked out from a single license. Account is the
+// number of the account holding the license, which is empty for checkouts made before several accounts were supported
+type licenseCheckoutInfo struct {
+	LicenseArn       string    `json:"licenseArn"`
+	Account          string    `json:"account,omitempty"`
+	Dimension        string    `json:"dimension,omitempty"`
+	ClientToken      string    `json:"clientToken,omitempty"`
+	ConsumptionToken string    `json:"consumptionToken"`
+	EntitledLicenses int       `json:"entitledLicenses"`
+	Expiry           time.Time `json:"expiry"`
+}
+
+// dimension gives the dimension checked out, checkouts made before several dimensions were supported are of
+// aws.DefaultDimension
+func (c licenseCheckoutInfo) dimension() string {
+	if c.Dimension == "" {
+		return aws.DefaultDimension
+	}
+	return c.Dimension
+}
+
+// checkoutIntent records a checkout before it is made, so that if the response is lost the checkout is retried with the
+// same client token, and aws returns the original checkout rather than consuming more entitlements
+type checkoutIntent struct {
+	LicenseArn       string    `json:"licenseArn"`
+	Dimension        string    `json:"dimension,omitempty"`
+	ClientToken      string    `json:"clientToken"`
+	EntitledLicenses int       `json:"entitledLicenses"`
+	CreatedAt        time.Time `json:"createdAt"`
+}
+
+// dimension gives the dimension to check out, intents recorded before several dimensions were supported are of
+// aws.DefaultDimension
+func (i checkoutIntent) dimension() string {
+	if i.Dimension == "" {
+		return aws.DefaultDimension
+	}
+	return i.Dimension
+}
+
+// totalEntitled gives the number of entitlements held across every checkout
+func totalEntitled(checkouts []licenseCheckoutInfo) int {
+	total := 0
+	for _, checkout := range checkouts {
+		total += checkout.EntitledLicenses
+	}
+	return total
+}
+
+// entitledFrom gives the number of entitlements held from the license with licenseArn
+func entitledFrom(checkouts []licenseCheckoutInfo, licenseArn string) int {
+	total := 0
+	for _, checkout := range checkouts {
+		if checkout.LicenseArn == licenseArn {
+			total += checkout.EntitledLicenses
+		}
+	}
+	return total
+}
+
+// consumptionTokens joins the tokens of every checkout, so that the set of checkouts can be identified as a whole
+func consumptionTokens(checkouts []licenseCheckoutInfo) string {
+	tokens := make([]string, 0, len(checkouts))
+	for _, checkout := range checkouts {
+		tokens = append(tokens, checkout.ConsumptionToken)
+	}
+	sort.Strings(tokens)
+	return strings.Join(tokens, ",")
+}
+
+// checkInAll checks in every checkout. Checkouts which fail to check in are dropped regardless, since they will expire
+// if they are no longer extended
+func (m *AWS) checkInAll(ctx context.Context, checkouts []licenseCheckoutInfo) {
+	for _, checkout := range checkouts {
+		if checkout.ConsumptionToken == "" {
+			continue
+		}
+		_, err := m.clientForAccount(checkout.Account).CheckInRancherLicense(ctx, checkout.ConsumptionToken)
+		recordAction(ctx, history.ActionCheckin, checkout.LicenseArn, checkout.EntitledLicenses, checkout.ConsumptionToken, err)
+		if err != nil {
+			logging.FromContext(ctx).Warnf("unable to checkin license with error %v", err)
+		} else {
+			logging.FromContext(ctx).Debugf("successfully checked in license %s", checkout.LicenseArn)
+			if checkout.ClientToken != "" {
+				m.checkedIn[checkout.ClientToken] = true
+			}
+		}
+	}
+}
+
+// releaseUnusable checks in the checkouts held from licenses which aren't in usable, returning the checkouts remaining.
+// Checkouts from before licenses were tracked have no arn, and are kept since they can't be attributed to a license, as
+// are checkouts from the failed accounts whose licenses couldn't be listed
+func (m *AWS) releaseUnusable(ctx context.Context, checkouts []licenseCheckoutInfo, usable []licenseState, failed map[string]bool) []licenseCheckoutInfo {
+	usableArns := map[string]bool{}
+	for _, state := range usable {
+		usableArns[state.arn()] = true
+	}
+	kept, checkouts := m.fromFailedAccounts(checkouts, failed)
+	var released []licenseCheckoutInfo
+	for _, checkout := range checkouts {
+		if checkout.LicenseArn == "" || usableArns[checkout.LicenseArn] {
+			kept = append(kept, checkout)
+		} else {
+			released = append(released, checkout)
+		}
+	}
+	if len(released) > 0 {
+		logging.FromContext(ctx).Infof("returning %d checkout(s) from licenses which are no longer usable", len(released))
+		m.checkInAll(ctx, released)
+	}
+	return kept
+}
+
+// resolveIntents retries the checkouts for intents left by an earlier run whose outcome is unknown, adopting the checkouts
+// which succeed. Returns the adopted checkouts, and the intents which should be retried again on the next run
+func (m *AWS) resolveIntents(ctx context.Context, intents []checkoutIntent, usable []licenseState) ([]licenseCheckoutInfo, []checkoutIntent) {
+	var adopted []licenseCheckoutInfo
+	var pending []checkoutIntent
+	for _, intent := range intents {
+		if time.Since(intent.CreatedAt) > checkoutIntentTTL {
+			logging.FromContext(ctx).Debugf("dropping checkout intent for license %s, anything checked out for it has expired", intent.LicenseArn)
+			continue
+		}
+		state, ok := findLicense(usable, intent.LicenseArn)
+		if !ok {
+			logging.FromContext(ctx).Debugf("dropping checkout intent for license %s, the license is no longer usable", intent.LicenseArn)
+			continue
+		}
+		checkout, err := m.checkout(ctx, state, intent)
+		if err != nil {
+			if !aws.IsClientFault(err) {
+				pending = append(pending, intent)
+			}
+			logging.FromContext(ctx).Warnf("unable to resolve earlier checkout from license %s: %v", intent.LicenseArn, err)
+			continue
+		}
+		logging.FromContext(ctx).Infof("adopted %d license(s) checked out from %s by an earlier run", checkout.EntitledLicenses, checkout.LicenseArn)
+		adopted = append(adopted, checkout)
+	}
+	return adopted, pending
+}
+
+// holdRequirements checks out, or extends, the entitlements of each dimension needed by requirements from the usable
+// licenses granting it, and checks in the checkouts of dimensions which are no longer needed. Checkouts from the failed
+// accounts whose licenses couldn't be listed are extended and count towards their dimension, but are never checked in.
+// Returns the checkouts held afterwards, the intents whose outcome is still unknown, whether every requirement is met, and
+// an error if a dimension couldn't be met because of failed checkouts
+func (m *AWS) holdRequirements(ctx context.Context, requirements []requirement, usable []licenseState, failed map[string]bool, checkouts []licenseCheckoutInfo, intents []checkoutIntent) ([]licenseCheckoutInfo, []checkoutIntent, bool, error) {
+	held, remaining := m.fromFailedAccounts(checkouts, failed)
+	if len(held) > 0 {
+		logging.FromContext(ctx).Infof("keeping %d checkout(s) from accounts whose licenses couldn't be listed", len(held))
+		held = m.extendCheckouts(ctx, m.effectiveLeadTime(), held)
+	}
+	var errs []error
+	met := true
+	for _, req := range requirements {
+		dimension := req.dimension.Name
+		var current []licenseCheckoutInfo
+		current, remaining = checkoutsOf(remaining, dimension)
+		kept, _ := checkoutsOf(held, dimension)
+		required := req.required - totalEntitled(kept)
+		if required < 0 {
+			required = 0
+		}
+		logging.FromContext(ctx).Debugf("counted %d %s for %s, have %d entitlements checked out, need %d", req.counted, req.dimension.Counting, dimension, totalEntitled(current)+totalEntitled(kept), req.required)
+		if totalEntitled(current) != required {
+			// if we know we need a new set of entitlements, checkin what we are currently using since we only hold one
+			// checked out set of entitlements of each dimension at a time
+			m.checkInAll(ctx, current)
+			var err error
+			current, intents, err = m.checkoutAcross(ctx, licensesWith(usable, dimension), dimension, required, append(append([]licenseCheckoutInfo{}, held...), remaining...), intents)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		} else if required != 0 {
+			// extend our checkout as long as we have something checked out
+			current = m.extendCheckouts(ctx, m.effectiveLeadTime(), current)
+		}
+		met = met && totalEntitled(current) == required
+		held = append(held, current...)
+	}
+	if len(remaining) > 0 {
+		logging.FromContext(ctx).Infof("returning %d checkout(s) of entitlement dimensions which are no longer needed", len(remaining))
+		m.checkInAll(ctx, remaining)
+	}
+	switch len(errs) {
+	case 0:
+		return held, intents, met, nil
+	case 1:
+		return held, intents, met, errs[0]
+	default:
+		return held, intents, met, fmt.Errorf("unable to checkout rancher licenses for several dimensions %v", errs)
+	}
+}
+
+// findLicense finds the license with licenseArn in licenses
+func findLicense(licenses []licenseState, licenseArn string) (licenseState, bool) {
+	for _, state := range licenses {
+		if state.arn() == licenseArn {
+			return state, true
+		}
+	}
+	return licenseState{}, false
+}
+
+// checkoutAcross checks out requiredLicenses entitlements of dimension, taking as many as are available from each license
+// in usable in turn. Each checkout is recorded as an intent in the cache, along with held (the checkouts of the other
+// dimensions) and pending intents, before it is made. Returns the checkouts made, the intents whose outcome is still
+// unknown, and an error if requiredLicenses couldn't be met because of failed checkouts
+func (m *AWS) checkoutAcross(ctx context.Context, usable []licenseState, dimension string, requiredLicenses int, held []licenseCheckoutInfo, pending []checkoutIntent) ([]licenseCheckoutInfo, []checkoutIntent, error) {
+	var checkouts []licenseCheckoutInfo
+	var errs []error
+	remaining := requiredLicenses
+	for _, state := range usable {
+		if remaining <= 0 {
+			break
+		}
+		availableLicenses, err := m.client(state).GetNumberOfAvailableEntitlements(ctx, state.license, dimension)
+		logging.FromContext(ctx).Debugf("found %d %s entitlements available on license %s", availableLicenses, dimension, state.arn())
+		if err != nil {
+			logging.FromContext(ctx).Warnf("unable to determine number of available entitlements, will attempt full checkout %v", err)
+			// if we can't verify how many licenses are available, assume that we have enough to meet our requirements
+			availableLicenses = remaining
+		}
+		checkoutAmount := remaining
+		if checkoutAmount > availableLicenses {
+			// only checkout what we actually have available to us
+			checkoutAmount = availableLicenses
+		}
+		if checkoutAmount <= 0 {
+			// it's possible that we have no licenses available - don't attempt checkout in this case
+			continue
+		}
+		intent := checkoutIntent{
+			LicenseArn:       state.arn(),
+			Dimension:        dimension,
+			ClientToken:      uuid.New().String(),
+			EntitledLicenses: checkoutAmount,
+			CreatedAt:        time.Now(),
+		}
+		// the intent must be stored before checking out, otherwise a lost response would leak the entitlements
+		cached := append(append([]licenseCheckoutInfo{}, held...), checkouts...)
+		if err := m.saveCheckouts(ctx, cached, append(pending, intent)); err != nil {
+			errs = append(errs, fmt.Errorf("license %s: unable to record checkout intent: %v", state.arn(), err))
+			continue
+		}
+		issued := time.Now()
+		checkout, err := m.checkout(ctx, state, intent)
+		if err != nil {
+			if !aws.IsClientFault(err) {
+				// aws may have made the checkout, so retry it with the same client token on the next run
+				pending = append(pending, intent)
+			}
+			errs = append(errs, fmt.Errorf("license %s: %v", state.arn(), err))
+			continue
+		}
+		logging.FromContext(ctx).Debugf("successfully checked out %d license(s) from %s", checkoutAmount, state.arn())
+		// the client token is new, so aws has just issued the token
+		m.observeTokenLifetime(issued, checkout.Expiry)
+		checkouts = append(checkouts, checkout)
+		remaining -= checkoutAmount
+	}
+	if remaining > 0 && len(errs) > 0 {
+		return checkouts, pending, fmt.Errorf("unable to checkout rancher licenses %v", errs)
+	}
+	return checkouts, pending, nil
+}
+
+// checkout makes the checkout described by intent from the license in state
+func (m *AWS) checkout(ctx context.Context, state licenseState, intent checkoutIntent) (licenseCheckoutInfo, error) {
+	client := m.client(state)
+	resp, err := client.CheckoutRancherLicense(ctx, state.license, intent.dimension(), intent.EntitledLicenses, intent.ClientToken)
+	if err != nil {
+		recordAction(ctx, history.ActionCheckout, state.arn(), intent.EntitledLicenses, "", err)
+		return licenseCheckoutInfo{}, err
+	}
+	m.redactor.AddToken(*resp.LicenseConsumptionToken)
+	recordAction(ctx, history.ActionCheckout, state.arn(), intent.EntitledLicenses, *resp.LicenseConsumptionToken, nil)
+	expiry := parseExpirationTimestamp(*resp.Expiration)
+	return licenseCheckoutInfo{
+		LicenseArn:       state.arn(),
+		Account:          client.AccountNumber(),
+		Dimension:        intent.dimension(),
+		ClientToken:      intent.ClientToken,
+		ConsumptionToken: *resp.LicenseConsumptionToken,
+		EntitledLicenses: intent.EntitledLicenses,
+		Expiry:           expiry,
+	}, nil
+}
+
+// extendCheckouts extends each checkout that is within minTimeTillExpiry of expiring. Checkouts which can't be extended
+// are dropped, and will be replaced on the next run
+func (m *AWS) extendCheckouts(ctx context.Context, minTimeTillExpiry time.Duration, checkouts []licenseCheckoutInfo) []licenseCheckoutInfo {
+	var extended []licenseCheckoutInfo
+	for _, checkout := range checkouts {
+		newCheckout, err := m.extendCheckout(ctx, minTimeTillExpiry, checkout)
+		if err != nil {
+			logging.FromContext(ctx).Warnf("unable to extend license checkout, will assume it failed and reset: %v", err)
+			m.alerts.Fire(ctx, alert.Alert{
+				Type:     alert.TypeTokenExtendFailed,
+				Subject:  checkout.LicenseArn,
+				Severity: alert.SeverityWarning,
+				Message:  fmt.Sprintf("unable to extend the checkout of %d license(s) from %s, it will be checked out again: %v", checkout.EntitledLicenses, checkout.LicenseArn, err),
+			})
+			continue
+		}
+		m.alerts.Resolve(alert.TypeTokenExtendFailed, checkout.LicenseArn)
+		extended = append(extended, newCheckout)
+	}
+	return extended
+}
+
+// extendCheckout extends the checkout of the licenses in info if info.Expiry is within minTimeTillExpiry
+func (m *AWS) extendCheckout(ctx context.Context, minTimeTillExpiry time.Duration, info licenseCheckoutInfo) (licenseCheckoutInfo, error) {
+	timeUntilExpiry := info.Expiry.Sub(time.Now())
+	if timeUntilExpiry > minTimeTillExpiry { // no need to extend consumption token yet
+		return info, nil
+	}
+	logging.FromContext(ctx).Debugf("extending consumption token")
+	issued := time.Now()
+	res, err := m.clientForAccount(info.Account).ExtendRancherLicenseConsumptionToken(ctx, info.ConsumptionToken)
+	if err != nil {
+		recordAction(ctx, history.ActionExtend, info.LicenseArn, info.EntitledLicenses, info.ConsumptionToken, err)
+		return licenseCheckoutInfo{}, err
+	}
+	m.redactor.AddToken(*res.LicenseConsumptionToken)
+	recordAction(ctx, history.ActionExtend, info.LicenseArn, info.EntitledLicenses, *res.LicenseConsumptionToken, nil)
+	info.ConsumptionToken = *res.LicenseConsumptionToken
+	info.Expiry = parseExpirationTimestamp(*res.Expiration)
+	m.observeTokenLifetime(issued, info.Expiry)
+	return info, nil
+}
+
+// getLicenseCheckouts retrieves the current checkouts from the cache in k8s - we cache to k8s to recover from pod
+// restart. Returns an error if it couldn't parse the values from the cache
+func (m *AWS) getLicenseCheckouts(ctx context.Context) ([]licenseCheckoutInfo, error) {
+	secret, err := m.k8s.GetConsumptionTokenSecret(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if raw, ok := secret.Data[checkoutsKey]; ok {
+		var checkouts []licenseCheckoutInfo
+		if err := json.Unmarshal(raw, &checkouts); err != nil {
+			return nil, fmt.Errorf("unable to parse license checkouts: %v", err)
+		}
+		m.addTokens(checkouts)
+		return checkouts, nil
+	}
+	// fall back to the format used before multiple licenses were supported
+	legacy, err := getLegacyCheckout(secret.Data)
+	if err != nil {
+		return nil, err
+	}
+	if legacy.ConsumptionToken == "" {
+		return nil, nil
+	}
+	m.redactor.AddToken(legacy.ConsumptionToken)
+	return []licenseCheckoutInfo{legacy}, nil
+}
+
+// addTokens gives the consumption token of each checkout to the redactor, for checkouts made by an earlier run
+func (m *AWS) addTokens(checkouts []licenseCheckoutInfo) {
+	for _, checkout := range checkouts {
+		m.redactor.AddToken(checkout.ConsumptionToken)
+	}
+}
+
+// getCheckoutIntents retrieves the checkout intents left in the k8s cache by earlier runs
+func (m *AWS) getCheckoutIntents(ctx context.Context) ([]checkoutIntent, error) {
+	secret, err := m.k8s.GetConsumptionTokenSecret(ctx)
+	if err != nil {
+		return nil, err
+	}
+	raw, ok := secret.Data[intentsKey]
+	if !ok {
+		return nil, nil
+	}
+	var intents []checkoutIntent
+	if err := json.Unmarshal(raw, &intents); err != nil {
+		return nil, fmt.Errorf("unable to parse checkout intents: %v", err)
+	}
+	return intents, nil
+}
+
+// getLegacyCheckout parses a single checkout from the separate keys that older versions of the adapter stored it in
+func getLegacyCheckout(data map[string][]byte) (licenseCheckoutInfo, error) {
+	token, tOk := data[tokenKey]
+	licenses, lOk := data[nodeKey]
+	expiry, eOk := data[expiryKey]
+	if !(tOk && lOk && eOk) {
+		// if we couldn't extract the token or node counts, we can't return accurate checkout info
+		return licenseCheckoutInfo{}, fmt.Errorf("couldn't license consumption info from secret")
+	}
+	numLicenses, err := strconv.Atoi(string(licenses))
+	if err != nil {
+		return licenseCheckoutInfo{}, fmt.Errorf("unable to parse the number of nodes the license token is for %v", err)
+	}
+	expiryTime, err := time.Parse(time.RFC3339, string(expiry))
+	if err != nil {
+		return licenseCheckoutInfo{}, fmt.Errorf("unable to parse the token's expiry time %v", err)
+	}
+	return licenseCheckoutInfo{
+		ConsumptionToken: string(token),
+		EntitledLicenses: numLicenses,
+		Expiry:           expiryTime,
+	}, nil
+}
+
+// saveCheckouts saves the checkouts and the intents for checkouts which haven't been confirmed to the k8s cache. If this
+// fails, returns an error
+func (m *AWS) saveCheckouts(ctx context.Context, checkouts []licenseCheckoutInfo, intents []checkoutIntent) error {
+	if checkouts == nil {
+		// store an empty list rather than null so the cache is always readable
+		checkouts = []licenseCheckoutInfo{}
+	}
+	marshalled, err := json.Marshal(checkouts)
+	if err != nil {
+		return err
+	}
+	data := map[string]string{
+		checkoutsKey: string(marshalled),
+	}
+	if len(intents) > 0 {
+		marshalledIntents, err := json.Marshal(intents)
+		if err != nil {
+			return err
+		}
+		data[intentsKey] = string(marshalledIntents)
+	}
+	return m.k8s.UpdateConsumptionTokenSecret(ctx, data)
+}
@@ -0,0 +1,167 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/licensemanager/types"
+	"github.com/rancher/csp-adapter/pkg/clients/aws"
+	"github.com/rancher/csp-adapter/pkg/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultipleLicenses(t *testing.T) {
+	tests := []struct {
+		name               string         // name of the test, to be displayed on failure
+		licenseMaxCounts   []int          // max entitlements for each license in the account
+		numRancherNodes    int            // nodes reported by rancher
+		inCompliance       bool           // if the check should be compliant
+		expectedCheckedOut map[int]int    // entitlements expected to be checked out, by license index
+		licenseStatus      map[int]string // status to set for licenses, by license index
+	}{
+		{
+			name:               "first license covers everything",
+			licenseMaxCounts:   []int{3, 2},
+			numRancherNodes:    60,
+			inCompliance:       true,
+			expectedCheckedOut: map[int]int{0: 3, 1: 0},
+		},
+		{
+			name:               "aggregate across licenses",
+			licenseMaxCounts:   []int{1, 2},
+			numRancherNodes:    60,
+			inCompliance:       true,
+			expectedCheckedOut: map[int]int{0: 1, 1: 2},
+		},
+		{
+			name:               "not enough across all licenses",
+			licenseMaxCounts:   []int{1, 1},
+			numRancherNodes:    60,
+			inCompliance:       false,
+			expectedCheckedOut: map[int]int{0: 1, 1: 1},
+		},
+		{
+			name:               "expired licenses are skipped",
+			licenseMaxCounts:   []int{5, 2},
+			numRancherNodes:    40,
+			inCompliance:       true,
+			expectedCheckedOut: map[int]int{0: 0, 1: 2},
+			licenseStatus:      map[int]string{0: string(types.LicenseStatusExpired)},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			mockAWSClient := mocks.NewMockAWSClient(test.licenseMaxCounts[0])
+			for _, maxCount := range test.licenseMaxCounts[1:] {
+				mockAWSClient.AddLicense(maxCount)
+			}
+			for i, status := range test.licenseStatus {
+				mockAWSClient.Licenses[i].Status = types.LicenseStatus(status)
+			}
+			mockK8sClient := mocks.NewMockK8sClient(nil)
+			m := NewAWS(mockAWSClient, mockK8sClient, mocks.NewMockScraper(test.numRancherNodes), Options{})
+			assert.NoError(t, m.runComplianceCheck(context.TODO()))
+
+			var config CSPSupportConfig
+			assert.NoError(t, json.Unmarshal(mockK8sClient.CurrentSupportConfig, &config))
+			assert.Equal(t, complianceStatus(test.inCompliance), config.Compliance.Status)
+			assert.Len(t, config.Licenses, len(test.licenseMaxCounts))
+			reported := map[string]int{}
+			for _, info := range config.Licenses {
+				reported[info.Arn] = info.CheckedOut
+			}
+			for i, expected := range test.expectedCheckedOut {
+				arn := *mockAWSClient.Licenses[i].LicenseArn
+				assert.Equal(t, expected, mockAWSClient.CheckedOutForLicense(arn), "checked out from license %d", i)
+				assert.Equal(t, expected, reported[arn], "reported as checked out from license %d", i)
+			}
+		})
+	}
+}
+
+func TestReleaseFromLicenseThatBecomesUnusable(t *testing.T) {
+	mockAWSClient := mocks.NewMockAWSClient(2)
+	mockAWSClient.AddLicense(2)
+	m := NewAWS(mockAWSClient, mocks.NewMockK8sClient(nil), mocks.NewMockScraper(40), Options{})
+	assert.NoError(t, m.runComplianceCheck(context.TODO()))
+	firstArn := *mockAWSClient.Licenses[0].LicenseArn
+	secondArn := *mockAWSClient.Licenses[1].LicenseArn
+	assert.Equal(t, 2, mockAWSClient.CheckedOutForLicense(firstArn))
+
+	mockAWSClient.Licenses[0].Status = types.LicenseStatusSuspended
+	assert.NoError(t, m.runComplianceCheck(context.TODO()))
+	assert.Equal(t, 0, mockAWSClient.CheckedOutForLicense(firstArn), "expected checkout from suspended license to be returned")
+	assert.Equal(t, 2, mockAWSClient.CheckedOutForLicense(secondArn), "expected the remaining license to be used instead")
+}
+
+func TestLegacyCheckoutCache(t *testing.T) {
+	mockK8sClient := mocks.NewMockK8sClient(map[string]string{
+		tokenKey:  "legacy-token",
+		nodeKey:   "2",
+		expiryKey: "2024-01-01T00:00:00Z",
+	})
+	m := NewAWS(mocks.NewMockAWSClient(2), mockK8sClient, mocks.NewMockScraper(0), Options{})
+	checkouts, err := m.getLicenseCheckouts(context.TODO())
+	assert.NoError(t, err)
+	if assert.Len(t, checkouts, 1) {
+		assert.Equal(t, "legacy-token", checkouts[0].ConsumptionToken)
+		assert.Equal(t, 2, checkouts[0].EntitledLicenses)
+		assert.Equal(t, aws.DefaultDimension, checkouts[0].dimension(), "expected legacy checkouts to be of the default dimension")
+	}
+
+	assert.NoError(t, m.saveCheckouts(context.TODO(), checkouts, nil))
+	_, hasLegacy := mockK8sClient.CurrentSecretData[tokenKey]
+	assert.False(t, hasLegacy, "expected the legacy keys to be replaced")
+	roundTripped, err := m.getLicenseCheckouts(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, checkouts, roundTripped)
+}
+
+func TestLostCheckoutResponse(t *testing.T) {
+	mockAWSClient := mocks.NewMockAWSClient(2)
+	mockK8sClient := mocks.NewMockK8sClient(nil)
+	m := NewAWS(mockAWSClient, mockK8sClient, mocks.NewMockScraper(40), Options{})
+	arn := *mockAWSClient.Licenses[0].LicenseArn
+
+	// the checkout is made in aws, but the response never arrives
+	mockAWSClient.CheckoutResponseErr = context.DeadlineExceeded
+	assert.Error(t, m.runComplianceCheck(context.TODO()))
+	assert.Equal(t, 2, mockAWSClient.CheckedOutForLicense(arn))
+	intents, err := m.getCheckoutIntents(context.TODO())
+	assert.NoError(t, err)
+	if assert.Len(t, intents, 1, "expected the checkout intent to be kept for the next run") {
+		assert.Equal(t, 2, intents[0].EntitledLicenses)
+	}
+
+	// the next run retries with the same client token, adopting the checkout rather than consuming more
+	assert.NoError(t, m.runComplianceCheck(context.TODO()))
+	assert.Equal(t, 2, mockAWSClient.CheckedOutForLicense(arn))
+	checkouts, err := m.getLicenseCheckouts(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, totalEntitled(checkouts))
+	intents, err = m.getCheckoutIntents(context.TODO())
+	assert.NoError(t, err)
+	assert.Empty(t, intents)
+}
+
+func TestResolveIntents(t *testing.T) {
+	mockAWSClient := mocks.NewMockAWSClient(2)
+	m := NewAWS(mockAWSClient, mocks.NewMockK8sClient(nil), mocks.NewMockScraper(0), Options{})
+	usable, _ := partitionLicenses(mockAWSClient.Licenses, time.Now())
+	arn := *mockAWSClient.Licenses[0].LicenseArn
+
+	adopted, pending := m.resolveIntents(context.TODO(), []checkoutIntent{
+		{LicenseArn: arn, ClientToken: "current", EntitledLicenses: 1, CreatedAt: time.Now()},
+		{LicenseArn: arn, ClientToken: "expired", EntitledLicenses: 1, CreatedAt: time.Now().Add(-2 * checkoutIntentTTL)},
+		{LicenseArn: "unknown", ClientToken: "unusable", EntitledLicenses: 1, CreatedAt: time.Now()},
+	}, usable)
+	assert.Empty(t, pending)
+	if assert.Len(t, adopted, 1) {
+		assert.Equal(t, arn, adopted[0].LicenseArn)
+		assert.Equal(t, 1, adopted[0].EntitledLicenses)
+	}
+	assert.Equal(t, 1, mockAWSClient.CheckedOutForLicense(arn), "expected expired and unusable intents not to be checked out")
+}
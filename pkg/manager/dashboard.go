@@ -0,0 +1,229 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rancher/csp-adapter/pkg/clients/aws"
+	"github.com/rancher/csp-adapter/pkg/dashboard"
+	"github.com/rancher/csp-adapter/pkg/ledger"
+	"github.com/rancher/csp-adapter/pkg/logging"
+	"github.com/rancher/csp-adapter/pkg/metrics"
+	"github.com/rancher/csp-adapter/pkg/tracing"
+)
+
+// usageCacheTTL is how long the usage gathered for the dashboard is reused for, so that viewing the dashboard doesn't
+// call aws on every refresh
+const usageCacheTTL = 30 * time.Second
+
+const (
+	// dashboardPublishInterval is how often the usage is published to the dashboard configmap. It is longer than
+	// usageCacheTTL, so each publish gathers the usage afresh
+	dashboardPublishInterval = time.Minute
+	// dashboardMaxBytes bounds the size of the usage published for the dashboard, leaving room in the 1MiB configmap
+	// limit
+	dashboardMaxBytes = 900 * 1024
+)
+
+// usageCache holds the usage last gathered for the dashboard, without its history
+type usageCache struct {
+	mu    sync.Mutex
+	usage dashboard.Usage
+	valid bool
+}
+
+// Usage gathers the license usage shown by rancher's dashboard, with the history recorded in the ledger since from.
+// Account numbers and consumption tokens are masked as they are in the logs
+func (m *AWS) Usage(ctx context.Context, from time.Time) (usage *dashboard.Usage, err error) {
+	ctx, end := tracing.Start(ctx, "manager.Usage")
+	defer end(&err)
+	current, err := m.currentUsage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	history, err := m.ledger.Entries(ctx, from, time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read usage history: %v", err)
+	}
+	current.History = append([]ledger.Entry{}, history...)
+	return &current, nil
+}
+
+// publishUsage stores the usage with dashboard.DefaultHistory of history in the dashboard configmap, which rancher's ui
+// reads through the kubernetes api since its service proxy can't pass the user on to the adapter's own api. The oldest
+// history is dropped if the usage doesn't fit in dashboardMaxBytes
+func (m *AWS) publishUsage(ctx context.Context) (err error) {
+	ctx, end := tracing.Start(ctx, "manager.publishUsage")
+	defer end(&err)
+	usage, err := m.Usage(ctx, time.Now().Add(-dashboard.DefaultHistory))
+	if err != nil {
+		return err
+	}
+	usage.APIVersion = dashboard.APIVersion
+	marshalled, err := json.Marshal(usage)
+	if err != nil {
+		return fmt.Errorf("unable to marshal license usage: %v", err)
+	}
+	for len(marshalled) > dashboardMaxBytes && len(usage.History) > 0 {
+		// estimate how many entries need to go from their average size, rather than re-marshalling for each one
+		drop := (len(marshalled)-dashboardMaxBytes)/(len(marshalled)/len(usage.History)) + 1
+		usage.History = usage.History[min(drop, len(usage.History)):]
+		marshalled, err = json.Marshal(usage)
+		if err != nil {
+			return fmt.Errorf("unable to marshal license usage: %v", err)
+		}
+	}
+	return m.k8s.UpdateDashboard(ctx, string(marshalled))
+}
+
+// currentUsage gives the usage gathered within the last usageCacheTTL, gathering it again if there isn't any
+func (m *AWS) currentUsage(ctx context.Context) (dashboard.Usage, error) {
+	// held while gathering, so that concurrent requests wait for one gather rather than each calling aws
+	m.usageCache.mu.Lock()
+	defer m.usageCache.mu.Unlock()
+	if m.usageCache.valid && time.Since(m.usageCache.usage.Time) < usageCacheTTL {
+		return m.usageCache.usage, nil
+	}
+	usage, err := m.gatherUsage(ctx, time.Now())
+	if err != nil {
+		return dashboard.Usage{}, err
+	}
+	m.usageCache.usage = usage
+	m.usageCache.valid = true
+	return usage, nil
+}
+
+// gatherUsage combines the node counts scraped from rancher, the licenses and their available entitlements from aws,
+// the cached checkouts, and the outcome of the last compliance check into the usage at now
+func (m *AWS) gatherUsage(ctx context.Context, now time.Time) (dashboard.Usage, error) {
+	usable, unusable, _, err := m.getLicenses(ctx, now)
+	if err != nil {
+		return dashboard.Usage{}, fmt.Errorf("unable to get rancher license, err: %v", err)
+	}
+	nodeCounts, err := m.scraper.ScrapeAndParse(ctx)
+	if err != nil {
+		return dashboard.Usage{}, fmt.Errorf("unable to determine number of active nodes: %v", err)
+	}
+	checkouts, err := m.getLicenseCheckouts(ctx)
+	if err != nil {
+		// the same as the compliance check, which starts fresh in this case
+		logging.FromContext(ctx).Warnf("unable to get current license consumption info, reporting none checked out: %v", err)
+		checkouts = nil
+	}
+
+	usage := dashboard.Usage{
+		Time:          now,
+		Nodes:         nodeCounts.Total,
+		CPUs:          nodeCounts.CPUs,
+		LicensedNodes: nodeCounts.Total,
+		UsageStrategy: string(m.usage.strategy),
+		Dimensions:    []dashboard.Dimension{},
+		Licenses:      []dashboard.License{},
+		Clusters:      []dashboard.Cluster{},
+	}
+	if latest := m.history.List(1); len(latest) == 1 {
+		decision := latest[0]
+		usage.Compliance = &dashboard.Compliance{
+			Time:         decision.End,
+			InCompliance: decision.Result.InCompliance,
+			Error:        m.redactor.Redact(decision.Result.Error),
+		}
+		if decision.Inputs.UsageStrategy != "" {
+			// the rolling strategies license more than the current count, which only the compliance check tracks
+			usage.LicensedNodes = decision.Inputs.LicensedNodes
+		}
+	}
+
+	nodeDimension, hasNodeDimension := m.nodeDimension()
+	nodeCheckouts, _ := checkoutsOf(checkouts, nodeDimension.Name)
+	for _, state := range usable {
+		license := dashboard.License{
+			Arn:     m.redactor.Redact(state.arn()),
+			Account: m.redactor.Redact(m.client(state).AccountNumber()),
+			Usable:  true,
+		}
+		if hasNodeDimension && aws.HasDimension(state.license, nodeDimension.Name) {
+			license.CheckedOut = entitledFrom(nodeCheckouts, state.arn())
+			available, err := m.client(state).GetNumberOfAvailableEntitlements(ctx, state.license, nodeDimension.Name)
+			if err != nil {
+				logging.FromContext(ctx).Warnf("unable to determine number of available entitlements for %s: %v", state.arn(), err)
+				license.Error = m.redactor.Redact(err.Error())
+			} else {
+				license.Available = available
+			}
+		}
+		usage.Licenses = append(usage.Licenses, license)
+	}
+	for _, state := range unusable {
+		usage.Licenses = append(usage.Licenses, dashboard.License{
+			Arn:     m.redactor.Redact(state.arn()),
+			Account: m.redactor.Redact(m.client(state).AccountNumber()),
+			Reason:  state.validity.Reason,
+		})
+	}
+
+	for _, dimension := range m.dimensions {
+		entitlements := m.dimensionUsage(ctx, dimension, usage.LicensedNodes, nodeCounts, usable, checkouts)
+		usage.Dimensions = append(usage.Dimensions, entitlements)
+		if hasNodeDimension && dimension.Name == nodeDimension.Name {
+			usage.Entitlements = dashboard.Entitlements{
+				NodesPerEntitlement: dimension.UnitsPerEntitlement,
+				Required:            entitlements.Required,
+				CheckedOut:          entitlements.CheckedOut,
+				Available:           entitlements.Available,
+			}
+		}
+	}
+	usage.Headroom.CoveredNodes = (usage.Entitlements.CheckedOut + usage.Entitlements.Available) * usage.Entitlements.NodesPerEntitlement
+	usage.Headroom.Nodes = usage.Headroom.CoveredNodes - usage.LicensedNodes
+	if usage.Headroom.CoveredNodes > 0 {
+		percent := 100 * float64(usage.Headroom.Nodes) / float64(usage.Headroom.CoveredNodes)
+		usage.Headroom.Percent = math.Round(percent*10) / 10
+	}
+
+	for id, nodes := range nodeCounts.Clusters {
+		usage.Clusters = append(usage.Clusters, dashboard.Cluster{ID: id, Nodes: nodes, CPUs: nodeCounts.ClusterCPUs[id]})
+	}
+	// largest first, since those are what the dashboard's breakdown is most interested in
+	sort.Slice(usage.Clusters, func(i, j int) bool {
+		if usage.Clusters[i].Nodes != usage.Clusters[j].Nodes {
+			return usage.Clusters[i].Nodes > usage.Clusters[j].Nodes
+		}
+		return usage.Clusters[i].ID < usage.Clusters[j].ID
+	})
+	return usage, nil
+}
+
+// dimensionUsage gives the entitlements of dimension needed for licensedNodes and counts, held in checkouts, and
+// available across the usable licenses granting it. Licenses whose availability can't be determined are skipped, and
+// nothing is counted if the dimension can't be
+func (m *AWS) dimensionUsage(ctx context.Context, dimension Dimension, licensedNodes int, counts *metrics.NodeCounts, usable []licenseState, checkouts []licenseCheckoutInfo) dashboard.Dimension {
+	held, _ := checkoutsOf(checkouts, dimension.Name)
+	usage := dashboard.Dimension{
+		Name:                dimension.Name,
+		Counting:            string(dimension.Counting),
+		UnitsPerEntitlement: dimension.UnitsPerEntitlement,
+		CheckedOut:          totalEntitled(held),
+	}
+	counted, err := dimension.count(licensedNodes, counts)
+	if err != nil {
+		usage.Error = err.Error()
+	} else {
+		usage.Counted = counted
+		usage.Required = dimension.required(counted)
+	}
+	for _, state := range licensesWith(usable, dimension.Name) {
+		available, err := m.client(state).GetNumberOfAvailableEntitlements(ctx, state.license, dimension.Name)
+		if err != nil {
+			logging.FromContext(ctx).Warnf("unable to determine number of available %s entitlements for %s: %v", dimension.Name, state.arn(), err)
+			continue
+		}
+		usage.Available += available
+	}
+	return usage
+}
@@ -0,0 +1,71 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rancher/csp-adapter/pkg/clients/aws"
+	"github.com/rancher/csp-adapter/pkg/dashboard"
+	"github.com/rancher/csp-adapter/pkg/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsage(t *testing.T) {
+	scraper := mocks.NewMockScraper(40)
+	scraper.Clusters = map[string]int{"c-small": 10, "c-large": 30}
+	m := NewAWS(mocks.NewMockAWSClient(5), mocks.NewMockK8sClient(nil), scraper, Options{})
+
+	// before any check, the current node count is what would be licensed
+	usage, err := m.Usage(context.Background(), time.Time{})
+	require.NoError(t, err)
+	assert.Nil(t, usage.Compliance)
+	assert.Equal(t, 40, usage.LicensedNodes)
+	assert.Equal(t, dashboard.Entitlements{NodesPerEntitlement: 20, Required: 2, CheckedOut: 0, Available: 5}, usage.Entitlements)
+	assert.Empty(t, usage.History)
+
+	// expire the cache so that the checkout made by the check is seen
+	require.NoError(t, m.runComplianceCheck(context.Background()))
+	m.usageCache.valid = false
+	usage, err = m.Usage(context.Background(), time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, 40, usage.Nodes)
+	assert.Equal(t, 40, usage.LicensedNodes)
+	assert.Equal(t, string(UsageStrategyInstantaneous), usage.UsageStrategy)
+	require.NotNil(t, usage.Compliance)
+	assert.True(t, usage.Compliance.InCompliance)
+	assert.Equal(t, dashboard.Entitlements{NodesPerEntitlement: 20, Required: 2, CheckedOut: 2, Available: 3}, usage.Entitlements)
+	assert.Equal(t, dashboard.Headroom{CoveredNodes: 100, Nodes: 60, Percent: 60}, usage.Headroom)
+	assert.Equal(t, []dashboard.Dimension{{Name: aws.DefaultDimension, Counting: "nodes", UnitsPerEntitlement: 20, Counted: 40, Required: 2, CheckedOut: 2, Available: 3}}, usage.Dimensions)
+	require.Len(t, usage.Licenses, 1)
+	assert.True(t, usage.Licenses[0].Usable)
+	assert.Equal(t, 2, usage.Licenses[0].CheckedOut)
+	assert.Equal(t, 3, usage.Licenses[0].Available)
+	assert.Equal(t, []dashboard.Cluster{{ID: "c-large", Nodes: 30}, {ID: "c-small", Nodes: 10}}, usage.Clusters)
+	assert.Len(t, usage.History, 1)
+
+	// within the cache's lifetime the gathered usage is reused, though the history is always current
+	scraper.Nodes = 60
+	cached, err := m.Usage(context.Background(), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 40, cached.Nodes)
+	assert.Empty(t, cached.History)
+}
+
+func TestPublishUsage(t *testing.T) {
+	k8sClient := mocks.NewMockK8sClient(nil)
+	m := NewAWS(mocks.NewMockAWSClient(5), k8sClient, mocks.NewMockScraper(40), Options{})
+
+	require.NoError(t, m.runComplianceCheck(context.Background()))
+	require.NoError(t, m.publishUsage(context.Background()))
+
+	var published dashboard.Usage
+	require.NoError(t, json.Unmarshal([]byte(k8sClient.CurrentDashboard), &published))
+	assert.Equal(t, dashboard.APIVersion, published.APIVersion)
+	require.NotNil(t, published.Compliance)
+	assert.True(t, published.Compliance.InCompliance)
+	assert.Equal(t, 2, published.Entitlements.CheckedOut)
+	assert.Len(t, published.History, 1)
+}
@@ -0,0 +1,242 @@
+package manager
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/rancher/csp-adapter/pkg/clients/aws"
+	"github.com/rancher/csp-adapter/pkg/ledger"
+	"github.com/rancher/csp-adapter/pkg/messages"
+	"github.com/rancher/csp-adapter/pkg/metrics"
+)
+
+// Counting is what is counted to determine how many entitlements of a dimension are needed
+type Counting string
+
+const (
+	// CountingNodes counts the nodes in downstream clusters, as licensed by the usage strategy
+	CountingNodes Counting = "nodes"
+	// CountingClusters counts the downstream clusters which have nodes
+	CountingClusters Counting = "clusters"
+	// CountingVCPUs counts the allocatable cpu cores of the nodes in downstream clusters, for offers priced per core
+	CountingVCPUs Counting = "vcpus"
+)
+
+// Dimension is an entitlement dimension of the rancher licenses, and how the entitlements needed of it are counted
+type Dimension struct {
+	// Name is the name of the entitlement in aws, such as RKE_NODE_SUPP
+	Name     string
+	Counting Counting
+	// UnitsPerEntitlement is how many of what is counted, such as nodes, a single entitlement covers
+	UnitsPerEntitlement int
+}
+
+// DefaultDimensions gives the dimension of the original rancher offers, an entitlement of RKE_NODE_SUPP per 20 nodes
+func DefaultDimensions() []Dimension {
+	return []Dimension{{Name: aws.DefaultDimension, Counting: CountingNodes, UnitsPerEntitlement: nodesPerLicense}}
+}
+
+// ParseDimensions parses a comma separated list of dimensions, each written as name=counting:unitsPerEntitlement, such
+// as "RKE_NODE_SUPP=nodes:20,RANCHER_CLUSTER_SUPP=clusters:1,RANCHER_VCPU_SUPP=vcpus:4". An empty list gives
+// DefaultDimensions
+func ParseDimensions(raw string) ([]Dimension, error) {
+	if strings.TrimSpace(raw) == "" {
+		return DefaultDimensions(), nil
+	}
+	var dimensions []Dimension
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(raw, ",") {
+		name, spec, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid dimension %q, must be name=counting:unitsPerEntitlement", entry)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("dimension %s is given more than once", name)
+		}
+		seen[name] = true
+		counting, units, ok := strings.Cut(spec, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid dimension %q, must be name=counting:unitsPerEntitlement", entry)
+		}
+		dimension := Dimension{Name: name, Counting: Counting(counting)}
+		switch dimension.Counting {
+		case CountingNodes, CountingClusters, CountingVCPUs:
+		default:
+			return nil, fmt.Errorf("unknown counting %q for dimension %s, must be one of %s, %s, %s", counting, name, CountingNodes, CountingClusters, CountingVCPUs)
+		}
+		var err error
+		dimension.UnitsPerEntitlement, err = strconv.Atoi(units)
+		if err != nil || dimension.UnitsPerEntitlement <= 0 {
+			return nil, fmt.Errorf("units per entitlement of dimension %s must be a positive number, got %s", name, units)
+		}
+		dimensions = append(dimensions, dimension)
+	}
+	return dimensions, nil
+}
+
+// count gives the number of units the dimension counts, licensedNodes being the node count licensed by the usage
+// strategy and counts the latest scrape of rancher. Cores are counted as of the latest scrape, rounded up to whole
+// cores, since the usage strategy only applies to nodes. Fails if cores are counted but rancher doesn't report them
+func (d Dimension) count(licensedNodes int, counts *metrics.NodeCounts) (int, error) {
+	switch d.Counting {
+	case CountingClusters:
+		clusters := 0
+		for _, nodes := range counts.Clusters {
+			if nodes > 0 {
+				clusters++
+			}
+		}
+		return clusters, nil
+	case CountingVCPUs:
+		if !counts.HasCPUs {
+			return 0, fmt.Errorf("rancher doesn't report the cpus of its nodes, which dimension %s counts", d.Name)
+		}
+		return int(math.Ceil(counts.CPUs)), nil
+	default:
+		return licensedNodes, nil
+	}
+}
+
+// required gives the entitlements needed to cover counted units, rounded up since part of an entitlement can't be held
+func (d Dimension) required(counted int) int {
+	return int(math.Ceil(float64(counted) / float64(d.UnitsPerEntitlement)))
+}
+
+// requirement is the number of entitlements of a dimension that a compliance check needs to hold
+type requirement struct {
+	dimension Dimension
+	counted   int
+	required  int
+}
+
+// requirements gives the entitlements needed of each configured dimension granted by a usable license, in the order the
+// dimensions are configured. Dimensions that no usable license grants aren't part of the offers held, so aren't needed
+func (m *AWS) requirements(licensedNodes int, counts *metrics.NodeCounts, usable []licenseState) ([]requirement, error) {
+	var requirements []requirement
+	for _, dimension := range m.dimensions {
+		if len(licensesWith(usable, dimension.Name)) == 0 {
+			continue
+		}
+		counted, err := dimension.count(licensedNodes, counts)
+		if err != nil {
+			return nil, err
+		}
+		requirements = append(requirements, requirement{dimension: dimension, counted: counted, required: dimension.required(counted)})
+	}
+	return requirements, nil
+}
+
+// usageOf gives the entitlements required of each dimension in requirements, and how many of them are held in checkouts
+func usageOf(requirements []requirement, checkouts []licenseCheckoutInfo) []ledger.DimensionUsage {
+	usage := make([]ledger.DimensionUsage, 0, len(requirements))
+	for _, req := range requirements {
+		held, _ := checkoutsOf(checkouts, req.dimension.Name)
+		usage = append(usage, ledger.DimensionUsage{Dimension: req.dimension.Name, RequiredLicenses: req.required, CheckedOut: totalEntitled(held)})
+	}
+	return usage
+}
+
+// primaryUsage gives the usage of the dimension counting nodes, or of the first dimension in usage if none counts nodes,
+// for the totals which predate several dimensions. Entitlements of different dimensions cover different things, so
+// they are never added up
+func (m *AWS) primaryUsage(usage []ledger.DimensionUsage) ledger.DimensionUsage {
+	if dimension, ok := m.nodeDimension(); ok {
+		for _, u := range usage {
+			if u.Dimension == dimension.Name {
+				return u
+			}
+		}
+	}
+	if len(usage) == 0 {
+		return ledger.DimensionUsage{}
+	}
+	return usage[0]
+}
+
+// usageByDimension gives the entitlements required and checked out of each dimension in usage, by name
+func usageByDimension(usage []ledger.DimensionUsage) (required, checkedOut map[string]int) {
+	required = make(map[string]int, len(usage))
+	checkedOut = make(map[string]int, len(usage))
+	for _, u := range usage {
+		required[u.Dimension] = u.RequiredLicenses
+		checkedOut[u.Dimension] = u.CheckedOut
+	}
+	return required, checkedOut
+}
+
+// renderPerDimension renders the message key with the params given for the usage of each dimension. With a single
+// dimension the message is rendered as is, with several each is prefixed with the name of its dimension
+func (m *AWS) renderPerDimension(key string, usage []ledger.DimensionUsage, params func(ledger.DimensionUsage) messages.Params) string {
+	if len(usage) <= 1 {
+		return m.messages.Render(key, params(m.primaryUsage(usage)))
+	}
+	rendered := make([]string, 0, len(usage))
+	for _, u := range usage {
+		rendered = append(rendered, u.Dimension+": "+m.messages.Render(key, params(u)))
+	}
+	return strings.Join(rendered, "; ")
+}
+
+// missingEntitlements gives the entitlements still needed to cover usage. With a single dimension it is a number, with
+// several it lists the number missing of each dimension which is short
+func missingEntitlements(usage []ledger.DimensionUsage) interface{} {
+	if len(usage) <= 1 {
+		missing := 0
+		for _, u := range usage {
+			missing = u.RequiredLicenses - u.CheckedOut
+		}
+		return missing
+	}
+	var missing []string
+	for _, u := range usage {
+		if u.RequiredLicenses > u.CheckedOut {
+			missing = append(missing, fmt.Sprintf("%d %s", u.RequiredLicenses-u.CheckedOut, u.Dimension))
+		}
+	}
+	return strings.Join(missing, ", ")
+}
+
+// nodeDimension gives the first configured dimension which counts nodes, which the headroom warnings and dashboard are
+// based on
+func (m *AWS) nodeDimension() (Dimension, bool) {
+	for _, dimension := range m.dimensions {
+		if dimension.Counting == CountingNodes {
+			return dimension, true
+		}
+	}
+	return Dimension{}, false
+}
+
+// dimensionNames gives the names of dimensions
+func dimensionNames(dimensions []Dimension) []string {
+	names := make([]string, 0, len(dimensions))
+	for _, dimension := range dimensions {
+		names = append(names, dimension.Name)
+	}
+	return names
+}
+
+// licensesWith gives the licenses which grant entitlements of dimension
+func licensesWith(licenses []licenseState, dimension string) []licenseState {
+	var granting []licenseState
+	for _, state := range licenses {
+		if aws.HasDimension(state.license, dimension) {
+			granting = append(granting, state)
+		}
+	}
+	return granting
+}
+
+// checkoutsOf splits checkouts into those of dimension and the rest
+func checkoutsOf(checkouts []licenseCheckoutInfo, dimension string) (of, rest []licenseCheckoutInfo) {
+	for _, checkout := range checkouts {
+		if checkout.dimension() == dimension {
+			of = append(of, checkout)
+		} else {
+			rest = append(rest, checkout)
+		}
+	}
+	return of, rest
+}
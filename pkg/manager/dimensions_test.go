@@ -0,0 +1,159 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rancher/csp-adapter/pkg/clients/aws"
+	"github.com/rancher/csp-adapter/pkg/ledger"
+	"github.com/rancher/csp-adapter/pkg/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const clusterDimension = "RANCHER_CLUSTER_SUPP"
+
+func TestParseDimensions(t *testing.T) {
+	tests := []struct {
+		name     string      // name of the test, to be displayed on failure
+		raw      string      // value being parsed
+		expected []Dimension // dimensions expected to be parsed
+		wantErr  bool        // if parsing should fail
+	}{
+		{
+			name:     "empty gives the default",
+			raw:      "",
+			expected: DefaultDimensions(),
+		},
+		{
+			name: "several dimensions in order",
+			raw:  "RKE_NODE_SUPP=nodes:20, RANCHER_CLUSTER_SUPP=clusters:1",
+			expected: []Dimension{
+				{Name: aws.DefaultDimension, Counting: CountingNodes, UnitsPerEntitlement: 20},
+				{Name: clusterDimension, Counting: CountingClusters, UnitsPerEntitlement: 1},
+			},
+		},
+		{
+			name:     "cores",
+			raw:      "RANCHER_VCPU_SUPP=vcpus:4",
+			expected: []Dimension{{Name: "RANCHER_VCPU_SUPP", Counting: CountingVCPUs, UnitsPerEntitlement: 4}},
+		},
+		{
+			name:    "missing counting",
+			raw:     "RKE_NODE_SUPP=20",
+			wantErr: true,
+		},
+		{
+			name:    "unknown counting",
+			raw:     "RKE_NODE_SUPP=pods:20",
+			wantErr: true,
+		},
+		{
+			name:    "units must be positive",
+			raw:     "RKE_NODE_SUPP=nodes:0",
+			wantErr: true,
+		},
+		{
+			name:    "duplicate dimension",
+			raw:     "RKE_NODE_SUPP=nodes:20,RKE_NODE_SUPP=clusters:1",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dimensions, err := ParseDimensions(test.raw)
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, dimensions)
+		})
+	}
+}
+
+func TestComplianceCheckDimensions(t *testing.T) {
+	mockAWSClient := mocks.NewMockAWSClient(5)
+	clusterArn := mockAWSClient.AddLicenseWithDimensions(map[string]int{aws.DefaultDimension: 5, clusterDimension: 5})
+	nodeArn := *mockAWSClient.Licenses[0].LicenseArn
+	scraper := mocks.NewMockScraper(40)
+	scraper.Clusters = map[string]int{"c-one": 25, "c-two": 15, "c-empty": 0}
+	dimensions, err := ParseDimensions("RKE_NODE_SUPP=nodes:20,RANCHER_CLUSTER_SUPP=clusters:1,RANCHER_VCLUSTER_SUPP=clusters:1")
+	require.NoError(t, err)
+	mockK8sClient := mocks.NewMockK8sClient(nil)
+	m := NewAWS(mockAWSClient, mockK8sClient, scraper, Options{Dimensions: dimensions})
+
+	require.NoError(t, m.runComplianceCheck(context.TODO()))
+	assert.Equal(t, 2, mockAWSClient.CheckedOutForDimension(nodeArn, aws.DefaultDimension))
+	assert.Equal(t, 0, mockAWSClient.CheckedOutForDimension(clusterArn, aws.DefaultDimension))
+	assert.Equal(t, 2, mockAWSClient.CheckedOutForDimension(clusterArn, clusterDimension), "expected an entitlement for each cluster with nodes")
+	assert.Equal(t, 0, mockAWSClient.CheckedOutForDimension(clusterArn, "RANCHER_VCLUSTER_SUPP"), "expected a dimension no license grants to be skipped")
+	checkouts, err := m.getLicenseCheckouts(context.TODO())
+	require.NoError(t, err)
+	assert.Len(t, checkouts, 2)
+
+	// running out of one dimension is non-compliant, but the others are still checked out
+	scraper.Nodes = 80
+	scraper.Clusters["c-three"] = 10
+	scraper.Clusters["c-four"] = 10
+	scraper.Clusters["c-five"] = 10
+	scraper.Clusters["c-six"] = 10
+	require.NoError(t, m.runComplianceCheck(context.TODO()))
+	assert.Equal(t, 5, mockAWSClient.CheckedOutForDimension(clusterArn, clusterDimension))
+	assert.Equal(t, 4, mockAWSClient.CheckedOutForDimension(nodeArn, aws.DefaultDimension))
+	decision := m.History().List(1)[0]
+	assert.False(t, decision.Result.InCompliance)
+	assert.Equal(t, map[string]int{aws.DefaultDimension: 4, clusterDimension: 6}, decision.Inputs.RequiredDimensions)
+	assert.Equal(t, map[string]int{aws.DefaultDimension: 4, clusterDimension: 5}, decision.Result.CheckedOutDimensions)
+	assert.Equal(t, 4, decision.Inputs.RequiredLicenses, "expected entitlements of different dimensions not to be added up")
+
+	// each dimension is recorded and reported on its own, as their entitlements cover different things
+	entries, err := m.Ledger().Entries(context.TODO(), time.Time{}, time.Time{})
+	require.NoError(t, err)
+	last := entries[len(entries)-1]
+	assert.Equal(t, 4, last.RequiredLicenses)
+	assert.Equal(t, 4, last.CheckedOut)
+	assert.Equal(t, []ledger.DimensionUsage{
+		{Dimension: aws.DefaultDimension, RequiredLicenses: 4, CheckedOut: 4},
+		{Dimension: clusterDimension, RequiredLicenses: 6, CheckedOut: 5},
+	}, last.Dimensions)
+	var config CSPSupportConfig
+	require.NoError(t, json.Unmarshal(mockK8sClient.CurrentSupportConfig, &config))
+	assert.Equal(t, "RKE_NODE_SUPP: Rancher server required 4 license(s) and was able to check out 4 license(s); "+
+		"RANCHER_CLUSTER_SUPP: Rancher server required 6 license(s) and was able to check out 5 license(s)", config.Compliance.Message)
+	assert.Contains(t, mockK8sClient.CurrentNotificationMessage, "At least 1 RANCHER_CLUSTER_SUPP more license(s)")
+
+	// once the license granting clusters is gone, its checkouts are returned
+	mockAWSClient.Licenses = mockAWSClient.Licenses[:1]
+	scraper.Nodes = 40
+	scraper.Clusters = map[string]int{"c-one": 40}
+	require.NoError(t, m.runComplianceCheck(context.TODO()))
+	assert.Equal(t, 2, mockAWSClient.CheckedOutForDimension(nodeArn, aws.DefaultDimension))
+	checkouts, err = m.getLicenseCheckouts(context.TODO())
+	require.NoError(t, err)
+	if assert.Len(t, checkouts, 1) {
+		assert.Equal(t, aws.DefaultDimension, checkouts[0].Dimension)
+	}
+}
+
+func TestComplianceCheckVCPUs(t *testing.T) {
+	const vcpuDimension = "RANCHER_VCPU_SUPP"
+	mockAWSClient := mocks.NewMockAWSClient(0)
+	mockAWSClient.Licenses = nil
+	arn := mockAWSClient.AddLicenseWithDimensions(map[string]int{vcpuDimension: 10})
+	scraper := mocks.NewMockScraper(3)
+	dimensions, err := ParseDimensions("RANCHER_VCPU_SUPP=vcpus:4")
+	require.NoError(t, err)
+	m := NewAWS(mockAWSClient, mocks.NewMockK8sClient(nil), scraper, Options{Dimensions: dimensions})
+
+	// without cpus from rancher the entitlements needed can't be known
+	assert.Error(t, m.runComplianceCheck(context.TODO()))
+	assert.Equal(t, 0, mockAWSClient.CheckedOutForLicense(arn))
+
+	scraper.ClusterCPUs = map[string]float64{"c-one": 8, "c-two": 5.5}
+	require.NoError(t, m.runComplianceCheck(context.TODO()))
+	assert.Equal(t, 4, mockAWSClient.CheckedOutForDimension(arn, vcpuDimension), "expected an entitlement for every 4 cores, rounded up")
+	assert.True(t, m.History().List(1)[0].Result.InCompliance)
+}
@@ -0,0 +1,152 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rancher/csp-adapter/pkg/clients/aws"
+	"github.com/rancher/csp-adapter/pkg/emulator"
+	"github.com/rancher/csp-adapter/pkg/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// emulatorTestSKU is the non-emea test product sku, used by the aws client in dev mode
+const emulatorTestSKU = "83929a73-7c49-4511-aa45-8854a4f001d4"
+
+// newEmulatorClient serves e for the duration of the test, returning a real aws client which calls it
+func newEmulatorClient(t *testing.T, e *emulator.Emulator) aws.Client {
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+	t.Setenv("AWS_ACCESS_KEY_ID", "emulator")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "emulator")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_CONFIG_FILE", t.TempDir()+"/config")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", t.TempDir()+"/credentials")
+	// fail on the first error rather than retrying, so that the errors the emulator is told to return reach the adapter
+	t.Setenv("AWS_MAX_ATTEMPTS", "1")
+	client, err := aws.NewClient(context.Background(), aws.ClientOptions{UseTestProducts: true, Endpoint: server.URL})
+	require.NoError(t, err)
+	return client
+}
+
+func reportedCompliance(t *testing.T, k8s *mocks.MockK8sClient) string {
+	var config CSPSupportConfig
+	require.NoError(t, json.Unmarshal(k8s.CurrentSupportConfig, &config))
+	return config.Compliance.Status
+}
+
+func TestEmulatorEndToEnd(t *testing.T) {
+	e := emulator.New("123456789012")
+	arn := e.AddLicense(emulatorTestSKU, 2)
+	k8s := mocks.NewMockK8sClient(nil)
+	scraper := mocks.NewMockScraper(40)
+	m := NewAWS(newEmulatorClient(t, e), k8s, scraper, Options{})
+
+	require.NoError(t, m.runComplianceCheck(context.Background()))
+	assert.Equal(t, StatusInCompliance, reportedCompliance(t, k8s))
+	assert.Equal(t, 2, e.Consumed(arn))
+
+	// fewer nodes returns the entitlements which are no longer needed
+	scraper.Nodes = 20
+	require.NoError(t, m.runComplianceCheck(context.Background()))
+	assert.Equal(t, 1, e.Consumed(arn))
+	assert.Equal(t, 1, e.Checkouts())
+
+	scraper.Nodes = 0
+	require.NoError(t, m.runComplianceCheck(context.Background()))
+	assert.Equal(t, 0, e.Consumed(arn))
+}
+
+func TestEmulatorConcurrentConsumers(t *testing.T) {
+	e := emulator.New("123456789012")
+	arn := e.AddLicense(emulatorTestSKU, 3)
+	firstK8s, secondK8s := mocks.NewMockK8sClient(nil), mocks.NewMockK8sClient(nil)
+	first := NewAWS(newEmulatorClient(t, e), firstK8s, mocks.NewMockScraper(40), Options{})
+	second := NewAWS(newEmulatorClient(t, e), secondK8s, mocks.NewMockScraper(40), Options{})
+
+	require.NoError(t, first.runComplianceCheck(context.Background()))
+	require.NoError(t, second.runComplianceCheck(context.Background()))
+	assert.Equal(t, StatusInCompliance, reportedCompliance(t, firstK8s))
+	assert.Equal(t, StatusNotInCompliance, reportedCompliance(t, secondK8s), "expected the second consumer to only get what was left")
+	assert.Equal(t, 3, e.Consumed(arn))
+}
+
+func TestEmulatorServerFaultKeepsIntent(t *testing.T) {
+	e := emulator.New("123456789012")
+	arn := e.AddLicense(emulatorTestSKU, 2)
+	m := NewAWS(newEmulatorClient(t, e), mocks.NewMockK8sClient(nil), mocks.NewMockScraper(40), Options{})
+
+	// aws makes the checkout, but fails to say so
+	e.FailAfterApplying("CheckoutLicense", 1)
+	assert.Error(t, m.runComplianceCheck(context.Background()))
+	assert.Equal(t, 2, e.Consumed(arn))
+	intents, err := m.getCheckoutIntents(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, intents, 1, "expected the intent to be kept after a server fault")
+
+	// the intent is retried with its client token, adopting the checkout rather than consuming more
+	require.NoError(t, m.runComplianceCheck(context.Background()))
+	assert.Equal(t, 2, e.Consumed(arn))
+	assert.Equal(t, 1, e.Checkouts())
+	intents, err = m.getCheckoutIntents(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, intents)
+}
+
+func TestEmulatorClientFaultDropsIntent(t *testing.T) {
+	e := emulator.New("123456789012")
+	arn := e.AddLicense(emulatorTestSKU, 2)
+	m := NewAWS(newEmulatorClient(t, e), mocks.NewMockK8sClient(nil), mocks.NewMockScraper(0), Options{})
+	usable, _, _, err := m.getLicenses(context.Background(), time.Now())
+	require.NoError(t, err)
+	// more than the license has, which aws rejects as the client's fault
+	unsatisfiable := checkoutIntent{LicenseArn: arn, ClientToken: "unsatisfiable", EntitledLicenses: 3, CreatedAt: time.Now()}
+
+	e.Throttle(1)
+	adopted, pending := m.resolveIntents(context.Background(), []checkoutIntent{unsatisfiable}, usable)
+	assert.Empty(t, adopted)
+	assert.Len(t, pending, 1, "expected the intent to be kept after being throttled")
+
+	adopted, pending = m.resolveIntents(context.Background(), pending, usable)
+	assert.Empty(t, adopted)
+	assert.Empty(t, pending, "expected the intent to be dropped after a client fault")
+	assert.Equal(t, 0, e.Consumed(arn))
+}
+
+func TestEmulatorReconcileAfterExtension(t *testing.T) {
+	e := emulator.New("123456789012")
+	arn := e.AddLicense(emulatorTestSKU, 5)
+	client := newEmulatorClient(t, e)
+	k8s := mocks.NewMockK8sClient(nil)
+	m := NewAWS(client, k8s, mocks.NewMockScraper(40), Options{})
+	require.NoError(t, m.runComplianceCheck(context.Background()))
+
+	// extend the checkout and save it, as a check does near its expiry, which replaces its consumption token
+	checkouts, err := m.getLicenseCheckouts(context.Background())
+	require.NoError(t, err)
+	extended := m.extendCheckouts(context.Background(), 2*emulator.DefaultTokenTTL, checkouts)
+	require.Len(t, extended, 1)
+	require.NotEqual(t, checkouts[0].ConsumptionToken, extended[0].ConsumptionToken)
+	require.NoError(t, m.saveCheckouts(context.Background(), extended, nil))
+	require.NoError(t, m.saveTokenJournal(context.Background(), extended))
+
+	// the adapter restarts having lost its cache, and adopts the checkout which is still held
+	k8s.CurrentSecretData = nil
+	restarted := NewAWS(client, k8s, mocks.NewMockScraper(40), Options{})
+	require.NoError(t, restarted.reconcileOrphans(context.Background()))
+	assert.Equal(t, 2, e.Consumed(arn))
+	adopted, err := restarted.getLicenseCheckouts(context.Background())
+	require.NoError(t, err)
+	if assert.Len(t, adopted, 1) {
+		assert.Equal(t, extended[0].ConsumptionToken, adopted[0].ConsumptionToken)
+	}
+
+	// the next check finds everything it needs already held
+	require.NoError(t, restarted.runComplianceCheck(context.Background()))
+	assert.Equal(t, 2, e.Consumed(arn))
+	assert.Equal(t, 1, e.Checkouts())
+}
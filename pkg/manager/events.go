@@ -0,0 +1,36 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultResyncInterval is how often the compliance check runs in event-driven mode if no interval is configured
+	DefaultResyncInterval = 2 * time.Minute
+	// DefaultDebounce is how long to wait for further changes after a trigger if no debounce is configured
+	DefaultDebounce = 5 * time.Second
+)
+
+// TriggerCheck requests a compliance check because of reason, such as a node being added to rancher. The check runs once
+// the debounce period has passed, so a burst of triggers results in a single check. Does nothing unless the manager is
+// event-driven, and never blocks
+func (m *AWS) TriggerCheck(reason string) {
+	if !m.eventDriven {
+		return
+	}
+	select {
+	case m.triggers <- reason:
+	default:
+		logrus.Debugf("compliance check already pending, not triggering again for %s", reason)
+	}
+}
+
+// tickerInterval gives how often the compliance check runs without a trigger
+func (m *AWS) tickerInterval() time.Duration {
+	if m.eventDriven {
+		return m.resyncInterval
+	}
+	return m.interval
+}
@@ -0,0 +1,91 @@
+package manager
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rancher/csp-adapter/pkg/metrics"
+	"github.com/rancher/csp-adapter/pkg/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingScraper reports nodes, counting how many times it was scraped
+type countingScraper struct {
+	nodes   atomic.Int32
+	scrapes atomic.Int32
+}
+
+func (c *countingScraper) ScrapeAndParse(ctx context.Context) (*metrics.NodeCounts, error) {
+	c.scrapes.Add(1)
+	return &metrics.NodeCounts{Total: int(c.nodes.Load())}, nil
+}
+
+func TestEventDrivenChecks(t *testing.T) {
+	scraper := &countingScraper{}
+	scraper.nodes.Store(20)
+	m := NewAWS(mocks.NewMockAWSClient(5), mocks.NewMockK8sClient(nil), scraper, Options{
+		EventDriven:    true,
+		ResyncInterval: time.Hour,
+		Debounce:       20 * time.Millisecond,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 10)
+	m.Start(ctx, errs)
+
+	// a burst of changes results in a single check once they settle
+	for i := 0; i < 5; i++ {
+		m.TriggerCheck("test change")
+	}
+	assert.Eventually(t, func() bool { return scraper.scrapes.Load() == 1 }, time.Second, 5*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), scraper.scrapes.Load(), "expected triggers to be debounced into a single check")
+
+	m.TriggerCheck("another change")
+	assert.Eventually(t, func() bool { return scraper.scrapes.Load() == 2 }, time.Second, 5*time.Millisecond)
+	assert.Empty(t, errs)
+}
+
+func TestTriggerIgnoredWithoutEventDriven(t *testing.T) {
+	m := NewAWS(mocks.NewMockAWSClient(5), mocks.NewMockK8sClient(nil), mocks.NewMockScraper(0), Options{})
+	m.TriggerCheck("test change")
+	assert.Empty(t, m.triggers)
+	assert.Equal(t, DefaultInterval, m.tickerInterval())
+}
+
+// blockingScraper blocks each scrape until the context is done, as a hung rancher would
+type blockingScraper struct {
+	started chan struct{}
+}
+
+func (b *blockingScraper) ScrapeAndParse(ctx context.Context) (*metrics.NodeCounts, error) {
+	close(b.started)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestShutdownCancelsCheck(t *testing.T) {
+	scraper := &blockingScraper{started: make(chan struct{})}
+	k8sClient := mocks.NewMockK8sClient(nil)
+	m := NewAWS(mocks.NewMockAWSClient(5), k8sClient, scraper, Options{
+		EventDriven:    true,
+		ResyncInterval: time.Hour,
+		Debounce:       time.Millisecond,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 10)
+	m.Start(ctx, errs)
+	m.TriggerCheck("test change")
+	select {
+	case <-scraper.started:
+	case <-time.After(time.Second):
+		t.Fatal("expected a compliance check to start")
+	}
+
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, errs, "expected a check cancelled by shutdown not to be reported as failed")
+	assert.Empty(t, k8sClient.CurrentSupportConfig)
+}
@@ -0,0 +1,51 @@
+package manager
+
+import (
+	"context"
+
+	"github.com/rancher/csp-adapter/pkg/history"
+	"github.com/rancher/csp-adapter/pkg/redact"
+)
+
+// History returns the ring holding the decisions of the most recent compliance checks
+func (m *AWS) History() *history.Ring {
+	return m.history
+}
+
+// recordAction adds a call to aws made by the compliance check in ctx to its decision. token is the consumption token
+// the call resulted in, or checked in, and is recorded by its id so that the decision holds no secrets
+func recordAction(ctx context.Context, actionType history.ActionType, licenseArn string, entitlements int, token string, err error) {
+	action := history.Action{
+		Type:         actionType,
+		LicenseArn:   licenseArn,
+		Entitlements: entitlements,
+		TokenID:      redact.TokenID(token),
+	}
+	if err != nil {
+		action.Error = err.Error()
+	}
+	history.AddAction(ctx, action)
+}
+
+// historyLicenses converts the licenses found by a compliance check to those recorded in its decision
+func historyLicenses(usable, unusable []licenseState) []history.License {
+	licenses := make([]history.License, 0, len(usable)+len(unusable))
+	for _, state := range usable {
+		licenses = append(licenses, history.License{Arn: state.arn(), Usable: true})
+	}
+	for _, state := range unusable {
+		licenses = append(licenses, history.License{Arn: state.arn(), Reason: state.validity.Reason})
+	}
+	return licenses
+}
+
+// tokenIDs gives the ids of the consumption tokens held by checkouts
+func tokenIDs(checkouts []licenseCheckoutInfo) []string {
+	ids := make([]string, 0, len(checkouts))
+	for _, checkout := range checkouts {
+		if checkout.ConsumptionToken != "" {
+			ids = append(ids, redact.TokenID(checkout.ConsumptionToken))
+		}
+	}
+	return ids
+}
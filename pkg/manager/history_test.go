@@ -0,0 +1,64 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/rancher/csp-adapter/pkg/clients/aws"
+	"github.com/rancher/csp-adapter/pkg/history"
+	"github.com/rancher/csp-adapter/pkg/logging"
+	"github.com/rancher/csp-adapter/pkg/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComplianceCheckRecordsDecision(t *testing.T) {
+	m := NewAWS(mocks.NewMockAWSClient(5), mocks.NewMockK8sClient(nil), mocks.NewMockScraper(40), Options{})
+	ctx := logging.WithRunID(context.Background(), "run-1")
+	require.NoError(t, m.runComplianceCheck(ctx))
+	require.NoError(t, m.runComplianceCheck(logging.WithRunID(context.Background(), "run-2")))
+
+	decisions := m.History().List(0)
+	require.Len(t, decisions, 2)
+	assert.Equal(t, "run-2", decisions[0].RunID)
+	first := decisions[1]
+	assert.Equal(t, "run-1", first.RunID)
+	assert.Equal(t, 40, first.Inputs.Nodes)
+	assert.Equal(t, 40, first.Inputs.LicensedNodes)
+	assert.Equal(t, string(UsageStrategyInstantaneous), first.Inputs.UsageStrategy)
+	assert.Equal(t, 2, first.Inputs.RequiredLicenses)
+	assert.Equal(t, map[string]int{aws.DefaultDimension: 2}, first.Inputs.RequiredDimensions)
+	assert.Empty(t, first.Inputs.CachedTokens)
+	require.Len(t, first.Inputs.Licenses, 1)
+	assert.True(t, first.Inputs.Licenses[0].Usable)
+	require.Len(t, first.Actions, 1)
+	assert.Equal(t, history.ActionCheckout, first.Actions[0].Type)
+	assert.Equal(t, 2, first.Actions[0].Entitlements)
+	assert.NotEmpty(t, first.Actions[0].TokenID)
+	assert.Empty(t, first.Actions[0].Error)
+	assert.Equal(t, history.Result{InCompliance: true, CheckedOut: 2, CheckedOutDimensions: map[string]int{aws.DefaultDimension: 2}}, first.Result)
+	assert.False(t, first.End.Before(first.Start))
+
+	// the second check finds the checkout cached by the first, and has nothing to change
+	assert.Equal(t, []string{first.Actions[0].TokenID}, decisions[0].Inputs.CachedTokens)
+	assert.Empty(t, decisions[0].Actions)
+}
+
+func TestComplianceCheckRecordsFailure(t *testing.T) {
+	awsClient := mocks.NewMockAWSClient(5)
+	awsClient.CheckoutResponseErr = fmt.Errorf("connection reset")
+	m := NewAWS(awsClient, mocks.NewMockK8sClient(nil), mocks.NewMockScraper(40), Options{})
+	checkErr := m.runComplianceCheck(context.Background())
+	require.Error(t, checkErr)
+
+	decisions := m.History().List(0)
+	require.Len(t, decisions, 1)
+	assert.Equal(t, 2, decisions[0].Inputs.RequiredLicenses)
+	require.Len(t, decisions[0].Actions, 1)
+	assert.Equal(t, history.ActionCheckout, decisions[0].Actions[0].Type)
+	assert.Equal(t, "connection reset", decisions[0].Actions[0].Error)
+	assert.Empty(t, decisions[0].Actions[0].TokenID)
+	assert.Equal(t, checkErr.Error(), decisions[0].Result.Error)
+	assert.False(t, decisions[0].Result.InCompliance)
+}
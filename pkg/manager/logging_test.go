@@ -0,0 +1,46 @@
+package manager
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/rancher/csp-adapter/pkg/logging"
+	"github.com/rancher/csp-adapter/pkg/mocks"
+	"github.com/rancher/csp-adapter/pkg/redact"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComplianceCheckLogsShareRunID(t *testing.T) {
+	logs := captureLogs(t, redact.New())
+	formatter := logrus.StandardLogger().Formatter
+	require.NoError(t, logging.Configure(logging.FormatJSON))
+	t.Cleanup(func() { logrus.SetFormatter(formatter) })
+
+	m := NewAWS(mocks.NewMockAWSClient(5), mocks.NewMockK8sClient(nil), mocks.NewMockScraper(40), Options{})
+	ctx := logging.WithRunID(context.Background(), "run-1")
+	require.NoError(t, m.runComplianceCheck(ctx))
+
+	// other tests leave managers running in the background, so only the entries of this run are looked at
+	var messages, operations []string
+	scanner := bufio.NewScanner(logs)
+	for scanner.Scan() {
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		if entry[logging.RunIDField] != "run-1" {
+			continue
+		}
+		messages = append(messages, entry[logrus.FieldKeyMsg].(string))
+		if operation, ok := entry[logging.OperationField].(string); ok {
+			operations = append(operations, operation)
+			assert.Equal(t, logging.OutcomeSuccess, entry[logging.OutcomeField])
+			assert.Contains(t, entry, logging.DurationField)
+		}
+	}
+	assert.Contains(t, messages, "found 40 nodes from rancher metrics")
+	assert.Contains(t, messages, "counted 40 nodes for RKE_NODE_SUPP, have 0 entitlements checked out, need 2")
+	assert.Contains(t, operations, "manager.ComplianceCheck")
+}
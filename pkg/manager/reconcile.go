@@ -0,0 +1,216 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/rancher/csp-adapter/pkg/clients/aws"
+	"github.com/rancher/csp-adapter/pkg/logging"
+	apierror "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	// legacyTokenJournalKey is the key in the usage configmap that older versions stored the journal of checkouts under,
+	// before it moved to a configmap of its own
+	legacyTokenJournalKey = "tokenJournal"
+)
+
+// getTokenJournal retrieves the checkouts recorded in the journal which may not have expired yet. The journal is kept
+// apart from the consumption token secret so that checkouts can be recovered if the secret is lost
+func (m *AWS) getTokenJournal(ctx context.Context) ([]licenseCheckoutInfo, error) {
+	live, _, err := m.loadTokenJournal(ctx)
+	return live, err
+}
+
+// loadTokenJournal gives the unexpired checkouts in the journal, and whether it was read from where older versions kept
+// it, see readTokenJournal
+func (m *AWS) loadTokenJournal(ctx context.Context) (live []licenseCheckoutInfo, legacy bool, err error) {
+	raw, legacy, err := m.readTokenJournal(ctx)
+	if err != nil || raw == "" {
+		return nil, legacy, err
+	}
+	var journal []licenseCheckoutInfo
+	if err := json.Unmarshal([]byte(raw), &journal); err != nil {
+		return nil, legacy, fmt.Errorf("unable to parse token journal: %v", err)
+	}
+	m.addTokens(journal)
+	for _, entry := range journal {
+		if entry.Expiry.After(time.Now()) {
+			live = append(live, entry)
+		}
+	}
+	return live, legacy, nil
+}
+
+// readTokenJournal reads the journal, falling back to the usage configmap older versions kept it in. legacy is true if
+// it was read from there
+func (m *AWS) readTokenJournal(ctx context.Context) (raw string, legacy bool, err error) {
+	raw, err = m.k8s.GetTokenJournal(ctx)
+	if err != nil || raw != "" {
+		return raw, false, err
+	}
+	data, err := m.k8s.GetUsageData(ctx)
+	if apierror.IsNotFound(err) {
+		// nothing has been recorded yet
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	raw = data[legacyTokenJournalKey]
+	return raw, raw != "", nil
+}
+
+// saveTokenJournal adds the checkouts which can be recovered by their client token to the journal. Earlier entries are
+// kept until they expire, unless they have since been checked in, since their checkouts may still be held in aws
+func (m *AWS) saveTokenJournal(ctx context.Context, checkouts []licenseCheckoutInfo) error {
+	previous, legacy, err := m.loadTokenJournal(ctx)
+	if err != nil {
+		logging.FromContext(ctx).Warnf("unable to read the token journal, earlier entries will be dropped: %v", err)
+		previous = nil
+	}
+	journal := []licenseCheckoutInfo{}
+	seen := map[string]bool{}
+	for _, checkout := range checkouts {
+		if checkout.ClientToken != "" {
+			journal = append(journal, checkout)
+			seen[checkout.ClientToken] = true
+		}
+	}
+	for _, entry := range previous {
+		if !seen[entry.ClientToken] && !m.checkedIn[entry.ClientToken] {
+			journal = append(journal, entry)
+		}
+	}
+	marshalled, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+	if err := m.k8s.UpdateTokenJournal(ctx, string(marshalled)); err != nil {
+		return err
+	}
+	if legacy {
+		// the entries have been carried over, so the usage configmap no longer needs to hold them
+		if err := m.k8s.UpdateUsageData(ctx, legacyTokenJournalKey, ""); err != nil {
+			logging.FromContext(ctx).Warnf("unable to remove the token journal from the usage configmap: %v", err)
+		}
+	}
+	m.checkedIn = map[string]bool{}
+	return nil
+}
+
+// reconcileOrphans recovers checkouts which the journal shows this adapter made, but which are missing from the cache,
+// for example because the consumption token secret was deleted or corrupted. For each usable license where aws reports
+// more entitlements consumed than the cache accounts for, the journaled checkouts are repeated with their client token to
+// get them back from aws. They are adopted if the cache holds nothing for the license, and checked in otherwise, so that
+// entitlements aren't consumed twice while the orphaned tokens wait to expire. Only entries which fit within the
+// unaccounted consumption are repeated. aws answers a repeat with the original response while the checkout is held, so its
+// consumption token may be one which extending the checkout has since replaced. Whether the repeat found the journaled
+// checkout is told from the license's consumption instead, and a repeat which consumed more is checked in, since the
+// original checkout was no longer held
+func (m *AWS) reconcileOrphans(ctx context.Context) error {
+	journal, err := m.getTokenJournal(ctx)
+	if err != nil {
+		return err
+	}
+	if len(journal) == 0 {
+		return nil
+	}
+	checkouts, err := m.getLicenseCheckouts(ctx)
+	if err != nil {
+		logging.FromContext(ctx).Warnf("unable to get current license consumption info, treating every journaled checkout as orphaned: %v", err)
+		checkouts = nil
+	}
+	usable, _, _, err := m.getLicenses(ctx, time.Now())
+	if err != nil {
+		return fmt.Errorf("unable to get rancher license, err: %v", err)
+	}
+
+	// matched by client token, which, unlike the consumption token, stays the same when a checkout is extended
+	cached := map[string]bool{}
+	for _, checkout := range checkouts {
+		if checkout.ClientToken != "" {
+			cached[checkout.ClientToken] = true
+		}
+	}
+	var adopted []licenseCheckoutInfo
+	for _, state := range usable {
+		for _, dimension := range m.dimensions {
+			if !aws.HasDimension(state.license, dimension.Name) {
+				continue
+			}
+			ofDimension, _ := checkoutsOf(checkouts, dimension.Name)
+			held := entitledFrom(ofDimension, state.arn())
+			consumed, err := m.client(state).GetNumberOfConsumedEntitlements(ctx, state.license, dimension.Name)
+			if err != nil {
+				logging.FromContext(ctx).Warnf("unable to get consumed %s entitlements for license %s, skipping reconciliation: %v", dimension.Name, state.arn(), err)
+				continue
+			}
+			if consumed <= held {
+				// everything consumed from the license is accounted for, whatever else is consumed belongs to someone else
+				continue
+			}
+			logging.FromContext(ctx).Infof("license %s has %d %s entitlement(s) consumed but %d cached, looking for orphaned checkouts", state.arn(), consumed, dimension.Name, held)
+			unaccounted := consumed - held
+			for _, entry := range journal {
+				if entry.LicenseArn != state.arn() || entry.dimension() != dimension.Name || cached[entry.ClientToken] {
+					continue
+				}
+				if entry.EntitledLicenses > unaccounted {
+					// the entry can't be among what aws reports consumed, so it has already been checked in or has expired
+					logging.FromContext(ctx).Debugf("skipping journaled checkout of %d license(s) from %s, only %d are unaccounted for", entry.EntitledLicenses, entry.LicenseArn, unaccounted)
+					continue
+				}
+				intent := checkoutIntent{LicenseArn: entry.LicenseArn, Dimension: entry.Dimension, ClientToken: entry.ClientToken, EntitledLicenses: entry.EntitledLicenses}
+				recovered, err := m.checkout(ctx, state, intent)
+				if err != nil {
+					logging.FromContext(ctx).Warnf("unable to recover orphaned checkout from license %s: %v", entry.LicenseArn, err)
+					continue
+				}
+				if recovered.ConsumptionToken != entry.ConsumptionToken && m.consumedMore(ctx, state, dimension.Name, consumed) {
+					// aws only returns the original checkout for a client token while it is live, so more being consumed
+					// means the repeat made a new checkout, which is returned rather than consumed twice
+					logging.FromContext(ctx).Infof("journaled checkout from %s is no longer held, returning the new checkout made to recover it", entry.LicenseArn)
+					m.checkInAll(ctx, []licenseCheckoutInfo{recovered})
+					continue
+				}
+				// the journal has the checkout's current consumption token and expiry, which the repeat may not
+				unaccounted -= entry.EntitledLicenses
+				if held == 0 {
+					logging.FromContext(ctx).Infof("adopting orphaned checkout of %d license(s) from %s", entry.EntitledLicenses, entry.LicenseArn)
+					adopted = append(adopted, entry)
+					continue
+				}
+				logging.FromContext(ctx).Infof("checking in orphaned checkout of %d license(s) from %s", entry.EntitledLicenses, entry.LicenseArn)
+				m.checkInAll(ctx, []licenseCheckoutInfo{entry})
+				consumed -= entry.EntitledLicenses
+			}
+		}
+	}
+	if len(adopted) == 0 {
+		return nil
+	}
+	intents, err := m.getCheckoutIntents(ctx)
+	if err != nil {
+		logging.FromContext(ctx).Warnf("unable to get checkout intents, they will not be retried: %v", err)
+		intents = nil
+	}
+	checkouts = append(checkouts, adopted...)
+	if err := m.saveCheckouts(ctx, checkouts, intents); err != nil {
+		return fmt.Errorf("unable to save adopted checkouts: %v", err)
+	}
+	return m.saveTokenJournal(ctx, checkouts)
+}
+
+// consumedMore reports whether more entitlements of dimension are consumed from the license in state than were before.
+// If the consumption can't be read, it is assumed to have grown, so that a new checkout is never kept by mistake
+func (m *AWS) consumedMore(ctx context.Context, state licenseState, dimension string, before int) bool {
+	after, err := m.client(state).GetNumberOfConsumedEntitlements(ctx, state.license, dimension)
+	if err != nil {
+		logging.FromContext(ctx).Warnf("unable to get consumed %s entitlements for license %s: %v", dimension, state.arn(), err)
+		return true
+	}
+	return after > before
+}
@@ -0,0 +1,122 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rancher/csp-adapter/pkg/clients/aws"
+	"github.com/rancher/csp-adapter/pkg/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconcileOrphans(t *testing.T) {
+	tests := []struct {
+		name               string // name of the test, to be displayed on failure
+		maxEntitlements    int    // max entitlements of the license
+		rerunBeforeRestart bool   // if a compliance check runs after the cache is lost but before the restart
+		expectedConsumed   int    // entitlements expected to be consumed from the license after reconciliation
+		expectedCached     int    // entitlements expected to be held in the cache after reconciliation
+	}{
+		{
+			name:             "orphans adopted when the cache is lost",
+			maxEntitlements:  5,
+			expectedConsumed: 2,
+			expectedCached:   2,
+		},
+		{
+			name:               "orphans checked in when the cache was rebuilt",
+			maxEntitlements:    5,
+			rerunBeforeRestart: true,
+			expectedConsumed:   2,
+			expectedCached:     2,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			mockAWSClient := mocks.NewMockAWSClient(test.maxEntitlements)
+			mockK8sClient := mocks.NewMockK8sClient(nil)
+			m := NewAWS(mockAWSClient, mockK8sClient, mocks.NewMockScraper(40), Options{})
+			arn := *mockAWSClient.Licenses[0].LicenseArn
+			assert.NoError(t, m.runComplianceCheck(context.TODO()))
+			assert.Equal(t, 2, mockAWSClient.CheckedOutForLicense(arn))
+
+			// the cache secret is deleted
+			mockK8sClient.CurrentSecretData = nil
+			if test.rerunBeforeRestart {
+				assert.NoError(t, m.runComplianceCheck(context.TODO()))
+				assert.Equal(t, 4, mockAWSClient.CheckedOutForLicense(arn), "expected the lost checkout to be consumed twice")
+			}
+
+			assert.NoError(t, m.reconcileOrphans(context.TODO()))
+			assert.Equal(t, test.expectedConsumed, mockAWSClient.CheckedOutForLicense(arn))
+			checkouts, err := m.getLicenseCheckouts(context.TODO())
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectedCached, totalEntitled(checkouts))
+
+			// the next check finds everything it needs already held
+			assert.NoError(t, m.runComplianceCheck(context.TODO()))
+			assert.Equal(t, test.expectedConsumed, mockAWSClient.CheckedOutForLicense(arn))
+		})
+	}
+}
+
+func TestReconcileIgnoresOtherConsumers(t *testing.T) {
+	mockAWSClient := mocks.NewMockAWSClient(5)
+	mockK8sClient := mocks.NewMockK8sClient(nil)
+	m := NewAWS(mockAWSClient, mockK8sClient, mocks.NewMockScraper(40), Options{})
+	arn := *mockAWSClient.Licenses[0].LicenseArn
+	assert.NoError(t, m.runComplianceCheck(context.TODO()))
+
+	// another adapter in the account consumes from the same license
+	_, err := mockAWSClient.CheckoutRancherLicense(context.TODO(), mockAWSClient.Licenses[0], aws.DefaultDimension, 2, "other-adapter")
+	assert.NoError(t, err)
+	assert.NoError(t, m.reconcileOrphans(context.TODO()))
+	assert.Equal(t, 4, mockAWSClient.CheckedOutForLicense(arn), "expected another consumer's checkout to be left alone")
+}
+
+func TestReconcileSkipsCheckoutsNoLongerHeld(t *testing.T) {
+	mockAWSClient := mocks.NewMockAWSClient(5)
+	mockK8sClient := mocks.NewMockK8sClient(nil)
+	m := NewAWS(mockAWSClient, mockK8sClient, mocks.NewMockScraper(40), Options{})
+	arn := *mockAWSClient.Licenses[0].LicenseArn
+	assert.NoError(t, m.runComplianceCheck(context.TODO()))
+	checkouts, err := m.getLicenseCheckouts(context.TODO())
+	require.NoError(t, err)
+
+	// the checkout is returned by a process which restarts before the journal is updated, and the cache is lost
+	_, err = mockAWSClient.CheckInRancherLicense(context.TODO(), checkouts[0].ConsumptionToken)
+	require.NoError(t, err)
+	mockK8sClient.CurrentSecretData = nil
+	// while another consumer's checkout leaves consumption unaccounted for
+	_, err = mockAWSClient.CheckoutRancherLicense(context.TODO(), mockAWSClient.Licenses[0], aws.DefaultDimension, 2, "other-adapter")
+	require.NoError(t, err)
+
+	assert.NoError(t, m.reconcileOrphans(context.TODO()))
+	assert.Equal(t, 2, mockAWSClient.CheckedOutForLicense(arn), "expected the journaled checkout not to be consumed again")
+	// nothing was adopted, so the cache is still missing
+	checkouts, _ = m.getLicenseCheckouts(context.TODO())
+	assert.Empty(t, checkouts)
+}
+
+func TestLegacyTokenJournal(t *testing.T) {
+	mockK8sClient := mocks.NewMockK8sClient(nil)
+	m := NewAWS(mocks.NewMockAWSClient(5), mockK8sClient, mocks.NewMockScraper(40), Options{})
+	expiry := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	legacy := []licenseCheckoutInfo{{LicenseArn: "arn", ConsumptionToken: "legacy-consumption-token", ClientToken: "legacy-client-token", EntitledLicenses: 1, Expiry: expiry}}
+	marshalled, err := json.Marshal(legacy)
+	require.NoError(t, err)
+	// older versions kept the journal in the usage configmap
+	mockK8sClient.CurrentUsageData = map[string]string{legacyTokenJournalKey: string(marshalled)}
+
+	journal, err := m.getTokenJournal(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, legacy, journal)
+
+	require.NoError(t, m.saveTokenJournal(context.TODO(), nil))
+	assert.Empty(t, mockK8sClient.CurrentUsageData[legacyTokenJournalKey], "expected the journal to be removed from the usage configmap")
+	assert.Contains(t, mockK8sClient.CurrentTokenJournal, "legacy-client-token", "expected the journal to be carried over")
+}
@@ -0,0 +1,113 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	lm "github.com/aws/aws-sdk-go-v2/service/licensemanager"
+	"github.com/rancher/csp-adapter/pkg/alert"
+	"github.com/rancher/csp-adapter/pkg/mocks"
+	"github.com/rancher/csp-adapter/pkg/output"
+	"github.com/rancher/csp-adapter/pkg/redact"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// leakyAWSClient fails to extend checkouts with an error which includes the consumption token, as errors from aws can
+type leakyAWSClient struct {
+	*mocks.MockAWSClient
+}
+
+func (l *leakyAWSClient) ExtendRancherLicenseConsumptionToken(ctx context.Context, consumptionToken string) (*lm.ExtendLicenseConsumptionOutput, error) {
+	return nil, fmt.Errorf("consumption token %s has expired", consumptionToken)
+}
+
+// captureLogs sends the logs written during the test to the returned buffer, masked by redactor
+func captureLogs(t *testing.T, redactor *redact.Redactor) *bytes.Buffer {
+	logger := logrus.StandardLogger()
+	var buf bytes.Buffer
+	level, out := logger.GetLevel(), logger.Out
+	hooks := logger.ReplaceHooks(logrus.LevelHooks{})
+	logger.AddHook(redact.NewHook(redactor))
+	logger.SetOutput(&buf)
+	logger.SetLevel(logrus.DebugLevel)
+	t.Cleanup(func() {
+		logger.ReplaceHooks(hooks)
+		logger.SetOutput(out)
+		logger.SetLevel(level)
+	})
+	return &buf
+}
+
+// alertBodies starts a local webhook, returning an alerter which sends to it and a func giving the bodies received
+func alertBodies(t *testing.T) (*alert.Alerter, func() string) {
+	var mu sync.Mutex
+	var received bytes.Buffer
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		_, _ = io.Copy(&received, r.Body)
+	}))
+	t.Cleanup(server.Close)
+	webhook, err := alert.NewWebhook(server.URL, "", nil, time.Second)
+	require.NoError(t, err)
+	return alert.New([]alert.Sender{webhook}, time.Hour), func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return received.String()
+	}
+}
+
+func TestNoSecretsInOutputs(t *testing.T) {
+	redactor := redact.New()
+	redactor.RedactAccounts(true)
+	logs := captureLogs(t, redactor)
+	alerter, alerts := alertBodies(t)
+	alerter.SetRedactor(redactor)
+	var sink bytes.Buffer
+
+	awsClient := mocks.NewMockAWSClient(5)
+	k8sClient := mocks.NewMockK8sClient(nil)
+	m := NewAWS(awsClient, k8sClient, mocks.NewMockScraper(40), Options{
+		Sinks:    []output.Sink{output.NewStreamSink("buffer", &sink)},
+		Alerter:  alerter,
+		Redactor: redactor,
+	})
+	require.NoError(t, m.runComplianceCheck(context.TODO()))
+	checkouts, err := m.getLicenseCheckouts(context.TODO())
+	require.NoError(t, err)
+	require.NotEmpty(t, checkouts)
+
+	// extend with a client which leaks the token into its error, which is logged and alerted on
+	m.accounts[0] = &leakyAWSClient{MockAWSClient: awsClient}
+	assert.Empty(t, m.extendCheckouts(context.TODO(), time.Hour*24, checkouts))
+	require.NoError(t, m.runComplianceCheck(context.TODO()))
+
+	outputs := map[string]string{
+		"logs":         logs.String(),
+		"alerts":       alerts(),
+		"sink":         sink.String(),
+		"config":       string(k8sClient.CurrentSupportConfig),
+		"notification": k8sClient.CurrentNotificationMessage,
+		"warning":      k8sClient.CurrentWarningMessage,
+	}
+	require.Contains(t, outputs["logs"], redact.TokenReplacement(checkouts[0].ConsumptionToken),
+		"expected the leaked token to reach the logs masked")
+	for name, content := range outputs {
+		for _, checkout := range checkouts {
+			assert.NotContains(t, content, checkout.ConsumptionToken, "expected no consumption token in %s", name)
+		}
+	}
+	for _, name := range []string{"logs", "alerts", "sink"} {
+		assert.NotContains(t, outputs[name], awsClient.AccountNumber(), "expected no account number in %s", name)
+	}
+	assert.Contains(t, outputs["config"], awsClient.AccountNumber(), "expected the support config to keep the account number")
+}
@@ -0,0 +1,58 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher/csp-adapter/pkg/ledger"
+	"github.com/rancher/csp-adapter/pkg/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// maxConfigMapBytes is the most data kubernetes stores in a single object
+const maxConfigMapBytes = 1024 * 1024
+
+func TestUsageConfigMapFitsAtMaximums(t *testing.T) {
+	k8sClient := mocks.NewMockK8sClient(nil)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 123456789, time.UTC)
+
+	// a full ledger where every check differs from the last, so that none were merged, with large counts so that entries
+	// are as big as they get
+	var full []ledger.Entry
+	for i := 0; i < ledger.DefaultMaxEntries; i++ {
+		at := start.Add(time.Duration(i) * time.Minute)
+		full = append(full, ledger.Entry{Start: at, End: at, Checks: 100000, Nodes: 100000 + i, RequiredLicenses: 10000, CheckedOut: 10000, TokenID: ledger.TokenID(strings.Repeat("a", 40)), Status: "NotCompliant"})
+	}
+	marshalled, err := json.Marshal(full)
+	require.NoError(t, err)
+	k8sClient.CurrentUsageData = map[string]string{"ledger": string(marshalled)}
+	l := ledger.New(k8sClient, 100*365*24*time.Hour, ledger.DefaultMaxEntries)
+	require.NoError(t, l.Record(context.TODO(), ledger.Check{
+		Time:             start.Add(ledger.DefaultMaxEntries * time.Minute),
+		Nodes:            100000 + ledger.DefaultMaxEntries,
+		ConsumptionToken: strings.Repeat("b", 40),
+		Status:           "NotCompliant",
+	}))
+
+	// a sample in every bucket of a long window
+	window := 30 * 24 * time.Hour
+	store := newUsageStore(k8sClient, UsageStrategyRollingMax, window)
+	for i := 0; i < maxUsageBuckets; i++ {
+		store.record(context.TODO(), start.Add(time.Duration(i)*store.bucketDuration()), 100000+i)
+	}
+
+	size := 0
+	for key, value := range k8sClient.CurrentUsageData {
+		size += len(key) + len(value)
+	}
+	// leave room for the configmap's metadata
+	assert.Less(t, size, maxConfigMapBytes-16*1024, "expected the usage configmap to fit at its maximums")
+	entries, err := l.Entries(context.TODO(), time.Time{}, time.Time{})
+	require.NoError(t, err)
+	assert.Less(t, len(entries), ledger.DefaultMaxEntries, "expected the oldest entries to be dropped to fit")
+	assert.Equal(t, 100000+ledger.DefaultMaxEntries, entries[len(entries)-1].Nodes, "expected the newest entry to be kept")
+}
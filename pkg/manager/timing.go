@@ -0,0 +1,60 @@
+package manager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultInterval is how often the compliance check runs if no interval is configured
+	DefaultInterval = 30 * time.Second
+	// DefaultExtensionLeadTime is how long before a checkout expires that it is extended if no lead time is configured
+	DefaultExtensionLeadTime = 5 * DefaultInterval
+	// TokenLifetime is how long aws holds a checkout before returning it if it isn't extended
+	TokenLifetime = time.Hour
+)
+
+// ValidateTiming checks that checkouts made with the extension leadTime will be extended by a compliance check that runs
+// every interval before they expire. leadTime must be longer than interval, so that a run always happens within the lead
+// time, and no more than half the token lifetime, so that a checkout isn't extended on every run
+func ValidateTiming(interval, leadTime time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("compliance interval must be a positive duration, got %s", interval)
+	}
+	if leadTime <= interval {
+		return fmt.Errorf("extension lead time %s must be longer than the compliance interval %s", leadTime, interval)
+	}
+	if leadTime > TokenLifetime/2 {
+		return fmt.Errorf("extension lead time %s must be no more than half of the %s token lifetime", leadTime, TokenLifetime)
+	}
+	return nil
+}
+
+// observeTokenLifetime records the lifetime of a token that aws issued or extended at issued until expiry. It must only
+// be given tokens aws has just issued, not checkouts returned again for a client token, whose expiry is set by the
+// original checkout
+func (m *AWS) observeTokenLifetime(issued, expiry time.Time) {
+	if lifetime := expiry.Sub(issued); lifetime > 0 {
+		m.tokenLifetime = lifetime
+	}
+}
+
+// effectiveLeadTime gives the lead time to extend checkouts with. If aws issues tokens with a shorter lifetime than
+// expected, the configured lead time is capped at half of it so checkouts are still extended before they expire
+func (m *AWS) effectiveLeadTime() time.Duration {
+	if m.tokenLifetime == 0 || m.extensionLeadTime <= m.tokenLifetime/2 {
+		return m.extensionLeadTime
+	}
+	leadTime := m.tokenLifetime / 2
+	if !m.leadTimeCapped {
+		logrus.Warnf("extension lead time %s is too long for the %s token lifetime returned by aws, using %s",
+			m.extensionLeadTime, m.tokenLifetime.Round(time.Second), leadTime.Round(time.Second))
+		if leadTime <= m.interval {
+			logrus.Warnf("the compliance interval %s is too long to extend checkouts before they expire", m.interval)
+		}
+		m.leadTimeCapped = true
+	}
+	return leadTime
+}
@@ -0,0 +1,80 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rancher/csp-adapter/pkg/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateTiming(t *testing.T) {
+	tests := []struct {
+		name     string        // name of the test, to be displayed on failure
+		interval time.Duration // compliance interval to validate
+		leadTime time.Duration // extension lead time to validate
+		valid    bool          // if the timing should be accepted
+	}{
+		{
+			name:     "defaults",
+			interval: DefaultInterval,
+			leadTime: DefaultExtensionLeadTime,
+			valid:    true,
+		},
+		{
+			name:     "slower polling",
+			interval: 5 * time.Minute,
+			leadTime: 15 * time.Minute,
+			valid:    true,
+		},
+		{
+			name:     "lead time within interval",
+			interval: 5 * time.Minute,
+			leadTime: 5 * time.Minute,
+			valid:    false,
+		},
+		{
+			name:     "lead time close to token lifetime",
+			interval: time.Minute,
+			leadTime: 45 * time.Minute,
+			valid:    false,
+		},
+		{
+			name:     "zero interval",
+			interval: 0,
+			leadTime: time.Minute,
+			valid:    false,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateTiming(test.interval, test.leadTime)
+			if test.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestEffectiveLeadTime(t *testing.T) {
+	m := NewAWS(mocks.NewMockAWSClient(1), mocks.NewMockK8sClient(nil), mocks.NewMockScraper(0), Options{
+		Interval:          time.Minute,
+		ExtensionLeadTime: 10 * time.Minute,
+	})
+	assert.Equal(t, 10*time.Minute, m.effectiveLeadTime(), "expected the configured lead time before any token is seen")
+
+	now := time.Now()
+	m.observeTokenLifetime(now, now.Add(time.Hour))
+	assert.Equal(t, 10*time.Minute, m.effectiveLeadTime())
+
+	// a token issued earlier has less time left than its lifetime
+	m.observeTokenLifetime(now.Add(-50*time.Minute), now.Add(10*time.Minute))
+	assert.Equal(t, 10*time.Minute, m.effectiveLeadTime(), "expected the lifetime to be measured from when the token was issued")
+
+	// aws issues tokens with a much shorter lifetime than expected
+	m.observeTokenLifetime(now, now.Add(10*time.Minute))
+	assert.Equal(t, 5*time.Minute, m.effectiveLeadTime())
+}
@@ -1,6 +1,7 @@
 package manager
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
@@ -12,6 +13,8 @@ type CSPSupportConfig struct {
 	Platform        string         `json:"platform"`
 	Product         string         `json:"product"`
 	CSP             CSPInfo        `json:"csp"`
+	Licenses        []LicenseInfo  `json:"licenses,omitempty"`
+	Accounts        []AccountUsage `json:"accounts,omitempty"`
 	Compliance      ComplianceInfo `json:"compliance"`
 }
 
@@ -28,14 +31,41 @@ const (
 	awsSupportConfigCSP = "EC2"
 )
 
+// LicenseInfo describes a license in the CSP that nodes can be licensed with
+type LicenseInfo struct {
+	Arn        string `json:"arn"`
+	Account    string `json:"account,omitempty"`
+	ProductSKU string `json:"product_sku,omitempty"`
+	Status     string `json:"status,omitempty"`
+	ValidFrom  string `json:"valid_from,omitempty"`
+	ValidUntil string `json:"valid_until,omitempty"`
+	CheckedOut int    `json:"checked_out"`
+}
+
 type ComplianceInfo struct {
-	Status  string `json:"status"`
+	Status string `json:"status"`
+	// Reason gives the cause of a non-compliant status when it's something other than too few licenses
+	Reason     string      `json:"reason,omitempty"`
+	Message    string      `json:"message"`
+	Conditions []Condition `json:"conditions,omitempty"`
+}
+
+// Condition describes a state that the user should know about even when in compliance, such as licenses running out
+type Condition struct {
+	Type    string `json:"type"`
 	Message string `json:"message"`
 }
 
+const (
+	// ConditionLowHeadroom is set when few of the nodes covered by the available licenses are unused
+	ConditionLowHeadroom = "LowHeadroom"
+	// ConditionProjectedExhaustion is set when node growth is projected to exceed the available licenses soon
+	ConditionProjectedExhaustion = "ProjectedExhaustion"
+)
+
 // GetDefaultSupportConfig produces a CSPSupportConfig with values that could be inferred from k8s
-func GetDefaultSupportConfig(client k8s.Client) CSPSupportConfig {
-	rancherVersion, err := client.GetRancherVersion()
+func GetDefaultSupportConfig(ctx context.Context, client k8s.Client) CSPSupportConfig {
+	rancherVersion, err := client.GetRancherVersion(ctx)
 	if err != nil {
 		rancherVersion = "unknown"
 	}
@@ -47,6 +77,14 @@ func GetDefaultSupportConfig(client k8s.Client) CSPSupportConfig {
 	}
 }
 
+// complianceStatus gives the status reported for inCompliance
+func complianceStatus(inCompliance bool) string {
+	if inCompliance {
+		return StatusInCompliance
+	}
+	return StatusNotInCompliance
+}
+
 func createProductString(rancherVersion string) string {
 	// rancher version that comes from k8s is prefixed with a v, but suse lists the product version without a v
 	productVersion := strings.TrimPrefix(rancherVersion, "v")
@@ -0,0 +1,213 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/rancher/csp-adapter/pkg/clients/k8s"
+	"github.com/rancher/csp-adapter/pkg/logging"
+	apierror "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// UsageStrategy determines how the node samples recorded by the manager are turned into the node count used for licensing
+type UsageStrategy string
+
+const (
+	// UsageStrategyInstantaneous licenses the node count from the most recent scrape
+	UsageStrategyInstantaneous UsageStrategy = "instantaneous"
+	// UsageStrategyRollingMax licenses the highest node count seen over the usage window
+	UsageStrategyRollingMax UsageStrategy = "rolling-max"
+	// UsageStrategyRollingAverage licenses the average node count seen over the usage window
+	UsageStrategyRollingAverage UsageStrategy = "rolling-average"
+
+	defaultUsageWindow = 24 * time.Hour
+	// maxUsageBuckets bounds the size of the persisted samples so that long windows still fit in a configmap
+	maxUsageBuckets = 1440
+	// usageSamplesKey is the key in the usage configmap that the rolling samples are stored under
+	usageSamplesKey = "samples"
+)
+
+// ParseUsageStrategy converts a user provided strategy name into a UsageStrategy. An empty name gives the default
+func ParseUsageStrategy(name string) (UsageStrategy, error) {
+	switch strategy := UsageStrategy(name); strategy {
+	case "":
+		return UsageStrategyInstantaneous, nil
+	case UsageStrategyInstantaneous, UsageStrategyRollingMax, UsageStrategyRollingAverage:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unknown usage strategy %q, must be one of %s, %s, %s", name,
+			UsageStrategyInstantaneous, UsageStrategyRollingMax, UsageStrategyRollingAverage)
+	}
+}
+
+// usageBucket aggregates every sample taken within one slice of the usage window
+type usageBucket struct {
+	Start time.Time `json:"start"`
+	Max   int       `json:"max"`
+	Sum   int       `json:"sum"`
+	Count int       `json:"count"`
+}
+
+// usageStore keeps a rolling record of node counts over a window. Samples are bucketed so that the amount of data
+// stored doesn't depend on the window length, and are persisted to k8s so that they survive a pod restart
+type usageStore struct {
+	k8s      k8s.Client
+	strategy UsageStrategy
+	window   time.Duration
+	buckets  []usageBucket
+	loaded   bool
+}
+
+func newUsageStore(k k8s.Client, strategy UsageStrategy, window time.Duration) *usageStore {
+	if strategy == "" {
+		strategy = UsageStrategyInstantaneous
+	}
+	if window <= 0 {
+		window = defaultUsageWindow
+	}
+	return &usageStore{
+		k8s:      k,
+		strategy: strategy,
+		window:   window,
+	}
+}
+
+// record adds a sample of nodes taken at now to the store, and returns the node count that should be licensed
+// according to the store's strategy
+func (u *usageStore) record(ctx context.Context, now time.Time, nodes int) int {
+	if !u.loaded {
+		// not a breaking error, we just lose the samples from before the restart
+		if err := u.load(ctx); err != nil {
+			logging.FromContext(ctx).Warnf("unable to load usage samples, starting a new window: %v", err)
+		}
+		u.loaded = true
+	}
+	u.add(now, nodes)
+	u.prune(now)
+	if err := u.save(ctx); err != nil {
+		logging.FromContext(ctx).Warnf("unable to save usage samples, samples will be lost on restart: %v", err)
+	}
+	switch u.strategy {
+	case UsageStrategyRollingMax:
+		return u.max()
+	case UsageStrategyRollingAverage:
+		return u.average()
+	default:
+		return nodes
+	}
+}
+
+// bucketDuration is the length of time covered by a single bucket
+func (u *usageStore) bucketDuration() time.Duration {
+	return u.window / maxUsageBuckets
+}
+
+func (u *usageStore) add(now time.Time, nodes int) {
+	start := now.Truncate(u.bucketDuration())
+	if len(u.buckets) > 0 {
+		last := &u.buckets[len(u.buckets)-1]
+		if last.Start.Equal(start) {
+			if nodes > last.Max {
+				last.Max = nodes
+			}
+			last.Sum += nodes
+			last.Count++
+			return
+		}
+	}
+	u.buckets = append(u.buckets, usageBucket{
+		Start: start,
+		Max:   nodes,
+		Sum:   nodes,
+		Count: 1,
+	})
+}
+
+// prune drops every bucket which started before the window ending at now
+func (u *usageStore) prune(now time.Time) {
+	cutoff := now.Add(-u.window)
+	i := 0
+	for i < len(u.buckets) && u.buckets[i].Start.Before(cutoff) {
+		i++
+	}
+	u.buckets = u.buckets[i:]
+}
+
+func (u *usageStore) max() int {
+	highest := 0
+	for _, bucket := range u.buckets {
+		if bucket.Max > highest {
+			highest = bucket.Max
+		}
+	}
+	return highest
+}
+
+// average is the mean of every sample in the window, rounded up since a partial node still needs a license
+func (u *usageStore) average() int {
+	sum, count := 0, 0
+	for _, bucket := range u.buckets {
+		sum += bucket.Sum
+		count += bucket.Count
+	}
+	if count == 0 {
+		return 0
+	}
+	return int(math.Ceil(float64(sum) / float64(count)))
+}
+
+func (u *usageStore) load(ctx context.Context) error {
+	data, err := u.k8s.GetUsageData(ctx)
+	if apierror.IsNotFound(err) {
+		// nothing has been recorded yet
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	samples, ok := data[usageSamplesKey]
+	if !ok {
+		return nil
+	}
+	var buckets []usageBucket
+	if err := json.Unmarshal([]byte(samples), &buckets); err != nil {
+		return fmt.Errorf("unable to parse stored usage samples: %v", err)
+	}
+	u.buckets = buckets
+	return nil
+}
+
+func (u *usageStore) save(ctx context.Context) error {
+	marshalled, err := json.Marshal(u.buckets)
+	if err != nil {
+		return err
+	}
+	return u.k8s.UpdateUsageData(ctx, usageSamplesKey, string(marshalled))
+}
+
+// trend estimates the rate of change of the node count in nodes per hour, using a least squares fit of the average of
+// each bucket. ok is false if there isn't enough data in the window to estimate a trend
+func (u *usageStore) trend() (nodesPerHour float64, ok bool) {
+	if len(u.buckets) < 2 {
+		return 0, false
+	}
+	origin := u.buckets[0].Start
+	var sumX, sumY, sumXY, sumXX float64
+	for _, bucket := range u.buckets {
+		x := bucket.Start.Sub(origin).Hours()
+		y := float64(bucket.Sum) / float64(bucket.Count)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	n := float64(len(u.buckets))
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0, false
+	}
+	return (n*sumXY - sumX*sumY) / denominator, true
+}
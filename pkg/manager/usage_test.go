@@ -0,0 +1,92 @@
+package manager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rancher/csp-adapter/pkg/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsageStoreRecord(t *testing.T) {
+	tests := []struct {
+		name     string        // name of the test, to be displayed on failure
+		strategy UsageStrategy // strategy used by the store
+		window   time.Duration // window used by the store
+		samples  []int         // node counts recorded, one per minute
+		expected int           // node count the store should license after the last sample
+	}{
+		{
+			name:     "instantaneous uses the last sample",
+			strategy: UsageStrategyInstantaneous,
+			window:   time.Hour,
+			samples:  []int{40, 60, 20},
+			expected: 20,
+		},
+		{
+			name:     "rolling max uses the peak in the window",
+			strategy: UsageStrategyRollingMax,
+			window:   time.Hour,
+			samples:  []int{40, 60, 20},
+			expected: 60,
+		},
+		{
+			name:     "rolling max forgets samples outside the window",
+			strategy: UsageStrategyRollingMax,
+			window:   2 * time.Minute,
+			samples:  []int{60, 20, 30, 10},
+			expected: 30,
+		},
+		{
+			name:     "rolling average rounds up",
+			strategy: UsageStrategyRollingAverage,
+			window:   time.Hour,
+			samples:  []int{10, 11},
+			expected: 11,
+		},
+		{
+			name:     "default strategy is instantaneous",
+			window:   time.Hour,
+			samples:  []int{60, 10},
+			expected: 10,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			store := newUsageStore(mocks.NewMockK8sClient(nil), test.strategy, test.window)
+			start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			var licensed int
+			for i, nodes := range test.samples {
+				licensed = store.record(context.TODO(), start.Add(time.Duration(i)*time.Minute), nodes)
+			}
+			assert.Equal(t, test.expected, licensed)
+		})
+	}
+}
+
+func TestUsageStorePersistence(t *testing.T) {
+	k8sClient := mocks.NewMockK8sClient(nil)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := newUsageStore(k8sClient, UsageStrategyRollingMax, time.Hour)
+	store.record(context.TODO(), start, 80)
+	assert.Contains(t, k8sClient.CurrentUsageData, usageSamplesKey, "expected samples to be persisted")
+
+	// a new store simulates a restart of the adapter, it should pick up the previous peak
+	restarted := newUsageStore(k8sClient, UsageStrategyRollingMax, time.Hour)
+	assert.Equal(t, 80, restarted.record(context.TODO(), start.Add(time.Minute), 10))
+}
+
+func TestParseUsageStrategy(t *testing.T) {
+	strategy, err := ParseUsageStrategy("")
+	assert.NoError(t, err)
+	assert.Equal(t, UsageStrategyInstantaneous, strategy)
+
+	strategy, err = ParseUsageStrategy("rolling-average")
+	assert.NoError(t, err)
+	assert.Equal(t, UsageStrategyRollingAverage, strategy)
+
+	_, err = ParseUsageStrategy("peak")
+	assert.Error(t, err)
+}
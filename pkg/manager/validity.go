@@ -0,0 +1,177 @@
+package manager
+
+import (
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/licensemanager/types"
+	"github.com/rancher/csp-adapter/pkg/messages"
+)
+
+const (
+	// ReasonLicenseExpired is reported when the license has expired or is past the end of its validity period
+	ReasonLicenseExpired = "LicenseExpired"
+	// ReasonLicenseSuspended is reported when the license has been suspended or deactivated
+	ReasonLicenseSuspended = "LicenseSuspended"
+	// ReasonLicenseNotYetValid is reported when the license is pending or before the start of its validity period
+	ReasonLicenseNotYetValid = "LicenseNotYetValid"
+	// ReasonLicenseDeleted is reported when the license has been, or is being, deleted
+	ReasonLicenseDeleted = "LicenseDeleted"
+
+	// ConditionLicenseExpiring is set when the end of the license's validity period is approaching
+	ConditionLicenseExpiring = "LicenseExpiring"
+
+	dateFormat = "2006-01-02"
+)
+
+// licenseValidity describes whether a license can currently be used to license nodes
+type licenseValidity struct {
+	// Usable is true if entitlements can be checked out from the license
+	Usable bool
+	// Reason explains why the license isn't usable, one of the Reason constants
+	Reason string
+	// Message is an explanation of why the license isn't usable, in the default locale for logs
+	Message string
+	// messageKey and messageParams render Message in other locales
+	messageKey    string
+	messageParams messages.Params
+	// Begin and End are the bounds of the validity period, either may be zero if aws didn't report it
+	Begin time.Time
+	End   time.Time
+}
+
+// checkLicenseValidity determines if license is usable at now, based on its status and validity period
+func checkLicenseValidity(license types.GrantedLicense, now time.Time) licenseValidity {
+	validity := licenseValidity{Usable: true}
+	if license.Validity != nil {
+		if license.Validity.Begin != nil {
+			validity.Begin, _ = parseTimestamp(*license.Validity.Begin)
+		}
+		if license.Validity.End != nil {
+			validity.End, _ = parseTimestamp(*license.Validity.End)
+		}
+	}
+	switch license.Status {
+	case types.LicenseStatusExpired:
+		return validity.unusable(ReasonLicenseExpired, messages.LicenseExpired, nil)
+	case types.LicenseStatusSuspended, types.LicenseStatusDeactivated:
+		return validity.unusable(ReasonLicenseSuspended, messages.LicenseSuspended, messages.Params{"Status": license.Status})
+	case types.LicenseStatusPendingAvailable:
+		return validity.unusable(ReasonLicenseNotYetValid, messages.LicenseNotAvailable, nil)
+	case types.LicenseStatusPendingDelete, types.LicenseStatusDeleted:
+		return validity.unusable(ReasonLicenseDeleted, messages.LicenseDeleted, nil)
+	}
+	// the status may lag behind the validity period, so check the dates as well
+	if !validity.End.IsZero() && now.After(validity.End) {
+		return validity.unusable(ReasonLicenseExpired, messages.LicenseExpiredOn, messages.Params{"Date": validity.End.Format(dateFormat)})
+	}
+	if !validity.Begin.IsZero() && now.Before(validity.Begin) {
+		return validity.unusable(ReasonLicenseNotYetValid, messages.LicenseNotValidUntil, messages.Params{"Date": validity.Begin.Format(dateFormat)})
+	}
+	return validity
+}
+
+func (v licenseValidity) unusable(reason, messageKey string, params messages.Params) licenseValidity {
+	v.Usable = false
+	v.Reason = reason
+	v.messageKey = messageKey
+	v.messageParams = params
+	v.Message = messages.Default().Render(messageKey, params)
+	return v
+}
+
+// localizedMessage gives the explanation of why the license isn't usable from catalogue
+func (v licenseValidity) localizedMessage(catalogue *messages.Catalogue) string {
+	if v.messageKey == "" {
+		return v.Message
+	}
+	return catalogue.Render(v.messageKey, v.messageParams)
+}
+
+// licenseState pairs a license with its validity at the time of a compliance check
+type licenseState struct {
+	license  types.GrantedLicense
+	validity licenseValidity
+	// account is the index of the account holding the license, in the manager's accounts
+	account int
+}
+
+func (l licenseState) arn() string {
+	if l.license.LicenseArn == nil {
+		return ""
+	}
+	return *l.license.LicenseArn
+}
+
+// name gives a user-facing name for the license
+func (l licenseState) name() string {
+	if l.license.LicenseName != nil && *l.license.LicenseName != "" {
+		return *l.license.LicenseName
+	}
+	return l.arn()
+}
+
+// partitionLicenses splits licenses into those usable at now and those which aren't. Usable licenses are ordered so that
+// the licenses whose validity period ends soonest are used first
+func partitionLicenses(licenses []types.GrantedLicense, now time.Time) (usable []licenseState, unusable []licenseState) {
+	for _, license := range licenses {
+		state := licenseState{
+			license:  license,
+			validity: checkLicenseValidity(license, now),
+		}
+		if state.validity.Usable {
+			usable = append(usable, state)
+		} else {
+			unusable = append(unusable, state)
+		}
+	}
+	sort.SliceStable(usable, func(i, j int) bool {
+		endI, endJ := usable[i].validity.End, usable[j].validity.End
+		if endI.IsZero() || endJ.IsZero() {
+			// licenses without an end date go last
+			return !endI.IsZero() && endJ.IsZero()
+		}
+		return endI.Before(endJ)
+	})
+	return usable, unusable
+}
+
+// expiryWarning returns a condition if the end of the license's validity period is within warningDays of now, with a
+// message from catalogue
+func (l licenseState) expiryWarning(now time.Time, warningDays int, catalogue *messages.Catalogue) *Condition {
+	v := l.validity
+	if warningDays <= 0 || v.End.IsZero() || !v.Usable {
+		return nil
+	}
+	remaining := v.End.Sub(now)
+	if remaining > time.Duration(warningDays)*24*time.Hour {
+		return nil
+	}
+	return &Condition{
+		Type: ConditionLicenseExpiring,
+		Message: catalogue.Render(messages.LicenseExpiring, messages.Params{
+			"License": l.name(),
+			"Date":    v.End.Format(dateFormat),
+			"Days":    int(remaining.Hours() / 24),
+		}),
+	}
+}
+
+// info creates the support config details for the license, with checkedOut entitlements held from it
+func (l licenseState) info(checkedOut int) LicenseInfo {
+	info := LicenseInfo{
+		Arn:        l.arn(),
+		Status:     string(l.license.Status),
+		CheckedOut: checkedOut,
+	}
+	if l.license.ProductSKU != nil {
+		info.ProductSKU = *l.license.ProductSKU
+	}
+	if !l.validity.Begin.IsZero() {
+		info.ValidFrom = l.validity.Begin.Format(time.RFC3339)
+	}
+	if !l.validity.End.IsZero() {
+		info.ValidUntil = l.validity.End.Format(time.RFC3339)
+	}
+	return info
+}
@@ -0,0 +1,121 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/licensemanager/types"
+	"github.com/rancher/csp-adapter/pkg/messages"
+	"github.com/rancher/csp-adapter/pkg/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckLicenseValidity(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name           string              // name of the test, to be displayed on failure
+		status         types.LicenseStatus // status of the license
+		begin          string              // start of the validity period, if any
+		end            string              // end of the validity period, if any
+		expectedUsable bool                // if the license should be usable
+		expectedReason string              // the reason the license isn't usable
+	}{
+		{
+			name:           "available with no validity period",
+			status:         types.LicenseStatusAvailable,
+			expectedUsable: true,
+		},
+		{
+			name:           "available within validity period",
+			status:         types.LicenseStatusAvailable,
+			begin:          "2024-01-01T00:00:00Z",
+			end:            "2025-01-01T00:00:00Z",
+			expectedUsable: true,
+		},
+		{
+			name:           "available but past validity period",
+			status:         types.LicenseStatusAvailable,
+			begin:          "2023-01-01T00:00:00Z",
+			end:            "2024-01-01T00:00:00",
+			expectedReason: ReasonLicenseExpired,
+		},
+		{
+			name:           "available but before validity period",
+			status:         types.LicenseStatusAvailable,
+			begin:          "2024-07-01T00:00:00Z",
+			expectedReason: ReasonLicenseNotYetValid,
+		},
+		{
+			name:           "expired",
+			status:         types.LicenseStatusExpired,
+			expectedReason: ReasonLicenseExpired,
+		},
+		{
+			name:           "suspended",
+			status:         types.LicenseStatusSuspended,
+			expectedReason: ReasonLicenseSuspended,
+		},
+		{
+			name:           "deactivated",
+			status:         types.LicenseStatusDeactivated,
+			expectedReason: ReasonLicenseSuspended,
+		},
+		{
+			name:           "deleted",
+			status:         types.LicenseStatusDeleted,
+			expectedReason: ReasonLicenseDeleted,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			license := types.GrantedLicense{Status: test.status}
+			if test.begin != "" || test.end != "" {
+				license.Validity = &types.DatetimeRange{}
+				if test.begin != "" {
+					license.Validity.Begin = &test.begin
+				}
+				if test.end != "" {
+					license.Validity.End = &test.end
+				}
+			}
+			validity := checkLicenseValidity(license, now)
+			assert.Equal(t, test.expectedUsable, validity.Usable)
+			assert.Equal(t, test.expectedReason, validity.Reason)
+		})
+	}
+}
+
+func TestLicenseExpiryWarning(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	state := licenseState{validity: licenseValidity{Usable: true, End: now.Add(10 * 24 * time.Hour)}}
+	assert.Nil(t, state.expiryWarning(now, 5, messages.Default()))
+	assert.Nil(t, state.expiryWarning(now, 0, messages.Default()))
+	warning := state.expiryWarning(now, 30, messages.Default())
+	if assert.NotNil(t, warning) {
+		assert.Equal(t, ConditionLicenseExpiring, warning.Type)
+	}
+}
+
+func TestComplianceCheckExpiredLicense(t *testing.T) {
+	mockAWSClient := mocks.NewMockAWSClient(2)
+	mockK8sClient := mocks.NewMockK8sClient(nil)
+	m := NewAWS(mockAWSClient, mockK8sClient, mocks.NewMockScraper(20), Options{})
+	assert.NoError(t, m.runComplianceCheck(context.TODO()))
+	assert.Len(t, mockAWSClient.CheckedOutEntitlements, 1)
+
+	mockAWSClient.Licenses[0].Status = types.LicenseStatusExpired
+	assert.NoError(t, m.runComplianceCheck(context.TODO()))
+	assert.Len(t, mockAWSClient.CheckedOutEntitlements, 0, "expected entitlements to be returned for an expired license")
+
+	var config CSPSupportConfig
+	assert.NoError(t, json.Unmarshal(mockK8sClient.CurrentSupportConfig, &config))
+	assert.Equal(t, StatusNotInCompliance, config.Compliance.Status)
+	assert.Equal(t, ReasonLicenseExpired, config.Compliance.Reason)
+	if assert.Len(t, config.Licenses, 1) {
+		assert.Equal(t, string(types.LicenseStatusExpired), config.Licenses[0].Status)
+	}
+	assert.NotEqual(t, "", mockK8sClient.CurrentNotificationMessage)
+}
@@ -0,0 +1,61 @@
+package manager
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/rancher/csp-adapter/pkg/messages"
+)
+
+// exhaustionWarnings returns the conditions warning that the licenses available to this rancher are running out.
+// licensedNodes is the node count being licensed and coveredNodes is the most nodes that could be licensed using the
+// licenses checked out plus those still available
+func (m *AWS) exhaustionWarnings(licensedNodes, coveredNodes int) []Condition {
+	if coveredNodes <= 0 {
+		return nil
+	}
+	var conditions []Condition
+	headroom := coveredNodes - licensedNodes
+	headroomPercent := 100 * float64(headroom) / float64(coveredNodes)
+	if m.headroomWarningPercent > 0 && headroomPercent < m.headroomWarningPercent {
+		conditions = append(conditions, Condition{
+			Type: ConditionLowHeadroom,
+			Message: m.messages.Render(messages.LowHeadroom, messages.Params{
+				"Licensed": licensedNodes,
+				"Covered":  coveredNodes,
+				"Headroom": fmt.Sprintf("%.0f", math.Max(headroomPercent, 0)),
+			}),
+		})
+	}
+	if m.exhaustionWarningDays > 0 && headroom > 0 {
+		nodesPerHour, ok := m.usage.trend()
+		if ok && nodesPerHour > 0 {
+			timeToExhaustion := time.Duration(float64(headroom) / nodesPerHour * float64(time.Hour))
+			if timeToExhaustion <= time.Duration(m.exhaustionWarningDays)*24*time.Hour {
+				conditions = append(conditions, Condition{
+					Type: ConditionProjectedExhaustion,
+					Message: m.messages.Render(messages.ProjectedExhaustion, messages.Params{
+						"Covered": coveredNodes,
+						"Date":    time.Now().Add(timeToExhaustion).UTC().Format(dateFormat),
+					}),
+				})
+			}
+		}
+	}
+	return conditions
+}
+
+// warningMessage combines conditions into a single user-facing message from catalogue, or returns "" if there are no
+// conditions
+func warningMessage(catalogue *messages.Catalogue, conditions []Condition) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	conditionMessages := make([]string, 0, len(conditions))
+	for _, condition := range conditions {
+		conditionMessages = append(conditionMessages, condition.Message)
+	}
+	return catalogue.Render(messages.Warning, messages.Params{"Conditions": strings.Join(conditionMessages, "; ")})
+}
@@ -0,0 +1,102 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rancher/csp-adapter/pkg/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExhaustionWarnings(t *testing.T) {
+	tests := []struct {
+		name           string   // name of the test, to be displayed on failure
+		headroom       float64  // headroom warning percent
+		projectionDays int      // exhaustion warning days
+		samples        []int    // node counts recorded, one per hour
+		licensedNodes  int      // node count being licensed
+		coveredNodes   int      // nodes covered by available licenses
+		expected       []string // condition types expected
+	}{
+		{
+			name:          "plenty of headroom",
+			headroom:      10,
+			licensedNodes: 20,
+			coveredNodes:  40,
+		},
+		{
+			name:          "low headroom",
+			headroom:      10,
+			licensedNodes: 38,
+			coveredNodes:  40,
+			expected:      []string{ConditionLowHeadroom},
+		},
+		{
+			name:          "headroom warning disabled",
+			licensedNodes: 38,
+			coveredNodes:  40,
+		},
+		{
+			name:           "growth projected to exceed licenses",
+			projectionDays: 7,
+			samples:        []int{10, 12, 14, 16},
+			licensedNodes:  16,
+			coveredNodes:   40,
+			expected:       []string{ConditionProjectedExhaustion},
+		},
+		{
+			name:           "growth too slow to exceed licenses in time",
+			projectionDays: 1,
+			samples:        []int{10, 10, 11, 11},
+			licensedNodes:  11,
+			coveredNodes:   400,
+		},
+		{
+			name:           "shrinking usage",
+			projectionDays: 7,
+			samples:        []int{16, 14, 12, 10},
+			licensedNodes:  10,
+			coveredNodes:   20,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			m := NewAWS(mocks.NewMockAWSClient(2), mocks.NewMockK8sClient(nil), mocks.NewMockScraper(0), Options{
+				UsageWindow:            24 * time.Hour,
+				HeadroomWarningPercent: test.headroom,
+				ExhaustionWarningDays:  test.projectionDays,
+			})
+			start := time.Now().Add(-time.Duration(len(test.samples)) * time.Hour)
+			for i, nodes := range test.samples {
+				m.usage.record(context.TODO(), start.Add(time.Duration(i)*time.Hour), nodes)
+			}
+			var types []string
+			for _, condition := range m.exhaustionWarnings(test.licensedNodes, test.coveredNodes) {
+				types = append(types, condition.Type)
+			}
+			assert.Equal(t, test.expected, types)
+		})
+	}
+}
+
+func TestComplianceCheckWarnings(t *testing.T) {
+	mockK8sClient := mocks.NewMockK8sClient(nil)
+	m := NewAWS(mocks.NewMockAWSClient(2), mockK8sClient, mocks.NewMockScraper(39), Options{HeadroomWarningPercent: 10})
+	assert.NoError(t, m.runComplianceCheck(context.TODO()))
+
+	var config CSPSupportConfig
+	assert.NoError(t, json.Unmarshal(mockK8sClient.CurrentSupportConfig, &config))
+	assert.Equal(t, StatusInCompliance, config.Compliance.Status)
+	if assert.Len(t, config.Compliance.Conditions, 1) {
+		assert.Equal(t, ConditionLowHeadroom, config.Compliance.Conditions[0].Type)
+	}
+	assert.NotEqual(t, "", mockK8sClient.CurrentWarningMessage, "expected a warning notification")
+
+	// once there is enough headroom again, the warning should be removed
+	m.scraper = mocks.NewMockScraper(21)
+	assert.NoError(t, m.runComplianceCheck(context.TODO()))
+	assert.Equal(t, "", mockK8sClient.CurrentWarningMessage, "expected the warning notification to be removed")
+}
@@ -0,0 +1,172 @@
+// Package messages holds the catalogue of user-facing messages produced by the adapter, such as the notifications shown
+// in rancher and the compliance message in the support config, in each supported locale
+package messages
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultLocale is used when no locale is configured, and for messages missing from another locale
+const DefaultLocale = "en"
+
+// keys of the messages in the catalogue. Each message is a text/template, see locales/en.json for the data each uses.
+// Messages can include other messages with the template action, such as {{template "statusPrefix"}}
+const (
+	StatusPrefix                = "statusPrefix"
+	Compliant                   = "compliant"
+	NonCompliant                = "nonCompliant"
+	CheckoutSummary             = "checkoutSummary"
+	CheckFailed                 = "checkFailed"
+	CheckFailedNotification     = "checkFailedNotification"
+	UnusableLicenseSummary      = "unusableLicenseSummary"
+	UnusableLicenseNotification = "unusableLicenseNotification"
+	LicenseExpired              = "licenseExpired"
+	LicenseExpiredOn            = "licenseExpiredOn"
+	LicenseSuspended            = "licenseSuspended"
+	LicenseNotAvailable         = "licenseNotAvailable"
+	LicenseNotValidUntil        = "licenseNotValidUntil"
+	LicenseDeleted              = "licenseDeleted"
+	LicenseExpiring             = "licenseExpiring"
+	LowHeadroom                 = "lowHeadroom"
+	ProjectedExhaustion         = "projectedExhaustion"
+	Warning                     = "warning"
+	StartupFailed               = "startupFailed"
+	StartupFailedNotification   = "startupFailedNotification"
+	MarketplaceLink             = "marketplaceLink"
+	DocsLink                    = "docsLink"
+)
+
+//go:embed locales/*.json
+var locales embed.FS
+
+// Params holds the values a message is rendered with, by name
+type Params map[string]interface{}
+
+// Catalogue renders messages in a single locale
+type Catalogue struct {
+	locale    string
+	templates *template.Template
+	fallback  *Catalogue
+}
+
+var (
+	defaultOnce      sync.Once
+	defaultCatalogue *Catalogue
+)
+
+// Default gives the catalogue for DefaultLocale
+func Default() *Catalogue {
+	defaultOnce.Do(func() {
+		var err error
+		defaultCatalogue, err = load(DefaultLocale, nil)
+		if err != nil {
+			// the default locale is embedded, so this can only happen if it was built broken
+			panic(fmt.Sprintf("unable to load default message catalogue: %v", err))
+		}
+	})
+	return defaultCatalogue
+}
+
+// New gives the catalogue for locale, such as "de" or "fr-FR". A locale with a region falls back to the language alone
+// if there is no catalogue for the region. Returns an error if neither is supported
+func New(locale string) (*Catalogue, error) {
+	normalized := strings.ReplaceAll(strings.ToLower(strings.TrimSpace(locale)), "_", "-")
+	if normalized == "" {
+		return Default(), nil
+	}
+	candidates := []string{normalized}
+	if language, _, ok := strings.Cut(normalized, "-"); ok {
+		candidates = append(candidates, language)
+	}
+	for _, candidate := range candidates {
+		if candidate == DefaultLocale {
+			return Default(), nil
+		}
+		if _, err := locales.Open(localePath(candidate)); err != nil {
+			continue
+		}
+		return load(candidate, Default())
+	}
+	return nil, fmt.Errorf("locale %q is not supported, supported locales are %v", locale, Locales())
+}
+
+// Locales lists the supported locales
+func Locales() []string {
+	entries, _ := locales.ReadDir("locales")
+	var supported []string
+	for _, entry := range entries {
+		supported = append(supported, strings.TrimSuffix(entry.Name(), ".json"))
+	}
+	sort.Strings(supported)
+	return supported
+}
+
+func localePath(locale string) string {
+	return path.Join("locales", locale+".json")
+}
+
+// load parses the messages for locale. Messages missing from the locale are rendered by fallback
+func load(locale string, fallback *Catalogue) (*Catalogue, error) {
+	raw, err := locales.ReadFile(localePath(locale))
+	if err != nil {
+		return nil, err
+	}
+	var messages map[string]string
+	if err := json.Unmarshal(raw, &messages); err != nil {
+		return nil, fmt.Errorf("unable to parse messages for locale %s: %v", locale, err)
+	}
+	// missing params are an error rather than rendering as "<no value>"
+	templates := template.New(locale).Option("missingkey=error")
+	for key, message := range messages {
+		if _, err := templates.New(key).Parse(message); err != nil {
+			return nil, fmt.Errorf("unable to parse message %s for locale %s: %v", key, locale, err)
+		}
+	}
+	return &Catalogue{
+		locale:    locale,
+		templates: templates,
+		fallback:  fallback,
+	}, nil
+}
+
+// Locale gives the locale that messages are rendered in
+func (c *Catalogue) Locale() string {
+	return c.locale
+}
+
+// Render renders the message with key using params. If the message can't be rendered in the catalogue's locale, it is
+// rendered in the default locale instead, and if that fails too the key is returned so that something is still shown
+func (c *Catalogue) Render(key string, params Params) string {
+	rendered, err := c.render(key, params)
+	if err == nil {
+		return rendered
+	}
+	if c.fallback != nil {
+		logrus.Debugf("unable to render message %s in locale %s, falling back to %s: %v", key, c.locale, c.fallback.locale, err)
+		return c.fallback.Render(key, params)
+	}
+	logrus.Warnf("unable to render message %s: %v", key, err)
+	return key
+}
+
+func (c *Catalogue) render(key string, params Params) (string, error) {
+	tmpl := c.templates.Lookup(key)
+	if tmpl == nil {
+		return "", fmt.Errorf("no message %s", key)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, params); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,103 @@
+package messages
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sampleParams holds every param used by a message
+var sampleParams = Params{
+	"Missing":    2,
+	"Required":   3,
+	"CheckedOut": 1,
+	"Error":      "access denied",
+	"License":    "has expired",
+	"Date":       "2024-01-01",
+	"Status":     "SUSPENDED",
+	"Days":       5,
+	"Licensed":   38,
+	"Covered":    40,
+	"Headroom":   "5",
+	"Conditions": "something is wrong",
+}
+
+var allKeys = []string{
+	StatusPrefix, Compliant, NonCompliant, CheckoutSummary, CheckFailed, CheckFailedNotification, UnusableLicenseSummary,
+	UnusableLicenseNotification, LicenseExpired, LicenseExpiredOn, LicenseSuspended, LicenseNotAvailable,
+	LicenseNotValidUntil, LicenseDeleted, LicenseExpiring, LowHeadroom, ProjectedExhaustion, Warning, StartupFailed,
+	StartupFailedNotification, MarketplaceLink, DocsLink,
+}
+
+func TestEveryLocaleIsComplete(t *testing.T) {
+	for _, locale := range Locales() {
+		locale := locale
+		t.Run(locale, func(t *testing.T) {
+			catalogue, err := New(locale)
+			require.NoError(t, err)
+			for _, key := range allKeys {
+				rendered, err := catalogue.render(key, sampleParams)
+				assert.NoError(t, err, "message %s", key)
+				assert.NotEmpty(t, rendered, "message %s", key)
+			}
+		})
+	}
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name     string // name of the test, to be displayed on failure
+		locale   string // locale to render in
+		key      string // message to render
+		params   Params // params to render with
+		expected string // expected message
+	}{
+		{
+			name:     "default locale",
+			locale:   "",
+			key:      NonCompliant,
+			params:   Params{"Missing": 2},
+			expected: "AWS Marketplace Adapter: You have exceeded your licensed node count. At least 2 more license(s) are required in AWS to become compliant.",
+		},
+		{
+			name:     "other locale",
+			locale:   "de",
+			key:      CheckoutSummary,
+			params:   Params{"Required": 3, "CheckedOut": 1},
+			expected: "Der Rancher-Server benötigte 3 Lizenz(en) und konnte 1 Lizenz(en) auschecken",
+		},
+		{
+			name:     "region falls back to language",
+			locale:   "fr_FR",
+			key:      LicenseExpired,
+			expected: "a expiré",
+		},
+		{
+			name:     "missing param falls back to default locale, then the key",
+			locale:   "de",
+			key:      LicenseExpiredOn,
+			params:   Params{},
+			expected: LicenseExpiredOn,
+		},
+		{
+			name:     "unknown message",
+			locale:   "en",
+			key:      "unknown",
+			expected: "unknown",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			catalogue, err := New(test.locale)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, catalogue.Render(test.key, test.params))
+		})
+	}
+}
+
+func TestUnsupportedLocale(t *testing.T) {
+	_, err := New("xx-YY")
+	assert.Error(t, err)
+}
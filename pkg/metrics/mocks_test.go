@@ -1,9 +1,16 @@
 package metrics
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
 )
 
 type mockPrometheusServer struct {
@@ -87,3 +94,33 @@ func (m *mockPrometheusServer) requestAuthorized(req *http.Request) bool {
 func (m *mockPrometheusServer) requestAuthenticated(req *http.Request) bool {
 	return req.Header.Get("Authorization") != ""
 }
+
+// newFakeNodes gives a lister of rancher's nodes holding a node in cluster with each of cpus as its allocatable cpu. An
+// empty cpu is left out of the node's status, as for a node still being provisioned
+func newFakeNodes(nodesForCluster map[string][]string) nodeLister {
+	var objects []runtime.Object
+	for cluster, cpus := range nodesForCluster {
+		for i, cpu := range cpus {
+			node := &unstructured.Unstructured{}
+			node.SetAPIVersion("management.cattle.io/v3")
+			node.SetKind("Node")
+			node.SetNamespace(cluster)
+			node.SetName(fmt.Sprintf("m-%d", i))
+			if cpu != "" {
+				_ = unstructured.SetNestedField(node.Object, cpu, "status", "internalNodeStatus", "allocatable", "cpu")
+			}
+			objects = append(objects, node)
+		}
+	}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{nodeGVR: "NodeList"}, objects...)
+	return client.Resource(nodeGVR)
+}
+
+// failingNodes fails to list rancher's nodes with err
+type failingNodes struct {
+	err error
+}
+
+func (f failingNodes) List(ctx context.Context, opts metav1.ListOptions) (*unstructured.UnstructuredList, error) {
+	return nil, f.err
+}
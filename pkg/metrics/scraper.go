@@ -1,47 +1,97 @@
 package metrics
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	prometheusClient "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	"github.com/rancher/csp-adapter/pkg/logging"
+	"github.com/rancher/csp-adapter/pkg/redact"
+	"github.com/rancher/csp-adapter/pkg/tracing"
 	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/rest"
 )
 
 // Scraper defines behavior that a Rancher metrics scraper should implement
 type Scraper interface {
-	ScrapeAndParse() (*NodeCounts, error)
+	ScrapeAndParse(ctx context.Context) (*NodeCounts, error)
+}
+
+// nodeLister lists rancher's management.cattle.io nodes
+type nodeLister interface {
+	List(ctx context.Context, opts metav1.ListOptions) (*unstructured.UnstructuredList, error)
 }
 
 type scraper struct {
 	metricsURL string
 	cli        *http.Client
 	cfg        *rest.Config
+	// nodes lists the nodes that cpus are counted from, cpus aren't counted if it is nil
+	nodes nodeLister
 }
 
-func NewScraper(rancherHost string, cfg *rest.Config) Scraper {
-	return &scraper{
+// DefaultScrapeTimeout is how long a scrape of rancher's metrics can take if no timeout is configured
+const DefaultScrapeTimeout = 10 * time.Second
+
+// NewScraper creates a scraper for the metrics of the rancher at rancherHost. Scrapes which take longer than timeout fail,
+// a timeout of zero uses DefaultScrapeTimeout. The bearer token from cfg is masked from the logs
+func NewScraper(rancherHost string, cfg *rest.Config, timeout time.Duration) Scraper {
+	if timeout <= 0 {
+		timeout = DefaultScrapeTimeout
+	}
+	redact.Default().AddBearerToken(cfg.BearerToken)
+	s := &scraper{
 		metricsURL: strings.Join([]string{"https://", rancherHost, "/metrics"}, ""),
-		cli:        &http.Client{},
+		cli:        &http.Client{Timeout: timeout},
 		cfg:        cfg,
 	}
+	dynamicClient, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		logrus.Warnf("unable to create a client for rancher's nodes, cpus will not be counted: %v", err)
+		return s
+	}
+	s.nodes = dynamicClient.Resource(nodeGVR)
+	return s
 }
 
 const (
 	nodeGaugeMetricName = "cluster_manager_nodes"
 	clusterNameLabel    = "cluster_id"
 	localClusterID      = "local"
+	// nodeListLimit is how many nodes are listed per page when counting cpus
+	nodeListLimit = 500
 )
 
+// nodeGVR is rancher's record of every node of the clusters it manages, kept in the namespace named after the node's
+// cluster, with the allocatable resources the node's kubelet reports
+var nodeGVR = schema.GroupVersionResource{Group: "management.cattle.io", Version: "v3", Resource: "nodes"}
+
 type NodeCounts struct {
+	// Total is the number of nodes across every downstream cluster, the local cluster isn't licensed
 	Total int
+	// Clusters holds the number of nodes in each downstream cluster, keyed by cluster id
+	Clusters map[string]int
+	// HasCPUs is whether the allocatable cpu of the nodes could be counted
+	HasCPUs bool
+	// CPUs is the allocatable cpu cores across every node of the downstream clusters, which may be fractional
+	CPUs float64
+	// ClusterCPUs holds the allocatable cpu cores of each downstream cluster, keyed by cluster id
+	ClusterCPUs map[string]float64
 }
 
-func (s *scraper) ScrapeAndParse() (*NodeCounts, error) {
-	req, err := http.NewRequest(http.MethodGet, s.metricsURL, nil)
+func (s *scraper) ScrapeAndParse(ctx context.Context) (counts *NodeCounts, err error) {
+	ctx, end := tracing.Start(ctx, "metrics.Scrape")
+	defer end(&err)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.metricsURL, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -68,31 +118,78 @@ func (s *scraper) ScrapeAndParse() (*NodeCounts, error) {
 		return nil, fmt.Errorf("no metric with name %s found in rancher /metrics output", nodeGaugeMetricName)
 	}
 
-	var nodeCount int
+	counts = &NodeCounts{Clusters: map[string]int{}, ClusterCPUs: map[string]float64{}}
 	for _, metric := range nodeMetricFamily.GetMetric() {
-		isMetricForLocal, err := isMetricForLocalCluster(metric)
+		clusterID, err := metricClusterID(metric)
 		clusterNodeCount := int(metric.GetGauge().GetValue())
-		logrus.Debugf("scraper found nodes: %d, isMetricForLocal: %t, err: %v", clusterNodeCount, isMetricForLocal, err)
+		logging.FromContext(ctx).Debugf("scraper found nodes: %d, cluster: %s, err: %v", clusterNodeCount, clusterID, err)
 		if err != nil {
-			logrus.Warnf("error when attempting to determine if count was for local cluster: %s, will not include %d nodes in total", err.Error(), clusterNodeCount)
+			logging.FromContext(ctx).Warnf("error when attempting to determine if count was for local cluster: %s, will not include %d nodes in total", err.Error(), clusterNodeCount)
 			continue
 		}
-		if !isMetricForLocal {
-			nodeCount += clusterNodeCount
+		if clusterID != localClusterID {
+			counts.Total += clusterNodeCount
+			counts.Clusters[clusterID] += clusterNodeCount
 		}
 
 	}
 
-	return &NodeCounts{
-		Total: nodeCount,
-	}, nil
+	if s.nodes == nil {
+		return counts, nil
+	}
+	if err := s.countCPUs(ctx, counts); err != nil {
+		logging.FromContext(ctx).Warnf("unable to count the allocatable cpus of rancher's nodes, cpus will not be counted: %v", err)
+		counts.CPUs = 0
+		counts.ClusterCPUs = map[string]float64{}
+		return counts, nil
+	}
+	counts.HasCPUs = true
+	return counts, nil
+}
+
+// countCPUs adds the allocatable cpus of the nodes of every downstream cluster to counts, from rancher's nodes. Nodes
+// which don't report their allocatable cpu yet, such as those still being provisioned, aren't counted
+func (s *scraper) countCPUs(ctx context.Context, counts *NodeCounts) error {
+	ctx, cancel := context.WithTimeout(ctx, s.cli.Timeout)
+	defer cancel()
+	opts := metav1.ListOptions{Limit: nodeListLimit}
+	for {
+		nodes, err := s.nodes.List(ctx, opts)
+		if err != nil {
+			return err
+		}
+		for _, node := range nodes.Items {
+			clusterID := node.GetNamespace()
+			if clusterID == localClusterID {
+				continue
+			}
+			raw, found, err := unstructured.NestedString(node.Object, "status", "internalNodeStatus", "allocatable", "cpu")
+			if err != nil || !found {
+				logging.FromContext(ctx).Debugf("node %s/%s doesn't report its allocatable cpu, it will not be counted", clusterID, node.GetName())
+				continue
+			}
+			quantity, err := resource.ParseQuantity(raw)
+			if err != nil {
+				logging.FromContext(ctx).Warnf("unable to parse allocatable cpu %q of node %s/%s, it will not be counted: %v", raw, clusterID, node.GetName(), err)
+				continue
+			}
+			nodeCPUs := float64(quantity.MilliValue()) / 1000
+			counts.CPUs += nodeCPUs
+			counts.ClusterCPUs[clusterID] += nodeCPUs
+		}
+		if nodes.GetContinue() == "" {
+			return nil
+		}
+		opts.Continue = nodes.GetContinue()
+	}
 }
 
-func isMetricForLocalCluster(metric *prometheusClient.Metric) (bool, error) {
+// metricClusterID gives the id of the cluster that metric counts the nodes of
+func metricClusterID(metric *prometheusClient.Metric) (string, error) {
 	for _, label := range metric.GetLabel() {
 		if label.Name != nil && *label.Name == clusterNameLabel {
-			return label.Value != nil && *label.Value == localClusterID, nil
+			return label.GetValue(), nil
 		}
 	}
-	return false, fmt.Errorf("unable to determine if metric is for local cluster due to missing label")
+	return "", fmt.Errorf("unable to determine if metric is for local cluster due to missing label")
 }
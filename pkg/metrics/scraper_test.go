@@ -1,11 +1,15 @@
 package metrics
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	"github.com/rancher/csp-adapter/pkg/redact"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"k8s.io/client-go/rest"
 )
@@ -119,14 +123,102 @@ func TestScrapeAndParse(t *testing.T) {
 				cli:        &http.Client{},
 				cfg:        config,
 			}
-			res, err := metricsScraper.ScrapeAndParse()
+			res, err := metricsScraper.ScrapeAndParse(context.TODO())
 			if test.expectedError {
 				assert.Error(t, err, "expected an error but err was nil")
 			} else {
 				assert.NoError(t, err, "expected no error but there was an error")
 				assert.NotNil(t, res, "expected a result but was nil")
 				assert.Equal(t, test.expectedTotal, res.Total, "did not get expected number of nodes")
+				clusterTotal := 0
+				for id, nodes := range res.Clusters {
+					assert.NotEqual(t, localClusterID, id, "local cluster should not be counted")
+					assert.Equal(t, test.nodesPerOtherClusters, nodes, "did not get expected number of nodes for %s", id)
+					clusterTotal += nodes
+				}
+				assert.Equal(t, test.expectedTotal, clusterTotal, "cluster counts should add up to the total")
 			}
 		})
 	}
 }
+
+func TestScrapeCPUs(t *testing.T) {
+	metricsServer := newMockPrometheusServer()
+	server := httptest.NewServer(&metricsServer)
+	defer server.Close()
+	config := &rest.Config{BearerToken: "abc123abc123abc123"}
+	metricsServer.AddAuthToken(config.BearerToken)
+	metricsServer.SetNodesForCluster(3, localClusterID, false)
+	metricsServer.SetNodesForCluster(3, "c-m-1", false)
+	metricsScraper := scraper{
+		metricsURL: fmt.Sprintf("%s/metrics", server.URL),
+		cli:        &http.Client{},
+		cfg:        config,
+	}
+
+	// without any nodes to count from, cpus aren't reported
+	res, err := metricsScraper.ScrapeAndParse(context.TODO())
+	assert.NoError(t, err)
+	assert.False(t, res.HasCPUs)
+	assert.Zero(t, res.CPUs)
+
+	metricsScraper.nodes = newFakeNodes(map[string][]string{
+		localClusterID: {"4", "4", "4"},
+		"c-m-1":        {"8", "3500m", ""},
+		"c-m-2":        {"16"},
+	})
+	res, err = metricsScraper.ScrapeAndParse(context.TODO())
+	assert.NoError(t, err)
+	assert.True(t, res.HasCPUs)
+	assert.Equal(t, 27.5, res.CPUs, "expected the local cluster and nodes without allocatable cpu to be excluded")
+	assert.Equal(t, map[string]float64{"c-m-1": 11.5, "c-m-2": 16}, res.ClusterCPUs)
+	assert.Equal(t, 3, res.Total, "expected nodes to still be counted from the metrics")
+
+	// nodes are still counted if the cpus can't be
+	metricsScraper.nodes = failingNodes{err: fmt.Errorf("forbidden")}
+	res, err = metricsScraper.ScrapeAndParse(context.TODO())
+	assert.NoError(t, err)
+	assert.False(t, res.HasCPUs)
+	assert.Zero(t, res.CPUs)
+	assert.Empty(t, res.ClusterCPUs)
+	assert.Equal(t, 3, res.Total)
+}
+
+func TestScrapeDoesNotLogBearerToken(t *testing.T) {
+	metricsServer := newMockPrometheusServer()
+	metricsServer.SetNodesForCluster(3, "cluster-0", false)
+	// rancher's api fails to list its nodes, with an error which echoes the request's credentials back
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics" {
+			metricsServer.ServeHTTP(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = fmt.Fprintf(w, "failed for credentials %s", r.Header.Get("Authorization"))
+	}))
+	defer server.Close()
+
+	logger := logrus.StandardLogger()
+	var logs bytes.Buffer
+	level, out := logger.GetLevel(), logger.Out
+	hooks := logger.ReplaceHooks(logrus.LevelHooks{})
+	logger.AddHook(redact.NewHook(redact.Default()))
+	logger.SetOutput(&logs)
+	logger.SetLevel(logrus.DebugLevel)
+	defer func() {
+		logger.ReplaceHooks(hooks)
+		logger.SetOutput(out)
+		logger.SetLevel(level)
+	}()
+
+	config := &rest.Config{Host: server.URL, BearerToken: "scraper-bearer-token-value"}
+	metricsScraper := NewScraper("rancher.example.com", config, 0).(*scraper)
+	metricsScraper.metricsURL = fmt.Sprintf("%s/metrics", server.URL)
+	metricsServer.AddAuthToken(config.BearerToken)
+
+	res, err := metricsScraper.ScrapeAndParse(context.TODO())
+	assert.NoError(t, err)
+	assert.False(t, res.HasCPUs)
+	assert.Contains(t, logs.String(), "failed for credentials", "expected the echoed request to be logged")
+	assert.NotContains(t, logs.String(), config.BearerToken)
+}
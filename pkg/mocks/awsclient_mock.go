@@ -3,73 +3,170 @@ package mocks
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strconv"
 	"time"
 
 	lm "github.com/aws/aws-sdk-go-v2/service/licensemanager"
 	"github.com/aws/aws-sdk-go-v2/service/licensemanager/types"
+	"github.com/rancher/csp-adapter/pkg/clients/aws"
 )
 
 type MockAWSClient struct {
 	AWSAccountNumber       string
-	License                types.GrantedLicense
+	Licenses               []types.GrantedLicense
 	CheckedOutEntitlements map[string]int
 	CheckoutTokenCtr       int
+	// CheckoutResponseErr is returned by the next checkout in place of its response, after the checkout has been made, as
+	// if the response had been lost
+	CheckoutResponseErr error
+	// GetLicensesErr is returned by GetRancherLicenses in place of the licenses while it is set
+	GetLicensesErr error
+	// checkoutLicenses tracks the arn of the license that each consumption token was checked out from
+	checkoutLicenses map[string]string
+	// checkoutDimensions tracks the dimension that each consumption token was checked out to
+	checkoutDimensions map[string]string
+	// clientTokens tracks the consumption token each client token was checked out with
+	clientTokens map[string]string
 }
 
 const (
-	rkeEntitlement = "RKE_NODE_SUPP"
 	fakeAWSAccount = "111111111111"
 	fakeLicenseID  = "l-12345"
 )
 
 func NewMockAWSClient(maxEntitlements int) *MockAWSClient {
-	fakeLicenseArn := fmt.Sprintf("arn:aws:license-manager::%s:license:%s", fakeAWSAccount, fakeLicenseID)
-	entitlementName := rkeEntitlement
-	// technically not a lossless conversion, but we should never run a test with values this high
-	maxCount := int64(maxEntitlements)
-	return &MockAWSClient{
-		AWSAccountNumber: fakeAWSAccount,
-		License: types.GrantedLicense{
-			LicenseArn: &fakeLicenseArn,
-			Entitlements: []types.Entitlement{{
-				Name:     &entitlementName,
-				Unit:     types.EntitlementUnitCount,
-				MaxCount: &maxCount,
-			}},
-		},
+	return NewMockAWSClientForAccount(fakeAWSAccount, maxEntitlements)
+}
+
+// NewMockAWSClientForAccount creates a client for the account with accountNumber, holding one license with
+// maxEntitlements entitlements. License arns include the account number, so they are distinct across accounts
+func NewMockAWSClientForAccount(accountNumber string, maxEntitlements int) *MockAWSClient {
+	m := &MockAWSClient{
+		AWSAccountNumber:       accountNumber,
 		CheckedOutEntitlements: map[string]int{},
+		checkoutLicenses:       map[string]string{},
+		checkoutDimensions:     map[string]string{},
+		clientTokens:           map[string]string{},
+	}
+	m.AddLicense(maxEntitlements)
+	return m
+}
+
+// AddLicense adds another license with maxEntitlements entitlements of aws.DefaultDimension to the account, returning
+// the arn of the license
+func (m *MockAWSClient) AddLicense(maxEntitlements int) string {
+	return m.AddLicenseWithDimensions(map[string]int{aws.DefaultDimension: maxEntitlements})
+}
+
+// AddLicenseWithDimensions adds another license to the account with the max entitlements of each dimension in
+// maxEntitlements, returning the arn of the license
+func (m *MockAWSClient) AddLicenseWithDimensions(maxEntitlements map[string]int) string {
+	fakeLicenseArn := fmt.Sprintf("arn:aws:license-manager::%s:license:%s-%d", m.AWSAccountNumber, fakeLicenseID, len(m.Licenses))
+	var dimensions []string
+	for dimension := range maxEntitlements {
+		dimensions = append(dimensions, dimension)
+	}
+	sort.Strings(dimensions)
+	var entitlements []types.Entitlement
+	for _, dimension := range dimensions {
+		// technically not a lossless conversion, but we should never run a test with values this high
+		maxCount := int64(maxEntitlements[dimension])
+		entitlements = append(entitlements, types.Entitlement{
+			Name:     &dimension,
+			Unit:     types.EntitlementUnitCount,
+			MaxCount: &maxCount,
+		})
 	}
+	m.Licenses = append(m.Licenses, types.GrantedLicense{
+		LicenseArn:   &fakeLicenseArn,
+		Status:       types.LicenseStatusAvailable,
+		Entitlements: entitlements,
+	})
+	return fakeLicenseArn
+}
+
+// CheckedOutForLicense gives the total entitlements checked out from the license with licenseArn, across every dimension
+func (m *MockAWSClient) CheckedOutForLicense(licenseArn string) int {
+	total := 0
+	for token, value := range m.CheckedOutEntitlements {
+		if m.checkoutLicenses[token] == licenseArn {
+			total += value
+		}
+	}
+	return total
+}
+
+// CheckedOutForDimension gives the entitlements of dimension checked out from the license with licenseArn
+func (m *MockAWSClient) CheckedOutForDimension(licenseArn, dimension string) int {
+	total := 0
+	for token, value := range m.CheckedOutEntitlements {
+		if m.checkoutLicenses[token] == licenseArn && m.checkoutDimensions[token] == dimension {
+			total += value
+		}
+	}
+	return total
 }
 
 func (m *MockAWSClient) AccountNumber() string {
 	return m.AWSAccountNumber
 }
 
-func (m *MockAWSClient) GetRancherLicense(ctx context.Context) (*types.GrantedLicense, error) {
-	return &m.License, nil
+func (m *MockAWSClient) GetRancherLicenses(ctx context.Context) ([]types.GrantedLicense, error) {
+	if m.GetLicensesErr != nil {
+		return nil, m.GetLicensesErr
+	}
+	if len(m.Licenses) == 0 {
+		return nil, fmt.Errorf("unable to get a valid rancher license")
+	}
+	return m.Licenses, nil
+}
+
+func (m *MockAWSClient) QueryLicenses(ctx context.Context, q aws.LicenseQuery) ([]types.GrantedLicense, error) {
+	if m.GetLicensesErr != nil {
+		return nil, m.GetLicensesErr
+	}
+	var matched []types.GrantedLicense
+	for _, license := range m.Licenses {
+		if q.Matches(license) {
+			matched = append(matched, license)
+		}
+	}
+	return matched, nil
 }
 
-func (m *MockAWSClient) CheckoutRancherLicense(ctx context.Context, l types.GrantedLicense, entitlementAmt int) (*lm.CheckoutLicenseOutput, error) {
-	if *l.LicenseArn != *m.License.LicenseArn {
+func (m *MockAWSClient) CheckoutRancherLicense(ctx context.Context, l types.GrantedLicense, dimension string, entitlementAmt int, clientToken string) (*lm.CheckoutLicenseOutput, error) {
+	license := m.getLicense(*l.LicenseArn)
+	if license == nil {
 		//TODO: Not found aws error mock
 		return nil, fmt.Errorf("license not found")
 	}
+	if consumptionToken, ok := m.clientTokens[clientToken]; ok {
+		// a checkout repeated with the same client token gets the original checkout back
+		return m.checkoutOutput(consumptionToken), nil
+	}
 	// remove from checkedIn and append to checkedOut
 	consumptionToken := m.genConsumptionToken()
-	currentTotal := 0
-	for _, value := range m.CheckedOutEntitlements {
-		currentTotal += value
-	}
-	if currentTotal > m.getMaxRKEEntitlements() {
+	if m.CheckedOutForDimension(*l.LicenseArn, dimension)+entitlementAmt > getMaxEntitlements(*license, dimension) {
 		//TODO: maybe return with less entitlements?
 		return nil, fmt.Errorf("can't checkout license - over entitlements")
 	}
 	m.CheckedOutEntitlements[consumptionToken] = entitlementAmt
+	m.checkoutLicenses[consumptionToken] = *l.LicenseArn
+	m.checkoutDimensions[consumptionToken] = dimension
+	m.clientTokens[clientToken] = consumptionToken
+	if err := m.CheckoutResponseErr; err != nil {
+		m.CheckoutResponseErr = nil
+		return nil, err
+	}
+	return m.checkoutOutput(consumptionToken), nil
+}
 
+func (m *MockAWSClient) checkoutOutput(consumptionToken string) *lm.CheckoutLicenseOutput {
+	licenseArn := m.checkoutLicenses[consumptionToken]
 	expiryTime := time.Now().Add(1 * time.Hour).Format(time.RFC3339)
-	name := rkeEntitlement
-	value := strconv.Itoa(entitlementAmt)
+	name := m.checkoutDimensions[consumptionToken]
+	value := strconv.Itoa(m.CheckedOutEntitlements[consumptionToken])
 	return &lm.CheckoutLicenseOutput{
 		// our checkouts are always provisional
 		CheckoutType: types.CheckoutTypeProvisional,
@@ -79,9 +176,9 @@ func (m *MockAWSClient) CheckoutRancherLicense(ctx context.Context, l types.Gran
 			Unit:  types.EntitlementDataUnitCount,
 		}},
 		Expiration:              &expiryTime,
-		LicenseArn:              l.LicenseArn,
+		LicenseArn:              &licenseArn,
 		LicenseConsumptionToken: &consumptionToken,
-	}, nil
+	}
 }
 
 func (m *MockAWSClient) CheckInRancherLicense(ctx context.Context, consumptionToken string) (*lm.CheckInLicenseOutput, error) {
@@ -91,6 +188,13 @@ func (m *MockAWSClient) CheckInRancherLicense(ctx context.Context, consumptionTo
 		return nil, fmt.Errorf("invalid token")
 	}
 	delete(m.CheckedOutEntitlements, consumptionToken)
+	delete(m.checkoutLicenses, consumptionToken)
+	delete(m.checkoutDimensions, consumptionToken)
+	for clientToken, token := range m.clientTokens {
+		if token == consumptionToken {
+			delete(m.clientTokens, clientToken)
+		}
+	}
 	return &lm.CheckInLicenseOutput{}, nil
 }
 
@@ -106,27 +210,43 @@ func (m *MockAWSClient) ExtendRancherLicenseConsumptionToken(ctx context.Context
 	}, nil
 }
 
-func (m *MockAWSClient) GetNumberOfAvailableEntitlements(ctx context.Context, license types.GrantedLicense) (int, error) {
-	currentTotal := 0
-	for _, value := range m.CheckedOutEntitlements {
-		currentTotal += value
+func (m *MockAWSClient) GetNumberOfAvailableEntitlements(ctx context.Context, license types.GrantedLicense, dimension string) (int, error) {
+	current := m.getLicense(*license.LicenseArn)
+	if current == nil {
+		return 0, fmt.Errorf("license not found")
 	}
-	maxEntitlements := m.getMaxRKEEntitlements()
-	remaining := maxEntitlements - currentTotal
+	remaining := getMaxEntitlements(*current, dimension) - m.CheckedOutForDimension(*license.LicenseArn, dimension)
 	if remaining < 0 {
 		return 0, fmt.Errorf("over entitlements")
 	}
 	return remaining, nil
 }
 
+func (m *MockAWSClient) GetNumberOfConsumedEntitlements(ctx context.Context, license types.GrantedLicense, dimension string) (int, error) {
+	if m.getLicense(*license.LicenseArn) == nil {
+		return 0, fmt.Errorf("license not found")
+	}
+	return m.CheckedOutForDimension(*license.LicenseArn, dimension), nil
+}
+
 func (m *MockAWSClient) genConsumptionToken() string {
 	m.CheckoutTokenCtr++
-	return fmt.Sprintf("%d", m.CheckoutTokenCtr)
+	// long enough to be treated as a secret by the redactor, like real tokens
+	return fmt.Sprintf("mock-consumption-token-%d", m.CheckoutTokenCtr)
+}
+
+func (m *MockAWSClient) getLicense(licenseArn string) *types.GrantedLicense {
+	for i := range m.Licenses {
+		if *m.Licenses[i].LicenseArn == licenseArn {
+			return &m.Licenses[i]
+		}
+	}
+	return nil
 }
 
-func (m *MockAWSClient) getMaxRKEEntitlements() int {
-	for _, entitlement := range m.License.Entitlements {
-		if *entitlement.Name == rkeEntitlement {
+func getMaxEntitlements(license types.GrantedLicense, dimension string) int {
+	for _, entitlement := range license.Entitlements {
+		if *entitlement.Name == dimension {
 			return int(*entitlement.MaxCount)
 		}
 	}
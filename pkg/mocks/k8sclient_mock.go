@@ -1,6 +1,9 @@
 package mocks
 
 import (
+	"context"
+
+	"github.com/rancher/csp-adapter/pkg/clients/k8s"
 	corev1 "k8s.io/api/core/v1"
 	apierror "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime/schema"
@@ -9,9 +12,17 @@ import (
 type MockK8sClient struct {
 	CurrentSecretData          map[string]string
 	CurrentSupportConfig       []byte
+	CurrentUsageData           map[string]string
+	CurrentTokenJournal        string
+	CurrentDashboard           string
 	CurrentNotificationMessage string
+	CurrentWarningMessage      string
+	Notifications              map[k8s.NotificationKind]*k8s.Notification
+	AdapterLogs                map[string][]byte
 	RancherHostName            string
 	RancherVersion             string
+	// UsageDataConflicts is how many more calls to UpdateUsageData fail with a conflict
+	UsageDataConflicts int
 }
 
 func NewMockK8sClient(secretData map[string]string) *MockK8sClient {
@@ -21,7 +32,7 @@ func NewMockK8sClient(secretData map[string]string) *MockK8sClient {
 	}
 }
 
-func (m *MockK8sClient) GetConsumptionTokenSecret() (*corev1.Secret, error) {
+func (m *MockK8sClient) GetConsumptionTokenSecret(ctx context.Context) (*corev1.Secret, error) {
 	if m.CurrentSecretData != nil {
 		binData := map[string][]byte{}
 		for key, value := range m.CurrentSecretData {
@@ -35,29 +46,90 @@ func (m *MockK8sClient) GetConsumptionTokenSecret() (*corev1.Secret, error) {
 	return nil, apierror.NewNotFound(schema.GroupResource{Group: "", Resource: "secret"}, "test-secret")
 }
 
-func (m *MockK8sClient) UpdateConsumptionTokenSecret(data map[string]string) error {
+func (m *MockK8sClient) UpdateConsumptionTokenSecret(ctx context.Context, data map[string]string) error {
 	// todo: mock error
 	m.CurrentSecretData = data
 	return nil
 }
 
-func (m *MockK8sClient) UpdateCSPConfigOutput(marshalledData []byte) error {
+func (m *MockK8sClient) UpdateCSPConfigOutput(ctx context.Context, marshalledData []byte) error {
 	//todo: mock error
 	m.CurrentSupportConfig = marshalledData
 	return nil
 }
 
-func (m *MockK8sClient) UpdateUserNotification(isInCompliance bool, message string) error {
-	if !isInCompliance {
-		m.CurrentNotificationMessage = message
+func (m *MockK8sClient) GetCSPConfigOutput(ctx context.Context) ([]byte, error) {
+	if m.CurrentSupportConfig == nil {
+		return nil, apierror.NewNotFound(schema.GroupResource{Group: "", Resource: "configmap"}, "test-configmap")
+	}
+	return m.CurrentSupportConfig, nil
+}
+
+func (m *MockK8sClient) GetAdapterLogs(ctx context.Context, tailLines int64) (map[string][]byte, error) {
+	return m.AdapterLogs, nil
+}
+
+func (m *MockK8sClient) GetUsageData(ctx context.Context) (map[string]string, error) {
+	if m.CurrentUsageData == nil {
+		return nil, apierror.NewNotFound(schema.GroupResource{Group: "", Resource: "configmap"}, "test-configmap")
+	}
+	return m.CurrentUsageData, nil
+}
+
+func (m *MockK8sClient) UpdateUsageData(ctx context.Context, key string, value string) error {
+	if m.UsageDataConflicts > 0 {
+		m.UsageDataConflicts--
+		return apierror.NewConflict(schema.GroupResource{Group: "", Resource: "configmap"}, "test-configmap", nil)
+	}
+	if m.CurrentUsageData == nil {
+		m.CurrentUsageData = map[string]string{}
+	}
+	m.CurrentUsageData[key] = value
+	return nil
+}
+
+func (m *MockK8sClient) GetTokenJournal(ctx context.Context) (string, error) {
+	return m.CurrentTokenJournal, nil
+}
+
+func (m *MockK8sClient) UpdateTokenJournal(ctx context.Context, journal string) error {
+	m.CurrentTokenJournal = journal
+	return nil
+}
+
+func (m *MockK8sClient) UpdateDashboard(ctx context.Context, usage string) error {
+	m.CurrentDashboard = usage
+	return nil
+}
+
+func (m *MockK8sClient) UpdateNotification(ctx context.Context, kind k8s.NotificationKind, notification *k8s.Notification) error {
+	if m.Notifications == nil {
+		m.Notifications = map[k8s.NotificationKind]*k8s.Notification{}
+	}
+	if notification == nil {
+		delete(m.Notifications, kind)
+	} else {
+		m.Notifications[kind] = notification
+	}
+	switch kind {
+	case k8s.NotificationNonCompliance:
+		// the last non-compliance message is kept after compliance is restored, so tests can check what was shown
+		if notification != nil {
+			m.CurrentNotificationMessage = notification.Message
+		}
+	case k8s.NotificationWarning:
+		m.CurrentWarningMessage = ""
+		if notification != nil {
+			m.CurrentWarningMessage = notification.Message
+		}
 	}
 	return nil
 }
 
-func (m *MockK8sClient) GetRancherHostname() (string, error) {
+func (m *MockK8sClient) GetRancherHostname(ctx context.Context) (string, error) {
 	return m.RancherHostName, nil
 }
 
-func (m *MockK8sClient) GetRancherVersion() (string, error) {
+func (m *MockK8sClient) GetRancherVersion(ctx context.Context) (string, error) {
 	return m.RancherVersion, nil
 }
@@ -1,11 +1,16 @@
 package mocks
 
 import (
+	"context"
 	"github.com/rancher/csp-adapter/pkg/metrics"
 )
 
 type MockScraper struct {
 	Nodes int
+	// Clusters is returned as the node count of each cluster, if nil every node is counted in a single cluster
+	Clusters map[string]int
+	// ClusterCPUs is returned as the cpus of each cluster, if nil cpus are reported as not available
+	ClusterCPUs map[string]float64
 }
 
 func NewMockScraper(numNodes int) *MockScraper {
@@ -14,9 +19,21 @@ func NewMockScraper(numNodes int) *MockScraper {
 	}
 }
 
-func (m *MockScraper) ScrapeAndParse() (*metrics.NodeCounts, error) {
+func (m *MockScraper) ScrapeAndParse(ctx context.Context) (*metrics.NodeCounts, error) {
 	// TODO: Error case
-	return &metrics.NodeCounts{
-		Total: m.Nodes,
-	}, nil
+	clusters := m.Clusters
+	if clusters == nil {
+		clusters = map[string]int{"c-m-mock": m.Nodes}
+	}
+	counts := &metrics.NodeCounts{
+		Total:       m.Nodes,
+		Clusters:    clusters,
+		HasCPUs:     m.ClusterCPUs != nil,
+		ClusterCPUs: map[string]float64{},
+	}
+	for id, cpus := range m.ClusterCPUs {
+		counts.CPUs += cpus
+		counts.ClusterCPUs[id] = cpus
+	}
+	return counts, nil
 }
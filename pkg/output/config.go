@@ -0,0 +1,82 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	SinkTypeWebhook = "webhook"
+	SinkTypeFile    = "file"
+	SinkTypeStdout  = "stdout"
+)
+
+// SinkConfig configures a sink, as listed in the sinks configmap
+type SinkConfig struct {
+	// Type is one of the SinkType constants
+	Type string `json:"type"`
+	// URL is where a webhook posts reports to
+	URL string `json:"url,omitempty"`
+	// SecretEnv is the env var holding the secret that a webhook signs requests with. If empty, requests aren't signed
+	SecretEnv string `json:"secretEnv,omitempty"`
+	// Timeout is how long a webhook has to respond, as a duration string. Defaults to DefaultWebhookTimeout
+	Timeout string `json:"timeout,omitempty"`
+	// Path is the file that a file sink writes reports to
+	Path string `json:"path,omitempty"`
+}
+
+// ParseSinks creates the sinks configured in raw, a JSON list of SinkConfig. getenv looks up the env vars holding webhook
+// secrets. Returns an error if any sink is misconfigured, so that a typo doesn't silently drop a sink
+func ParseSinks(raw string, getenv func(string) string) ([]Sink, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var configs []SinkConfig
+	if err := json.Unmarshal([]byte(raw), &configs); err != nil {
+		return nil, fmt.Errorf("unable to parse sinks: %v", err)
+	}
+	sinks := make([]Sink, 0, len(configs))
+	for i, config := range configs {
+		sink, err := config.sink(getenv)
+		if err != nil {
+			return nil, fmt.Errorf("sink %d: %v", i, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+func (c SinkConfig) sink(getenv func(string) string) (Sink, error) {
+	switch c.Type {
+	case SinkTypeWebhook:
+		if c.URL == "" {
+			return nil, fmt.Errorf("webhook requires a url")
+		}
+		var timeout time.Duration
+		if c.Timeout != "" {
+			var err error
+			timeout, err = time.ParseDuration(c.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse webhook timeout: %v", err)
+			}
+		}
+		var secret []byte
+		if c.SecretEnv != "" {
+			secret = []byte(getenv(c.SecretEnv))
+			if len(secret) == 0 {
+				return nil, fmt.Errorf("webhook secret env var %s is not set", c.SecretEnv)
+			}
+		}
+		return NewWebhookSink(c.URL, secret, timeout), nil
+	case SinkTypeFile:
+		if c.Path == "" {
+			return nil, fmt.Errorf("file requires a path")
+		}
+		return NewFileSink(c.Path), nil
+	case SinkTypeStdout:
+		return NewStdoutSink(), nil
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", c.Type)
+	}
+}
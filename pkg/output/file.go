@@ -0,0 +1,74 @@
+package output
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileSink stores the most recent report as JSON in a local file
+type FileSink struct {
+	path string
+}
+
+func NewFileSink(path string) *FileSink {
+	return &FileSink{path: path}
+}
+
+func (f *FileSink) Name() string {
+	return "file " + f.path
+}
+
+// Write replaces the file with report. The report is written to a temporary file which is renamed over the file, so
+// readers never see a partial report
+func (f *FileSink) Write(_ context.Context, report Report) error {
+	body, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to marshal report: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// StreamSink writes each report to a stream as a line of JSON
+type StreamSink struct {
+	name string
+	mu   sync.Mutex
+	w    io.Writer
+}
+
+// NewStdoutSink creates a sink which writes each report to stdout as a line of JSON
+func NewStdoutSink() *StreamSink {
+	return NewStreamSink("stdout", os.Stdout)
+}
+
+// NewStreamSink creates a sink called name which writes each report to w as a line of JSON
+func NewStreamSink(name string, w io.Writer) *StreamSink {
+	return &StreamSink{name: name, w: w}
+}
+
+func (s *StreamSink) Name() string {
+	return s.name
+}
+
+func (s *StreamSink) Write(_ context.Context, report Report) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// the encoder terminates each report with a newline
+	return json.NewEncoder(s.w).Encode(report)
+}
@@ -0,0 +1,72 @@
+package output
+
+import (
+	"context"
+	"github.com/rancher/csp-adapter/pkg/clients/k8s"
+	"github.com/rancher/csp-adapter/pkg/logging"
+)
+
+// ConfigWriter stores the support config, as implemented by k8s.Client
+type ConfigWriter interface {
+	UpdateCSPConfigOutput(ctx context.Context, marshalledData []byte) error
+}
+
+// Notifier shows messages to rancher's users, as implemented by k8s.Client
+type Notifier interface {
+	UpdateNotification(ctx context.Context, kind k8s.NotificationKind, notification *k8s.Notification) error
+}
+
+// ConfigMapSink stores the support config from each report in the csp-config configmap
+type ConfigMapSink struct {
+	client ConfigWriter
+}
+
+func NewConfigMapSink(client ConfigWriter) *ConfigMapSink {
+	return &ConfigMapSink{client: client}
+}
+
+func (c *ConfigMapSink) Name() string {
+	return "configmap"
+}
+
+func (c *ConfigMapSink) Write(ctx context.Context, report Report) error {
+	return c.client.UpdateCSPConfigOutput(ctx, report.Config)
+}
+
+// NotificationSink shows the messages from each report to rancher's users as RancherUserNotifications. Non-compliance
+// is shown as an error and warnings as a warning, each in its own notification, and both include links for the user to
+// act on
+type NotificationSink struct {
+	client Notifier
+	links  []k8s.Link
+}
+
+func NewNotificationSink(client Notifier, links []k8s.Link) *NotificationSink {
+	return &NotificationSink{client: client, links: links}
+}
+
+func (n *NotificationSink) Name() string {
+	return "notification"
+}
+
+func (n *NotificationSink) Write(ctx context.Context, report Report) error {
+	var nonCompliance *k8s.Notification
+	if !report.InCompliance {
+		nonCompliance = &k8s.Notification{Severity: k8s.SeverityError, Message: report.Notification, Links: n.links}
+	}
+	if err := n.client.UpdateNotification(ctx, k8s.NotificationNonCompliance, nonCompliance); err != nil {
+		return err
+	}
+	var warning *k8s.Notification
+	if report.Warning != "" {
+		warning = &k8s.Notification{Severity: k8s.SeverityWarning, Message: report.Warning, Links: n.links}
+	}
+	if err := n.client.UpdateNotification(ctx, k8s.NotificationWarning, warning); err != nil {
+		return err
+	}
+	// a report means the adapter started, so any notification left from a failed start no longer applies
+	if err := n.client.UpdateNotification(ctx, k8s.NotificationStartupError, nil); err != nil {
+		logging.FromContext(ctx).Warnf("unable to remove startup error notification: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+// Package output delivers the result of each compliance check to the sinks that report it, such as the csp-config
+// configmap, rancher's notifications, or a webhook
+package output
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rancher/csp-adapter/pkg/logging"
+	"github.com/rancher/csp-adapter/pkg/redact"
+)
+
+// Report is the result of a compliance check, as delivered to each sink
+type Report struct {
+	Time         time.Time `json:"time"`
+	InCompliance bool      `json:"inCompliance"`
+	// Notification is the user-facing message about compliance, shown in rancher while out of compliance
+	Notification string `json:"notification"`
+	// Warning is a user-facing warning shown while in compliance, empty if there is nothing to warn about
+	Warning string `json:"warning,omitempty"`
+	// Config is the marshalled support config, as stored in the csp-config configmap
+	Config json.RawMessage `json:"config"`
+}
+
+// Sink is somewhere that the result of each compliance check is delivered to
+type Sink interface {
+	// Name identifies the sink in logs and errors
+	Name() string
+	// Write delivers report to the sink, returning an error if it couldn't be delivered
+	Write(ctx context.Context, report Report) error
+}
+
+// Fanout writes each report to several sinks. Each sink is written to independently, so that a slow or failing sink
+// doesn't hold up the others
+type Fanout struct {
+	required []Sink
+	optional []Sink
+	redactor *redact.Redactor
+}
+
+// NewFanout creates a Fanout which writes to the required and the optional sinks. Failures of required sinks are
+// returned from Write, failures of optional sinks are only logged. Secrets known to redactor are masked from every
+// report, and account numbers are also masked from the reports written to optional sinks, since those can leave the
+// cluster. A nil redactor masks nothing
+func NewFanout(required []Sink, optional []Sink, redactor *redact.Redactor) *Fanout {
+	return &Fanout{
+		required: required,
+		optional: optional,
+		redactor: redactor,
+	}
+}
+
+func (f *Fanout) Name() string {
+	return "fanout"
+}
+
+// Write writes report to every sink concurrently, returning once every sink has finished. Returns an error if any of the
+// required sinks failed
+func (f *Fanout) Write(ctx context.Context, report Report) error {
+	sinks := append(append([]Sink{}, f.required...), f.optional...)
+	internal, external := report, report
+	if f.redactor != nil {
+		internal = redactReport(report, f.redactor.RedactSecrets)
+		external = redactReport(report, f.redactor.Redact)
+	}
+	errs := make([]error, len(sinks))
+	var wg sync.WaitGroup
+	for i, sink := range sinks {
+		sinkReport := external
+		if i < len(f.required) {
+			sinkReport = internal
+		}
+		wg.Add(1)
+		go func(i int, sink Sink, report Report) {
+			defer wg.Done()
+			errs[i] = write(ctx, sink, report)
+		}(i, sink, sinkReport)
+	}
+	wg.Wait()
+
+	var requiredErrs []error
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if i < len(f.required) {
+			requiredErrs = append(requiredErrs, err)
+			continue
+		}
+		logging.FromContext(ctx).Warnf("unable to write compliance report to sink %s: %v", sinks[i].Name(), err)
+	}
+	if len(requiredErrs) == 1 {
+		return requiredErrs[0]
+	}
+	if len(requiredErrs) > 1 {
+		return fmt.Errorf("unable to write compliance report %v", requiredErrs)
+	}
+	return nil
+}
+
+// redactReport gives report with redact applied to each of its messages and to the support config
+func redactReport(report Report, redact func(string) string) Report {
+	report.Notification = redact(report.Notification)
+	report.Warning = redact(report.Warning)
+	if report.Config != nil {
+		report.Config = json.RawMessage(redact(string(report.Config)))
+	}
+	return report
+}
+
+// write writes report to sink, converting a panic into an error so that a broken sink can't take down the others
+func write(ctx context.Context, sink Sink, report Report) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("sink %s panicked: %v", sink.Name(), r)
+		}
+	}()
+	return sink.Write(ctx, report)
+}
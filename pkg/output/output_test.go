@@ -0,0 +1,282 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rancher/csp-adapter/pkg/clients/k8s"
+	"github.com/rancher/csp-adapter/pkg/mocks"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingSink records the reports written to it, failing with err if set
+type recordingSink struct {
+	name    string
+	err     error
+	panics  bool
+	written int32
+}
+
+func (r *recordingSink) Name() string {
+	return r.name
+}
+
+func (r *recordingSink) Write(_ context.Context, report Report) error {
+	atomic.AddInt32(&r.written, 1)
+	if r.panics {
+		panic("broken sink")
+	}
+	return r.err
+}
+
+func testReport() Report {
+	return Report{
+		Time:         time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		InCompliance: false,
+		Notification: "not compliant",
+		Config:       json.RawMessage(`{"compliance":{"status":"NonCompliant"}}`),
+	}
+}
+
+func TestFanout(t *testing.T) {
+	tests := []struct {
+		name        string // name of the test, to be displayed on failure
+		requiredErr error  // error returned by the required sink
+		optionalErr error  // error returned by the first optional sink
+		panics      bool   // if the first optional sink panics
+		errDesired  bool   // if the fanout should return an error
+	}{
+		{
+			name: "all sinks succeed",
+		},
+		{
+			name:        "required sink fails",
+			requiredErr: fmt.Errorf("configmap unavailable"),
+			errDesired:  true,
+		},
+		{
+			name:        "optional sink fails",
+			optionalErr: fmt.Errorf("webhook unavailable"),
+		},
+		{
+			name:   "optional sink panics",
+			panics: true,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			required := &recordingSink{name: "required", err: test.requiredErr}
+			failing := &recordingSink{name: "failing", err: test.optionalErr, panics: test.panics}
+			healthy := &recordingSink{name: "healthy"}
+			fanout := NewFanout([]Sink{required}, []Sink{failing, healthy}, nil)
+			err := fanout.Write(context.TODO(), testReport())
+			if test.errDesired {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			// every sink is written to, whatever happens to the others
+			for _, sink := range []*recordingSink{required, failing, healthy} {
+				assert.Equal(t, int32(1), atomic.LoadInt32(&sink.written), "sink %s", sink.name)
+			}
+		})
+	}
+}
+
+func TestNotificationSink(t *testing.T) {
+	links := []k8s.Link{{Title: "Marketplace", URL: "https://example.com/marketplace"}}
+	client := mocks.NewMockK8sClient(nil)
+	client.Notifications = map[k8s.NotificationKind]*k8s.Notification{
+		k8s.NotificationStartupError: {Severity: k8s.SeverityError, Message: "unable to start"},
+	}
+	sink := NewNotificationSink(client, links)
+
+	require.NoError(t, sink.Write(context.TODO(), Report{InCompliance: false, Notification: "out of compliance"}))
+	assert.Equal(t, map[k8s.NotificationKind]*k8s.Notification{
+		k8s.NotificationNonCompliance: {Severity: k8s.SeverityError, Message: "out of compliance", Links: links},
+	}, client.Notifications, "expected only the non-compliance notification, with the startup error cleared")
+
+	require.NoError(t, sink.Write(context.TODO(), Report{InCompliance: true, Warning: "running out"}))
+	assert.Equal(t, map[k8s.NotificationKind]*k8s.Notification{
+		k8s.NotificationWarning: {Severity: k8s.SeverityWarning, Message: "running out", Links: links},
+	}, client.Notifications, "expected only the warning notification")
+
+	require.NoError(t, sink.Write(context.TODO(), Report{InCompliance: true}))
+	assert.Empty(t, client.Notifications)
+}
+
+func TestWebhookSink(t *testing.T) {
+	secret := []byte("hmac-secret")
+	var received Report
+	var signature string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		signature = r.Header.Get(SignatureHeader)
+		if signature != "" {
+			assert.Equal(t, Sign(secret, body), signature, "expected the signature to match the body")
+		}
+		assert.NoError(t, json.Unmarshal(body, &received))
+	}))
+	defer server.Close()
+
+	report := testReport()
+	require.NoError(t, NewWebhookSink(server.URL, secret, time.Second).Write(context.TODO(), report))
+	assert.True(t, strings.HasPrefix(signature, "sha256="))
+	assert.Equal(t, report.Notification, received.Notification)
+	assert.JSONEq(t, string(report.Config), string(received.Config))
+
+	// unsigned without a secret
+	require.NoError(t, NewWebhookSink(server.URL, nil, time.Second).Write(context.TODO(), report))
+	assert.Empty(t, signature)
+}
+
+func TestWebhookSinkFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	assert.Error(t, NewWebhookSink(server.URL, nil, time.Second).Write(context.TODO(), testReport()), "expected an error status to fail")
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	assert.Error(t, NewWebhookSink(slow.URL, nil, 50*time.Millisecond).Write(context.TODO(), testReport()), "expected a slow webhook to time out")
+}
+
+func TestUnreachableWebhookSinkURLNotLogged(t *testing.T) {
+	// a closed server's address refuses connections, and the path is a secret as in chat webhooks
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	sinkURL := server.URL + "/hooks/sink-secret-value"
+	sink := NewWebhookSink(sinkURL, nil, time.Second)
+
+	logger := logrus.StandardLogger()
+	var logs bytes.Buffer
+	level, out := logger.GetLevel(), logger.Out
+	logger.SetOutput(&logs)
+	logger.SetLevel(logrus.DebugLevel)
+	defer func() {
+		logger.SetOutput(out)
+		logger.SetLevel(level)
+	}()
+
+	fanout := NewFanout([]Sink{&recordingSink{name: "required"}}, []Sink{sink}, nil)
+	require.NoError(t, fanout.Write(context.TODO(), testReport()))
+	assert.Contains(t, logs.String(), "unable to post report to "+sink.host)
+	assert.NotContains(t, logs.String(), "sink-secret-value")
+	assert.NotContains(t, logs.String(), sinkURL)
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+	sink := NewFileSink(path)
+	first := testReport()
+	require.NoError(t, sink.Write(context.TODO(), first))
+	second := testReport()
+	second.InCompliance = true
+	require.NoError(t, sink.Write(context.TODO(), second))
+
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var stored Report
+	require.NoError(t, json.Unmarshal(raw, &stored))
+	assert.True(t, stored.InCompliance, "expected the file to hold the latest report")
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "expected no temporary files to be left behind")
+}
+
+func TestStreamSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewStreamSink("buffer", &buf)
+	require.NoError(t, sink.Write(context.TODO(), testReport()))
+	require.NoError(t, sink.Write(context.TODO(), testReport()))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 2)
+	for _, line := range lines {
+		var report Report
+		assert.NoError(t, json.Unmarshal([]byte(line), &report))
+	}
+}
+
+func TestParseSinks(t *testing.T) {
+	env := map[string]string{"WEBHOOK_SECRET": "hmac-secret"}
+	getenv := func(key string) string { return env[key] }
+	tests := []struct {
+		name          string   // name of the test, to be displayed on failure
+		raw           string   // sinks configmap contents
+		expectedNames []string // names of the sinks expected, in order
+		errDesired    bool     // if parsing should fail
+	}{
+		{
+			name: "no sinks",
+			raw:  "",
+		},
+		{
+			name:          "every sink type",
+			raw:           `[{"type":"webhook","url":"https://example.com/hook","secretEnv":"WEBHOOK_SECRET","timeout":"5s"},{"type":"file","path":"/tmp/report.json"},{"type":"stdout"}]`,
+			expectedNames: []string{"webhook to example.com", "file /tmp/report.json", "stdout"},
+		},
+		{
+			name:       "webhook without url",
+			raw:        `[{"type":"webhook"}]`,
+			errDesired: true,
+		},
+		{
+			name:       "webhook secret not set",
+			raw:        `[{"type":"webhook","url":"https://example.com/hook","secretEnv":"MISSING"}]`,
+			errDesired: true,
+		},
+		{
+			name:       "invalid timeout",
+			raw:        `[{"type":"webhook","url":"https://example.com/hook","timeout":"soon"}]`,
+			errDesired: true,
+		},
+		{
+			name:       "file without path",
+			raw:        `[{"type":"file"}]`,
+			errDesired: true,
+		},
+		{
+			name:       "unknown type",
+			raw:        `[{"type":"email"}]`,
+			errDesired: true,
+		},
+		{
+			name:       "invalid json",
+			raw:        `{"type":"stdout"}`,
+			errDesired: true,
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			sinks, err := ParseSinks(test.raw, getenv)
+			if test.errDesired {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			var names []string
+			for _, sink := range sinks {
+				names = append(names, sink.Name())
+			}
+			assert.Equal(t, test.expectedNames, names)
+		})
+	}
+}
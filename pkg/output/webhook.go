@@ -0,0 +1,97 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// SignatureHeader holds the hex-encoded HMAC-SHA256 of the request body, prefixed with "sha256=", when the webhook has
+	// a secret
+	SignatureHeader = "X-CSP-Adapter-Signature"
+	// DefaultWebhookTimeout is how long a webhook has to respond before the delivery fails
+	DefaultWebhookTimeout = 10 * time.Second
+)
+
+// WebhookSink POSTs each report as JSON to a url
+type WebhookSink struct {
+	url string
+	// host is the host of url, which identifies the sink in logs without the rest of the url, which may hold a secret
+	host   string
+	secret []byte
+	client *http.Client
+}
+
+// NewWebhookSink creates a sink which posts to url. If secret isn't empty, each request is signed with it, see
+// SignatureHeader
+func NewWebhookSink(sinkURL string, secret []byte, timeout time.Duration) *WebhookSink {
+	if timeout <= 0 {
+		timeout = DefaultWebhookTimeout
+	}
+	var host string
+	if parsed, err := url.Parse(sinkURL); err == nil {
+		host = parsed.Host
+	}
+	return &WebhookSink{
+		url:    sinkURL,
+		host:   host,
+		secret: secret,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (w *WebhookSink) Name() string {
+	if w.host == "" {
+		return "webhook"
+	}
+	return "webhook to " + w.host
+}
+
+func (w *WebhookSink) Write(ctx context.Context, report Report) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("unable to marshal report: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		// the error quotes the url, so only say that it couldn't be used
+		return fmt.Errorf("unable to create a request to %s", w.host)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.secret) > 0 {
+		req.Header.Set(SignatureHeader, Sign(w.secret, body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		// the client's errors contain the url, which is logged when an optional sink fails
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return fmt.Errorf("unable to post report to %s: %w", w.host, urlErr.Err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	// drain the body so the connection can be reused
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign gives the signature of body with secret, in the format sent in SignatureHeader
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
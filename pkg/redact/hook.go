@@ -0,0 +1,44 @@
+package redact
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Hook is a logrus hook which masks sensitive values in each entry's message and fields before it is written
+type Hook struct {
+	redactor *Redactor
+}
+
+// NewHook gives a hook which masks the values known to redactor, install it with logrus.AddHook
+func NewHook(redactor *Redactor) *Hook {
+	return &Hook{redactor: redactor}
+}
+
+func (h *Hook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *Hook) Fire(entry *logrus.Entry) error {
+	entry.Message = h.redactor.Redact(entry.Message)
+	if len(entry.Data) == 0 {
+		return nil
+	}
+	// fields are replaced rather than edited in place, since the map may be shared with other entries
+	data := make(logrus.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			data[key] = h.redactor.Redact(v)
+		case error:
+			data[key] = h.redactor.Redact(v.Error())
+		case fmt.Stringer:
+			data[key] = h.redactor.Redact(v.String())
+		default:
+			data[key] = value
+		}
+	}
+	entry.Data = data
+	return nil
+}
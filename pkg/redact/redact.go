@@ -0,0 +1,179 @@
+// Package redact masks sensitive values, such as consumption tokens and bearer tokens, before they reach the adapter's
+// logs or outputs
+package redact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// Mask replaces bearer tokens
+	Mask = "REDACTED"
+	// accountMask replaces account numbers
+	accountMask = "REDACTED-ACCOUNT"
+	// maxTokens is how many consumption tokens are remembered. Each extension gives a new token, so the oldest are
+	// forgotten once they can no longer be in use
+	maxTokens = 256
+	// minSecretLength is the shortest value which is masked. Real tokens are far longer, and masking short values would
+	// mangle unrelated text which happens to contain them
+	minSecretLength = 16
+	// tokenIDLength is the number of hex characters of the token hash kept as the token id
+	tokenIDLength = 12
+)
+
+// bearerPattern matches bearer tokens in Authorization headers, so that they are masked even if they were never added
+var bearerPattern = regexp.MustCompile(`(?i)(bearer\s+)[^\s"',]+`)
+
+// Redactor masks the sensitive values added to it wherever they appear. Values are added as they are found, such as
+// when a license is checked out, since tokens are opaque and can't be recognized by their format. It is safe for
+// concurrent use
+type Redactor struct {
+	mu sync.RWMutex
+	// secrets holds the replacement for each value which is always masked
+	secrets map[string]string
+	// tokens holds the consumption tokens in secrets, oldest first
+	tokens []string
+	// accounts holds the account numbers which are masked if redactAccounts is set
+	accounts       map[string]bool
+	redactAccounts bool
+	// ordered holds every value to mask, longest first, so that a value containing another is replaced whole. It is
+	// rebuilt when a value is added
+	ordered []string
+}
+
+func New() *Redactor {
+	return &Redactor{
+		secrets:  map[string]string{},
+		accounts: map[string]bool{},
+	}
+}
+
+var defaultRedactor = New()
+
+// Default gives the redactor used by the log hook, to which every sensitive value found by the adapter is added
+func Default() *Redactor {
+	return defaultRedactor
+}
+
+// TokenID identifies a consumption token without revealing it, it is the id used for tokens in the usage ledger
+func TokenID(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])[:tokenIDLength]
+}
+
+// TokenReplacement gives what a consumption token is replaced with. It includes the token's id, so that a masked token
+// can still be matched up with the usage ledger and with other occurrences of the same token
+func TokenReplacement(token string) string {
+	return "REDACTED(" + TokenID(token) + ")"
+}
+
+// AddToken masks the consumption token from now on
+func (r *Redactor) AddToken(token string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.addSecret(token, TokenReplacement(token)) {
+		return
+	}
+	r.tokens = append(r.tokens, token)
+	if len(r.tokens) > maxTokens {
+		delete(r.secrets, r.tokens[0])
+		r.tokens = r.tokens[1:]
+	}
+	r.reorder()
+}
+
+// AddBearerToken masks the bearer token, such as the one from a rest.Config, from now on
+func (r *Redactor) AddBearerToken(token string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.addSecret(token, Mask) {
+		r.reorder()
+	}
+}
+
+// addSecret masks value with replacement from now on, returning false if value is too short to mask or was already
+// masked. The caller must hold the lock and reorder if a secret was added
+func (r *Redactor) addSecret(value, replacement string) bool {
+	if len(value) < minSecretLength {
+		return false
+	}
+	if _, ok := r.secrets[value]; ok {
+		return false
+	}
+	r.secrets[value] = replacement
+	return true
+}
+
+// AddAccount masks the account number from now on, if account numbers are being redacted
+func (r *Redactor) AddAccount(account string) {
+	if account == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.accounts[account] {
+		return
+	}
+	r.accounts[account] = true
+	r.reorder()
+}
+
+// RedactAccounts sets whether account numbers are masked by Redact. They are never masked by RedactSecrets
+func (r *Redactor) RedactAccounts(enabled bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.redactAccounts = enabled
+}
+
+func (r *Redactor) reorder() {
+	ordered := make([]string, 0, len(r.secrets)+len(r.accounts))
+	for value := range r.secrets {
+		ordered = append(ordered, value)
+	}
+	for account := range r.accounts {
+		if _, ok := r.secrets[account]; !ok {
+			ordered = append(ordered, account)
+		}
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		return len(ordered[i]) > len(ordered[j])
+	})
+	r.ordered = ordered
+}
+
+// Redact masks every secret in s, along with account numbers if they are being redacted. It is used for output which
+// leaves the cluster, such as logs and additional output sinks
+func (r *Redactor) Redact(s string) string {
+	return r.redact(s, true)
+}
+
+// RedactSecrets masks every secret in s, but leaves account numbers. It is used for output which needs the account
+// number, such as the support config in the csp-config configmap
+func (r *Redactor) RedactSecrets(s string) string {
+	return r.redact(s, false)
+}
+
+func (r *Redactor) redact(s string, accounts bool) string {
+	if s == "" {
+		return s
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	accounts = accounts && r.redactAccounts
+	for _, value := range r.ordered {
+		if replacement, ok := r.secrets[value]; ok {
+			s = strings.ReplaceAll(s, value, replacement)
+		} else if accounts {
+			s = strings.ReplaceAll(s, value, accountMask)
+		}
+	}
+	return bearerPattern.ReplaceAllString(s, "${1}"+Mask)
+}
@@ -0,0 +1,108 @@
+package redact
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	token   = "AQICAHh-consumption-token-value"
+	bearer  = "kubeconfig-user-abcdef:0123456789abcdef"
+	account = "123456789012"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name            string // name of the test, to be displayed on failure
+		redactAccounts  bool   // whether account numbers are redacted
+		input           string // string to redact
+		expected        string // expected result of Redact
+		expectedSecrets string // expected result of RedactSecrets
+	}{
+		{
+			name:            "consumption token",
+			input:           "extended " + token,
+			expected:        "extended " + TokenReplacement(token),
+			expectedSecrets: "extended " + TokenReplacement(token),
+		},
+		{
+			name:            "added bearer token",
+			input:           "token=" + bearer,
+			expected:        "token=" + Mask,
+			expectedSecrets: "token=" + Mask,
+		},
+		{
+			name:            "unknown bearer token in a header",
+			input:           `Authorization: Bearer some-other-token, next`,
+			expected:        `Authorization: Bearer ` + Mask + `, next`,
+			expectedSecrets: `Authorization: Bearer ` + Mask + `, next`,
+		},
+		{
+			name:            "account kept by default",
+			input:           "arn:aws:license-manager::" + account + ":license:l-1",
+			expected:        "arn:aws:license-manager::" + account + ":license:l-1",
+			expectedSecrets: "arn:aws:license-manager::" + account + ":license:l-1",
+		},
+		{
+			name:            "account redacted",
+			redactAccounts:  true,
+			input:           "arn:aws:license-manager::" + account + ":license:l-1",
+			expected:        "arn:aws:license-manager::" + accountMask + ":license:l-1",
+			expectedSecrets: "arn:aws:license-manager::" + account + ":license:l-1",
+		},
+		{
+			name:            "nothing sensitive",
+			redactAccounts:  true,
+			input:           "checked out 2 license(s)",
+			expected:        "checked out 2 license(s)",
+			expectedSecrets: "checked out 2 license(s)",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			r := New()
+			r.AddToken(token)
+			r.AddBearerToken(bearer)
+			r.AddAccount(account)
+			r.RedactAccounts(test.redactAccounts)
+			assert.Equal(t, test.expected, r.Redact(test.input))
+			assert.Equal(t, test.expectedSecrets, r.RedactSecrets(test.input))
+		})
+	}
+}
+
+func TestShortValuesAreNotMasked(t *testing.T) {
+	r := New()
+	r.AddToken("1")
+	assert.Equal(t, "checked out 1 license(s)", r.Redact("checked out 1 license(s)"))
+}
+
+func TestOldTokensAreForgotten(t *testing.T) {
+	r := New()
+	first := fmt.Sprintf("%s-%d", token, 0)
+	r.AddToken(first)
+	for i := 1; i <= maxTokens; i++ {
+		r.AddToken(fmt.Sprintf("%s-%d", token, i))
+	}
+	assert.Equal(t, first, r.Redact(first))
+	latest := fmt.Sprintf("%s-%d", token, maxTokens)
+	assert.Equal(t, TokenReplacement(latest), r.Redact(latest))
+}
+
+func TestHook(t *testing.T) {
+	r := New()
+	r.AddToken(token)
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+	logger.AddHook(NewHook(r))
+	logger.WithField("token", token).WithError(errors.New("invalid token "+token)).Warnf("unable to extend %s", token)
+	assert.NotContains(t, buf.String(), token)
+	assert.Contains(t, buf.String(), TokenReplacement(token))
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+// Reviewer checks who the bearer token of a request belongs to, and what they may access, such as with a kubernetes
+// TokenReview and SubjectAccessReview
+type Reviewer interface {
+	// ReviewToken gives the user that token authenticates as, and whether it is valid
+	ReviewToken(ctx context.Context, token string) (user authenticationv1.UserInfo, authenticated bool, err error)
+	// ReviewAccess gives whether user may act on the resource described by attributes
+	ReviewAccess(ctx context.Context, user authenticationv1.UserInfo, attributes authorizationv1.ResourceAttributes) (allowed bool, err error)
+}
+
+// Authorized only serves requests to handler which have a bearer token accepted by reviewer, for a user that reviewer
+// allows the access described by attributes. Requests without a valid token are rejected as unauthorized, and those of
+// users without the access as forbidden
+func Authorized(reviewer Reviewer, attributes authorizationv1.ResourceAttributes, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "a bearer token is required", http.StatusUnauthorized)
+			return
+		}
+		user, authenticated, err := reviewer.ReviewToken(r.Context(), token)
+		if err != nil {
+			logrus.Warnf("[server] unable to authenticate request to %s: %v", r.URL.Path, err)
+			http.Error(w, "unable to authenticate request", http.StatusInternalServerError)
+			return
+		}
+		if !authenticated {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+		allowed, err := reviewer.ReviewAccess(r.Context(), user, attributes)
+		if err != nil {
+			logrus.Warnf("[server] unable to authorize %s for %s: %v", user.Username, r.URL.Path, err)
+			http.Error(w, "unable to authorize request", http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			logrus.Debugf("[server] %s is not allowed to %s %s/%s %s in %s", user.Username, attributes.Verb, attributes.Resource, attributes.Subresource, attributes.Name, attributes.Namespace)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		logrus.Debugf("[server] %s authorized for %s", user.Username, r.URL.Path)
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+// apiAccess is the access required in the tests
+var apiAccess = authorizationv1.ResourceAttributes{Namespace: "cattle-csp-adapter-system", Verb: "get", Resource: "services", Subresource: "proxy", Name: "rancher-csp-adapter"}
+
+type fakeReviewer struct {
+	// tokens holds the user each valid token authenticates as
+	tokens map[string]string
+	// allowed holds the users granted apiAccess
+	allowed   map[string]bool
+	err       error
+	accessErr error
+}
+
+func (f *fakeReviewer) ReviewToken(_ context.Context, token string) (authenticationv1.UserInfo, bool, error) {
+	if f.err != nil {
+		return authenticationv1.UserInfo{}, false, f.err
+	}
+	user, ok := f.tokens[token]
+	return authenticationv1.UserInfo{Username: user}, ok, nil
+}
+
+func (f *fakeReviewer) ReviewAccess(_ context.Context, user authenticationv1.UserInfo, attributes authorizationv1.ResourceAttributes) (bool, error) {
+	if f.accessErr != nil {
+		return false, f.accessErr
+	}
+	return attributes == apiAccess && f.allowed[user.Username], nil
+}
+
+func TestAuthorized(t *testing.T) {
+	tests := []struct {
+		name          string // name of the test, to be displayed on failure
+		authorization string // value of the Authorization header, omitted if empty
+		reviewErr     error  // error returned by the token review
+		accessErr     error  // error returned by the access review
+		expectedCode  int    // status code expected in the response
+	}{
+		{
+			name:          "valid token",
+			authorization: "Bearer valid",
+			expectedCode:  http.StatusOK,
+		},
+		{
+			name:         "no token",
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:          "not a bearer token",
+			authorization: "Basic dXNlcjpwYXNz",
+			expectedCode:  http.StatusUnauthorized,
+		},
+		{
+			name:          "invalid token",
+			authorization: "Bearer invalid",
+			expectedCode:  http.StatusUnauthorized,
+		},
+		{
+			name:          "valid token without access",
+			authorization: "Bearer denied",
+			expectedCode:  http.StatusForbidden,
+		},
+		{
+			name:          "review failed",
+			authorization: "Bearer valid",
+			reviewErr:     errors.New("connection refused"),
+			expectedCode:  http.StatusInternalServerError,
+		},
+		{
+			name:          "access review failed",
+			authorization: "Bearer valid",
+			accessErr:     errors.New("connection refused"),
+			expectedCode:  http.StatusInternalServerError,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reviewer := &fakeReviewer{
+				tokens:    map[string]string{"valid": "admin", "denied": "system:serviceaccount:default:default"},
+				allowed:   map[string]bool{"admin": true},
+				err:       test.reviewErr,
+				accessErr: test.accessErr,
+			}
+			handler := Authorized(reviewer, apiAccess, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/v1/status/decisions", nil)
+			if test.authorization != "" {
+				req.Header.Set("Authorization", test.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			assert.Equal(t, test.expectedCode, rec.Code)
+		})
+	}
+}
@@ -0,0 +1,60 @@
+// Package server runs the adapter's http api, which exposes the data gathered by the manager to other tools
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const shutdownTimeout = 5 * time.Second
+
+// Server is an http server which other packages register their handlers with
+type Server struct {
+	addr string
+	mux  *http.ServeMux
+}
+
+// New creates a server which listens on addr once started
+func New(addr string) *Server {
+	return &Server{
+		addr: addr,
+		mux:  http.NewServeMux(),
+	}
+}
+
+// Handle registers handler for requests matching pattern, see http.ServeMux for the pattern syntax
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// ServeHTTP allows the server's handlers to be used without listening, such as in tests
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Start listens in the background until ctx is done, sending any error which stops the server to errs
+func (s *Server) Start(ctx context.Context, errs chan<- error) {
+	httpServer := &http.Server{
+		Addr:              s.addr,
+		Handler:           s.mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			logrus.Warnf("[server] unable to shutdown cleanly: %v", err)
+		}
+	}()
+	go func() {
+		logrus.Infof("[server] listening on %s", s.addr)
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errs <- err
+		}
+	}()
+}
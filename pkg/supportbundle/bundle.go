@@ -0,0 +1,270 @@
+// Package supportbundle collects the adapter's logs and state into a tarball which can be attached to a support case,
+// so that none of it needs to be gathered by hand with kubectl
+package supportbundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/licensemanager/types"
+	"github.com/rancher/csp-adapter/pkg/clients/aws"
+	"github.com/rancher/csp-adapter/pkg/clients/k8s"
+	"github.com/rancher/csp-adapter/pkg/ledger"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultLogLines is how many of the most recent lines of each pod's logs are included by default
+	DefaultLogLines = 5000
+	// DefaultHistory is how far back the usage history included by default goes
+	DefaultHistory = 30 * 24 * time.Hour
+)
+
+// K8sClient reads the adapter's state from k8s, as implemented by k8s.Clients
+type K8sClient interface {
+	k8s.Client
+	k8s.SupportReader
+}
+
+// Options configures what is collected into a bundle
+type Options struct {
+	// Accounts are the aws accounts the adapter checks out licenses from, the adapter's own account first
+	Accounts []aws.Client
+	// LogLines is how many of the most recent lines of each pod's logs to include. Defaults to DefaultLogLines
+	LogLines int64
+	// History is how far back the usage history goes. Defaults to DefaultHistory
+	History time.Duration
+	// Version is the version of the adapter, recorded in the bundle's metadata
+	Version string
+}
+
+// Metadata describes a bundle, it is stored as metadata.json. Errors lists anything that couldn't be collected, so
+// that a partial bundle can still be used
+type Metadata struct {
+	Version   string    `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	Errors    []string  `json:"errors,omitempty"`
+}
+
+// AccountLicenses holds the rancher licenses in a single account, it is stored in licenses.json
+type AccountLicenses struct {
+	Account  string           `json:"account"`
+	Licenses []LicenseDetails `json:"licenses,omitempty"`
+	Error    string           `json:"error,omitempty"`
+}
+
+// LicenseDetails holds a license as returned by aws, along with its entitlement usage. Available and Consumed are of
+// the RKE_NODE_SUPP entitlement, the usage of every entitlement granted by the license is in Entitlements
+type LicenseDetails struct {
+	License      types.GrantedLicense `json:"license"`
+	Available    *int                 `json:"availableEntitlements,omitempty"`
+	Consumed     *int                 `json:"consumedEntitlements,omitempty"`
+	Entitlements []EntitlementUsage   `json:"entitlements,omitempty"`
+	Errors       []string             `json:"errors,omitempty"`
+}
+
+// EntitlementUsage holds the usage of a single entitlement dimension of a license
+type EntitlementUsage struct {
+	Dimension string `json:"dimension"`
+	Available *int   `json:"available,omitempty"`
+	Consumed  *int   `json:"consumed,omitempty"`
+}
+
+// Collector collects bundles
+type Collector struct {
+	k8s  K8sClient
+	opts Options
+	now  func() time.Time
+}
+
+func NewCollector(k K8sClient, opts Options) *Collector {
+	if opts.LogLines <= 0 {
+		opts.LogLines = DefaultLogLines
+	}
+	if opts.History <= 0 {
+		opts.History = DefaultHistory
+	}
+	return &Collector{
+		k8s:  k,
+		opts: opts,
+		now:  time.Now,
+	}
+}
+
+// file is a single file in a bundle
+type file struct {
+	name string
+	data []byte
+}
+
+// Write collects a bundle and writes it to w as a gzipped tarball. Anything which can't be collected is recorded in
+// the bundle's metadata rather than failing the bundle, so only a failure to write the bundle is returned. Consumption
+// tokens are redacted from every file in the bundle
+func (c *Collector) Write(ctx context.Context, w io.Writer) error {
+	createdAt := c.now()
+	var errs []string
+	recordErr := func(err error) {
+		logrus.Warnf("support bundle is incomplete: %v", err)
+		errs = append(errs, err.Error())
+	}
+
+	r := newRedactor()
+	var files []file
+
+	// the cache is read first, since it holds the tokens which need to be redacted from the other files
+	cache, err := c.cache(ctx, r)
+	if err != nil {
+		recordErr(fmt.Errorf("unable to collect cache: %v", err))
+	} else {
+		files = append(files, file{name: "cache.json", data: cache})
+	}
+
+	config, err := c.k8s.GetCSPConfigOutput(ctx)
+	if err != nil {
+		recordErr(fmt.Errorf("unable to collect csp config: %v", err))
+	} else {
+		files = append(files, file{name: "config.json", data: config})
+	}
+
+	licenses, err := json.MarshalIndent(c.licenses(ctx), "", "  ")
+	if err != nil {
+		recordErr(fmt.Errorf("unable to collect licenses: %v", err))
+	} else {
+		files = append(files, file{name: "licenses.json", data: licenses})
+	}
+
+	history, err := c.history(ctx, createdAt)
+	if err != nil {
+		recordErr(fmt.Errorf("unable to collect usage history: %v", err))
+	} else {
+		files = append(files, file{name: "history.json", data: history})
+	}
+
+	logs, err := c.k8s.GetAdapterLogs(ctx, c.opts.LogLines)
+	if err != nil {
+		recordErr(fmt.Errorf("unable to collect logs: %v", err))
+	}
+	pods := make([]string, 0, len(logs))
+	for pod := range logs {
+		pods = append(pods, pod)
+	}
+	sort.Strings(pods)
+	for _, pod := range pods {
+		files = append(files, file{name: "logs/" + pod + ".log", data: logs[pod]})
+	}
+
+	metadata, err := json.MarshalIndent(Metadata{Version: c.opts.Version, CreatedAt: createdAt, Errors: errs}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to marshal bundle metadata: %v", err)
+	}
+	files = append([]file{{name: "metadata.json", data: metadata}}, files...)
+
+	return writeTarball(w, createdAt, files, r)
+}
+
+// cache gives the contents of the consumption token secret with the tokens redacted, registering each token with r so
+// that it is also redacted from the rest of the bundle
+func (c *Collector) cache(ctx context.Context, r *redactor) ([]byte, error) {
+	secret, err := c.k8s.GetConsumptionTokenSecret(ctx)
+	if err != nil {
+		return nil, err
+	}
+	contents := map[string]interface{}{}
+	for key, value := range secret.Data {
+		var parsed interface{}
+		if err := json.Unmarshal(value, &parsed); err != nil {
+			// values which aren't json, such as the token stored by older versions, are kept as strings
+			parsed = string(value)
+		}
+		contents[key] = r.redactValue(key, parsed)
+	}
+	return json.MarshalIndent(contents, "", "  ")
+}
+
+// licenses gives the rancher licenses in every account, with the entitlements available and consumed for each.
+// Failures are recorded alongside the account or license they happened for
+func (c *Collector) licenses(ctx context.Context) []AccountLicenses {
+	var accounts []AccountLicenses
+	for _, client := range c.opts.Accounts {
+		account := AccountLicenses{Account: client.AccountNumber()}
+		licenses, err := client.GetRancherLicenses(ctx)
+		if err != nil {
+			account.Error = err.Error()
+			accounts = append(accounts, account)
+			continue
+		}
+		for _, license := range licenses {
+			details := LicenseDetails{License: license}
+			for _, entitlement := range license.Entitlements {
+				if entitlement.Name == nil {
+					continue
+				}
+				usage := EntitlementUsage{Dimension: *entitlement.Name}
+				available, err := client.GetNumberOfAvailableEntitlements(ctx, license, usage.Dimension)
+				if err != nil {
+					details.Errors = append(details.Errors, fmt.Sprintf("unable to get available %s entitlements: %v", usage.Dimension, err))
+				} else {
+					usage.Available = &available
+				}
+				consumed, err := client.GetNumberOfConsumedEntitlements(ctx, license, usage.Dimension)
+				if err != nil {
+					details.Errors = append(details.Errors, fmt.Sprintf("unable to get consumed %s entitlements: %v", usage.Dimension, err))
+				} else {
+					usage.Consumed = &consumed
+				}
+				if usage.Dimension == aws.DefaultDimension {
+					details.Available, details.Consumed = usage.Available, usage.Consumed
+				}
+				details.Entitlements = append(details.Entitlements, usage)
+			}
+			account.Licenses = append(account.Licenses, details)
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts
+}
+
+// history gives the usage ledger's entries for the configured history
+func (c *Collector) history(ctx context.Context, now time.Time) ([]byte, error) {
+	entries, err := ledger.New(c.k8s, 0, 0).Entries(ctx, now.Add(-c.opts.History), time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := ledger.Export(&buf, ledger.FormatJSON, entries); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeTarball writes files to w as a gzipped tarball, redacting the tokens known to r from each
+func writeTarball(w io.Writer, modTime time.Time, files []file, r *redactor) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		data := r.redactBytes(f.data)
+		header := &tar.Header{
+			Name:    f.name,
+			Mode:    0600,
+			Size:    int64(len(data)),
+			ModTime: modTime,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("unable to write %s to bundle: %v", f.name, err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			return fmt.Errorf("unable to write %s to bundle: %v", f.name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
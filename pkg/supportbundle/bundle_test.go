@@ -0,0 +1,141 @@
+package supportbundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/rancher/csp-adapter/pkg/clients/aws"
+	"github.com/rancher/csp-adapter/pkg/ledger"
+	"github.com/rancher/csp-adapter/pkg/mocks"
+	"github.com/rancher/csp-adapter/pkg/redact"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const token = "AQICAHh-secret-consumption-token"
+
+// readBundle gives the contents of each file in a bundle, by name
+func readBundle(t *testing.T, bundle []byte) map[string][]byte {
+	gz, err := gzip.NewReader(bytes.NewReader(bundle))
+	require.NoError(t, err)
+	tr := tar.NewReader(gz)
+	files := map[string][]byte{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		require.NoError(t, err)
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		files[header.Name] = data
+	}
+}
+
+func TestWrite(t *testing.T) {
+	k8sClient := mocks.NewMockK8sClient(map[string]string{
+		"checkouts":        `[{"licenseArn":"arn","consumptionToken":"` + token + `","entitledLicenses":2}]`,
+		"consumptionToken": token,
+	})
+	k8sClient.CurrentSupportConfig = []byte(`{"compliance":{"status":"InCompliance"}}`)
+	k8sClient.AdapterLogs = map[string][]byte{
+		"rancher-csp-adapter-1": []byte("level=debug msg=\"extended checkout with token " + token + "\"\n"),
+	}
+	require.NoError(t, ledger.New(k8sClient, 0, 0).Record(context.TODO(), ledger.Check{
+		Time:             time.Now(),
+		Nodes:            40,
+		RequiredLicenses: 2,
+		CheckedOut:       2,
+		ConsumptionToken: token,
+		Status:           "InCompliance",
+	}))
+
+	collector := NewCollector(k8sClient, Options{Accounts: []aws.Client{mocks.NewMockAWSClient(5)}, Version: "v1.0.0"})
+	var buf bytes.Buffer
+	require.NoError(t, collector.Write(context.TODO(), &buf))
+	files := readBundle(t, buf.Bytes())
+
+	for _, name := range []string{"metadata.json", "cache.json", "config.json", "licenses.json", "history.json", "logs/rancher-csp-adapter-1.log"} {
+		assert.Contains(t, files, name)
+	}
+	for name, data := range files {
+		assert.NotContains(t, string(data), token, "expected the token to be redacted from %s", name)
+	}
+	assert.Contains(t, string(files["cache.json"]), redact.TokenReplacement(token))
+	assert.Contains(t, string(files["logs/rancher-csp-adapter-1.log"]), redact.TokenReplacement(token))
+
+	var metadata Metadata
+	require.NoError(t, json.Unmarshal(files["metadata.json"], &metadata))
+	assert.Equal(t, "v1.0.0", metadata.Version)
+	assert.Empty(t, metadata.Errors)
+
+	var licenses []AccountLicenses
+	require.NoError(t, json.Unmarshal(files["licenses.json"], &licenses))
+	require.Len(t, licenses, 1)
+	require.Len(t, licenses[0].Licenses, 1)
+	assert.Equal(t, 5, *licenses[0].Licenses[0].Available)
+	if assert.Len(t, licenses[0].Licenses[0].Entitlements, 1) {
+		assert.Equal(t, aws.DefaultDimension, licenses[0].Licenses[0].Entitlements[0].Dimension)
+		assert.Equal(t, 0, *licenses[0].Licenses[0].Entitlements[0].Consumed)
+	}
+}
+
+func TestWritePartial(t *testing.T) {
+	// no cache, support config or logs exist yet
+	collector := NewCollector(mocks.NewMockK8sClient(nil), Options{})
+	var buf bytes.Buffer
+	require.NoError(t, collector.Write(context.TODO(), &buf), "expected missing state not to fail the bundle")
+	files := readBundle(t, buf.Bytes())
+
+	assert.NotContains(t, files, "cache.json")
+	assert.NotContains(t, files, "config.json")
+	var metadata Metadata
+	require.NoError(t, json.Unmarshal(files["metadata.json"], &metadata))
+	assert.Len(t, metadata.Errors, 2)
+}
+
+func TestRedactValue(t *testing.T) {
+	tests := []struct {
+		name     string      // name of the test, to be displayed on failure
+		key      string      // key the value was found under
+		value    interface{} // value to redact
+		expected interface{} // expected redacted value
+	}{
+		{
+			name:     "sensitive key",
+			key:      "consumptionToken",
+			value:    token,
+			expected: redact.TokenReplacement(token),
+		},
+		{
+			name:     "other key",
+			key:      "clientToken",
+			value:    "client-token",
+			expected: "client-token",
+		},
+		{
+			name:     "nested",
+			key:      "checkouts",
+			value:    []interface{}{map[string]interface{}{"ConsumptionToken": token, "entitledLicenses": 2.0}},
+			expected: []interface{}{map[string]interface{}{"ConsumptionToken": redact.TokenReplacement(token), "entitledLicenses": 2.0}},
+		},
+		{
+			name:     "empty",
+			key:      "consumptionToken",
+			value:    "",
+			expected: "",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, newRedactor().redactValue(test.key, test.value))
+		})
+	}
+}
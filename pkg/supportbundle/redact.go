@@ -0,0 +1,54 @@
+package supportbundle
+
+import (
+	"strings"
+
+	"github.com/rancher/csp-adapter/pkg/redact"
+)
+
+// sensitiveKeys are the keys, compared case-insensitively, whose values are redacted from json in the bundle
+var sensitiveKeys = map[string]bool{
+	"consumptiontoken": true,
+}
+
+// redactor replaces consumption tokens in the bundle. Tokens are found under sensitiveKeys, and once found are also
+// replaced wherever else they appear, such as in logs. Account numbers are kept, since support needs them
+type redactor struct {
+	known *redact.Redactor
+}
+
+func newRedactor() *redactor {
+	return &redactor{known: redact.New()}
+}
+
+// redactValue redacts the values under sensitive keys from value, which is a value as decoded by encoding/json and
+// found under key
+func (r *redactor) redactValue(key string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for k, inner := range v {
+			redacted[k] = r.redactValue(k, inner)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, inner := range v {
+			redacted[i] = r.redactValue(key, inner)
+		}
+		return redacted
+	case string:
+		if v == "" || !sensitiveKeys[strings.ToLower(key)] {
+			return v
+		}
+		r.known.AddToken(v)
+		return redact.TokenReplacement(v)
+	default:
+		return v
+	}
+}
+
+// redactBytes replaces every token found so far in data
+func (r *redactor) redactBytes(data []byte) []byte {
+	return []byte(r.known.RedactSecrets(string(data)))
+}
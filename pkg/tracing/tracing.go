@@ -0,0 +1,84 @@
+// Package tracing records OpenTelemetry spans for each compliance run and the aws, kubernetes and metrics calls it
+// makes, so that a slow run can be traced to the call at fault. Spans are only exported once Setup is called with an
+// endpoint, until then they are discarded
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rancher/csp-adapter/pkg/logging"
+	"github.com/rancher/csp-adapter/pkg/redact"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName  = "github.com/rancher/csp-adapter"
+	serviceName = "csp-adapter"
+	// RunIDAttribute holds the run id of the compliance run a span belongs to, matching the run_id field of its logs
+	RunIDAttribute = attribute.Key("csp_adapter.run_id")
+)
+
+// Options configures where spans are exported to
+type Options struct {
+	// Endpoint is the url of the OTLP/HTTP collector, such as http://otel-collector:4318. Tracing is disabled if empty
+	Endpoint string
+	// ServiceVersion is reported as the version of the adapter on every span
+	ServiceVersion string
+}
+
+// Setup exports spans to the collector at opts.Endpoint. The returned func flushes any spans not yet exported and stops
+// exporting, it should be called before exiting. If no endpoint is set tracing stays disabled, and the returned func does
+// nothing
+func Setup(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	if opts.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(opts.Endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create trace exporter for %s: %v", opts.Endpoint, err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName(serviceName),
+			semconv.ServiceVersion(opts.ServiceVersion),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Start starts a span for operation, as a child of the span in ctx if there is one. The returned func ends the span,
+// marking it as failed if *err is set, and logs the operation's duration and outcome with logging.Observe. It is meant
+// to be deferred at the start of a call with a named error result:
+//
+//	ctx, end := tracing.Start(ctx, "aws.CheckoutLicense")
+//	defer end(&err)
+func Start(ctx context.Context, operation string) (context.Context, func(err *error)) {
+	start := time.Now()
+	var attributes []attribute.KeyValue
+	if runID := logging.RunID(ctx); runID != "" {
+		attributes = append(attributes, RunIDAttribute.String(runID))
+	}
+	ctx, span := otel.Tracer(tracerName).Start(ctx, operation, trace.WithAttributes(attributes...))
+	return ctx, func(err *error) {
+		if err != nil && *err != nil {
+			// errors can hold tokens and account numbers, which mustn't leave the adapter
+			message := redact.Default().Redact((*err).Error())
+			span.RecordError(errors.New(message))
+			span.SetStatus(codes.Error, message)
+		}
+		span.End()
+		logging.Observe(ctx, operation, start, err)
+	}
+}
@@ -0,0 +1,109 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rancher/csp-adapter/pkg/logging"
+	"github.com/rancher/csp-adapter/pkg/redact"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans records the spans ended during the test
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+func TestStart(t *testing.T) {
+	recorder := recordSpans(t)
+	ctx := logging.WithRunID(context.Background(), "run-1")
+
+	func() (err error) {
+		ctx, end := Start(ctx, "manager.ComplianceCheck")
+		defer end(&err)
+		func() (err error) {
+			_, end := Start(ctx, "aws.CheckoutLicense")
+			defer end(&err)
+			return errors.New("access denied")
+		}()
+		return nil
+	}()
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	call, run := spans[0], spans[1]
+	assert.Equal(t, "aws.CheckoutLicense", call.Name())
+	assert.Equal(t, codes.Error, call.Status().Code)
+	assert.Equal(t, "access denied", call.Status().Description)
+	assert.Equal(t, run.SpanContext().SpanID(), call.Parent().SpanID(), "expected the call to be a child of the run")
+	assert.Equal(t, "manager.ComplianceCheck", run.Name())
+	assert.Equal(t, codes.Unset, run.Status().Code)
+	assert.Contains(t, run.Attributes(), RunIDAttribute.String("run-1"))
+}
+
+func TestStartRedactsErrors(t *testing.T) {
+	recorder := recordSpans(t)
+	token := "tracing-consumption-token-1234567890"
+	redact.Default().AddToken(token)
+
+	func() (err error) {
+		_, end := Start(context.Background(), "aws.ExtendLicenseConsumption")
+		defer end(&err)
+		return errors.New("unable to extend " + token)
+	}()
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 1)
+	assert.NotContains(t, spans[0].Status().Description, token)
+	assert.Contains(t, spans[0].Status().Description, redact.TokenReplacement(token))
+	for _, event := range spans[0].Events() {
+		for _, attr := range event.Attributes {
+			assert.NotContains(t, attr.Value.Emit(), token, "expected the recorded error to be redacted")
+		}
+	}
+}
+
+func TestSetup(t *testing.T) {
+	var exported atomic.Int32
+	// stands in for a collector, accepting every export
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/v1/traces" {
+			exported.Add(1)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer collector.Close()
+	previous := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	shutdown, err := Setup(context.Background(), Options{Endpoint: collector.URL, ServiceVersion: "test"})
+	require.NoError(t, err)
+	func() (err error) {
+		_, end := Start(context.Background(), "metrics.Scrape")
+		defer end(&err)
+		return nil
+	}()
+	require.NoError(t, shutdown(context.Background()))
+	assert.Equal(t, int32(1), exported.Load(), "expected the span to be exported on shutdown")
+}
+
+func TestSetupDisabled(t *testing.T) {
+	previous := otel.GetTracerProvider()
+	shutdown, err := Setup(context.Background(), Options{})
+	require.NoError(t, err)
+	assert.Equal(t, previous, otel.GetTracerProvider(), "expected no exporting tracer provider without an endpoint")
+	assert.NoError(t, shutdown(context.Background()))
+}
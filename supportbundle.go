@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rancher/csp-adapter/pkg/clients/aws"
+	"github.com/rancher/csp-adapter/pkg/clients/k8s"
+	"github.com/rancher/csp-adapter/pkg/supportbundle"
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/rest"
+)
+
+const supportBundleCommand = "support-bundle"
+
+// runSupportBundle writes a support bundle to stdout, or to the file given by -output. It is meant to be run from inside
+// the adapter pod, for example:
+// kubectl exec -n cattle-csp-adapter-system deploy/rancher-csp-adapter -- csp-adapter support-bundle > bundle.tar.gz
+func runSupportBundle(args []string) error {
+	flags := flag.NewFlagSet(supportBundleCommand, flag.ContinueOnError)
+	outputPath := flags.String("output", "-", "file to write the bundle to, or - for stdout")
+	logLines := flags.Int64("log-lines", supportbundle.DefaultLogLines, "number of the most recent log lines to include from each adapter pod")
+	history := flags.Duration("history", supportbundle.DefaultHistory, "how far back to include usage history")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	k8sTimeout, awsTimeout, err := clientTimeoutsFromEnv()
+	if err != nil {
+		return err
+	}
+	cfg, err := rest.InClusterConfig()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	k8sClients, err := k8s.New(ctx, cfg, k8sTimeout)
+	if err != nil {
+		return err
+	}
+
+	clientOpts := aws.ClientOptions{UseTestProducts: os.Getenv(devModeEnv) == "true", AdditionalProductSKUs: productSKUs(), Endpoint: os.Getenv(awsEndpointEnv), Timeout: awsTimeout}
+	var accounts []aws.Client
+	awsClient, err := aws.NewClient(ctx, clientOpts)
+	if err != nil {
+		// the bundle is most needed when something is broken, so collect what can be collected without aws
+		logrus.Warnf("unable to start aws client, licenses won't be included in the bundle: %v", err)
+	} else {
+		accounts = append(accounts, awsClient)
+		additional, err := additionalAccountClients(ctx, clientOpts)
+		if err != nil {
+			logrus.Warnf("unable to start aws client for additional account, its licenses won't be included in the bundle: %v", err)
+		}
+		accounts = append(accounts, additional...)
+	}
+
+	collector := supportbundle.NewCollector(k8sClients, supportbundle.Options{
+		Accounts: accounts,
+		LogLines: *logLines,
+		History:  *history,
+		Version:  fmt.Sprintf("%s (%s)", Version, GitCommit),
+	})
+	if *outputPath == "-" {
+		return collector.Write(ctx, os.Stdout)
+	}
+	f, err := os.OpenFile(*outputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %v", *outputPath, err)
+	}
+	if err := collector.Write(ctx, f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}